@@ -3,6 +3,7 @@ package oob
 import (
 	"fmt"
 	"strconv"
+	"time"
 
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/api"
@@ -20,6 +21,7 @@ func (bf *boundFrame) cmdPublishPersist() {
 	el := bf.loadCommonElaborate()
 	verify := bf.loadBoolParam("doverify")
 	ros, pos := loadCommonXOs(bf.f)
+	encfor, encibe := bf.loadEncryption()
 	p := &api.PublishParams{
 		MVK:                mvk,
 		URISuffix:          suffix,
@@ -32,6 +34,8 @@ func (bf *boundFrame) cmdPublishPersist() {
 		Persist:            bf.f.Cmd == objects.CmdPersist,
 		DoVerify:           verify,
 		AutoChain:          autochain,
+		EncryptFor:         encfor,
+		EncryptIBE:         encibe,
 	}
 	bf.bwcl.Publish(p, bf.mkFinalGenericActionCB())
 }
@@ -81,6 +85,10 @@ func (bf *boundFrame) cmdQuery() {
 		ElaboratePAC:       el,
 		RoutingObjects:     ros,
 		AutoChain:          autochain,
+		From:               bf.loadTimeParam("from"),
+		To:                 bf.loadTimeParam("to"),
+		KeepBoxed:          bf.loadBoolParam("keepboxed"),
+		IBEIdentities:      bf.loadIBEIdentities(),
 	}
 	bf.bwcl.Query(p,
 		bf.mkGenericActionCB(),
@@ -91,6 +99,9 @@ func (bf *boundFrame) cmdQuery() {
 				if unpack {
 					commonUnpackMsg(m, r)
 				} else {
+					if !m.RXTime.IsZero() {
+						r.AddHeader("rxtime", m.RXTime.Format(time.RFC3339Nano))
+					}
 					po, err := objects.CreateOpaquePayloadObjectDF("1.0.1.1", m.Encoded)
 					if err != nil {
 						panic("Not expecting this")
@@ -124,6 +135,24 @@ func (bf *boundFrame) cmdSubscribe() {
 		RoutingObjects:     ros,
 		AutoChain:          autochain,
 	}
+	durable, _ := bf.f.GetFirstHeader("durable")
+	p.Durable = durable
+	p.KeepBoxed = bf.loadBoolParam("keepboxed")
+	p.IBEIdentities = bf.loadIBEIdentities()
+	//If the router ends the subscription, the final frame says why so the
+	//client can build a new chain and subscribe again
+	var terminated error
+	p.Terminated = func(err error) {
+		terminated = err
+	}
+	//A result without a URI that only says the results are being held back
+	p.Throttled = func() {
+		r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+		r.AddHeader("finished", "false")
+		r.AddHeader("code", strconv.Itoa(bwe.Throttled))
+		r.AddHeader("reason", "the designated router is holding back results")
+		bf.send(r)
+	}
 	bf.bwcl.Subscribe(p,
 		func(err error, id core.UniqueMessageID) {
 			if err == nil {
@@ -139,7 +168,15 @@ func (bf *boundFrame) cmdSubscribe() {
 		func(m *core.Message) {
 			r := objects.CreateFrame(objects.CmdResult, bf.replyto)
 			r.AddHeader("finished", strconv.FormatBool(m == nil))
+			if m == nil && terminated != nil {
+				bws := bwe.AsBW(terminated)
+				r.AddHeader("code", strconv.Itoa(bws.Code))
+				r.AddHeader("reason", bws.Msg)
+			}
 			if m != nil {
+				if durable != "" {
+					r.AddHeader("qseq", strconv.FormatUint(m.QueueSeq, 10))
+				}
 				if unpack {
 					commonUnpackMsg(m, r)
 				} else {
@@ -240,8 +277,12 @@ func (bf *boundFrame) cmdMakeDot() {
 		p.MVK = mvk
 		p.URISuffix = suffix
 		p.AccessPermissions = perms
+		p.PublishLimits = bf.loadPublishLimits()
 	} else {
-		panic(bwe.M(bwe.InvalidOOBCommand, "Application DOTs are not implemented"))
+		p.Permissions = bf.loadPermissions()
+		if len(p.Permissions) == 0 {
+			panic(bwe.M(bwe.MalformedOOBCommand, "permission DOTs require a permission kv"))
+		}
 	}
 	dot, err := bf.bwcl.CreateDOT(&p)
 	if err != nil {
@@ -324,7 +365,7 @@ func (bf *boundFrame) cmdMakeChain() {
 	bf.send(r)
 }
 func (bf *boundFrame) cmdBuildChain() {
-	bf.checkChainAge()
+	bf.checkResolvable()
 	var to []byte
 	mvk, suffix := bf.loadCommonURI()
 	perms, ok := bf.f.GetFirstHeader("accesspermissions")
@@ -1,18 +1,23 @@
 package oob
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"math/big"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/regsnap"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/objects/advpo"
+	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
 	"github.com/immesys/bw2bc/common"
 )
@@ -185,6 +190,15 @@ func (bf *boundFrame) cmdBCInteractionParams() {
 	diff := bf.bwcl.BC().GetHeader(bf.bwcl.BC().CurrentBlock()).Difficulty.Int64()
 	//diff := bf.bwcl.BC().GetBlock(bf.bwcl.BC().CurrentBlock()).Difficulty
 	r.AddHeader("difficulty", strconv.FormatInt(int64(diff), 10))
+	if snap := bf.bwcl.BW().Snapshot(); snap != nil {
+		r.AddHeader("snapshotblock", strconv.FormatUint(snap.Block, 10))
+		r.AddHeader("snapshotage", strconv.FormatInt(int64(snap.Age().Seconds()), 10))
+	}
+	if bf.bwcl.BW().UsingSnapshot() {
+		r.AddHeader("resolvefrom", "snapshot")
+	} else {
+		r.AddHeader("resolvefrom", "chain")
+	}
 	bf.send(r)
 }
 func (bf *boundFrame) cmdTransfer() {
@@ -273,7 +287,7 @@ func (bf *boundFrame) cmdMakeLongAlias() {
 		bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdResolveAlias() {
-	bf.checkChainAge()
+	bf.checkResolvable()
 	longkey, longkeyok := bf.f.GetFirstHeader("longkey")
 	shortkey, shortkeyok := bf.f.GetFirstHeader("shortkey")
 	embedded, embeddedok := bf.f.GetFirstHeader("embedded")
@@ -476,7 +490,7 @@ func (bf *boundFrame) cmdAcceptDesignatedRouterOffer() {
 }
 
 func (bf *boundFrame) cmdResolveRegistryObject() {
-	bf.checkChainAge()
+	bf.checkResolvable()
 	key, keyok := bf.f.GetFirstHeader("key")
 	if !keyok {
 		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(key)"))
@@ -633,7 +647,7 @@ func (bf *boundFrame) cmdRevokeDRAccept() {
 	bf.bwcl.BCC().RetractRoutingAcceptance(context.TODO(), acc, ent, drvk, bf.mkFinalGenericActionCB())
 }
 func (bf *boundFrame) cmdFindDOTs() {
-	bf.checkChainAge()
+	bf.checkResolvable()
 	vkS, vkok := bf.f.GetFirstHeader("vk")
 	if !vkok {
 		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(vk)"))
@@ -658,6 +672,530 @@ func (bf *boundFrame) cmdFindDOTs() {
 	}
 	bf.send(r)
 }
+func (bf *boundFrame) cmdAckDurable() {
+	queue, ok := bf.f.GetFirstHeader("durable")
+	if !ok || queue == "" {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(durable)"))
+	}
+	seqS, ok := bf.f.GetFirstHeader("qseq")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(qseq)"))
+	}
+	seq, err := strconv.ParseUint(seqS, 10, 64)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "invalid qseq"))
+	}
+	bf.bwcl.AckDurable(queue, seq, bf.mkFinalGenericActionCB())
+}
+func (bf *boundFrame) cmdExplainChain() {
+	bf.checkResolvable()
+	mvk, suffix := bf.loadCommonURI()
+	perms, ok := bf.f.GetFirstHeader("accesspermissions")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(accesspermissions)"))
+	}
+	toS, ok := bf.f.GetFirstHeader("to")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(to)"))
+	}
+	to, err := bf.bwcl.BW().ResolveKey(toS)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve 'to'", err))
+	}
+	maxPartial, _, perr := bf.f.ParseFirstHeaderAsInt("max", 10)
+	if perr != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, *perr))
+	}
+	go func() {
+		ex, err := bf.bwcl.ExplainChain(&api.BuildChainParams{
+			To:          to,
+			URI:         crypto.FmtKey(mvk) + "/" + suffix,
+			Permissions: perms,
+		}, maxPartial)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		js, err := json.Marshal(ex)
+		if err != nil {
+			panic(err)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+		if err != nil {
+			panic(err)
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}()
+}
+func (bf *boundFrame) cmdTrustGraph() {
+	bf.checkResolvable()
+	nsS, ok := bf.f.GetFirstHeader("namespace")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(namespace)"))
+	}
+	nsvk, err := bf.bwcl.BW().ResolveKey(nsS)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err))
+	}
+	filter, _ := bf.f.GetFirstHeader("filter")
+	go func() {
+		g, err := bf.bwcl.BW().TrustGraph(nsvk, filter)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		js, err := json.Marshal(g)
+		if err != nil {
+			panic(err)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+		if err != nil {
+			panic(err)
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}()
+}
+
+//cmdEstimateCost estimates the cost of publishing the routing objects in the
+//frame and of setting the long aliases given as aliaskey/aliasvalue kv pairs.
+//Each gets a gas kv, in order, which is "unknown" if it could not be
+//estimated (usually because it depends on another object being published)
+func (bf *boundFrame) cmdEstimateCost() {
+	bf.checkChainAge()
+	acc := bf.loadAccount()
+	keys := bf.f.GetAllHeadersB("aliaskey")
+	vals := bf.f.GetAllHeadersB("aliasvalue")
+	if len(keys) != len(vals) {
+		panic(bwe.M(bwe.InvalidOOBCommand, "every kv(aliaskey) needs a kv(aliasvalue)"))
+	}
+	gprice, err := bf.bwcl.BC().GasPrice(context.TODO())
+	if err != nil {
+		panic(err)
+	}
+	total := big.NewInt(0)
+	unknown := 0
+	r := bf.mkFinalResponseOkayFrame()
+	addGas := func(gas *big.Int, value *big.Int, err error) {
+		if err != nil {
+			unknown++
+			r.AddHeader("gas", "unknown")
+			return
+		}
+		r.AddHeader("gas", gas.Text(10))
+		total.Add(total, new(big.Int).Mul(gas, gprice))
+		if value != nil {
+			total.Add(total, value)
+		}
+	}
+	for _, ro := range bf.f.ROs {
+		gas, err := bf.bwcl.BCC().EstimatePublish(context.TODO(), acc, ro.RO)
+		addGas(gas, nil, err)
+	}
+	for i := range keys {
+		addGas(bf.bwcl.BCC().EstimateSetAlias(context.TODO(), acc, bc.SliceToBytes32(keys[i]), bc.SliceToBytes32(vals[i])))
+	}
+	r.AddHeader("gasprice", gprice.Text(10))
+	r.AddHeader("wei", total.Text(10))
+	r.AddHeader("unknown", strconv.Itoa(unknown))
+	bf.send(r)
+}
+
+//cmdLimitUsage returns the usage this router has metered against DOTs with
+//PublishLimits, for the DOTs given as dot kvs or all of them
+func (bf *boundFrame) cmdLimitUsage() {
+	var hashes [][]byte
+	for _, sdhash := range bf.f.GetAllHeaders("dot") {
+		dhash, e := crypto.UnFmtHash(sdhash)
+		if e != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "could not parse dot hash"))
+		}
+		hashes = append(hashes, dhash)
+	}
+	js, err := json.Marshal(bf.bwcl.BW().LimitUsage(hashes...))
+	if err != nil {
+		panic(err)
+	}
+	po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+	if err != nil {
+		panic(err)
+	}
+	r := bf.mkFinalResponseOkayFrame()
+	r.AddPayloadObject(po)
+	bf.send(r)
+}
+
+//cmdBuildPermChain finds permission chains from the authority to the target
+//that grant every permission kv (key=value). Each chain is returned as a PO
+//with a hash and grants kv, in order.
+func (bf *boundFrame) cmdBuildPermChain() {
+	bf.checkResolvable()
+	authority, to := bf.loadAuthorityAndTo()
+	perms := bf.loadPermissions()
+	go func() {
+		chains, err := bf.bwcl.BuildPermissionChain(&api.BuildPermissionChainParams{
+			Authority:   authority,
+			To:          to,
+			Permissions: perms,
+		})
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		for _, c := range chains {
+			kv, err := bf.bwcl.BW().VerifyPermissionChain(c, authority, to, perms)
+			if err != nil {
+				continue
+			}
+			po, err := objects.CreateOpaquePayloadObject(c.GetRONum(), c.GetContent())
+			if err != nil {
+				panic(err)
+			}
+			r.AddHeader("hash", crypto.FmtHash(c.GetChainHash()))
+			r.AddHeader("grants", api.FmtPermissions(kv))
+			r.AddPayloadObject(po)
+		}
+		bf.send(r)
+	}()
+}
+
+//cmdVerifyPermChain checks the permission chain given as an RO (or by its
+//hash in the chain kv) goes from the authority to the target and grants
+//every permission kv. It replies with what the chain grants.
+func (bf *boundFrame) cmdVerifyPermChain() {
+	bf.checkResolvable()
+	authority, to := bf.loadAuthorityAndTo()
+	perms := bf.loadPermissions()
+	var dc *objects.DChain
+	for _, ro := range bf.f.ROs {
+		switch ro.RO.GetRONum() {
+		case objects.ROPermissionDChain, objects.ROPermissionDChainHash:
+			dc = ro.RO.(*objects.DChain)
+		}
+	}
+	if dc == nil {
+		schain, ok := bf.f.GetFirstHeader("chain")
+		if !ok {
+			panic(bwe.M(bwe.InvalidOOBCommand, "missing permission chain RO or kv(chain)"))
+		}
+		hash, err := crypto.UnFmtHash(schain)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "could not parse chain hash"))
+		}
+		dci, err := objects.NewDChain(objects.ROPermissionDChainHash, hash)
+		if err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "bad chain hash", err))
+		}
+		dc = dci.(*objects.DChain)
+	}
+	go func() {
+		kv, err := bf.bwcl.BW().VerifyPermissionChain(dc, authority, to, perms)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("hash", crypto.FmtHash(dc.GetChainHash()))
+		r.AddHeader("grants", api.FmtPermissions(kv))
+		bf.send(r)
+	}()
+}
+
+//cmdPublishBatch publishes (or persists, if the persist kv is set) each PO
+//as its own message on the URI. It takes the same kvs and ROs as publ. The
+//reply has a result kv with the status code of each message, in order.
+func (bf *boundFrame) cmdPublishBatch() {
+	mvk, suffix := bf.loadCommonURI()
+	autochain := bf.loadBoolParam("autochain")
+	pac := bf.loadCommonPAC(autochain, "P")
+	expd, expt := bf.loadCommonExpiry()
+	el := bf.loadCommonElaborate()
+	verify := bf.loadBoolParam("doverify")
+	persist := bf.loadBoolParam("persist")
+	ros, pos := loadCommonXOs(bf.f)
+	encfor, encibe := bf.loadEncryption()
+	if len(pos) == 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "a batch needs at least one PO"))
+	}
+	params := make([]*api.PublishParams, len(pos))
+	for i, po := range pos {
+		params[i] = &api.PublishParams{
+			MVK:                mvk,
+			URISuffix:          suffix,
+			PrimaryAccessChain: pac,
+			ExpiryDelta:        expd,
+			Expiry:             expt,
+			ElaboratePAC:       el,
+			RoutingObjects:     ros,
+			PayloadObjects:     []objects.PayloadObject{po},
+			Persist:            persist,
+			DoVerify:           verify,
+			AutoChain:          autochain,
+			EncryptFor:         encfor,
+			EncryptIBE:         encibe,
+		}
+	}
+	bf.bwcl.PublishBatch(params, func(errs []error) {
+		r := bf.mkFinalResponseOkayFrame()
+		for _, err := range errs {
+			code := bwe.Okay
+			if err != nil {
+				code = bwe.AsBW(err).Code
+			}
+			r.AddHeader("result", strconv.Itoa(code))
+		}
+		bf.send(r)
+	})
+}
+
+//cmdExportRegistry exports the registry objects relevant to each kv(ns)
+//as a signed snapshot in a blob PO, see api.ExportRegistry. It is signed
+//with the client entity if one has been set, otherwise the router's.
+func (bf *boundFrame) cmdExportRegistry() {
+	bf.checkResolvable()
+	nsz := bf.f.GetAllHeaders("ns")
+	if len(nsz) == 0 {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(ns)"))
+	}
+	nsvks := make([][]byte, len(nsz))
+	for i, ns := range nsz {
+		nsvk, err := bf.bwcl.BW().ResolveKey(ns)
+		if err != nil {
+			panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err))
+		}
+		nsvks[i] = nsvk
+	}
+	signer := bf.bwcl.GetUs()
+	if signer == nil {
+		signer = bf.bwcl.BW().Entity
+	}
+	go func() {
+		snap, err := bf.bwcl.BW().ExportRegistry(nsvks)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		buf := bytes.Buffer{}
+		if err := snap.Write(&buf, signer); err != nil {
+			panic(err)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumBlob, buf.Bytes())
+		if err != nil {
+			panic(err)
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("block", strconv.FormatUint(snap.Block, 10))
+		r.AddHeader("entities", strconv.Itoa(len(snap.Entities)))
+		r.AddHeader("dots", strconv.Itoa(len(snap.DOTs)))
+		r.AddHeader("chains", strconv.Itoa(len(snap.Chains)))
+		r.AddHeader("aliases", strconv.Itoa(len(snap.Aliases)))
+		r.AddHeader("revoked", strconv.Itoa(len(snap.Revocations)))
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}()
+}
+
+//cmdImportRegistry imports the snapshot in the blob PO, see
+//api.ImportRegistry
+func (bf *boundFrame) cmdImportRegistry() {
+	var snap *regsnap.Snapshot
+	for _, po := range bf.f.POs {
+		if po.PO.GetPONum() != objects.PONumBlob {
+			continue
+		}
+		s, err := regsnap.Read(bytes.NewReader(po.PO.GetContent()))
+		if err != nil {
+			panic(bwe.WrapM(bwe.MalformedOOBCommand, "Bad registry snapshot", err))
+		}
+		snap = s
+	}
+	if snap == nil {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing registry snapshot PO"))
+	}
+	go func() {
+		if err := bf.bwcl.BW().ImportRegistry(snap); err != nil {
+			bf.Err(err)
+			return
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("block", strconv.FormatUint(snap.Block, 10))
+		r.AddHeader("signer", crypto.FmtKey(snap.SignerVK))
+		r.AddHeader("entities", strconv.Itoa(len(snap.Entities)))
+		r.AddHeader("dots", strconv.Itoa(len(snap.DOTs)))
+		r.AddHeader("chains", strconv.Itoa(len(snap.Chains)))
+		r.AddHeader("aliases", strconv.Itoa(len(snap.Aliases)))
+		r.AddHeader("revoked", strconv.Itoa(len(snap.Revocations)))
+		bf.send(r)
+	}()
+}
+
+//cmdListExpiring lists what api.Expiring finds for kv(vk) and kv(within),
+//as a JSON PO. DOTs granted to the VK are also looked for on every kv(ns).
+func (bf *boundFrame) cmdListExpiring() {
+	bf.checkResolvable()
+	vkS, ok := bf.f.GetFirstHeader("vk")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(vk)"))
+	}
+	vk, err := bf.bwcl.BW().ResolveKey(vkS)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve vk", err))
+	}
+	withinS, ok := bf.f.GetFirstHeader("within")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(within)"))
+	}
+	within, err := util.ParseDuration(withinS)
+	if err != nil || within == nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "invalid within"))
+	}
+	var nsvks [][]byte
+	for _, ns := range bf.f.GetAllHeaders("ns") {
+		nsvk, err := bf.bwcl.BW().ResolveKey(ns)
+		if err != nil {
+			panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve namespace", err))
+		}
+		nsvks = append(nsvks, nsvk)
+	}
+	go func() {
+		ws, err := bf.bwcl.BW().Expiring(vk, nsvks, *within)
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		js, err := json.Marshal(ws)
+		if err != nil {
+			panic(err)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+		if err != nil {
+			panic(err)
+		}
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}()
+}
+
+//cmdWatchExpiry streams the router's expiry warnings, each as a result
+//with a JSON PO, until the client disconnects
+func (bf *boundFrame) cmdWatchExpiry() {
+	//Fail before the response, a client only gets one
+	if bf.bwcl.BW().WarnExpiryWithin() <= 0 {
+		panic(bwe.M(bwe.BadOperation, "Expiry warnings are not enabled on this router"))
+	}
+	send := func(w *api.ExpiryWarning) {
+		js, err := json.Marshal(w)
+		if err != nil {
+			panic(err)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+		if err != nil {
+			panic(err)
+		}
+		r := objects.CreateFrame(objects.CmdResult, bf.replyto)
+		r.AddHeader("finished", "false")
+		r.AddPayloadObject(po)
+		bf.send(r)
+	}
+	//The current warnings are sent by WatchExpiry, after the response
+	bf.send(bf.mkNonfinalResponseOkayFrame())
+	if err := bf.bwcl.WatchExpiry(send); err != nil {
+		bf.Err(err)
+	}
+}
+
+//cmdRenewDot publishes a copy of kv(dot) with the new expiry, signed by
+//the giver (the PO, or the client entity). With kv(revokeold) the old DOT
+//is then revoked. Either way the cached chains that used it are rebuilt.
+func (bf *boundFrame) cmdRenewDot() {
+	bf.checkChainAge()
+	acc := bf.loadAccount()
+	giver := bf.loadEntityPoOrUs()
+	dhashS, ok := bf.f.GetFirstHeader("dot")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(dot)"))
+	}
+	ohash, err := crypto.UnFmtHash(dhashS)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad dot hash"))
+	}
+	expd, expt := bf.loadCommonExpiry()
+	var expiry time.Time
+	if expd != nil {
+		expiry = time.Now().Add(*expd)
+	} else if expt != nil {
+		expiry = *expt
+	} else {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(expiry) or kv(expirydelta)"))
+	}
+	revokeold := bf.loadBoolParam("revokeold")
+	nd, err := bf.bwcl.BW().RenewDOT(ohash, giver, expiry)
+	if err != nil {
+		panic(err)
+	}
+	df := "0.0.0.32"
+	if !nd.IsAccess() {
+		df = "0.0.0.33"
+	}
+	po, err := objects.CreateOpaquePayloadObjectDF(df, nd.GetContent())
+	if err != nil {
+		panic(err)
+	}
+	done := func(rvk *objects.Revocation) {
+		r := bf.mkFinalResponseOkayFrame()
+		r.AddHeader("hash", crypto.FmtHash(nd.GetHash()))
+		r.AddHeader("old", crypto.FmtHash(ohash))
+		if rvk != nil {
+			r.AddHeader("revocation", crypto.FmtHash(rvk.GetHash()))
+		}
+		r.AddPayloadObject(po)
+		bf.send(r)
+		//Building the chains can take a while, so the client need not wait
+		go bf.bwcl.RebuildChainsUsing(ohash)
+	}
+	bf.bwcl.BCC().PublishDOT(context.TODO(), acc, nd, func(err error) {
+		if err != nil {
+			bf.Err(err)
+			return
+		}
+		if !revokeold {
+			done(nil)
+			return
+		}
+		//Only now that the new DOT is confirmed
+		rvk := objects.CreateRevocation(giver.GetVK(), ohash, "renewed as "+crypto.FmtHash(nd.GetHash()))
+		rvk.Encode(giver.GetSK())
+		bf.bwcl.BCC().PublishRevocation(context.TODO(), acc, rvk, func(err error) {
+			if err != nil {
+				bf.Err(bwe.WrapM(bwe.BadOperation, "Published "+crypto.FmtHash(nd.GetHash())+" but could not revoke the old DOT", err))
+				return
+			}
+			done(rvk)
+		})
+	})
+}
+
+//cmdUnpinPeer forgets the key pinned for a designated router
+func (bf *boundFrame) cmdUnpinPeer() {
+	vkS, ok := bf.f.GetFirstHeader("vk")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(vk)"))
+	}
+	vk, err := bf.bwcl.BW().ResolveKey(vkS)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve vk", err))
+	}
+	if !bf.bwcl.BW().UnpinPeer(vk) {
+		panic(bwe.M(bwe.BadOperation, "no key is pinned for that router"))
+	}
+	bf.send(bf.mkFinalResponseOkayFrame())
+}
+
 func (bf *boundFrame) cmdDevelop() {
 	// bf.checkChainAge()
 	// fmt.Println("\n\n\nDEVELOP CALL")
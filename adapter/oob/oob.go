@@ -19,6 +19,7 @@ package oob
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
 	"math/rand"
 	"net"
@@ -33,11 +34,13 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/box"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
+	"vuvuzela.io/crypto/ibe"
 )
 
 type Adapter struct {
@@ -82,17 +85,21 @@ func (a *Adapter) handleClient(conn net.Conn) {
 	in := bufio.NewReader(conn)
 	olock := sync.Mutex{}
 	abort := false
+	//The PO size above which frames to the client are compressed, zero
+	//until the client asks for compression. Protected by olock
+	compressAbove := 0
 	send := func(f *objects.Frame) {
 		if abort {
 			return
 		}
 		olock.Lock()
-		f.WriteToStream(out)
+		f.WriteToStreamCompressed(out, compressAbove)
 		olock.Unlock()
 	}
 
 	helo := objects.CreateFrame(objects.CmdHello, mkSeqNo())
 	helo.AddHeader("version", util.BW2Version)
+	helo.AddHeader("compression", "snappy")
 	send(helo)
 
 	for {
@@ -102,10 +109,44 @@ func (a *Adapter) handleClient(conn net.Conn) {
 			abort = true
 			return
 		}
+		if f.Cmd == objects.CmdCompression {
+			//This changes how the session is written so it is not dispatched
+			threshold, err := compressionThreshold(f)
+			if err != nil {
+				bf := &boundFrame{bwcl: bwcl, f: f, send: send, replyto: f.SeqNo}
+				bf.Err(err)
+				continue
+			}
+			olock.Lock()
+			compressAbove = threshold
+			olock.Unlock()
+			r := objects.CreateFrame(objects.CmdResponse, f.SeqNo)
+			r.AddHeader("status", "okay")
+			r.AddHeader("finished", "true")
+			send(r)
+			continue
+		}
 		dispatchFrame(bwcl, f, send)
 	}
 }
 
+//compressionThreshold returns the PO size above which frames should be
+//compressed, as requested by a CmdCompression frame. The only algorithm is
+//snappy, and a threshold of zero turns compression off
+func compressionThreshold(f *objects.Frame) (int, error) {
+	if alg, ok := f.GetFirstHeader("algorithm"); ok && alg != "snappy" {
+		return 0, bwe.M(bwe.InvalidOOBCommand, "Unsupported compression algorithm")
+	}
+	threshold, _, perr := f.ParseFirstHeaderAsInt("threshold", objects.DefaultCompressThreshold)
+	if perr != nil {
+		return 0, bwe.M(bwe.MalformedOOBCommand, *perr)
+	}
+	if threshold < 0 {
+		return 0, bwe.M(bwe.MalformedOOBCommand, "Invalid compression threshold")
+	}
+	return threshold, nil
+}
+
 func (bf *boundFrame) loadAccount() int {
 	account, accountOK := bf.f.GetFirstHeader("account")
 	if !accountOK {
@@ -173,6 +214,19 @@ func (bf *boundFrame) loadBoolParam(name string) bool {
 	return v
 }
 
+//loadTimeParam parses an RFC3339 time header, returning nil if it is absent
+func (bf *boundFrame) loadTimeParam(name string) *time.Time {
+	v, ok := bf.f.GetFirstHeader(name)
+	if !ok || v == "" {
+		return nil
+	}
+	t, err := time.Parse(time.RFC3339Nano, v)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad "+name+" param: expected RFC3339 time"))
+	}
+	return &t
+}
+
 //Panics on error, returns nil or object on success
 func (bf *boundFrame) loadCommonPAC(autochain bool, perms string) *objects.DChain {
 	if autochain {
@@ -228,6 +282,15 @@ func (bf *boundFrame) checkChainAge() {
 		panic(bwe.M(bwe.ChainStale, "Chain is too stale"))
 	}
 }
+
+//checkResolvable is like checkChainAge for commands that only resolve
+//registry objects, which can be answered from a snapshot
+func (bf *boundFrame) checkResolvable() {
+	bf.checkHaveChain()
+	if bf.bwcl.RegistryStale() {
+		panic(bwe.M(bwe.ChainStale, "Chain is too stale"))
+	}
+}
 func (bf *boundFrame) checkHaveChain() {
 	//TODO add this in
 
@@ -253,6 +316,118 @@ func (bf *boundFrame) loadCommonExpiry() (*time.Duration, *time.Time) {
 	}
 	return rvd, rvt
 }
+
+//loadAuthorityAndTo resolves the authority and to kvs of a permission
+//chain command
+func (bf *boundFrame) loadAuthorityAndTo() ([]byte, []byte) {
+	sauth, ok := bf.f.GetFirstHeader("authority")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(authority)"))
+	}
+	sto, ok := bf.f.GetFirstHeader("to")
+	if !ok {
+		panic(bwe.M(bwe.InvalidOOBCommand, "missing kv(to)"))
+	}
+	authority, err := bf.bwcl.BW().ResolveKey(sauth)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve authority", err))
+	}
+	to, err := bf.bwcl.BW().ResolveKey(sto)
+	if err != nil {
+		panic(bwe.WrapM(bwe.ResolutionFailed, "Could not resolve to", err))
+	}
+	return authority, to
+}
+
+//loadPermissions parses the permission headers, which are key=value
+func (bf *boundFrame) loadPermissions() map[string]string {
+	rv := make(map[string]string)
+	for _, p := range bf.f.GetAllHeaders("permission") {
+		parts := strings.SplitN(p, "=", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 || len(parts[0]) > 255 || len(parts[1]) > 65535 {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad permission kv, expected key=value"))
+		}
+		rv[parts[0]] = parts[1]
+	}
+	return rv
+}
+
+//loadPublishLimits parses the txlimit, storelimit and retain headers,
+//returning nil if none are present
+func (bf *boundFrame) loadPublishLimits() *objects.PublishLimits {
+	rv := &objects.PublishLimits{}
+	found := false
+	for _, k := range []string{"txlimit", "storelimit", "retain"} {
+		v, ok := bf.f.GetFirstHeader(k)
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad "+k+" param"))
+		}
+		switch k {
+		case "txlimit":
+			rv.TxLimit = n
+		case "storelimit":
+			rv.StoreLimit = n
+		case "retain":
+			if n > 255 {
+				panic(bwe.M(bwe.MalformedOOBCommand, "retain out of range"))
+			}
+			rv.Retain = int(n)
+		}
+		found = true
+	}
+	if !found {
+		return nil
+	}
+	return rv
+}
+
+//loadEncryption parses the encrypt_for headers (recipient VKs) and the
+//encrypt_ibe header (base64 IBE master public key)
+func (bf *boundFrame) loadEncryption() ([][]byte, *ibe.MasterPublicKey) {
+	var vks [][]byte
+	for _, svk := range bf.f.GetAllHeaders("encrypt_for") {
+		vk, err := crypto.UnFmtKey(svk)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad encrypt_for kv"))
+		}
+		vks = append(vks, vk)
+	}
+	spub, ok := bf.f.GetFirstHeader("encrypt_ibe")
+	if !ok {
+		return vks, nil
+	}
+	bin, err := base64.URLEncoding.DecodeString(spub)
+	if err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad encrypt_ibe kv"))
+	}
+	pub := new(ibe.MasterPublicKey)
+	if err := pub.UnmarshalBinary(bin); err != nil {
+		panic(bwe.M(bwe.MalformedOOBCommand, "bad encrypt_ibe kv"))
+	}
+	return vks, pub
+}
+
+//loadIBEIdentities parses the ibe_identity headers (base64 encoded
+//box identities)
+func (bf *boundFrame) loadIBEIdentities() []*box.BoxIdentity {
+	var rv []*box.BoxIdentity
+	for _, sid := range bf.f.GetAllHeaders("ibe_identity") {
+		bin, err := base64.URLEncoding.DecodeString(sid)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad ibe_identity kv"))
+		}
+		id, err := box.UnmarshalBoxIdentity(bin)
+		if err != nil {
+			panic(bwe.M(bwe.MalformedOOBCommand, "bad ibe_identity kv"))
+		}
+		rv = append(rv, id)
+	}
+	return rv
+}
 func (bf *boundFrame) loadCommonElaborate() int {
 	elaboratePAC, ok := bf.f.GetFirstHeader("elaborate_pac")
 
@@ -291,6 +466,9 @@ func commonUnpackMsg(m *core.Message, r *objects.Frame) {
 	r.AddHeader("signature", crypto.FmtSig(m.Signature))
 	r.AddHeader("from", crypto.FmtKey(*m.OriginVK))
 	r.AddHeader("uri", crypto.FmtKey(m.MVK)+"/"+m.TopicSuffix)
+	if !m.RXTime.IsZero() {
+		r.AddHeader("rxtime", m.RXTime.Format(time.RFC3339Nano))
+	}
 	for _, ro := range m.RoutingObjects {
 		r.AddRoutingObject(ro)
 	}
@@ -465,6 +643,34 @@ func (bf *boundFrame) Handle() {
 		bf.cmdPutRevocation()
 	case objects.CmdFindDots:
 		bf.cmdFindDOTs()
+	case objects.CmdAckDurable:
+		bf.cmdAckDurable()
+	case objects.CmdExplainChain:
+		bf.cmdExplainChain()
+	case objects.CmdTrustGraph:
+		bf.cmdTrustGraph()
+	case objects.CmdEstimateCost:
+		bf.cmdEstimateCost()
+	case objects.CmdLimitUsage:
+		bf.cmdLimitUsage()
+	case objects.CmdBuildPermChain:
+		bf.cmdBuildPermChain()
+	case objects.CmdVerifyPermChain:
+		bf.cmdVerifyPermChain()
+	case objects.CmdPublishBatch:
+		bf.cmdPublishBatch()
+	case objects.CmdExportRegistry:
+		bf.cmdExportRegistry()
+	case objects.CmdImportRegistry:
+		bf.cmdImportRegistry()
+	case objects.CmdListExpiring:
+		bf.cmdListExpiring()
+	case objects.CmdWatchExpiry:
+		bf.cmdWatchExpiry()
+	case objects.CmdRenewDot:
+		bf.cmdRenewDot()
+	case objects.CmdUnpinPeer:
+		bf.cmdUnpinPeer()
 	case "devl":
 		bf.cmdDevelop()
 	default:
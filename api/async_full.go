@@ -24,15 +24,21 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"sync"
 	"sync/atomic"
 	"time"
 
+	"golang.org/x/net/context"
+
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/box"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
+	"vuvuzela.io/crypto/ibe"
 )
 
 const (
@@ -75,6 +81,11 @@ type PublishParams struct {
 	DoVerify           bool
 	Persist            bool
 	AutoChain          bool
+	//If either of these are set, every payload object is boxed into a
+	//PONumBoxedPayload object that can only be opened by these VKs
+	//or by the holder of the IBE identity for the URI under EncryptIBE
+	EncryptFor [][]byte
+	EncryptIBE *ibe.MasterPublicKey
 }
 type PublishCallback func(err error)
 
@@ -111,25 +122,113 @@ func (c *BosswaveClient) checkAddOriginVK(m *core.Message) {
 }
 func (c *BosswaveClient) Publish(params *PublishParams,
 	cb PublishCallback) {
+	m, err := c.newPublish(params)
+	if err != nil {
+		cb(err)
+		return
+	}
+	err = c.VerifyAffinity(m)
+	if err == nil { //Local delivery
+		cb(c.deliverLocal(m))
+	} else { //Remote delivery
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			cb(bwe.WrapC(bwe.PeerError, err))
+			return
+		}
+		peer.PublishPersist(m, cb)
+	}
+}
+
+//PublishBatch publishes several messages, calling cb once with the error
+//for each of them in the same order as params. Messages for namespaces
+//that another router is designated for are sent to it together.
+func (c *BosswaveClient) PublishBatch(params []*PublishParams,
+	cb func(errs []error)) {
+	errs := make([]error, len(params))
+	type peerBatch struct {
+		msgs []*core.Message
+		//The index in params of each message
+		idx []int
+	}
+	batches := make(map[*PeerClient]*peerBatch)
+	for i, p := range params {
+		m, err := c.newPublish(p)
+		if err != nil {
+			errs[i] = err
+			continue
+		}
+		if c.VerifyAffinity(m) == nil {
+			errs[i] = c.deliverLocal(m)
+			continue
+		}
+		peer, err := c.GetPeer(m.MVK)
+		if err != nil {
+			log.Info("Could not deliver to peer: ", err)
+			errs[i] = bwe.WrapC(bwe.PeerError, err)
+			continue
+		}
+		b, ok := batches[peer]
+		if !ok {
+			b = &peerBatch{}
+			batches[peer] = b
+		}
+		b.msgs = append(b.msgs, m)
+		b.idx = append(b.idx, i)
+	}
+	wg := sync.WaitGroup{}
+	wg.Add(len(batches))
+	for peer, b := range batches {
+		b := b
+		peer.PublishBatch(b.msgs, func(perrs []error) {
+			for j, err := range perrs {
+				errs[b.idx[j]] = err
+			}
+			wg.Done()
+		})
+	}
+	go func() {
+		wg.Wait()
+		cb(errs)
+	}()
+}
+
+//deliverLocal publishes or persists a message for a namespace that we
+//are the designated router of
+func (c *BosswaveClient) deliverLocal(m *core.Message) error {
+	if err := c.cl.ChargeLimits(m, c.BW()); err != nil {
+		return err
+	}
+	if m.Type == core.TypePersist {
+		c.cl.Persist(m)
+	} else {
+		c.cl.Publish(m)
+	}
+	return nil
+}
+
+//newPublish creates the signed message for the publish parameters
+func (c *BosswaveClient) newPublish(params *PublishParams) (*core.Message, error) {
 	t := core.TypePublish
 	if params.Persist {
 		t = core.TypePersist
 	}
 	if err := c.doAutoChain(params.MVK, params.URISuffix, "P", params.AutoChain, &params.PrimaryAccessChain); err != nil {
-		cb(err)
-		return
+		return nil, err
 	}
 	m, err := c.newMessage(t, params.MVK, params.URISuffix)
 	if err != nil {
-		cb(err)
-		return
+		return nil, err
 	}
 	m.PrimaryAccessChain = params.PrimaryAccessChain
 	m.RoutingObjects = params.RoutingObjects
 	m.PayloadObjects = params.PayloadObjects
+	if err := c.boxPayloads(m, params.EncryptFor, params.EncryptIBE); err != nil {
+		return nil, err
+	}
 	if err := c.doPAC(m, params.ElaboratePAC); err != nil {
-		cb(err)
-		return
+		return nil, err
 	}
 
 	//Check if we need to add an origin VK header
@@ -145,40 +244,11 @@ func (c *BosswaveClient) Publish(params *PublishParams,
 	c.finishMessage(m)
 
 	if params.DoVerify {
-		//log.Info("verifying")
-		enc := m.Encoded
-		realm, err := core.LoadMessage(enc)
-		if err != nil {
-			log.Info("verification (phase 1) failed")
-			cb(err)
-			return
-		}
-		err = realm.Verify(c.BW())
-		if err != nil {
-			log.Info("verification (phase 2) failed")
-			cb(err)
-			return
-		}
-	}
-	//Probably wanna do shit like determine if this is for remote delivery or local
-
-	err = c.VerifyAffinity(m)
-	if err == nil { //Local delivery
-		if params.Persist {
-			c.cl.Persist(m)
-		} else {
-			c.cl.Publish(m)
-		}
-		cb(nil)
-	} else { //Remote delivery
-		peer, err := c.GetPeer(m.MVK)
-		if err != nil {
-			log.Info("Could not deliver to peer: ", err)
-			cb(bwe.WrapC(bwe.PeerError, err))
-			return
+		if err := core.VerifyEncoded(m.Encoded, c.BW()); err != nil {
+			return nil, err
 		}
-		peer.PublishPersist(m, cb)
 	}
+	return m, nil
 }
 
 func (c *BosswaveClient) VerifyAffinity(m *core.Message) error {
@@ -203,6 +273,23 @@ type SubscribeParams struct {
 	ElaboratePAC       int
 	DoVerify           bool
 	AutoChain          bool
+	//If set, messages are delivered through a durable queue with this
+	//name. Each message has QueueSeq set and must be acknowledged
+	//with AckDurable or it will be delivered again when a subscription
+	//with the same durable queue name is next created.
+	Durable string
+	//Boxed payload objects that can be opened with our entity (unless
+	//KeepBoxed is set) or any of the IBE identities are replaced with the
+	//original payload object before the message is delivered
+	KeepBoxed     bool
+	IBEIdentities []*box.BoxIdentity
+	//If set, it is called with the reason before the final nil message
+	//when the router terminates the subscription because a DOT in its
+	//access chain has been revoked or has expired
+	Terminated func(err error)
+	//If set, it is called when the designated router of another namespace
+	//holds back results because they are not being consumed fast enough
+	Throttled func()
 }
 type SubscribeInitialCallback func(err error, id core.UniqueMessageID)
 type SubscribeMessageCallback func(m *core.Message)
@@ -255,36 +342,110 @@ func (c *BosswaveClient) Subscribe(params *SubscribeParams,
 	c.checkAddOriginVK(m)
 	c.finishMessage(m)
 	if params.DoVerify {
-		enc := m.Encoded
-		realm, err := core.LoadMessage(enc)
-		if err != nil {
-			log.Info("verification (phase 1) failed")
-			actionCB(err, core.UniqueMessageID{})
-			return
-		}
-		err = realm.Verify(c.BW())
-		if err != nil {
-			log.Info("verification (phase 2) failed")
+		if err := core.VerifyEncoded(m.Encoded, c.BW()); err != nil {
 			actionCB(err, core.UniqueMessageID{})
 			return
 		}
 	}
 
+	deliver := func(nm *core.Message) {
+		if nm == nil {
+			//The terminus uses the message ID as the subscription ID
+			if err := c.cl.TerminationError(m.UMid); err != nil && params.Terminated != nil {
+				params.Terminated(err)
+			}
+		}
+		messageCB(c.openPayloads(nm, !params.KeepBoxed, params.IBEIdentities))
+	}
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
-		subid := c.cl.Subscribe(c.ctx, m, func(m *core.Message) {
-			messageCB(m)
-		})
+		if params.Durable != "" {
+			subid, err := c.cl.SubscribeDurable(c.ctx, m, c.durableName(params.Durable), deliver)
+			if err != nil {
+				actionCB(err, core.UniqueMessageID{})
+				return
+			}
+			regActionCB(nil, subid)
+			return
+		}
+		subid := c.cl.Subscribe(c.ctx, m, deliver)
 		regActionCB(nil, subid)
 	} else { //Remote delivery
-		peer, err := c.GetPeer(m.MVK)
-		if err != nil {
-			log.Info("Could not deliver to peer: ", err)
-			actionCB(bwe.WrapM(bwe.PeerError, "could not peer", err), core.UniqueMessageID{})
+		//The upstream subscription may be shared with other subscribers,
+		//so the designated router will not check our access for us
+		if err := m.Verify(c.BW()); err != nil {
+			m.Audit(err)
+			actionCB(err, core.UniqueMessageID{})
 			return
 		}
-		peer.Subscribe(m, regActionCB, messageCB)
+		fed := c.bw.federation()
+		var subid core.UniqueMessageID
+		var durableCancel context.CancelFunc
+		member := &fedMember{msg: m, throttled: params.Throttled}
+		if params.Durable != "" {
+			//Durable queue handlers never get the final nil message, so
+			//the upstream is left when the queue is closed
+			dctx, dcancel := context.WithCancel(c.ctx)
+			subid, err = c.cl.SubscribeDurable(dctx, m, c.durableName(params.Durable), deliver)
+			if err != nil {
+				dcancel()
+				actionCB(err, core.UniqueMessageID{})
+				return
+			}
+			go func() {
+				<-dctx.Done()
+				fed.leave(subid, m.MVK)
+			}()
+			durableCancel = dcancel
+			member.terminate = func() {
+				//The subscription is over, so its queue is not kept
+				c.cl.Unsubscribe(subid)
+				dcancel()
+			}
+		} else {
+			subid = c.cl.Subscribe(c.ctx, m, func(nm *core.Message) {
+				if nm == nil {
+					//The terminus uses the message ID as the subscription ID
+					fed.leave(m.UMid, m.MVK)
+				}
+				deliver(nm)
+			})
+			member.terminate = func() {
+				c.cl.Unsubscribe(subid)
+			}
+		}
+		member.joined = func(err error) {
+			if err != nil {
+				member.terminate()
+				actionCB(err, core.UniqueMessageID{})
+				return
+			}
+			regActionCB(nil, subid)
+			c.subsmu.Lock()
+			if sub, ok := c.subs[subid]; ok {
+				sub.federated = true
+				sub.durableCancel = durableCancel
+			}
+			c.subsmu.Unlock()
+		}
+		fed.join(subid, member)
+	}
+}
+
+//Durable queue names are scoped to the entity so that clients cannot
+//consume each other's queues
+func (c *BosswaveClient) durableName(name string) string {
+	return crypto.FmtKey(c.GetUs().GetVK()) + "/" + name
+}
+
+//AckDurable acknowledges a message that was delivered through the given
+//durable queue
+func (c *BosswaveClient) AckDurable(queue string, seq uint64, actioncb func(error)) {
+	if c.GetUs() == nil {
+		actioncb(bwe.M(bwe.NoEntity, "no entity set"))
+		return
 	}
+	actioncb(c.cl.AckDurable(c.durableName(queue), seq))
 }
 
 func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(error)) {
@@ -304,6 +465,9 @@ func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(erro
 			delete(c.subs, id)
 		}
 		c.subsmu.Unlock()
+		if sub.durableCancel != nil {
+			sub.durableCancel()
+		}
 		actioncb(err)
 	}
 
@@ -332,7 +496,7 @@ func (c *BosswaveClient) Unsubscribe(id core.UniqueMessageID, actioncb func(erro
 	//end just for dev
 
 	err = c.VerifyAffinity(m)
-	if err == nil { //Local delivery
+	if err == nil || sub.federated { //Local delivery
 		c.cl.Unsubscribe(m.UnsubUMid)
 		//TODO remove subscription entry
 		regActionCB(nil)
@@ -405,6 +569,78 @@ func (c *BosswaveClient) BuildChain(p *BuildChainParams) (chan *objects.DChain,
 	return rv, nil
 }
 
+//ExplainChain reports why no chain can be built for the given parameters,
+//returning at most maxPartial partial chains (0 for all of them)
+func (c *BosswaveClient) ExplainChain(p *BuildChainParams, maxPartial int) (*Explanation, error) {
+	status := make(chan string, 10)
+	go func() {
+		for m := range status {
+			log.Info("chain explain status: ", m)
+		}
+	}()
+	parts := strings.SplitN(p.URI, "/", 2)
+	if len(parts) != 2 {
+		close(status)
+		return nil, bwe.M(bwe.BadURI, "Bad URI")
+	}
+	rnsvk, err := c.BW().ResolveKey(parts[0])
+	if err != nil {
+		close(status)
+		return nil, err
+	}
+	cb := NewChainBuilder(c, crypto.FmtKey(rnsvk)+"/"+parts[1], p.Permissions, p.To, status)
+	if cb == nil {
+		close(status)
+		return nil, bwe.M(bwe.BadChainBuildParams, "Could not construct CB: bad params")
+	}
+	return cb.Explain(maxPartial)
+}
+
+type BuildPermissionChainParams struct {
+	//The entity the chains must start at
+	Authority []byte
+	To        []byte
+	//The key/value pairs the chains must grant
+	Permissions map[string]string
+	Status      *chan string
+}
+
+//BuildPermissionChain finds the permission chains from the authority to
+//the target that grant all of the given permissions
+func (c *BosswaveClient) BuildPermissionChain(p *BuildPermissionChainParams) ([]*objects.DChain, error) {
+	var status chan string
+	if p.Status == nil {
+		status = make(chan string, 10)
+		go func() {
+			for m := range status {
+				log.Info("permission chain build status: ", m)
+			}
+		}()
+	} else {
+		status = *p.Status
+	}
+	cb := NewPermissionChainBuilder(c, p.Authority, p.To, p.Permissions, status)
+	return cb.Build()
+}
+
+//CheckPermission answers whether the target holds all of the given
+//permissions from the authority via a valid, unrevoked permission chain.
+//It returns the first such chain and everything that chain grants, or a
+//BadPermissions error if there is none.
+func (c *BosswaveClient) CheckPermission(p *BuildPermissionChainParams) (*objects.DChain, map[string]string, error) {
+	chains, err := c.BuildPermissionChain(p)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, ch := range chains {
+		kv, err := c.BW().VerifyPermissionChain(ch, p.Authority, p.To, p.Permissions)
+		if err == nil {
+			return ch, kv, nil
+		}
+	}
+	return nil, nil, bwe.M(bwe.BadPermissions, "no valid permission chain grants "+FmtPermissions(p.Permissions))
+}
+
 type SetEntityParams struct {
 	Keyfile []byte
 }
@@ -434,6 +670,7 @@ func (c *BosswaveClient) SetEntityObj(e *objects.Entity) error {
 	}
 	c.ourvk = e
 	c.bcc = c.bchain.GetClient(e)
+	c.bw.expw.Note(c.ctx, e)
 	return nil
 }
 
@@ -482,17 +719,7 @@ func (c *BosswaveClient) List(params *ListParams,
 	c.finishMessage(m)
 
 	if params.DoVerify {
-		//log.Info("verifying")
-		enc := m.Encoded
-		realm, err := core.LoadMessage(enc)
-		if err != nil {
-			log.Info("verification (phase 1) failed")
-			actionCB(err)
-			return
-		}
-		err = realm.Verify(c.BW())
-		if err != nil {
-			log.Info("verification (phase 2) failed")
+		if err := core.VerifyEncoded(m.Encoded, c.BW()); err != nil {
 			actionCB(err)
 			return
 		}
@@ -522,6 +749,15 @@ type QueryParams struct {
 	ElaboratePAC       int
 	DoVerify           bool
 	AutoChain          bool
+	//If either of these is set, the query returns all the persisted
+	//messages received in the (inclusive) range rather than only the
+	//latest message on each URI. This requires the router to have history
+	//enabled
+	From *time.Time
+	To   *time.Time
+	//Boxed payload objects in the results are opened as for subscriptions
+	KeepBoxed     bool
+	IBEIdentities []*box.BoxIdentity
 }
 type QueryInitialCallback func(err error)
 type QueryResultCallback func(m *core.Message)
@@ -556,26 +792,32 @@ func (c *BosswaveClient) Query(params *QueryParams,
 	c.finishMessage(m)
 
 	if params.DoVerify {
-		//log.Info("verifying")
-		enc := m.Encoded
-		realm, err := core.LoadMessage(enc)
-		if err != nil {
-			log.Info("verification (phase 1) failed")
-			actionCB(err)
-			return
-		}
-		err = realm.Verify(c.BW())
-		if err != nil {
-			log.Info("verification (phase 2) failed")
+		if err := core.VerifyEncoded(m.Encoded, c.BW()); err != nil {
 			actionCB(err)
 			return
 		}
 	}
 
+	openCB := resultCB
+	resultCB = func(m *core.Message) {
+		openCB(c.openPayloads(m, !params.KeepBoxed, params.IBEIdentities))
+	}
+	history := params.From != nil || params.To != nil
+	var from, to time.Time
+	if params.From != nil {
+		from = *params.From
+	}
+	if params.To != nil {
+		to = *params.To
+	}
 	err = c.VerifyAffinity(m)
 	if err == nil { //Local delivery
+		if history && !store.HistoryEnabled() {
+			actionCB(bwe.M(bwe.HistoryDisabled, "this router does not retain message history"))
+			return
+		}
 		actionCB(nil)
-		c.cl.Query(m, func(m *core.Message) {
+		localCB := func(m *core.Message) {
 			if m == nil {
 				resultCB(nil)
 				return
@@ -586,7 +828,12 @@ func (c *BosswaveClient) Query(params *QueryParams,
 			} else {
 				log.Infof("dropping local query result (failed verify %s)", err.Error())
 			}
-		})
+		}
+		if history {
+			c.cl.QueryHistory(m, from, to, localCB)
+		} else {
+			c.cl.Query(m, localCB)
+		}
 	} else { //Remote delivery
 		peer, err := c.GetPeer(m.MVK)
 		if err != nil {
@@ -594,7 +841,11 @@ func (c *BosswaveClient) Query(params *QueryParams,
 			actionCB(bwe.WrapM(bwe.PeerError, "could not peer", err))
 			return
 		}
-		peer.Query(m, actionCB, resultCB)
+		if history {
+			peer.QueryHistory(m, from, to, actionCB, resultCB)
+		} else {
+			peer.Query(m, actionCB, resultCB)
+		}
 	}
 }
 
@@ -613,6 +864,7 @@ type CreateDOTParams struct {
 	URISuffix         string
 	MVK               []byte
 	AccessPermissions string
+	PublishLimits     *objects.PublishLimits
 
 	//For Permissions
 	Permissions map[string]string
@@ -663,6 +915,7 @@ func (c *BosswaveClient) CreateDOT(p *CreateDOTParams) (*objects.DOT, error) {
 		if !d.SetPermString(p.AccessPermissions) {
 			return nil, bwe.M(bwe.BadPermissions, "Permission string is invalid")
 		}
+		d.SetPublishLimits(p.PublishLimits)
 	}
 	d.Encode(c.GetUs().GetSK())
 	return d, nil
@@ -0,0 +1,99 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/audit"
+	"github.com/immesys/bw2/objects"
+)
+
+//If the publisher falls this far behind, records are only written to the
+//file
+const auditQueueDepth = 1024
+
+//startAudit opens the audit log and, if configured, publishes every
+//record as the router
+func (bw *BW) startAudit() {
+	cfg := bw.Config.Audit
+	if cfg.File == "" {
+		return
+	}
+	if err := audit.Open(cfg.File, int64(cfg.MaxSize)*1024*1024, cfg.MaxFiles); err != nil {
+		fmt.Println("Could not open audit log:", err)
+		os.Exit(1)
+	}
+	if cfg.PublishURI == "" {
+		return
+	}
+	parts := strings.SplitN(cfg.PublishURI, "/", 2)
+	if len(parts) != 2 {
+		fmt.Println("Audit PublishURI must be of the form namespace/suffix")
+		os.Exit(1)
+	}
+	cl := bw.CreateClient(context.Background(), "AUDIT")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		panic(err)
+	}
+	q := make(chan []byte, auditQueueDepth)
+	//The namespace the records were last published to. Records can only be
+	//caused by our own publishes once it has been resolved
+	var ns atomic.Value
+	ns.Store("")
+	audit.SetPublisher(func(r *audit.Record, line []byte) {
+		//Don't audit the audit stream, it would never end
+		if rparts := strings.SplitN(r.URI, "/", 2); len(rparts) == 2 &&
+			rparts[1] == parts[1] && r.Namespace == ns.Load().(string) {
+			return
+		}
+		select {
+		case q <- line:
+		default:
+			log.Warn("audit publish queue is full, dropping record")
+		}
+	})
+	go func() {
+		for line := range q {
+			mvk, err := bw.ResolveKey(parts[0])
+			if err != nil {
+				log.Warnf("could not resolve audit namespace: %v", err)
+				continue
+			}
+			ns.Store(crypto.FmtKey(mvk))
+			po, _ := objects.CreateOpaquePayloadObject(objects.PONumJSON, line)
+			cl.Publish(&PublishParams{
+				MVK:            mvk,
+				URISuffix:      parts[1],
+				PayloadObjects: []objects.PayloadObject{po},
+				ElaboratePAC:   PartialElaboration,
+				AutoChain:      true,
+			}, func(err error) {
+				if err != nil {
+					log.Warnf("could not publish audit record to %s/%s: %v", crypto.FmtKey(mvk), parts[1], err)
+				}
+			})
+		}
+	}()
+}
@@ -25,14 +25,18 @@ import (
 	"path"
 	"strings"
 	"sync"
+	"sync/atomic"
 
 	"golang.org/x/net/context"
 
 	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/metrics"
+	"github.com/immesys/bw2/internal/regsnap"
 	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2bc/common"
 )
 
@@ -47,12 +51,31 @@ type BW struct {
 	Entity *objects.Entity
 	bchain bc.BlockChainProvider
 	rdata  *ResolutionData
+	lagger *Lagger
+	//The registry snapshot used while the chain is stale, if any, and
+	//whether it is in use (accessed atomically)
+	snap      *regsnap.Snapshot
+	snapInUse int32
+	//The registry objects imported with ImportRegistry (a *regsnap.Snapshot)
+	imported atomic.Value
+	impmu    sync.Mutex
+	//DOTs and entities the router depends on that expire soon
+	expw *expiryWatch
+
+	fed     *federation
+	fedOnce sync.Once
 }
 
 func (bw *BW) BC() bc.BlockChainProvider {
 	return bw.bchain
 }
 
+//LimitUsage returns the usage metered against DOTs with PublishLimits by
+//this router, for the given DOTs or all of them if none are given
+func (bw *BW) LimitUsage(dothashes ...[]byte) []*core.LimitUsage {
+	return bw.tm.LimitUsage(dothashes...)
+}
+
 // In seconds
 const defaultMaxAge = 120
 
@@ -66,6 +89,7 @@ func OpenBWContext(config *core.BWConfig) (*BW, chan bool) {
 		tm: core.CreateTerminus(),
 		//dotcache:   make(map[bc.Bytes32]map[bc.Bytes32][]bc.Bytes32),
 		rdata: newResolutionData(),
+		expw:  newExpiryWatch(),
 	}
 	entcontents, err := ioutil.ReadFile(config.Router.Entity)
 	if err != nil {
@@ -86,7 +110,28 @@ func OpenBWContext(config *core.BWConfig) (*BW, chan bool) {
 	if (ben == common.Address{}) {
 		panic("Invalid mining benificiary")
 	}
-	store.Initialize(config.Router.DB)
+	if err := store.Initialize(config.Router.DBBackend, config.Router.DB); err != nil {
+		fmt.Println("Could not open database:", err)
+		os.Exit(1)
+	}
+	switch config.Native.CertPinning {
+	case CertPinningOff, CertPinningTOFU, CertPinningWarn:
+	default:
+		fmt.Println("Invalid Native CertPinning:", config.Native.CertPinning)
+		os.Exit(1)
+	}
+	if config.History.Enabled {
+		maxage, err := util.ParseDuration(config.History.MaxAge)
+		if err != nil {
+			fmt.Println("Invalid history MaxAge:", err)
+			os.Exit(1)
+		}
+		if maxage == nil {
+			store.SetHistoryRetention(config.History.MaxCount, 0)
+		} else {
+			store.SetHistoryRetention(config.History.MaxCount, *maxage)
+		}
+	}
 	rv.Entity = ent
 	//In future we can add our own on-shutdown logic here. For now
 	//only the BC has shutdown tasks
@@ -103,7 +148,17 @@ func OpenBWContext(config *core.BWConfig) (*BW, chan bool) {
 		ExternalAddr:      config.P2P.ExternalIP,
 		ListenPort:        config.P2P.Port,
 	})
+	rv.lagger = NewLagger(rv.bchain)
+	rv.lagger.BeginLoop()
+	metrics.RegisterChainLag(rv.lagger.HeadAge, rv.lagger.Head, rv.lagger.Confirmed)
+	rv.loadSnapshot()
+	if config.Metrics.PrefixDepth > 0 {
+		metrics.PrefixDepth = config.Metrics.PrefixDepth
+	}
+	rv.startAudit()
 	rv.startResolutionServices()
+	rv.startKeyAuthority()
+	rv.startExpiryWatch()
 	return rv, bcShutdown
 }
 
@@ -143,6 +198,10 @@ type BosswaveClient struct {
 type Subscription struct {
 	Msg  *core.Message
 	UMid core.UniqueMessageID
+	//Delivered through our terminus from a shared upstream subscription
+	federated bool
+	//Closes the local durable queue of a federated subscription
+	durableCancel context.CancelFunc
 }
 
 func (cl *BosswaveClient) registerView(v *View) int {
@@ -163,6 +222,13 @@ func (cl *BosswaveClient) SetMaxChainAge(age uint64) {
 func (cl *BosswaveClient) ChainStale() bool {
 	return (cl.bchain.HeadBlockAge() > int64(cl.GetMaxChainAge()))
 }
+
+//RegistryStale is like ChainStale, but false if registry objects can be
+//resolved from a snapshot instead. Only use it for operations that do not
+//touch the chain.
+func (cl *BosswaveClient) RegistryStale() bool {
+	return cl.ChainStale() && !cl.bw.UsingSnapshot()
+}
 func (cl *BosswaveClient) GetUs() *objects.Entity {
 	return cl.ourvk
 }
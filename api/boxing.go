@@ -0,0 +1,80 @@
+package api
+
+import (
+	"github.com/immesys/bw2/box"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"vuvuzela.io/crypto/ibe"
+)
+
+//IBEIdentityForURI returns the IBE identity that payload objects published
+//to the URI are boxed for, see box.IdentityForURI
+func IBEIdentityForURI(mvk []byte, suffix string) []byte {
+	return box.IdentityForURI(mvk, suffix)
+}
+
+//boxPayloads replaces every payload object in the message with a boxed
+//payload object that the given VKs, and the URI identity under ibepub,
+//can open. It must be called before the message is encoded.
+func (c *BosswaveClient) boxPayloads(m *core.Message, vks [][]byte, ibepub *ibe.MasterPublicKey) error {
+	if len(vks) == 0 && ibepub == nil {
+		return nil
+	}
+	for _, vk := range vks {
+		if len(vk) != 32 {
+			return bwe.M(bwe.BadOperation, "invalid encryption recipient VK")
+		}
+	}
+	var id []byte
+	if ibepub != nil {
+		id = IBEIdentityForURI(m.MVK, m.TopicSuffix)
+	}
+	pos := make([]objects.PayloadObject, len(m.PayloadObjects))
+	for i, po := range m.PayloadObjects {
+		bpo, err := box.BoxPayloadObject(c.GetUs(), po, vks, ibepub, id)
+		if err != nil {
+			return bwe.WrapM(bwe.BadOperation, "could not box payload", err)
+		}
+		pos[i] = bpo
+	}
+	m.PayloadObjects = pos
+	return nil
+}
+
+//openPayloads returns the message with every boxed payload object that the
+//client's entity (if decrypt is set) or one of the identities can open
+//replaced by the original payload object. Boxed payload objects that cannot
+//be opened are left as they are. Messages are shared between subscribers so
+//if anything is opened a copy is returned. The encoded form of the message
+//is not changed.
+func (c *BosswaveClient) openPayloads(m *core.Message, decrypt bool, ids []*box.BoxIdentity) *core.Message {
+	if m == nil || (!decrypt && len(ids) == 0) {
+		return m
+	}
+	var ent *objects.Entity
+	if decrypt {
+		ent = c.GetUs()
+	}
+	var pos []objects.PayloadObject
+	for i, po := range m.PayloadObjects {
+		if po.GetPONum() != objects.PONumBoxedPayload {
+			continue
+		}
+		opo, err := box.OpenPayloadObject(po, ent, ids)
+		if err != nil {
+			continue
+		}
+		if pos == nil {
+			pos = make([]objects.PayloadObject, len(m.PayloadObjects))
+			copy(pos, m.PayloadObjects)
+		}
+		pos[i] = opo
+	}
+	if pos == nil {
+		return m
+	}
+	nm := *m
+	nm.PayloadObjects = pos
+	return &nm
+}
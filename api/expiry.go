@@ -0,0 +1,250 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/expiry"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//How often the DOTs and entities the router depends on are checked for
+//upcoming expiry, if nothing prompts it sooner
+const expiryCheckInterval = 1 * time.Hour
+
+//ExpiryWarning is a DOT or entity that expires soon
+type ExpiryWarning = expiry.Warning
+
+//expiryWatch keeps the current expiry warnings, who to tell about new
+//ones and the entities clients have set
+type expiryWatch struct {
+	*expiry.Watch
+	kick chan struct{}
+}
+
+func newExpiryWatch() *expiryWatch {
+	return &expiryWatch{
+		Watch: expiry.NewWatch(),
+		kick:  make(chan struct{}, 1),
+	}
+}
+
+//check asks for the warnings to be recomputed soon
+func (ew *expiryWatch) check() {
+	select {
+	case ew.kick <- struct{}{}:
+	default:
+	}
+}
+
+//WarnExpiryWithin returns how long before expiry the router warns about
+//the DOTs and entities it depends on, or 0 if it does not
+func (bw *BW) WarnExpiryWithin() time.Duration {
+	return time.Duration(bw.Config.Expiry.WarnDays) * 24 * time.Hour
+}
+
+//startExpiryWatch periodically looks for DOTs in the chains the router has
+//built, and entities it has loaded (its own, those that clients have set
+//and those at either end of the DOTs), that expire within WarnDays. New
+//warnings are logged and given to WatchExpiry callbacks, and if StatusURI
+//is set all of the current warnings are persisted there as JSON whenever
+//they change.
+func (bw *BW) startExpiryWatch() {
+	cfg := bw.Config.Expiry
+	if cfg.WarnDays <= 0 {
+		return
+	}
+	var publish func(js []byte)
+	if cfg.StatusURI != "" {
+		parts := strings.SplitN(cfg.StatusURI, "/", 2)
+		if len(parts) != 2 {
+			fmt.Println("Expiry StatusURI must be of the form namespace/suffix")
+			os.Exit(1)
+		}
+		cl := bw.CreateClient(context.Background(), "EXPIRY")
+		if err := cl.SetEntityObj(bw.Entity); err != nil {
+			panic(err)
+		}
+		publish = func(js []byte) {
+			mvk, err := bw.ResolveKey(parts[0])
+			if err != nil {
+				log.Warnf("could not resolve expiry status namespace: %v", err)
+				return
+			}
+			po, _ := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+			cl.Publish(&PublishParams{
+				MVK:            mvk,
+				URISuffix:      parts[1],
+				PayloadObjects: []objects.PayloadObject{po},
+				ElaboratePAC:   PartialElaboration,
+				AutoChain:      true,
+				Persist:        true,
+			}, func(err error) {
+				if err != nil {
+					log.Warnf("could not persist expiry status to %s/%s: %v", crypto.FmtKey(mvk), parts[1], err)
+				}
+			})
+		}
+	}
+	go func() {
+		for {
+			select {
+			case <-bw.expw.kick:
+			case <-time.After(expiryCheckInterval):
+			}
+			changed := bw.updateExpiryWarnings()
+			if changed && publish != nil {
+				js, err := json.Marshal(bw.ExpiryWarnings())
+				if err != nil {
+					panic(err)
+				}
+				publish(js)
+			}
+		}
+	}()
+	bw.expw.check()
+}
+
+//updateExpiryWarnings recomputes the warnings and returns true if they
+//are not the same as before
+func (bw *BW) updateExpiryWarnings() bool {
+	dots := []expiry.Link{}
+	for _, hash := range bw.builtChainDOTs() {
+		d, state, err := bw.ResolveDOT(hash[:])
+		if err != nil || d == nil {
+			continue
+		}
+		dots = append(dots, expiry.Link{D: d, S: state})
+	}
+	vks := append(bw.expw.Loaded(), bw.Entity.GetVK())
+	warnings, _ := expiry.Expiring(dots, vks, time.Now().Add(bw.WarnExpiryWithin()), lenientResolver{bw})
+	fresh, changed := bw.expw.Update(warnings)
+	for _, w := range fresh {
+		log.Warnf("%s", w)
+	}
+	return changed
+}
+
+//lenientResolver skips the entities that cannot be resolved right now
+type lenientResolver struct {
+	*BW
+}
+
+func (lr lenientResolver) ResolveEntity(vk []byte) (*objects.Entity, int, error) {
+	e, state, err := lr.BW.ResolveEntity(vk)
+	if err != nil {
+		return nil, StateUnknown, nil
+	}
+	return e, state, nil
+}
+
+//builtChainDOTs returns the hashes of the DOTs in the cached built chains
+func (bw *BW) builtChainDOTs() []bc.Bytes32 {
+	bw.getlock()
+	defer bw.rellock()
+	seen := make(map[bc.Bytes32]bool)
+	rv := []bc.Bytes32{}
+	for _, nsmap := range bw.rdata.chaincache {
+		for _, chains := range nsmap {
+			for _, dc := range chains {
+				for i := 0; i < dc.NumHashes(); i++ {
+					h := bc.SliceToBytes32(dc.GetDotHash(i))
+					if !seen[h] {
+						seen[h] = true
+						rv = append(rv, h)
+					}
+				}
+			}
+		}
+	}
+	return rv
+}
+
+//ExpiryWarnings returns the current expiry warnings, soonest first
+func (bw *BW) ExpiryWarnings() []*ExpiryWarning {
+	return bw.expw.Current()
+}
+
+//WatchExpiry calls cb with every current expiry warning, and then with
+//each new one until ctx is done. New warnings are given to the watchers
+//in order, by the goroutine that finds them.
+func (bw *BW) WatchExpiry(ctx context.Context, cb func(w *ExpiryWarning)) error {
+	if bw.WarnExpiryWithin() <= 0 {
+		return bwe.M(bwe.BadOperation, "Expiry warnings are not enabled on this router")
+	}
+	bw.expw.Watch.Watch(ctx, cb)
+	return nil
+}
+
+//WatchExpiry is like BW.WatchExpiry, until the client is closed
+func (cl *BosswaveClient) WatchExpiry(cb func(w *ExpiryWarning)) error {
+	return cl.bw.WatchExpiry(cl.ctx, cb)
+}
+
+//Expiring returns the entity, the DOTs it has granted and the DOTs granted
+//to it, and the entities at the other end of those DOTs, that expire
+//within the given duration. The registry cannot list the DOTs granted to
+//an entity, so those are the ones the router has seen plus, for each of
+//the given namespaces, the ones reachable from it (as in TrustGraph).
+//Objects that have already expired are included.
+func (bw *BW) Expiring(vk []byte, nsvks [][]byte, within time.Duration) ([]*ExpiryWarning, error) {
+	deadline := time.Now().Add(within)
+	dots := make(map[bc.Bytes32]DOTLink)
+	granted, err := bw.ResolveGrantedDOTs(vk)
+	if err != nil {
+		return nil, err
+	}
+	for _, dl := range granted {
+		if dl.D != nil {
+			dots[bc.SliceToBytes32(dl.D.GetHash())] = dl
+		}
+	}
+	bw.getlock()
+	toHashes := append([]bc.Bytes32{}, bw.rdata.dotToInvCache[bc.SliceToBytes32(vk)]...)
+	bw.rellock()
+	for _, hash := range toHashes {
+		d, state, err := bw.ResolveDOT(hash[:])
+		if err != nil {
+			return nil, err
+		}
+		if d != nil && bytes.Equal(d.GetReceiverVK(), vk) {
+			dots[hash] = DOTLink{D: d, S: state}
+		}
+	}
+	for _, nsvk := range nsvks {
+		g, err := bw.TrustGraph(nsvk, "")
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range g.Edges {
+			if e.To != crypto.FmtKey(vk) {
+				continue
+			}
+			hash, err := crypto.UnFmtHash(e.Hash)
+			if err != nil {
+				continue
+			}
+			d, state, err := bw.ResolveDOT(hash)
+			if err != nil {
+				return nil, err
+			}
+			if d != nil {
+				dots[bc.SliceToBytes32(hash)] = DOTLink{D: d, S: state}
+			}
+		}
+	}
+	links := make([]expiry.Link, 0, len(dots))
+	for _, dl := range dots {
+		links = append(links, expiry.Link{D: dl.D, S: dl.S})
+	}
+	return expiry.Expiring(links, [][]byte{vk}, deadline, bw)
+}
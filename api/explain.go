@@ -0,0 +1,41 @@
+package api
+
+import "github.com/immesys/bw2/internal/trust"
+
+//RejectedDOT is a DOT that could not be used to extend a partial chain
+type RejectedDOT = trust.RejectedDOT
+
+//PartialChain is a chain from the namespace that does not reach the target
+type PartialChain = trust.PartialChain
+
+//Explanation is the result of ChainBuilder.Explain
+type Explanation = trust.Explanation
+
+//Explain walks the same graph as Build, but instead of only returning the
+//chains that reach the target, it also returns the partial chains that
+//could not be extended and why, closest to the target first. It does not
+//use or populate the chain cache.
+func (b *ChainBuilder) Explain(maxPartial int) (*Explanation, error) {
+	defer close(b.status)
+	return trust.Explain(trustResolver{b.cl.BW()}, b.nsvk, b.urisuffix, b.perms, b.target, maxPartial, b.status)
+}
+
+//trustResolver resolves granted DOTs for the walks in trust
+type trustResolver struct {
+	bw *BW
+}
+
+func (r trustResolver) ResolveGrantedDOTs(vk []byte) ([]trust.Link, error) {
+	dlz, err := r.bw.ResolveGrantedDOTs(vk)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]trust.Link, 0, len(dlz))
+	for _, dl := range dlz {
+		rv = append(rv, trust.Link{D: dl.D, S: dl.S})
+	}
+	return rv, nil
+}
+func (r trustResolver) StateToString(state int) string {
+	return r.bw.StateToString(state)
+}
@@ -0,0 +1,484 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package api
+
+// Subscriptions to namespaces that we are not the designated router for
+// are federated. Every local subscriber gets a normal subscription in our
+// own terminus, and the federation makes sure that there is an upstream
+// subscription on the designated router that covers it. Upstream messages
+// are published into our terminus, which fans them out to the matching
+// local subscribers. Upstream subscriptions are shared: a new subscriber
+// whose URI is covered by an existing upstream (identical, or matched by
+// its wildcards) just attaches to it.
+//
+// The designated router only checks the access of the subscriber whose
+// message created the upstream (its owner), so every subscriber that
+// attaches to an upstream has its own subscribe message verified locally
+// first. When the owner leaves, the remaining members are rejoined so that
+// the upstream is not served on the credentials of someone who is gone.
+
+import (
+	"sync"
+	"time"
+
+	"golang.org/x/net/context"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//How many recent message IDs are remembered to drop duplicates that
+//arrive on overlapping upstreams
+const fedDedupDepth = 4096
+
+//How many times in a row a member is rejoined after its upstream fails or
+//ends before its subscription is terminated
+const fedMaxRejoins = 3
+
+//If an upstream lasted this long before it ended, it does not count
+//towards fedMaxRejoins
+const fedRejoinReset = 1 * time.Minute
+
+type fedMember struct {
+	msg *core.Message
+	//Terminates the local subscription if it can no longer be served
+	terminate func()
+	//If set, it is called once with the result of the next join
+	joined func(err error)
+	//If set, it is called when the designated router throttles the upstream
+	throttled func()
+	rejoins   int
+	left      bool
+}
+
+type upstreamSub struct {
+	msg *core.Message
+	//The member whose message msg is
+	owner   core.UniqueMessageID
+	peer    *PeerClient
+	id      core.UniqueMessageID
+	members map[core.UniqueMessageID]*fedMember
+	//zero until the designated router has accepted the subscribe
+	established time.Time
+	err         error
+	retired     bool
+}
+
+type federation struct {
+	bw *BW
+	//The client that owns the shared peer links, it uses the router entity
+	cl *BosswaveClient
+	mu sync.Mutex
+	//upstreams per namespace
+	ups map[string][]*upstreamSub
+	//members that have not left, whether or not they have an upstream
+	members map[core.UniqueMessageID]*fedMember
+
+	seenmu  sync.Mutex
+	seen    map[core.UniqueMessageID]bool
+	seenlog []core.UniqueMessageID
+	seenidx int
+}
+
+func newFederation(bw *BW) *federation {
+	cl := bw.CreateClient(context.Background(), "FEDERATION")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		panic(err)
+	}
+	return &federation{
+		bw:      bw,
+		cl:      cl,
+		ups:     make(map[string][]*upstreamSub),
+		members: make(map[core.UniqueMessageID]*fedMember),
+		seen:    make(map[core.UniqueMessageID]bool),
+		seenlog: make([]core.UniqueMessageID, fedDedupDepth),
+	}
+}
+
+func (bw *BW) federation() *federation {
+	bw.fedOnce.Do(func() {
+		bw.fed = newFederation(bw)
+	})
+	return bw.fed
+}
+
+//covers returns true if every URI matched by suffix is also matched by
+//upstream
+func covers(upstream string, suffix string) bool {
+	res, ok := util.RestrictBy(upstream, suffix)
+	return ok && res == suffix
+}
+
+//isDuplicate records the message ID and returns true if it was seen recently
+func (f *federation) isDuplicate(umid core.UniqueMessageID) bool {
+	f.seenmu.Lock()
+	defer f.seenmu.Unlock()
+	if f.seen[umid] {
+		return true
+	}
+	delete(f.seen, f.seenlog[f.seenidx])
+	f.seenlog[f.seenidx] = umid
+	f.seenidx = (f.seenidx + 1) % fedDedupDepth
+	f.seen[umid] = true
+	return false
+}
+
+//join attaches a local subscription to an upstream that covers it,
+//creating one with the member's message if required. It does not wait
+//for the designated router: member.joined is called once the upstream is
+//established, or with the error if it could not be.
+func (f *federation) join(subid core.UniqueMessageID, member *fedMember) {
+	m := member.msg
+	ns := crypto.FmtKey(m.MVK)
+	f.mu.Lock()
+	if member.left {
+		f.mu.Unlock()
+		return
+	}
+	f.members[subid] = member
+	for _, u := range f.ups[ns] {
+		if covers(u.msg.TopicSuffix, m.TopicSuffix) {
+			u.members[subid] = member
+			var cb func(err error)
+			if !u.established.IsZero() {
+				cb = member.joined
+				member.joined = nil
+			}
+			f.mu.Unlock()
+			//Otherwise established or failed tells it
+			if cb != nil {
+				cb(nil)
+			}
+			return
+		}
+	}
+	up := &upstreamSub{
+		msg:     m,
+		owner:   subid,
+		members: map[core.UniqueMessageID]*fedMember{subid: member},
+	}
+	f.ups[ns] = append(f.ups[ns], up)
+	f.mu.Unlock()
+	f.establish(up)
+}
+
+//establish sends the upstream subscribe
+func (f *federation) establish(up *upstreamSub) {
+	peer, err := f.cl.GetPeer(up.msg.MVK)
+	if err != nil {
+		f.failed(up, bwe.WrapM(bwe.PeerError, "could not peer", err))
+		return
+	}
+	up.peer = peer
+	peer.Subscribe(up.msg, func(err error, id core.UniqueMessageID) {
+		if err != nil {
+			f.failed(up, err)
+			return
+		}
+		f.established(up, id)
+	}, func(nm *core.Message) {
+		if f.isDuplicate(nm.UMid) {
+			return
+		}
+		f.cl.cl.Forward(nm)
+	}, func(err error) {
+		f.upstreamEnded(up, err)
+	}, func() {
+		f.throttled(up)
+	})
+}
+
+//throttled tells the members of an upstream that the designated router is
+//holding back its results
+func (f *federation) throttled(up *upstreamSub) {
+	f.mu.Lock()
+	cbs := []func(){}
+	for _, member := range up.members {
+		if member.throttled != nil {
+			cbs = append(cbs, member.throttled)
+		}
+	}
+	f.mu.Unlock()
+	for _, cb := range cbs {
+		cb()
+	}
+}
+
+//established is called when the designated router accepts an upstream
+func (f *federation) established(up *upstreamSub, id core.UniqueMessageID) {
+	ns := crypto.FmtKey(up.msg.MVK)
+	f.mu.Lock()
+	up.id = id
+	up.established = time.Now()
+	cbs := []func(err error){}
+	for _, member := range up.members {
+		if member.joined != nil {
+			cbs = append(cbs, member.joined)
+			member.joined = nil
+		}
+	}
+	//Everyone may have left while we were waiting for the router
+	empty := len(up.members) == 0
+	_, owned := up.members[up.owner]
+	if empty {
+		f.removeUpstream(ns, up)
+	}
+	f.mu.Unlock()
+	log.Infof("federated upstream %s/%s established", ns, up.msg.TopicSuffix)
+	for _, cb := range cbs {
+		cb(nil)
+	}
+	if empty {
+		f.retire(up)
+		return
+	}
+	f.absorb(ns, up)
+	if !owned {
+		f.handoff(ns, up)
+	}
+}
+
+//failed is called when an upstream could not be established. The owner's
+//credentials were refused, so it gets the error, and the other members
+//are rejoined with their own.
+func (f *federation) failed(up *upstreamSub, err error) {
+	f.mu.Lock()
+	f.removeUpstream(crypto.FmtKey(up.msg.MVK), up)
+	up.err = err
+	members := up.members
+	up.members = make(map[core.UniqueMessageID]*fedMember)
+	f.mu.Unlock()
+	for subid, member := range members {
+		if subid == up.owner {
+			f.drop(member, err)
+		} else {
+			f.rejoin(subid, member, err)
+		}
+	}
+}
+
+//rejoin joins a member again after its upstream failed or ended, unless
+//that has happened too many times
+func (f *federation) rejoin(subid core.UniqueMessageID, member *fedMember, err error) {
+	f.mu.Lock()
+	member.rejoins++
+	n := member.rejoins
+	f.mu.Unlock()
+	if n > fedMaxRejoins {
+		f.drop(member, err)
+		return
+	}
+	go func() {
+		time.Sleep(time.Duration(n) * time.Second)
+		f.join(subid, member)
+	}()
+}
+
+//drop gives up on a member
+func (f *federation) drop(member *fedMember, err error) {
+	f.mu.Lock()
+	cb := member.joined
+	member.joined = nil
+	f.mu.Unlock()
+	if cb != nil {
+		cb(err)
+		return
+	}
+	log.Infof("dropping federated subscription %s: %v", member.msg.TopicSuffix, err)
+	member.terminate()
+}
+
+//absorb moves the members of upstreams that are covered by up onto it and
+//retires the covered upstreams
+func (f *federation) absorb(ns string, up *upstreamSub) {
+	f.mu.Lock()
+	toRetire := []*upstreamSub{}
+	for _, u := range f.ups[ns] {
+		if u == up || u.established.IsZero() {
+			continue
+		}
+		if covers(up.msg.TopicSuffix, u.msg.TopicSuffix) {
+			for k, v := range u.members {
+				up.members[k] = v
+			}
+			toRetire = append(toRetire, u)
+		}
+	}
+	for _, u := range toRetire {
+		f.removeUpstream(ns, u)
+	}
+	f.mu.Unlock()
+	for _, u := range toRetire {
+		f.retire(u)
+	}
+}
+
+//handoff replaces an upstream whose owner has left. Its members are
+//rejoined, which establishes upstreams with the messages of members that
+//are still subscribed, and it is retired once they have been.
+func (f *federation) handoff(ns string, up *upstreamSub) {
+	f.mu.Lock()
+	f.removeUpstream(ns, up)
+	members := up.members
+	up.members = make(map[core.UniqueMessageID]*fedMember)
+	wg := &sync.WaitGroup{}
+	for _, member := range members {
+		member := member
+		wg.Add(1)
+		member.joined = func(err error) {
+			if err != nil {
+				log.Infof("dropping federated subscription %s: %v", member.msg.TopicSuffix, err)
+				member.terminate()
+			}
+			wg.Done()
+		}
+	}
+	f.mu.Unlock()
+	log.Infof("handing off federated upstream %s/%s", ns, up.msg.TopicSuffix)
+	for subid, member := range members {
+		f.join(subid, member)
+	}
+	go func() {
+		wg.Wait()
+		f.retire(up)
+	}()
+}
+
+//must be called with f.mu held
+func (f *federation) removeUpstream(ns string, up *upstreamSub) {
+	lst := f.ups[ns]
+	for i, u := range lst {
+		if u == up {
+			f.ups[ns] = append(lst[:i], lst[i+1:]...)
+			break
+		}
+	}
+	if len(f.ups[ns]) == 0 {
+		delete(f.ups, ns)
+	}
+}
+
+//leave detaches a local subscription. When an upstream has no members
+//left it is unsubscribed, and when its owner leaves it is handed off.
+func (f *federation) leave(subid core.UniqueMessageID, mvk []byte) {
+	ns := crypto.FmtKey(mvk)
+	f.mu.Lock()
+	var cb func(err error)
+	if member, ok := f.members[subid]; ok {
+		delete(f.members, subid)
+		member.left = true
+		cb = member.joined
+		member.joined = nil
+	}
+	var empty, orphaned *upstreamSub
+	for _, u := range f.ups[ns] {
+		if _, ok := u.members[subid]; ok {
+			delete(u.members, subid)
+			if u.established.IsZero() {
+				//established deals with it
+				break
+			}
+			if len(u.members) == 0 {
+				empty = u
+				f.removeUpstream(ns, u)
+			} else if subid == u.owner {
+				orphaned = u
+			}
+			break
+		}
+	}
+	f.mu.Unlock()
+	if cb != nil {
+		cb(bwe.M(bwe.UnsubscribeError, "Subscription ended before it was federated"))
+	}
+	if empty != nil {
+		f.retire(empty)
+	}
+	if orphaned != nil {
+		f.handoff(ns, orphaned)
+	}
+}
+
+//retire unsubscribes an upstream that is no longer needed
+func (f *federation) retire(up *upstreamSub) {
+	f.mu.Lock()
+	up.retired = true
+	f.mu.Unlock()
+	m, err := f.cl.newMessage(core.TypeUnsubscribe, up.msg.MVK, up.msg.TopicSuffix)
+	if err != nil {
+		log.Warnf("could not retire upstream: %v", err)
+		return
+	}
+	m.UnsubUMid = up.id
+	f.cl.finishMessage(m)
+	up.peer.Unsubscribe(m, func(err error) {
+		if err != nil {
+			log.Infof("retiring upstream %s failed: %v", up.msg.TopicSuffix, err)
+		}
+	})
+}
+
+//upstreamEnded is called when the designated router ends an upstream. If
+//we did not ask for that, the members are rejoined, which establishes
+//new upstreams with their own credentials. A member whose own
+//credentials are refused is dropped, and the rest stop being rejoined
+//after fedMaxRejoins upstreams in a row end quickly. If the router ended it
+//because the access of the upstream's message was revoked, the member it
+//belongs to is terminated with that error instead.
+func (f *federation) upstreamEnded(up *upstreamSub, err error) {
+	f.mu.Lock()
+	if up.retired {
+		f.mu.Unlock()
+		return
+	}
+	f.removeUpstream(crypto.FmtKey(up.msg.MVK), up)
+	members := up.members
+	up.members = make(map[core.UniqueMessageID]*fedMember)
+	if time.Since(up.established) > fedRejoinReset {
+		for _, member := range members {
+			member.rejoins = 0
+		}
+	}
+	f.mu.Unlock()
+	if err == nil {
+		err = bwe.M(bwe.PeerError, "upstream subscription ended")
+	}
+	for subid, member := range members {
+		if subid == up.owner && bwe.AsBW(err).Code == bwe.AccessRevoked {
+			log.Infof("federated subscription %s lost its access: %v", member.msg.TopicSuffix, err)
+			f.revoked(subid, err)
+			member.terminate()
+			continue
+		}
+		f.rejoin(subid, member, err)
+	}
+}
+
+//revoked terminates the local subscription with the error, so that the
+//subscriber is told why
+func (f *federation) revoked(subid core.UniqueMessageID, err error) {
+	f.bw.tm.TerminateSubs(func(m *core.Message) error {
+		if m.UMid == subid {
+			return err
+		}
+		return nil
+	})
+}
@@ -0,0 +1,245 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/keyauth"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/objects/advpo"
+	"golang.org/x/crypto/sha3"
+	"vuvuzela.io/crypto/ibe"
+)
+
+//A key authority hands out IBE identity keys for the URIs in a namespace.
+//Requests are published as a JSON KeyRequest to KeyAuthorityRequestSuffix.
+//If the access chain in the request grants the requester C on the URI, the
+//identity key for the URI is put in a KeyResponse that is boxed for the
+//requester and persisted on KeyAuthorityResponseURI(requester). The master
+//public key is persisted as metadata on KeyAuthorityMPKSuffix so that
+//publishers can box payloads for a URI (see PublishParams.EncryptIBE).
+//The authority publishes and subscribes as the router entity, so the
+//namespace must grant it P and C on $/ibe/*
+const (
+	KeyAuthorityRequestSuffix  = "$/ibe/request"
+	KeyAuthorityResponseSuffix = "$/ibe/response"
+	KeyAuthorityMPKSuffix      = "$/ibe/!meta/mpk"
+)
+
+//How long to wait before trying to start the key authority again if the
+//namespace cannot be resolved, we lack permissions yet or the request
+//subscription ended. It doubles up to keyAuthorityMaxRetry while starting
+//keeps failing.
+const keyAuthorityRetry = 30 * time.Second
+const keyAuthorityMaxRetry = 10 * time.Minute
+
+//KeyRequest is the JSON payload of a request to a key authority
+type KeyRequest struct {
+	//The URI suffix that the identity key is wanted for
+	URI string `json:"uri"`
+	//The hash of an access DChain that grants the requester C on the URI
+	Chain string `json:"chain"`
+	//Copied into the response so requests can be matched up
+	Nonce string `json:"nonce"`
+}
+
+//KeyResponse is the JSON payload of a response from a key authority
+type KeyResponse struct {
+	URI   string `json:"uri"`
+	Nonce string `json:"nonce"`
+	//The base64 encoded identity, see box.UnmarshalBoxIdentity
+	Identity string `json:"identity,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+//KeyAuthorityResponseURI returns the URI suffix that responses to the
+//given requester are persisted on
+func KeyAuthorityResponseURI(vk []byte) string {
+	return KeyAuthorityResponseSuffix + "/" + hex.EncodeToString(vk)
+}
+
+//LoadIBEMasterKey returns the IBE master key kept in the given file,
+//creating it if it does not exist. The master private key cannot be
+//serialized so the file holds a seed that the key is derived from.
+func LoadIBEMasterKey(fname string) (*ibe.MasterPublicKey, *ibe.MasterPrivateKey, error) {
+	seed, err := ioutil.ReadFile(fname)
+	if os.IsNotExist(err) {
+		seed = make([]byte, 32)
+		if _, err := rand.Read(seed); err != nil {
+			return nil, nil, err
+		}
+		if err := ioutil.WriteFile(fname, seed, 0600); err != nil {
+			return nil, nil, err
+		}
+	} else if err != nil {
+		return nil, nil, err
+	}
+	if len(seed) != 32 {
+		return nil, nil, fmt.Errorf("%s is not an IBE master key file", fname)
+	}
+	shk := sha3.NewShake256()
+	shk.Write(seed)
+	pub, priv := ibe.Setup(shk)
+	return pub, priv, nil
+}
+
+type keyAuthority struct {
+	bw    *BW
+	cl    *BosswaveClient
+	ns    string
+	auth  *keyauth.Authority
+	ended chan struct{}
+}
+
+//startKeyAuthority starts the key authority for the configured namespace,
+//if there is one
+func (bw *BW) startKeyAuthority() {
+	cfg := bw.Config.KeyAuthority
+	if cfg.Namespace == "" {
+		return
+	}
+	if cfg.KeyFile == "" {
+		fmt.Println("KeyAuthority KeyFile must be set if Namespace is")
+		os.Exit(1)
+	}
+	pub, priv, err := LoadIBEMasterKey(cfg.KeyFile)
+	if err != nil {
+		fmt.Println("Could not load IBE master key:", err)
+		os.Exit(1)
+	}
+	cl := bw.CreateClient(context.Background(), "IBEKA")
+	if err := cl.SetEntityObj(bw.Entity); err != nil {
+		panic(err)
+	}
+	ka := &keyAuthority{bw: bw, cl: cl, ns: cfg.Namespace,
+		auth:  &keyauth.Authority{Pub: pub, Priv: priv, Res: bw},
+		ended: make(chan struct{}, 1)}
+	go ka.run()
+}
+
+//run starts the key authority and starts it again whenever the request
+//subscription ends
+func (ka *keyAuthority) run() {
+	delay := keyAuthorityRetry
+	for {
+		started := time.Now()
+		err := ka.start()
+		if err == nil {
+			<-ka.ended
+			err = fmt.Errorf("request subscription ended")
+		}
+		//Only back off if it keeps failing soon after starting
+		if time.Now().Sub(started) > keyAuthorityMaxRetry {
+			delay = keyAuthorityRetry
+		}
+		log.Warnf("key authority for %s stopped, restarting in %s: %v", ka.ns, delay, err)
+		time.Sleep(delay)
+		delay *= 2
+		if delay > keyAuthorityMaxRetry {
+			delay = keyAuthorityMaxRetry
+		}
+	}
+}
+
+//start publishes the master public key and subscribes to requests
+func (ka *keyAuthority) start() error {
+	mvk, err := ka.bw.ResolveKey(ka.ns)
+	if err != nil {
+		return err
+	}
+	ka.auth.MVK = mvk
+	bin, err := ka.auth.Pub.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	po := advpo.CreateMetadataPayloadObject(&advpo.MetadataTuple{
+		Value:     base64.URLEncoding.EncodeToString(bin),
+		Timestamp: time.Now().UnixNano(),
+	})
+	errc := make(chan error, 1)
+	ka.cl.Publish(&PublishParams{
+		MVK:            mvk,
+		URISuffix:      KeyAuthorityMPKSuffix,
+		PayloadObjects: []objects.PayloadObject{po},
+		ElaboratePAC:   PartialElaboration,
+		AutoChain:      true,
+		Persist:        true,
+	}, func(err error) {
+		errc <- err
+	})
+	if err := <-errc; err != nil {
+		return err
+	}
+	ka.cl.Subscribe(&SubscribeParams{
+		MVK:          mvk,
+		URISuffix:    KeyAuthorityRequestSuffix,
+		ElaboratePAC: PartialElaboration,
+		AutoChain:    true,
+	}, func(err error, id core.UniqueMessageID) {
+		errc <- err
+	}, ka.handle)
+	return <-errc
+}
+
+func (ka *keyAuthority) handle(m *core.Message) {
+	if m == nil {
+		select {
+		case ka.ended <- struct{}{}:
+		default:
+		}
+		return
+	}
+	if err := m.Verify(ka.bw); err != nil || m.OriginVK == nil {
+		return
+	}
+	requester := *m.OriginVK
+	for _, po := range m.PayloadObjects {
+		if po.GetPONum() != objects.PONumJSON {
+			continue
+		}
+		req := KeyRequest{}
+		if err := json.Unmarshal(po.GetContent(), &req); err != nil {
+			continue
+		}
+		id, err := ka.auth.Issue(req.URI, req.Chain, requester)
+		resp := &KeyResponse{URI: req.URI, Nonce: req.Nonce, Identity: id}
+		if err != nil {
+			resp.Error = err.Error()
+		}
+		ka.respond(requester, resp)
+	}
+}
+
+func (ka *keyAuthority) respond(requester []byte, resp *KeyResponse) {
+	js, err := json.Marshal(resp)
+	if err != nil {
+		panic(err)
+	}
+	po, err := objects.CreateOpaquePayloadObject(objects.PONumJSON, js)
+	if err != nil {
+		panic(err)
+	}
+	ka.cl.Publish(&PublishParams{
+		MVK:            ka.auth.MVK,
+		URISuffix:      KeyAuthorityResponseURI(requester),
+		PayloadObjects: []objects.PayloadObject{po},
+		ElaboratePAC:   PartialElaboration,
+		AutoChain:      true,
+		Persist:        true,
+		EncryptFor:     [][]byte{requester},
+	}, func(err error) {
+		if err != nil {
+			log.Warnf("could not send key authority response to %s: %v", crypto.FmtKey(requester), err)
+		}
+	})
+}
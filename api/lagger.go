@@ -1,8 +1,7 @@
-// +build ignore
-
 package api
 
 import (
+	"context"
 	"fmt"
 	"sync"
 	"time"
@@ -19,6 +18,9 @@ type Lagger struct {
 	bchain        bc.BlockChainProvider
 	caughtup      bool
 	lastPrintTime time.Time
+	//The latest head and its timestamp, zero until the first one arrives
+	head     uint64
+	headTime int64
 }
 
 const LagConfirmations = 3
@@ -33,6 +35,8 @@ func NewLagger(bchain bc.BlockChainProvider) *Lagger {
 
 //Returns true if initial replay is complete
 func (lag *Lagger) CaughtUp() bool {
+	lag.smu.Lock()
+	defer lag.smu.Unlock()
 	return lag.caughtup
 }
 func (lag *Lagger) Subscribe(onConfirmedBlock func(b *bc.Block)) {
@@ -41,6 +45,38 @@ func (lag *Lagger) Subscribe(onConfirmedBlock func(b *bc.Block)) {
 	lag.subscribers = append(lag.subscribers, onConfirmedBlock)
 }
 
+//HeadAge returns the age in seconds of the latest head, which is how far
+//behind the chain we are
+func (lag *Lagger) HeadAge() int64 {
+	lag.smu.Lock()
+	defer lag.smu.Unlock()
+	if lag.headTime == 0 {
+		return lag.bchain.HeadBlockAge()
+	}
+	return time.Now().Unix() - lag.headTime
+}
+
+//Head returns the number of the latest head
+func (lag *Lagger) Head() uint64 {
+	lag.smu.Lock()
+	defer lag.smu.Unlock()
+	if lag.headTime == 0 {
+		return lag.bchain.CurrentBlock()
+	}
+	return lag.head
+}
+
+//Confirmed returns the number of the latest block that has
+//LagConfirmations blocks on top of it
+func (lag *Lagger) Confirmed() uint64 {
+	lag.smu.Lock()
+	defer lag.smu.Unlock()
+	if lag.doneNumber < 0 {
+		return 0
+	}
+	return uint64(lag.doneNumber)
+}
+
 //Must be called with smu locked
 func (lag *Lagger) onConfirmedBlock(b *bc.Block) {
 	if b.Number != 0 && b.Parent != lag.expectParent {
@@ -54,9 +90,9 @@ func (lag *Lagger) onConfirmedBlock(b *bc.Block) {
 	lag.expectParent = b.Hash
 	lag.doneNumber = int64(b.Number)
 }
-func (lag *Lagger) onBlock(b *bc.Block) {
-	lag.smu.Lock()
-	defer lag.smu.Unlock()
+
+//Must be called with smu locked
+func (lag *Lagger) onBlock() {
 	for {
 		if lag.bchain.GetBlock(uint64(lag.doneNumber+1+LagConfirmations)) != nil {
 			laggedBlock := lag.bchain.GetBlock(uint64(lag.doneNumber + 1))
@@ -72,22 +108,30 @@ func (lag *Lagger) printrblock(block uint64, doneNumber int64) {
 		lag.lastPrintTime = time.Now()
 	}
 }
+
+//BeginLoop follows the head of the chain. Subscribers get the confirmed
+//blocks after the head at the time the first new head arrives, rather
+//than replaying the whole chain.
 func (lag *Lagger) BeginLoop() {
-	lag.bchain.CallOnNewBlocks(func(b *bc.Block) bool {
-		lag.printrblock(b.Number, lag.doneNumber)
-		if !lag.caughtup {
-			st := lag.doneNumber
-			if st < 0 {
-				st = 0
-			}
-			lag.bchain.CallOnBlocksBetween(uint64(st), b.Number, func(oldb *bc.Block) {
-				if oldb != nil {
-					lag.onBlock(oldb)
+	heads := lag.bchain.NewHeads(context.Background())
+	go func() {
+		for hdr := range heads {
+			lag.smu.Lock()
+			lag.head = hdr.Number.Uint64()
+			lag.headTime = hdr.Time.Int64()
+			lag.printrblock(lag.head, lag.doneNumber)
+			if !lag.caughtup {
+				start := int64(lag.head) - LagConfirmations
+				if start >= 0 {
+					if b := lag.bchain.GetBlock(uint64(start)); b != nil {
+						lag.doneNumber = start
+						lag.expectParent = b.Hash
+					}
 				}
-			})
-			lag.caughtup = true
+				lag.caughtup = true
+			}
+			lag.onBlock()
+			lag.smu.Unlock()
 		}
-		lag.onBlock(b)
-		return false
-	})
+	}()
 }
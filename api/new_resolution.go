@@ -14,6 +14,8 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/bc"
 	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/metrics"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2bc/common"
 )
@@ -113,9 +115,11 @@ func newResolutionData() *ResolutionData {
 	}
 }
 
+//dropAllCaches forgets everything resolved so far. The expiry timer is set
+//from the cached objects, so the subscriptions are checked again, which
+//caches the objects they depend on, and the timer is reset.
 func (bw *BW) dropAllCaches() {
 	bw.getlock()
-	defer bw.rellock()
 	bw.rdata.chaincache = make(map[bc.Bytes32]map[CacheKey][]*objects.DChain)
 	bw.rdata.entityCache = make(map[bc.Bytes32]*registryEntityResult)
 	bw.rdata.dotHashCache = make(map[bc.Bytes32]*registryDOTResult)
@@ -123,8 +127,10 @@ func (bw *BW) dropAllCaches() {
 	bw.rdata.dotFromCompleteCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.dotToInvCache = make(map[bc.Bytes32][]bc.Bytes32)
 	bw.rdata.dotChainCache = make(map[bc.Bytes32][]bc.Bytes32)
-	bw.rdata.expinvchan = make(chan struct{})
 	bw.rdata.holdoff = make(map[bc.Bytes32]uint64)
+	bw.rellock()
+	bw.revalidateSubs()
+	bw.forceExpiryInv()
 }
 
 func init() {
@@ -221,9 +227,10 @@ func (bw *BW) checkExpiryInv() time.Duration {
 	bw.getlock()
 	defer bw.rellock()
 	minexpiry := time.Now().Add(1 * time.Hour)
+	var expiredVKs, expiredDOTs [][]byte
 	for _, er := range bw.rdata.entityCache {
 		if er.ro.IsExpired() {
-			go bw.FlushEntity(er.ro.GetVK())
+			expiredVKs = append(expiredVKs, er.ro.GetVK())
 		} else {
 			ex := er.ro.GetExpiry()
 			if ex != nil && ex.Before(minexpiry) {
@@ -233,7 +240,7 @@ func (bw *BW) checkExpiryInv() time.Duration {
 	}
 	for _, dr := range bw.rdata.dotHashCache {
 		if dr.ro.IsExpired() {
-			go bw.FlushDOT(dr.ro.GetHash())
+			expiredDOTs = append(expiredDOTs, dr.ro.GetHash())
 		} else {
 			ex := dr.ro.GetExpiry()
 			if ex != nil && ex.Before(minexpiry) {
@@ -241,8 +248,31 @@ func (bw *BW) checkExpiryInv() time.Duration {
 			}
 		}
 	}
+	if len(expiredVKs) > 0 || len(expiredDOTs) > 0 {
+		go func() {
+			for _, vk := range expiredVKs {
+				bw.FlushEntity(vk)
+			}
+			for _, hash := range expiredDOTs {
+				bw.FlushDOT(hash)
+			}
+			bw.revalidateSubs()
+		}()
+	}
 	return minexpiry.Sub(time.Now())
 }
+
+//revalidateSubs terminates the active subscriptions whose access chain has
+//a DOT that has been revoked or has expired, or that depends on an entity
+//that has been. It must be called after the changed objects are flushed.
+func (bw *BW) revalidateSubs() {
+	n := bw.tm.TerminateSubs(func(m *core.Message) error {
+		return m.CheckPACState(bw)
+	})
+	if n > 0 {
+		log.Infof("terminated %d subscriptions with revoked or expired access chains", n)
+	}
+}
 func (bw *BW) forceExpiryInv() {
 	bw.rdata.expinvchan <- struct{}{}
 }
@@ -280,6 +310,8 @@ func (bw *BW) checkChainChange() {
 	bw.rdata.chainchangemu.Lock()
 	defer bw.rdata.chainchangemu.Unlock()
 	currentBlock := bw.BC().CurrentBlock()
+	//The chain may have caught up with the snapshot, or fallen behind
+	bw.checkSnapshotUse()
 	fmt.Printf("checking chain change for #%d -> #%d\n", bw.rdata.lastblock, currentBlock)
 	if bw.rdata.lastblock == currentBlock {
 		fmt.Printf(" -- skip\n")
@@ -297,6 +329,7 @@ func (bw *BW) checkChainChange() {
 		panic(err)
 	}
 	bw.rdata.lastblock = currentBlock
+	revoked := false
 	for _, log := range logs {
 		switch log.Topics()[0] {
 		case bc.HexToBytes32(bc.EventSig_Registry_NewDOT):
@@ -314,12 +347,17 @@ func (bw *BW) checkChainChange() {
 		case bc.HexToBytes32(bc.EventSig_Registry_NewDOTRevocation):
 			fmt.Printf("flushing dot")
 			bw.FlushDOT(log.Topics()[1][:])
+			revoked = revoked || log.Topics()[0] == bc.HexToBytes32(bc.EventSig_Registry_NewDOTRevocation)
 		case bc.HexToBytes32(bc.EventSig_Registry_NewEntityRevocation), bc.HexToBytes32(bc.EventSig_Registry_NewEntity):
 			fmt.Printf("flushing entity")
 			bw.FlushEntity(log.Topics()[1][:])
+			revoked = revoked || log.Topics()[0] == bc.HexToBytes32(bc.EventSig_Registry_NewEntityRevocation)
 		default:
 		}
 	}
+	if revoked {
+		bw.revalidateSubs()
+	}
 }
 
 // Resolve an Entity and it's state. An error will only be returned
@@ -429,6 +467,7 @@ func (bw *BW) resolveEntityFromCache(vk []byte) (bool, *objects.Entity, int) {
 	defer bw.rellock()
 	kvk := bc.SliceToBytes32(vk)
 	entry, ok := bw.rdata.entityCache[kvk]
+	metrics.CacheLookup("entity", ok)
 	if ok {
 		return true, entry.ro, entry.s
 	}
@@ -436,7 +475,7 @@ func (bw *BW) resolveEntityFromCache(vk []byte) (bool, *objects.Entity, int) {
 }
 func (bw *BW) resolveEntityFromBC(vk []byte) (ro *objects.Entity, s int, err error) {
 	var si int
-	ro, si, err = bw.BC().ResolveEntity(context.TODO(), vk)
+	ro, si, err = bw.registry().ResolveEntity(context.TODO(), vk)
 	s = int(si)
 	if s == StateValid && ro.IsExpired() {
 		s = StateExpired
@@ -454,6 +493,7 @@ func (bw *BW) resolveDOTFromCache(hash []byte) (bool, *objects.DOT, int) {
 	defer bw.rellock()
 	khash := bc.SliceToBytes32(hash)
 	entry, ok := bw.rdata.dotHashCache[khash]
+	metrics.CacheLookup("dot", ok)
 	if ok {
 		//We can trust the state stored in the DOT cache because any change
 		//in the entity state would have flushed the DOT from the cache
@@ -463,7 +503,7 @@ func (bw *BW) resolveDOTFromCache(hash []byte) (bool, *objects.DOT, int) {
 }
 func (bw *BW) resolveDOTFromBC(hash []byte) (*objects.DOT, int, error) {
 	var si int
-	ro, si, err := bw.BC().ResolveDOT(context.TODO(), hash)
+	ro, si, err := bw.registry().ResolveDOT(context.TODO(), hash)
 	if err != nil {
 		return nil, StateError, err
 	}
@@ -512,7 +552,7 @@ func (bw *BW) cacheDOT(ro *objects.DOT, s int) {
 }
 func (bw *BW) resolveAccessDChainFromBC(hash []byte) (*objects.DChain, int, error) {
 	var si int
-	ro, si, err := bw.BC().ResolveAccessDChain(context.TODO(), hash)
+	ro, si, err := bw.registry().ResolveAccessDChain(context.TODO(), hash)
 	if err != nil {
 		return nil, StateError, err
 	}
@@ -536,10 +576,12 @@ func (bw *BW) resolveBuiltChain(k CacheKey) ([]*objects.DChain, []int) {
 	nsmap, ok := bw.rdata.chaincache[k.nsvk]
 	if !ok {
 		bw.rellock()
+		metrics.CacheLookup("chain", false)
 		return nil, nil
 	}
 	chains, ok2 := nsmap[k]
 	bw.rellock()
+	metrics.CacheLookup("chain", ok2)
 	if !ok2 {
 		return nil, nil
 	}
@@ -587,17 +629,20 @@ func (bw *BW) cacheBuiltChains(k CacheKey, ro []*objects.DChain) {
 	}
 	nsmap[k] = ro
 	bw.rdata.chaincache[k.nsvk] = nsmap
+	//The new chain may have DOTs that expire soon
+	bw.expw.check()
 }
 func (bw *BW) resolveGrantedDOTsFromCache(vk []byte) (bool, []bc.Bytes32) {
 	bw.getlock()
 	defer bw.rellock()
 	kvk := bc.SliceToBytes32(vk)
 	hashlist, ok := bw.rdata.dotFromCompleteCache[kvk]
+	metrics.CacheLookup("granted", ok)
 	return ok, hashlist
 }
 func (bw *BW) resolveGrantedDOTsFromBC(vk []byte) ([]bc.Bytes32, error) {
 	kvk := bc.SliceToBytes32(vk)
-	dhashes, err := bw.BC().ResolveDOTsFromVK(context.TODO(), kvk)
+	dhashes, err := bw.registry().ResolveDOTsFromVK(context.TODO(), kvk)
 	return dhashes, err
 }
 func (bw *BW) cacheGrantedDOTs(vk []byte, dots []bc.Bytes32) {
@@ -18,7 +18,7 @@ func (bw *BW) UnresolveAlias(val []byte) (string, bool, error) {
 	if len(val) > 32 {
 		return "", false, nil
 	}
-	key, iszero, err := bw.BC().UnresolveAlias(context.TODO(), bc.SliceToBytes32(val))
+	key, iszero, err := bw.registry().UnresolveAlias(context.TODO(), bc.SliceToBytes32(val))
 	if err != nil || iszero {
 		return "", false, err
 	}
@@ -28,12 +28,12 @@ func (bw *BW) UnresolveAlias(val []byte) (string, bool, error) {
 //Get the host:port SRV record for a drvk. XTAG add this to the bc caching
 //mechanism
 func (bw *BW) LookupDesignatedRouterSRV(drvk []byte) (string, error) {
-	return bw.bchain.GetSRVRecordFor(context.TODO(), drvk)
+	return bw.registry().GetSRVRecordFor(context.TODO(), drvk)
 }
 
 //XTAG add this to the bc caching mechanism
 func (bw *BW) LookupDesignatedRouter(nsvk []byte) ([]byte, error) {
-	return bw.bchain.GetDesignatedRouterFor(context.TODO(), nsvk)
+	return bw.registry().GetDesignatedRouterFor(context.TODO(), nsvk)
 }
 func (bw *BW) LookupDesignatedRouterS(nsvk string) ([]byte, error) {
 	nsvkbin, err := crypto.UnFmtKey(nsvk)
@@ -46,7 +46,7 @@ func (bw *BW) LookupDesignatedRouterS(nsvk string) ([]byte, error) {
 func (bw *BW) ResolveLongAlias(in string) ([]byte, error) {
 	k := bc.Bytes32{}
 	copy(k[:], []byte(in))
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.registry().ResolveAlias(context.TODO(), k)
 	if err != nil {
 		return nil, err
 	}
@@ -65,7 +65,7 @@ func (bw *BW) ResolveShortAlias(hexstr string) ([]byte, error) {
 	}
 	k := bc.Bytes32{}
 	copy(k[32-len(bin):], bin)
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.registry().ResolveAlias(context.TODO(), k)
 	if err != nil {
 		return nil, err
 	}
@@ -145,7 +145,7 @@ func (bw *BW) ResolveKey(name string) ([]byte, error) {
 	}
 	k := bc.Bytes32{}
 	copy(k[:], []byte(name))
-	res, iszero, err := bw.bchain.ResolveAlias(context.TODO(), k)
+	res, iszero, err := bw.registry().ResolveAlias(context.TODO(), k)
 	if err != nil {
 		return nil, err
 	}
@@ -0,0 +1,227 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package api
+
+import (
+	"bytes"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/audit"
+	"github.com/immesys/bw2/internal/metrics"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//The values of Native.CertPinning. With CertPinningTOFU the key a
+//designated router presents on first contact is pinned, and connections
+//presenting a different one are refused until the operator unpins it (see
+//UnpinPeer). CertPinningWarn reports changes but accepts them. Without
+//pinning, the default, only the VK proof is checked.
+const (
+	CertPinningOff  = ""
+	CertPinningTOFU = "tofu"
+	CertPinningWarn = "warn"
+)
+
+//A stored certificate is replaced this long before it expires
+const certRenewBefore = 30 * 24 * time.Hour
+
+//CertFingerprint returns the SHA256 of the certificate's public key, which
+//is what is pinned for a router. The key is kept when the certificate is
+//renewed, so renewing does not change the fingerprint.
+func CertFingerprint(cert *x509.Certificate) []byte {
+	rv := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return rv[:]
+}
+
+//The transports a designated router can be reached over. SchemeMux
+//multiplexes streams over one connection, see internal/peermux
+const (
+	SchemeTLS = "tls"
+	SchemeMux = "mux"
+)
+
+//SRVTarget is one of the addresses in an SRV record
+type SRVTarget struct {
+	Scheme string
+	Addr   string
+}
+
+//SRVRecord is a parsed designated router SRV record
+type SRVRecord struct {
+	//In order of preference
+	Targets []SRVTarget
+}
+
+//ParseSRVRecord parses a designated router SRV record. It is a comma
+//separated list of addresses, each optionally prefixed by its transport.
+//The first must be a bare host:port reached over TLS, as routers that
+//predate the other transports dial the record as it is. Later addresses
+//are tried first if their transport is supported, then the TLS ones in
+//the order given. A record with a multiplexed address looks like
+//100.12.42.23:4514,mux://100.12.42.23:4515
+//Anything after a ; is ignored.
+func ParseSRVRecord(srv string) (*SRVRecord, error) {
+	parts := strings.Split(srv, ";")
+	var mux, plain []SRVTarget
+	for i, addr := range strings.Split(parts[0], ",") {
+		t := SRVTarget{Scheme: SchemeTLS, Addr: addr}
+		if j := strings.Index(addr, "://"); j >= 0 {
+			if i == 0 {
+				return nil, bwe.M(bwe.PeerError, "the first address in an SRV record must be a bare host:port")
+			}
+			t.Scheme, t.Addr = addr[:j], addr[j+3:]
+		}
+		switch t.Scheme {
+		case SchemeTLS:
+			plain = append(plain, t)
+		case SchemeMux:
+			mux = append(mux, t)
+		}
+		//Transports added by newer routers are ignored
+	}
+	if len(plain) == 0 || plain[0].Addr == "" {
+		return nil, bwe.M(bwe.PeerError, "no usable address in SRV record")
+	}
+	return &SRVRecord{Targets: append(mux, plain...)}, nil
+}
+
+//loadCert returns the certificate kept in fname, or in the database if
+//fname is empty, replacing it if it does not exist, is for a different VK
+//or is about to expire. A replacement keeps the key of the old certificate
+//so that routers that pinned it still accept the new one.
+func loadCert(vk string, fname string) (tls.Certificate, *x509.Certificate) {
+	var contents []byte
+	var err error
+	if fname == "" {
+		var ok bool
+		if contents, ok = store.GetLocalCert(); !ok {
+			err = os.ErrNotExist
+		}
+	} else {
+		contents, err = ioutil.ReadFile(fname)
+	}
+	var key *rsa.PrivateKey
+	if err == nil {
+		cert, err := tls.X509KeyPair(contents, contents)
+		if err == nil {
+			x509cert, err := x509.ParseCertificate(cert.Certificate[0])
+			if err == nil && x509cert.Subject.CommonName == vk &&
+				time.Now().Add(certRenewBefore).Before(x509cert.NotAfter) {
+				return cert, x509cert
+			}
+			if err == nil && x509cert.Subject.CommonName == vk {
+				key, _ = cert.PrivateKey.(*rsa.PrivateKey)
+			}
+		}
+		if key != nil {
+			log.Infof("renewing peer certificate")
+		} else {
+			log.Warnf("replacing peer certificate and key, routers that pinned the old key must unpin it")
+		}
+	} else if !os.IsNotExist(err) {
+		log.Criticalf("could not read peer certificate: %v", err)
+		os.Exit(1)
+	}
+	cert, x509cert, contents := genCert(vk, key)
+	if fname == "" {
+		store.PutLocalCert(contents)
+	} else if err := ioutil.WriteFile(fname, contents, 0600); err != nil {
+		log.Criticalf("could not save peer certificate: %v", err)
+		os.Exit(1)
+	}
+	return cert, x509cert
+}
+
+//checkPeerCert checks the key presented by the designated router with the
+//given VK against the one pinned for it. The key is pinned if it is the
+//first one seen.
+func (bw *BW) checkPeerCert(drvk []byte, target string, cert *x509.Certificate) error {
+	if bw.Config.Native.CertPinning == CertPinningOff {
+		return nil
+	}
+	fp := CertFingerprint(cert)
+	pinned, havePin := store.GetPeerCert(drvk)
+	if havePin && !bytes.Equal(pinned, fp) {
+		return bw.peerCertChanged(drvk, target, pinned, fp, "does not match the pinned key")
+	}
+	if !havePin {
+		log.Infof("pinned key %s for peer %s (%s)", hex.EncodeToString(fp), crypto.FmtKey(drvk), target)
+		store.PutPeerCert(drvk, fp)
+	}
+	return nil
+}
+
+//UnpinPeer forgets the key pinned for the designated router with the given
+//VK, so that the key it presents next is pinned. It is used when a router
+//has really changed its key. It returns false if nothing was pinned.
+func (bw *BW) UnpinPeer(drvk []byte) bool {
+	pinned, havePin := store.GetPeerCert(drvk)
+	if !havePin {
+		return false
+	}
+	store.DeletePeerCert(drvk)
+	log.Infof("unpinned key %s for peer %s", hex.EncodeToString(pinned), crypto.FmtKey(drvk))
+	return true
+}
+
+//peerCertChanged reports a key that does not match the one pinned. It is refused unless pinning is in warn mode.
+func (bw *BW) peerCertChanged(drvk []byte, target string, expected []byte, fp []byte, reason string) error {
+	if bw.Config.Native.CertPinning == CertPinningWarn {
+		bw.peerCertEvent(drvk, target, expected, fp, true, reason)
+		store.PutPeerCert(drvk, fp)
+		return nil
+	}
+	bw.peerCertEvent(drvk, target, expected, fp, false, reason+", unpin it if the router changed its key")
+	return bwe.M(bwe.PeerError, "peer certificate "+reason)
+}
+
+//peerCertEvent tells the operator that a router presented a different
+//key, in the log, the metrics and the audit log
+func (bw *BW) peerCertEvent(drvk []byte, target string, old []byte, fp []byte, accepted bool, reason string) {
+	msg := fmt.Sprintf("peer %s (%s) key changed from %s to %s: %s",
+		crypto.FmtKey(drvk), target, hex.EncodeToString(old), hex.EncodeToString(fp), reason)
+	if accepted {
+		log.Warn(msg + ", accepted")
+	} else {
+		log.Critical(msg + ", refusing to connect")
+	}
+	metrics.PeerCertChanges.WithLabelValues(target, strconv.FormatBool(accepted)).Inc()
+	r := &audit.Record{
+		Time:     time.Now(),
+		Accepted: accepted,
+		Type:     "peercert",
+		OriginVK: crypto.FmtKey(drvk),
+		URI:      target,
+		Code:     bwe.PeerError,
+		Reason:   msg,
+	}
+	audit.Log(r)
+}
@@ -32,6 +32,9 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/metrics"
+	"github.com/immesys/bw2/internal/peermux"
+	"github.com/immesys/bw2/internal/peerproto"
 	"github.com/immesys/bw2/util/bwe"
 )
 
@@ -42,59 +45,203 @@ type PeerClient struct {
 	replyCB    map[uint64]func(*nativeFrame)
 	expectedVK []byte
 	target     string
+	targets    []SRVTarget
 	bwcl       *BosswaveClient
 	asublock   sync.Mutex
 	activesubs map[uint64]*core.Message
+	//What was negotiated with the peer, protected by txmtx
+	proto peerproto.Hello
+	//If connected over a multiplexed transport, the session and the
+	//stream of each seqno, protected by txmtx. conn is nil.
+	mux     *peermux.Session
+	streams map[uint64]*peerStream
 }
 
-func (cl *PeerClient) reconnectPeer() error {
+//Each request gets its own stream on a multiplexed transport
+type peerStream struct {
+	st *peermux.Stream
+	//Frames are written whole
+	wmu sync.Mutex
+}
+
+//How long the peer has to answer our hello
+const peerHandshakeTimeout = 30 * time.Second
+
+//dial connects to the peer at addr, checking that it is the designated
+//router we expect
+func (cl *PeerClient) dial(addr string) (net.Conn, error) {
 	roots := x509.NewCertPool()
-	conn, err := tls.Dial("tcp", cl.target, &tls.Config{
+	conn, err := tls.Dial("tcp", addr, &tls.Config{
 		InsecureSkipVerify: true,
 		RootCAs:            roots,
 	})
 	if err != nil {
-		return err
+		return nil, err
 	}
 	cs := conn.ConnectionState()
 	if len(cs.PeerCertificates) != 1 {
 		log.Criticalf("peer connection weird response")
-		return errors.New("Wrong certificates")
+		conn.Close()
+		return nil, errors.New("Wrong certificates")
 	}
 	proof := make([]byte, 96)
 	_, err = io.ReadFull(conn, proof)
 	if err != nil {
-		return errors.New("failed to read proof: " + err.Error())
+		conn.Close()
+		return nil, errors.New("failed to read proof: " + err.Error())
 	}
 	proofOK := crypto.VerifyBlob(proof[:32], proof[32:], cs.PeerCertificates[0].Signature)
 	if !proofOK {
-		return errors.New("peer verification failed")
+		conn.Close()
+		return nil, errors.New("peer verification failed")
 	}
 	if !bytes.Equal(proof[:32], cl.expectedVK) {
-		return errors.New("peer has a different VK")
+		conn.Close()
+		return nil, errors.New("peer has a different VK")
+	}
+	err = cl.bwcl.BW().checkPeerCert(cl.expectedVK, cl.target, cs.PeerCertificates[0])
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	return conn, nil
+}
+
+//reconnectPeer connects to the first of the peer's addresses that works.
+//It returns true if a multiplexed session was resumed, in which case
+//nothing was lost and subscriptions do not need to be made again.
+func (cl *PeerClient) reconnectPeer() (bool, error) {
+	var err error
+	for _, t := range cl.targets {
+		var conn net.Conn
+		conn, err = cl.dial(t.Addr)
+		if err != nil {
+			log.Infof("could not connect to peer %s at %s: %v", cl.target, t.Addr, err)
+			continue
+		}
+		if t.Scheme == SchemeMux {
+			var resumed bool
+			resumed, err = cl.connectMux(t.Addr, conn)
+			if err != nil {
+				log.Infof("could not connect to peer %s at %s: %v", cl.target, t.Addr, err)
+				continue
+			}
+			return resumed, nil
+		}
+		//The peer may have been upgraded or downgraded since we last spoke
+		conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+		var proto peerproto.Hello
+		proto, err = peerproto.ClientHandshake(conn, peerproto.Ours())
+		if err != nil {
+			conn.Close()
+			err = errors.New("peer handshake failed: " + err.Error())
+			log.Infof("could not connect to peer %s at %s: %v", cl.target, t.Addr, err)
+			continue
+		}
+		conn.SetDeadline(time.Time{})
+		log.Infof("peer %s negotiated protocol %s", cl.target, proto)
+		cl.txmtx.Lock()
+		cl.conn = conn
+		cl.proto = proto
+		if cl.mux != nil {
+			cl.mux.Close()
+			cl.mux = nil
+		}
+		cl.txmtx.Unlock()
+		return false, nil
+	}
+	return false, err
+}
+
+//connectMux resumes our session with the peer over conn, or starts a new
+//one if there is none, the peer has forgotten it or it has been closed
+func (cl *PeerClient) connectMux(addr string, conn net.Conn) (bool, error) {
 	cl.txmtx.Lock()
-	cl.conn = conn
+	sess := cl.mux
 	cl.txmtx.Unlock()
-	return nil
+	if sess != nil {
+		conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+		err := sess.Resume(conn)
+		if err == nil {
+			conn.SetDeadline(time.Time{})
+			log.Infof("resumed session with peer %s", cl.target)
+			return true, nil
+		}
+		switch err {
+		case peermux.ErrUnknownSession:
+			log.Infof("peer %s has forgotten our session, starting a new one", cl.target)
+		case peermux.ErrClosed:
+			log.Infof("our session with peer %s was closed, starting a new one", cl.target)
+		default:
+			return false, err
+		}
+		conn, err = cl.dial(addr)
+		if err != nil {
+			return false, err
+		}
+	}
+	conn.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	sess, err := peermux.Client(conn)
+	if err != nil {
+		return false, err
+	}
+	conn.SetDeadline(time.Time{})
+	ctl, err := sess.Open()
+	if err != nil {
+		sess.Close()
+		return false, err
+	}
+	ctl.SetDeadline(time.Now().Add(peerHandshakeTimeout))
+	proto, err := peerproto.ClientHandshake(ctl, peerproto.Ours())
+	if err != nil {
+		sess.Close()
+		return false, errors.New("peer handshake failed: " + err.Error())
+	}
+	ctl.SetDeadline(time.Time{})
+	log.Infof("peer %s negotiated protocol %s over mux", cl.target, proto)
+	cl.txmtx.Lock()
+	if cl.mux != nil {
+		cl.mux.Close()
+	}
+	cl.conn = nil
+	cl.mux = sess
+	cl.streams = make(map[uint64]*peerStream)
+	cl.proto = proto
+	cl.txmtx.Unlock()
+	return false, nil
 }
 
+//ConnectToPeer connects to the designated router with the given VK. The
+//target is its SRV record, see ParseSRVRecord
 func (cl *BosswaveClient) ConnectToPeer(vk []byte, target string) (*PeerClient, error) {
+	srv, err := ParseSRVRecord(target)
+	if err != nil {
+		return nil, err
+	}
 	rv := PeerClient{
 		conn:       nil,
 		replyCB:    make(map[uint64]func(*nativeFrame)),
-		target:     target,
+		target:     srv.Targets[0].Addr,
+		targets:    srv.Targets,
 		bwcl:       cl,
 		expectedVK: vk,
 		activesubs: make(map[uint64]*core.Message),
 	}
-	err := rv.reconnectPeer()
+	_, err = rv.reconnectPeer()
 	if err != nil {
 		return nil, err
 	}
+	metrics.SetPeerConnected(rv.target, true)
 	go func() {
 		<-rv.bwcl.ctx.Done()
-		rv.conn.Close()
+		rv.txmtx.Lock()
+		if rv.conn != nil {
+			rv.conn.Close()
+		}
+		if rv.mux != nil {
+			rv.mux.Close()
+		}
+		rv.txmtx.Unlock()
 	}()
 	go rv.rxloop()
 	return &rv, nil
@@ -113,6 +260,14 @@ func (pc *PeerClient) GetTarget() string {
 func (pc *PeerClient) GetRemoteVK() []byte {
 	return pc.expectedVK
 }
+
+//GetProtocol returns the protocol version and capabilities negotiated
+//with the peer
+func (pc *PeerClient) GetProtocol() peerproto.Hello {
+	pc.txmtx.Lock()
+	defer pc.txmtx.Unlock()
+	return pc.proto
+}
 func (pc *PeerClient) regenSubs() {
 	pc.asublock.Lock()
 	defer pc.asublock.Unlock()
@@ -138,48 +293,87 @@ func (pc *PeerClient) regenSubs() {
 	}
 }
 func (pc *PeerClient) rxloop() {
-	hdr := make([]byte, 17)
 	for {
-		_, err := io.ReadFull(pc.conn, hdr)
-		if err != nil {
-			log.Infof("PEER CONNECTION to %s: %s", pc.target, err)
-			if pc.bwcl.ctx.Err() != nil {
-				return
-			}
-			pc.conn.Close()
-			pc.txmtx.Lock()
-			cbz := pc.replyCB
-			for _, e := range cbz {
-				go e(nil)
-			}
-			pc.txmtx.Unlock()
-			for {
-				log.Infof("Attempting to reconnect to peer: %s", pc.target)
-				err := pc.reconnectPeer()
-				if err == nil {
-					log.Infof("Peer reconnected: %s", pc.target)
-					pc.regenSubs()
-					break
-				} else {
-					if pc.bwcl.ctx.Err() != nil {
-						return
+		pc.txmtx.Lock()
+		conn, sess := pc.conn, pc.mux
+		pc.txmtx.Unlock()
+		var err error
+		if sess != nil {
+			//The streams read their own frames
+			<-sess.Broken()
+			err = errors.New("connection lost")
+		} else {
+			err = pc.readFrames(conn)
+		}
+		log.Infof("PEER CONNECTION to %s: %s", pc.target, err)
+		metrics.SetPeerConnected(pc.target, false)
+		if pc.bwcl.ctx.Err() != nil {
+			return
+		}
+		if sess == nil {
+			conn.Close()
+			pc.failCallbacks()
+		}
+		for {
+			log.Infof("Attempting to reconnect to peer: %s", pc.target)
+			resumed, err := pc.reconnectPeer()
+			if err == nil {
+				log.Infof("Peer reconnected: %s", pc.target)
+				metrics.SetPeerConnected(pc.target, true)
+				metrics.PeerReconnects.WithLabelValues(pc.target).Inc()
+				if !resumed {
+					if sess != nil {
+						//The session and its streams are gone
+						pc.failCallbacks()
 					}
-					time.Sleep(5 * time.Second)
+					pc.regenSubs()
+				}
+				break
+			} else {
+				if pc.bwcl.ctx.Err() != nil {
+					return
 				}
+				time.Sleep(5 * time.Second)
 			}
-			continue
+		}
+	}
+}
+
+//failCallbacks tells every outstanding request that the peer disconnected
+func (pc *PeerClient) failCallbacks() {
+	pc.txmtx.Lock()
+	cbz := pc.replyCB
+	for _, e := range cbz {
+		go e(nil)
+	}
+	pc.txmtx.Unlock()
+}
+
+//readFrames dispatches frames from a TLS connection until it fails
+func (pc *PeerClient) readFrames(conn net.Conn) error {
+	hdr := make([]byte, 17)
+	for {
+		_, err := io.ReadFull(conn, hdr)
+		if err != nil {
+			return err
 		}
 		ln := binary.LittleEndian.Uint64(hdr)
 		seqno := binary.LittleEndian.Uint64(hdr[8:])
 		cmd := hdr[16]
 		body := make([]byte, ln)
-		_, err = io.ReadFull(pc.conn, body)
+		_, err = io.ReadFull(conn, body)
+		if err != nil {
+			log.Info("peer client: ", err)
+			continue
+		}
+		cmd, body, err = peerproto.Decompress(cmd, body)
 		if err != nil {
 			log.Info("peer client: ", err)
+			conn.Close()
 			continue
 		}
 		fr := nativeFrame{
-			length: ln,
+			length: uint64(len(body)),
 			seqno:  seqno,
 			cmd:    cmd,
 			body:   body,
@@ -191,35 +385,118 @@ func (pc *PeerClient) rxloop() {
 		cb(&fr)
 	}
 }
+
+//streamRx dispatches the frames of one stream until it is closed
+func (pc *PeerClient) streamRx(seqno uint64, st *peermux.Stream) {
+	for {
+		_, cmd, body, err := peerproto.ReadFrame(st, peerproto.MaxDecompressedSize)
+		if err != nil {
+			return
+		}
+		cmd, body, err = peerproto.Decompress(cmd, body)
+		if err != nil {
+			log.Info("peer client: ", err)
+			st.Close()
+			return
+		}
+		pc.txmtx.Lock()
+		cb := pc.replyCB[seqno]
+		pc.txmtx.Unlock()
+		if cb == nil {
+			//The request is over
+			continue
+		}
+		cb(&nativeFrame{
+			length: uint64(len(body)),
+			seqno:  seqno,
+			cmd:    cmd,
+			body:   body,
+		})
+	}
+}
 func (pc *PeerClient) getSeqno() uint64 {
 	return atomic.AddUint64(&pc.seqno, 1)
 }
 func (pc *PeerClient) removeCB(seqno uint64) {
 	pc.txmtx.Lock()
 	delete(pc.replyCB, seqno)
+	ps := pc.streams[seqno]
+	delete(pc.streams, seqno)
 	pc.txmtx.Unlock()
+	if ps != nil {
+		ps.st.Close()
+	}
 }
 func (pc *PeerClient) transact(f *nativeFrame, onRX func(f *nativeFrame)) {
-	tmphdr := make([]byte, 17)
-	binary.LittleEndian.PutUint64(tmphdr, uint64(len(f.body)))
-	binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
-	tmphdr[16] = byte(f.cmd)
 	pc.txmtx.Lock()
 	pc.replyCB[f.seqno] = onRX
+	pc.txmtx.Unlock()
+	if err := pc.write(f); err != nil {
+		go onRX(nil)
+	}
+}
+
+//send writes a frame that the peer does not reply to
+func (pc *PeerClient) send(f *nativeFrame) {
+	pc.write(f)
+}
+
+//write writes the frame, closing the connection on error. Over a
+//multiplexed transport it goes on the stream for its seqno, which is
+//opened if this is the first frame of the request.
+func (pc *PeerClient) write(f *nativeFrame) error {
+	pc.txmtx.Lock()
+	cmd, body := f.cmd, f.body
+	if pc.proto.Has(peerproto.CapCompression) {
+		cmd, body = peerproto.Compress(cmd, body)
+	}
+	if pc.mux != nil {
+		ps, err := pc.stream(f.seqno)
+		pc.txmtx.Unlock()
+		if err != nil {
+			return err
+		}
+		//Write outside txmtx, this stream's window may be full
+		buf := bytes.Buffer{}
+		peerproto.WriteFrame(&buf, f.seqno, cmd, body)
+		ps.wmu.Lock()
+		_, err = ps.st.Write(buf.Bytes())
+		ps.wmu.Unlock()
+		if err != nil {
+			log.Info("peer write error: ", err.Error())
+		}
+		return err
+	}
 	defer pc.txmtx.Unlock()
+	tmphdr := make([]byte, 17)
+	binary.LittleEndian.PutUint64(tmphdr, uint64(len(body)))
+	binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
+	tmphdr[16] = cmd
 	_, err := pc.conn.Write(tmphdr)
+	if err == nil {
+		_, err = pc.conn.Write(body)
+	}
 	if err != nil {
 		log.Info("peer write error: ", err.Error())
 		pc.conn.Close()
-		go onRX(nil)
-		return
 	}
-	_, err = pc.conn.Write(f.body)
+	return err
+}
+
+//stream returns the stream for the seqno, opening it if need be. txmtx
+//must be held
+func (pc *PeerClient) stream(seqno uint64) (*peerStream, error) {
+	if ps, ok := pc.streams[seqno]; ok {
+		return ps, nil
+	}
+	st, err := pc.mux.Open()
 	if err != nil {
-		log.Info("peer write error: ", err.Error())
-		pc.conn.Close()
-		go onRX(nil)
+		return nil, err
 	}
+	ps := &peerStream{st: st}
+	pc.streams[seqno] = ps
+	go pc.streamRx(seqno, st)
+	return ps, nil
 }
 func (pc *PeerClient) PublishPersist(m *core.Message, actionCB func(err error)) {
 	nf := nativeFrame{
@@ -248,14 +525,119 @@ func (pc *PeerClient) PublishPersist(m *core.Message, actionCB func(err error))
 	})
 }
 
+//PublishBatch sends publish or persist messages to the peer, calling
+//actionCB once with the error for each message in order. If the peer
+//supports batching they are sent MaxBatch at a time in single frames,
+//otherwise they are sent one by one.
+func (pc *PeerClient) PublishBatch(ms []*core.Message, actionCB func(errs []error)) {
+	errs := make([]error, len(ms))
+	if len(ms) == 0 {
+		actionCB(errs)
+		return
+	}
+	if !pc.GetProtocol().Has(peerproto.CapBatching) {
+		wg := sync.WaitGroup{}
+		wg.Add(len(ms))
+		for i, m := range ms {
+			i := i
+			pc.PublishPersist(m, func(err error) {
+				errs[i] = err
+				wg.Done()
+			})
+		}
+		go func() {
+			wg.Wait()
+			actionCB(errs)
+		}()
+		return
+	}
+	wg := sync.WaitGroup{}
+	for start := 0; start < len(ms); start += peerproto.MaxBatch {
+		end := start + peerproto.MaxBatch
+		if end > len(ms) {
+			end = len(ms)
+		}
+		wg.Add(1)
+		pc.publishBatch(ms[start:end], errs[start:end], wg.Done)
+	}
+	go func() {
+		wg.Wait()
+		actionCB(errs)
+	}()
+}
+
+//publishBatch sends one batch frame, filling in errs before calling done
+func (pc *PeerClient) publishBatch(ms []*core.Message, errs []error, done func()) {
+	bodies := make([][]byte, len(ms))
+	for i, m := range ms {
+		bodies[i] = m.Encoded
+	}
+	nf := nativeFrame{
+		cmd:   nCmdBatch,
+		body:  peerproto.EncodeBatch(bodies),
+		seqno: pc.getSeqno(),
+	}
+	setAll := func(err error) {
+		for i := range errs {
+			errs[i] = err
+		}
+	}
+	pc.transact(&nf, func(f *nativeFrame) {
+		defer done()
+		defer pc.removeCB(nf.seqno)
+		if f == nil {
+			setAll(bwe.M(bwe.PeerError, "Peer disconnected"))
+			return
+		}
+		if f.cmd == nCmdRStatus {
+			//The whole batch was rejected
+			if len(f.body) < 2 {
+				setAll(bwe.M(bwe.PeerError, "short response frame"))
+				return
+			}
+			setAll(bwe.M(int(binary.LittleEndian.Uint16(f.body)), string(f.body[2:])))
+			return
+		}
+		codes, err := peerproto.DecodeStatuses(f.body)
+		if err != nil || len(codes) != len(errs) {
+			setAll(bwe.M(bwe.PeerError, "bad batch status frame"))
+			return
+		}
+		for i, code := range codes {
+			if code != bwe.Okay {
+				errs[i] = bwe.C(code)
+			}
+		}
+	})
+}
+
+//Subscribe subscribes to the message's topic on the peer. Results are
+//given to messageCB and when the subscription ends endedCB is called, with
+//the reason if the peer ended it (such as AccessRevoked). If the peer
+//holds results back because we are not returning credit fast enough,
+//throttledCB (if not nil) is called.
 func (pc *PeerClient) Subscribe(m *core.Message,
 	actionCB func(err error, id core.UniqueMessageID),
-	messageCB func(m *core.Message)) {
+	messageCB func(m *core.Message),
+	endedCB func(err error),
+	throttledCB func()) {
 	nf := nativeFrame{
 		cmd:   nCmdMessage,
 		body:  m.Encoded,
 		seqno: pc.getSeqno(),
 	}
+	//Results are verified and delivered by their own goroutine so that a
+	//slow subscriber does not hold up rxloop. Whether credit is returned
+	//is decided by deliver with the protocol of the current connection,
+	//because the subscription is regenerated on reconnect and the peer
+	//may have been upgraded in the meantime.
+	results := make(chan *nativeFrame, 2*peerproto.InitialCredit)
+	stop := make(chan struct{})
+	go pc.deliver(nf.seqno, results, stop, messageCB, endedCB)
+	fail := func(err error) {
+		close(stop)
+		actionCB(err, core.UniqueMessageID{})
+	}
 	pc.transact(&nf, func(f *nativeFrame) {
 		if f == nil {
 			//Peer error, on a subscribe it will just get regenned
@@ -263,16 +645,24 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 		}
 		switch f.cmd {
 		case nCmdRStatus:
+			if len(f.body) >= 2 && int(binary.LittleEndian.Uint16(f.body)) == bwe.Throttled {
+				log.Infof("peer %s is throttling subscription to uri=%s", pc.target, m.Topic)
+				metrics.PeerThrottles.WithLabelValues(pc.target).Inc()
+				if throttledCB != nil {
+					throttledCB()
+				}
+				return
+			}
 			fallthrough
 		case nCmdRSub:
 			log.Infof("Got subscribe status response")
 			if len(f.body) < 2 {
-				actionCB(bwe.M(bwe.PeerError, "short response frame"), core.UniqueMessageID{})
+				fail(bwe.M(bwe.PeerError, "short response frame"))
 				return
 			}
 			code := int(binary.LittleEndian.Uint16(f.body))
 			if code != bwe.Okay {
-				actionCB(bwe.M(code, string(f.body[2:])), core.UniqueMessageID{})
+				fail(bwe.M(code, string(f.body[2:])))
 			} else {
 				mid := binary.LittleEndian.Uint64(f.body[2:])
 				sig := binary.LittleEndian.Uint64(f.body[10:])
@@ -285,28 +675,96 @@ func (pc *PeerClient) Subscribe(m *core.Message,
 			return
 		case nCmdResult:
 			//log.Infof("Got subscribe message response")
-			nm, err := core.LoadMessage(f.body)
-			if err != nil {
-				log.Info("dropping incoming subscription result (malformed message)")
-				return
-			}
-			err = nm.Verify(pc.bwcl.BW())
-			if err != nil {
-				log.Infof("dropping incoming subscription result on uri=%s (failed local validation %s)", nm.Topic, err.Error())
-				return
+			select {
+			case results <- f:
+			default:
+				//The peer does not do flow control, or sent results from
+				//before a reconnect. Hold up rxloop rather than drop them.
+				log.Infof("subscriber on uri=%s is behind, holding up peer %s", m.Topic, pc.target)
+				select {
+				case results <- f:
+				case <-pc.bwcl.ctx.Done():
+				}
 			}
-			messageCB(nm)
 			return
 		case nCmdEnd:
 			//This will be signalled when we unsubscribe
 			pc.asublock.Lock()
 			delete(pc.activesubs, nf.seqno)
 			pc.asublock.Unlock()
-			messageCB(nil)
+			//After the results that are still queued
+			go func() {
+				select {
+				case results <- f:
+				case <-pc.bwcl.ctx.Done():
+				}
+			}()
 			pc.removeCB(nf.seqno)
 		}
 	})
 }
+
+//loadResult loads and verifies a subscription result, returning nil if
+//it should be dropped
+func (pc *PeerClient) loadResult(body []byte) *core.Message {
+	nm, err := core.LoadMessage(body)
+	if err != nil {
+		log.Info("dropping incoming subscription result (malformed message)")
+		return nil
+	}
+	err = nm.Verify(pc.bwcl.BW())
+	if err != nil {
+		log.Infof("dropping incoming subscription result on uri=%s (failed local validation %s)", nm.Topic, err.Error())
+		return nil
+	}
+	return nm
+}
+
+//deliver delivers the queued results of a subscription, returning credit
+//to the peer as the subscriber consumes them if the peer does flow
+//control. It returns when the subscription ends or stop is closed because
+//the subscribe failed.
+func (pc *PeerClient) deliver(seqno uint64, results chan *nativeFrame, stop chan struct{},
+	messageCB func(m *core.Message), endedCB func(err error)) {
+	consumed := 0
+	for {
+		var f *nativeFrame
+		select {
+		case <-pc.bwcl.ctx.Done():
+			return
+		case <-stop:
+			return
+		case f = <-results:
+		}
+		if f.cmd == nCmdEnd {
+			var err error
+			if len(f.body) >= 2 {
+				if code := int(binary.LittleEndian.Uint16(f.body)); code != bwe.Okay {
+					err = bwe.M(code, string(f.body[2:]))
+				}
+			}
+			endedCB(err)
+			return
+		}
+		if nm := pc.loadResult(f.body); nm != nil {
+			messageCB(nm)
+		}
+		if !pc.GetProtocol().Has(peerproto.CapFlowControl) {
+			consumed = 0
+			continue
+		}
+		consumed++
+		//Return credit in batches, but well before the peer runs out
+		if consumed >= peerproto.InitialCredit/2 {
+			pc.send(&nativeFrame{
+				cmd:   nCmdCredit,
+				body:  peerproto.EncodeCredit(consumed),
+				seqno: seqno,
+			})
+			consumed = 0
+		}
+	}
+}
 func (pc *PeerClient) Unsubscribe(m *core.Message, actionCB func(err error)) {
 	nf := nativeFrame{
 		cmd:   nCmdMessage,
@@ -370,7 +828,39 @@ func (pc *PeerClient) Query(m *core.Message,
 		body:  m.Encoded,
 		seqno: pc.getSeqno(),
 	}
-	pc.transact(&nf, func(f *nativeFrame) {
+	pc.query(&nf, m, actionCB, resultCB)
+}
+
+//QueryHistory queries the persisted messages received by the peer
+//in the range [from, to]. The range is prepended to the message as two
+//little endian unix nanosecond timestamps, zero meaning unbounded.
+func (pc *PeerClient) QueryHistory(m *core.Message, from time.Time, to time.Time,
+	actionCB func(err error),
+	resultCB func(m *core.Message)) {
+	if !pc.GetProtocol().Has(peerproto.CapHistory) {
+		actionCB(bwe.M(bwe.HistoryDisabled, "peer does not support history queries"))
+		return
+	}
+	body := make([]byte, 16+len(m.Encoded))
+	if !from.IsZero() {
+		binary.LittleEndian.PutUint64(body, uint64(from.UnixNano()))
+	}
+	if !to.IsZero() {
+		binary.LittleEndian.PutUint64(body[8:], uint64(to.UnixNano()))
+	}
+	copy(body[16:], m.Encoded)
+	nf := nativeFrame{
+		cmd:   nCmdHistoryQuery,
+		body:  body,
+		seqno: pc.getSeqno(),
+	}
+	pc.query(&nf, m, actionCB, resultCB)
+}
+
+func (pc *PeerClient) query(nf *nativeFrame, m *core.Message,
+	actionCB func(err error),
+	resultCB func(m *core.Message)) {
+	pc.transact(nf, func(f *nativeFrame) {
 		switch f.cmd {
 		case nCmdRStatus:
 			if len(f.body) < 2 {
@@ -396,6 +886,23 @@ func (pc *PeerClient) Query(m *core.Message,
 				return
 			}
 			resultCB(nm)
+		case nCmdHistoryResult:
+			if len(f.body) < 8 {
+				log.Info("dropping incoming query result (short frame)")
+				return
+			}
+			nm, err := core.LoadMessage(f.body[8:])
+			if err != nil {
+				log.Info("dropping incoming query result (malformed message)")
+				return
+			}
+			err = nm.Verify(pc.bwcl.BW())
+			if err != nil {
+				log.Warnf("dropping incoming query result on uri=%s (failed local validation (%s))", m.Topic, err.Error())
+				return
+			}
+			nm.RXTime = time.Unix(0, int64(binary.LittleEndian.Uint64(f.body)))
+			resultCB(nm)
 		case nCmdEnd:
 			resultCB(nil)
 			//This will be signalled when we unsubscribe
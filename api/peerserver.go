@@ -24,6 +24,7 @@ import (
 	"crypto/x509"
 	"crypto/x509/pkix"
 	"encoding/binary"
+	"encoding/hex"
 	"encoding/pem"
 	"io"
 	"math/big"
@@ -37,19 +38,27 @@ import (
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/metrics"
+	"github.com/immesys/bw2/internal/peermux"
+	"github.com/immesys/bw2/internal/peerproto"
+	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/util/bwe"
 )
 
-func genCert(vk string) (tls.Certificate, *x509.Certificate) {
+//genCert returns a new self signed certificate for the VK, along with the
+//PEM encoded certificate and key. A new key is generated if priv is nil.
+func genCert(vk string, priv *rsa.PrivateKey) (tls.Certificate, *x509.Certificate, []byte) {
 	serialNumberLimit := new(big.Int).Lsh(big.NewInt(1), 128)
 	serialNumber, err := rand.Int(rand.Reader, serialNumberLimit)
 	if err != nil {
 		log.Criticalf("failed to generate serial number: %s", err)
 		panic(err)
 	}
-	priv, err := rsa.GenerateKey(rand.Reader, 2048)
-	if err != nil {
-		panic(err)
+	if priv == nil {
+		priv, err = rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			panic(err)
+		}
 	}
 	template := x509.Certificate{
 		SerialNumber: serialNumber,
@@ -81,13 +90,14 @@ func genCert(vk string) (tls.Certificate, *x509.Certificate) {
 	if err != nil {
 		panic(err)
 	}
-	return cert, x509cert
+	return cert, x509cert, append(certbytes, keybytes...)
 }
 
 func Start(bw *BW) {
-	//Generate TLS certificate
+	//Load or generate TLS certificate
 	vk := crypto.FmtKey(bw.Entity.GetVK())
-	cert, cert2 := genCert(vk)
+	cert, cert2 := loadCert(vk, bw.Config.Native.CertFile)
+	log.Infof("peer key fingerprint is %s", hex.EncodeToString(CertFingerprint(cert2)))
 	tlsConfig := tls.Config{Certificates: []tls.Certificate{cert}}
 	ln, err := tls.Listen("tcp", bw.Config.Native.ListenOn, &tlsConfig)
 	log.Info("peer server listening on:", bw.Config.Native.ListenOn)
@@ -103,6 +113,9 @@ func Start(bw *BW) {
 		os.Exit(1)
 	}
 	crypto.SignBlob(bw.Entity.GetSK(), bw.Entity.GetVK(), proof[32:], cert2.Signature)
+	if bw.Config.Native.MuxListenOn != "" {
+		go startMux(bw, &tlsConfig, proof)
+	}
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
@@ -118,6 +131,92 @@ func Start(bw *BW) {
 	}
 }
 
+//How long a new mux connection has to finish the handshake
+const muxHandshakeTimeout = 30 * time.Second
+
+//startMux accepts multiplexed peer connections. Each stream of a session
+//is served like a TCP connection, except that the first one is only used
+//to negotiate the protocol for the whole session. A client whose
+//connection breaks can resume its session on a new one, so its
+//subscriptions carry on without being made again.
+func startMux(bw *BW, tlsConfig *tls.Config, proof []byte) {
+	ln, err := tls.Listen("tcp", bw.Config.Native.MuxListenOn, tlsConfig)
+	if err != nil {
+		log.Criticalf("Could not open native mux socket: %v", err)
+		os.Exit(1)
+	}
+	log.Info("peer mux server listening on:", bw.Config.Native.MuxListenOn)
+	sv := peermux.NewServer()
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			log.Criticalf("Socket error: %v", err)
+			continue
+		}
+		go func() {
+			conn.Write(proof)
+			conn.SetDeadline(time.Now().Add(muxHandshakeTimeout))
+			sess, isNew, err := sv.Serve(conn)
+			if err != nil {
+				log.Info("peer mux handshake error: ", err.Error())
+				return
+			}
+			conn.SetDeadline(time.Time{})
+			if !isNew {
+				log.Info("peer ", conn.RemoteAddr().String(), " resumed a mux session")
+				return
+			}
+			log.Info("peer ", conn.RemoteAddr().String(), " connected on ", conn.LocalAddr().String(), " (mux)")
+			cl := bw.CreateClient(context.Background(), "PEER:"+conn.RemoteAddr().String())
+			handleMuxSession(cl, sess)
+		}()
+	}
+}
+
+func handleMuxSession(cl *BosswaveClient, sess *peermux.Session) {
+	defer func() {
+		sess.Close()
+		cl.ctxCancel()
+	}()
+	ctl, err := sess.Accept()
+	if err != nil {
+		return
+	}
+	seqno, cmd, body, err := peerproto.ReadFrame(ctl, muxMaxHelloSize)
+	if err != nil || cmd != nCmdHello {
+		log.Info("peer mux session did not start with a hello")
+		return
+	}
+	body, proto, err := peerproto.ServerHandshake(body, peerproto.Ours())
+	if err != nil {
+		log.Info("peer mux hello error: ", err.Error())
+		return
+	}
+	if err := peerproto.WriteFrame(ctl, seqno, nCmdHello, body); err != nil {
+		return
+	}
+	log.Info("peer ", sess.RemoteAddr(), " negotiated protocol ", proto)
+	for {
+		st, err := sess.Accept()
+		if err != nil {
+			return
+		}
+		//Subscriptions made on a stream end with it
+		ctx, cancel := context.WithCancel(cl.ctx)
+		go func() {
+			serveFrames(cl, ctx, st, proto, func() {
+				st.Close()
+				cancel()
+			})
+			st.Close()
+			cancel()
+		}()
+	}
+}
+
+//The largest hello frame accepted on a mux control stream
+const muxMaxHelloSize = 4096
+
 type nativeFrame struct {
 	length uint64
 	seqno  uint64
@@ -132,38 +231,87 @@ const (
 	nCmdRStatus = 6
 	nCmdRSub    = 7
 	nCmdResult  = 8
+
+	//A query message prefixed by a time range
+	nCmdHistoryQuery = 9
+	//A query result prefixed by the time it was received
+	nCmdHistoryResult = 10
+
+	//Protocol version and capability exchange
+	nCmdHello = peerproto.CmdHello
+	//Flow control credit for a subscription
+	nCmdCredit = peerproto.CmdCredit
+	//Several publish or persist messages, and the status of each
+	nCmdBatch       = peerproto.CmdBatch
+	nCmdBatchStatus = peerproto.CmdBatchStatus
 )
 
+//How many frames from one peer may be handled at once. Reading from the
+//peer stops while they are all busy.
+const peerSessionWorkers = 64
+
 func handleSession(cl *BosswaveClient, conn net.Conn) {
 	log.Info("peer ", conn.RemoteAddr().String(), " connected on ", conn.LocalAddr().String())
 	defer func() {
 		cl.ctxCancel()
 	}()
+	//Until the client says otherwise it is from before the handshake
+	serveFrames(cl, cl.ctx, conn, peerproto.Legacy, func() {
+		conn.Close()
+		cl.ctxCancel()
+	})
+}
+
+//serveFrames handles the frames a peer sends on conn until it can no
+//longer be read. Subscriptions last until ctx is done, and abort is
+//called if a reply cannot be written.
+func serveFrames(cl *BosswaveClient, ctx context.Context, conn net.Conn, proto peerproto.Hello, abort func()) {
 	hdr := make([]byte, 17)
+	workers := make(chan struct{}, peerSessionWorkers)
+	//Ports are ephemeral, so only label metrics by the host
+	peername, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+
+	//The flow control windows of our subscriptions, by the seqno of the
+	//subscribe request
+	windows := make(map[uint64]*peerproto.Window)
+	subseqnos := make(map[core.UniqueMessageID]uint64)
+	wmutex := sync.Mutex{}
+	closeWindow := func(seqno uint64) {
+		wmutex.Lock()
+		if w, ok := windows[seqno]; ok {
+			w.Close()
+			delete(windows, seqno)
+		}
+		wmutex.Unlock()
+	}
 
 	rmutex := sync.Mutex{}
+	//Whether replies may be compressed, protected by rmutex
+	compress := proto.Has(peerproto.CapCompression)
 
 	reply := func(f *nativeFrame) {
 		//log.Infof("Sending reply of length %v to seqno %v", len(f.body), f.seqno)
-		tmphdr := make([]byte, 17)
-		binary.LittleEndian.PutUint64(tmphdr, uint64(len(f.body)))
-		binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
-		tmphdr[16] = byte(f.cmd)
 		rmutex.Lock()
 		defer rmutex.Unlock()
+		cmd, body := f.cmd, f.body
+		if compress {
+			cmd, body = peerproto.Compress(cmd, body)
+		}
+		tmphdr := make([]byte, 17)
+		binary.LittleEndian.PutUint64(tmphdr, uint64(len(body)))
+		binary.LittleEndian.PutUint64(tmphdr[8:], f.seqno)
+		tmphdr[16] = cmd
 		conn.SetWriteDeadline(time.Now().Add(60 * time.Second))
 		_, err := conn.Write(tmphdr)
 		if err != nil {
 			log.Info("peer write error: ", err.Error())
-			conn.Close()
-			cl.ctxCancel()
+			abort()
 			return
 		}
-		_, err = conn.Write(f.body)
+		_, err = conn.Write(body)
 		if err != nil {
 			log.Info("peer write error: ", err.Error())
-			conn.Close()
-			cl.ctxCancel()
+			abort()
 		}
 	}
 	errframe := func(seqno uint64, code int, msg string) {
@@ -193,41 +341,81 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 			log.Info("peer error: ", err.Error())
 			return
 		}
+		nf.cmd, nf.body, err = peerproto.Decompress(nf.cmd, nf.body)
+		if err != nil {
+			log.Info("peer error: ", err.Error())
+			return
+		}
+		if nf.cmd == nCmdHello {
+			//This is handled before any later frame is dispatched so
+			//that they all see what was negotiated
+			body, h, err := peerproto.ServerHandshake(nf.body, peerproto.Ours())
+			if err != nil {
+				errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+				continue
+			}
+			proto = h
+			log.Info("peer ", conn.RemoteAddr().String(), " negotiated protocol ", proto)
+			reply(&nativeFrame{seqno: nf.seqno, cmd: nCmdHello, body: body})
+			rmutex.Lock()
+			compress = proto.Has(peerproto.CapCompression)
+			rmutex.Unlock()
+			continue
+		}
+		if nf.cmd == nCmdCredit {
+			//Never wait for a worker, they may be waiting for this
+			n, err := peerproto.DecodeCredit(nf.body)
+			if err != nil {
+				errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+				continue
+			}
+			wmutex.Lock()
+			if w, ok := windows[nf.seqno]; ok {
+				w.Add(n)
+			}
+			wmutex.Unlock()
+			continue
+		}
 
+		workers <- struct{}{}
 		go func() {
+			defer func() {
+				<-workers
+			}()
 			switch nf.cmd {
-			case nCmdMessage:
-				msg, err := core.LoadMessage(nf.body)
-				//log.Info("Load message returned")
+			case nCmdMessage, nCmdHistoryQuery:
+				body := nf.body
+				var from, to time.Time
+				history := nf.cmd == nCmdHistoryQuery
+				if history {
+					if len(body) < 16 {
+						errframe(nf.seqno, bwe.MalformedMessage, "short history query")
+						return
+					}
+					if ts := binary.LittleEndian.Uint64(body); ts != 0 {
+						from = time.Unix(0, int64(ts))
+					}
+					if ts := binary.LittleEndian.Uint64(body[8:]); ts != 0 {
+						to = time.Unix(0, int64(ts))
+					}
+					body = body[16:]
+				}
+				msg, err := loadPeerMessage(cl, body)
 				if err != nil {
-					log.Info("Load message error: ", err.Error())
-					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					bws := bwe.AsBW(err)
+					errframe(nf.seqno, bws.Code, bws.Msg)
 					return
 				}
-				err = cl.VerifyAffinity(msg)
-				if err != nil {
-					errframe(nf.seqno, bwe.AffinityMismatch, err.Error())
+
+				if history && msg.Type != core.TypeQuery && msg.Type != core.TypeTapQuery {
+					errframe(nf.seqno, bwe.BadOperation, "history requires a query")
 					return
 				}
-				err = msg.Verify(cl.BW())
-				if err != nil {
+				if err := cl.cl.ChargeLimits(msg, cl.BW()); err != nil {
 					bws := bwe.AsBW(err)
 					errframe(nf.seqno, bws.Code, bws.Msg)
-					log.Infof("message failed verification: %#v", msg)
-					if msg.PrimaryAccessChain != nil {
-						log.Infof("pac src %v\n", crypto.FmtKey(msg.PrimaryAccessChain.GetGiverVK()))
-						log.Infof("pac dst %v\n", crypto.FmtKey(msg.PrimaryAccessChain.GetReceiverVK()))
-					}
-					log.Infof("roz are %#v\n", msg.RoutingObjects)
-					if msg.OriginVK != nil {
-						log.Infof("msg src %\v\n", crypto.FmtKey(*msg.OriginVK))
-					} else {
-						log.Infof("msg has no origin VK header\n")
-					}
 					return
 				}
-				//log.Info("message verified ok")
-
 				switch msg.Type {
 				case core.TypePublish:
 					errframe(nf.seqno, bwe.Okay, "")
@@ -237,6 +425,13 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					cl.cl.Persist(msg)
 				case core.TypeUnsubscribe:
 					err := cl.cl.Unsubscribe(msg.UnsubUMid)
+					wmutex.Lock()
+					seqno, ok := subseqnos[msg.UnsubUMid]
+					delete(subseqnos, msg.UnsubUMid)
+					wmutex.Unlock()
+					if ok {
+						closeWindow(seqno)
+					}
 					if err == nil {
 						errframe(nf.seqno, bwe.Okay, "")
 					} else {
@@ -244,14 +439,51 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					}
 
 				case core.TypeSubscribe, core.TypeTap:
-					subid := cl.cl.Subscribe(cl.ctx, msg, func(m *core.Message) {
+					var win *peerproto.Window
+					if proto.Has(peerproto.CapFlowControl) {
+						win = peerproto.NewWindow(peerproto.InitialCredit)
+						wmutex.Lock()
+						windows[nf.seqno] = win
+						wmutex.Unlock()
+					}
+					throttled := func() {
+						metrics.PeerThrottles.WithLabelValues(peername).Inc()
+						errframe(nf.seqno, bwe.Throttled, "subscription is out of credit")
+					}
+					//Set by the handler, which is only called once the
+					//subscription exists
+					var subdone <-chan struct{}
+					subid := cl.cl.Subscribe(ctx, msg, func(m *core.Message) {
 						if m == nil {
+							closeWindow(nf.seqno)
 							rv := nativeFrame{
 								seqno: nf.seqno,
 								cmd:   nCmdEnd,
 							}
+							//Say why if the router ended it, older
+							//clients ignore the body
+							if err := cl.cl.TerminationError(msg.UMid); err != nil {
+								bwerr, ok := err.(*bwe.BWStatus)
+								if !ok {
+									bwerr = bwe.WrapC(bwe.AccessRevoked, err)
+								}
+								rv.body = make([]byte, 2+len(bwerr.Msg))
+								binary.LittleEndian.PutUint16(rv.body, uint16(bwerr.Code))
+								copy(rv.body[2:], bwerr.Msg)
+							}
 							reply(&rv)
 						} else {
+							//Hold results back until the subscriber
+							//catches up, the terminus queue absorbs them
+							if win != nil {
+								if subdone == nil {
+									//The terminus uses the message ID as the subscription ID
+									subdone = cl.cl.SubscriptionDone(msg.UMid)
+								}
+								if !win.Take(subdone, throttled) {
+									return
+								}
+							}
 							rv := nativeFrame{
 								seqno: nf.seqno,
 								cmd:   nCmdResult,
@@ -260,6 +492,11 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 							reply(&rv)
 						}
 					})
+					if win != nil {
+						wmutex.Lock()
+						subseqnos[subid] = nf.seqno
+						wmutex.Unlock()
+					}
 					rv := nativeFrame{
 						seqno: nf.seqno,
 						cmd:   nCmdRSub,
@@ -270,6 +507,29 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					binary.LittleEndian.PutUint64(rv.body[10:], subid.Sig)
 					reply(&rv)
 				case core.TypeQuery, core.TypeTapQuery:
+					if history {
+						if !store.HistoryEnabled() {
+							errframe(nf.seqno, bwe.HistoryDisabled, "this router does not retain message history")
+							return
+						}
+						errframe(nf.seqno, bwe.Okay, "")
+						cl.cl.QueryHistory(msg, from, to, func(m *core.Message) {
+							rv := nativeFrame{
+								seqno: nf.seqno,
+							}
+							if m == nil {
+								rv.cmd = nCmdEnd
+								rv.body = []byte{}
+							} else {
+								rv.cmd = nCmdHistoryResult
+								rv.body = make([]byte, 8+len(m.Encoded))
+								binary.LittleEndian.PutUint64(rv.body, uint64(m.RXTime.UnixNano()))
+								copy(rv.body[8:], m.Encoded)
+							}
+							reply(&rv)
+						})
+						return
+					}
 					errframe(nf.seqno, bwe.Okay, "")
 					cl.cl.Query(msg, func(m *core.Message) {
 						rv := nativeFrame{
@@ -303,6 +563,24 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 					errframe(nf.seqno, bwe.BadOperation, "type mismatch")
 					return
 				}
+			case nCmdBatch:
+				bodies, err := peerproto.DecodeBatch(nf.body)
+				if err != nil {
+					errframe(nf.seqno, bwe.MalformedMessage, err.Error())
+					return
+				}
+				codes := make([]int, len(bodies))
+				for i, body := range bodies {
+					codes[i] = bwe.Okay
+					if err := publishPeerMessage(cl, body); err != nil {
+						codes[i] = bwe.AsBW(err).Code
+					}
+				}
+				reply(&nativeFrame{
+					seqno: nf.seqno,
+					cmd:   nCmdBatchStatus,
+					body:  peerproto.EncodeStatuses(codes),
+				})
 			default: //nCmd
 				errframe(nf.seqno, bwe.BadOperation, "what command is this?")
 				return
@@ -310,3 +588,55 @@ func handleSession(cl *BosswaveClient, conn net.Conn) {
 		}()
 	}
 }
+
+//loadPeerMessage decodes a message from a peer and checks that it is for
+//a namespace we are the designated router of and that it verifies
+func loadPeerMessage(cl *BosswaveClient, body []byte) (*core.Message, error) {
+	msg, err := core.LoadMessage(body)
+	if err != nil {
+		log.Info("Load message error: ", err.Error())
+		return nil, bwe.M(bwe.MalformedMessage, err.Error())
+	}
+	err = cl.VerifyAffinity(msg)
+	if err != nil {
+		return nil, bwe.M(bwe.AffinityMismatch, err.Error())
+	}
+	err = msg.Verify(cl.BW())
+	if err != nil {
+		msg.Audit(err)
+		log.Infof("message failed verification: %#v", msg)
+		if msg.PrimaryAccessChain != nil {
+			log.Infof("pac src %v\n", crypto.FmtKey(msg.PrimaryAccessChain.GetGiverVK()))
+			log.Infof("pac dst %v\n", crypto.FmtKey(msg.PrimaryAccessChain.GetReceiverVK()))
+		}
+		log.Infof("roz are %#v\n", msg.RoutingObjects)
+		if msg.OriginVK != nil {
+			log.Infof("msg src %\v\n", crypto.FmtKey(*msg.OriginVK))
+		} else {
+			log.Infof("msg has no origin VK header\n")
+		}
+		return nil, bwe.AsBW(err)
+	}
+	return msg, nil
+}
+
+//publishPeerMessage delivers one message of a batch from a peer. Only
+//publish and persist messages may be batched.
+func publishPeerMessage(cl *BosswaveClient, body []byte) error {
+	msg, err := loadPeerMessage(cl, body)
+	if err != nil {
+		return err
+	}
+	if msg.Type != core.TypePublish && msg.Type != core.TypePersist {
+		return bwe.M(bwe.BadOperation, "only publish and persist may be batched")
+	}
+	if err := cl.cl.ChargeLimits(msg, cl.BW()); err != nil {
+		return err
+	}
+	if msg.Type == core.TypePersist {
+		cl.cl.Persist(msg)
+	} else {
+		cl.cl.Publish(msg)
+	}
+	return nil
+}
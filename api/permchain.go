@@ -0,0 +1,54 @@
+package api
+
+import (
+	"sort"
+	"strings"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/trust"
+	"github.com/immesys/bw2/objects"
+)
+
+//PermissionChainBuilder finds permission DOT chains from an authority to a
+//target that grant all of the wanted key/value pairs. A chain grants a key
+//only if every DOT in it grants that key with the same value.
+type PermissionChainBuilder struct {
+	cl        *BosswaveClient
+	status    chan string
+	authority []byte
+	target    []byte
+	want      map[string]string
+}
+
+func NewPermissionChainBuilder(cl *BosswaveClient, authority []byte, target []byte, want map[string]string, status chan string) *PermissionChainBuilder {
+	return &PermissionChainBuilder{cl: cl,
+		authority: authority,
+		target:    target,
+		want:      want,
+		status:    status}
+}
+
+//FmtPermissions formats a permission table as sorted k=v pairs
+func FmtPermissions(kv map[string]string) string {
+	parts := make([]string, 0, len(kv))
+	for k, v := range kv {
+		parts = append(parts, k+"="+v)
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, ",")
+}
+
+//Build walks the permission DOTs granted from the authority and returns
+//every chain that reaches the target
+func (b *PermissionChainBuilder) Build() ([]*objects.DChain, error) {
+	defer close(b.status)
+	return trust.BuildPermissionChains(trustResolver{b.cl.BW()}, b.authority, b.target, b.want, b.status)
+}
+
+//VerifyPermissionChain checks that the permission chain starts at the
+//authority, ends at the target (or everybody), that every DOT in it is
+//valid, unexpired and unrevoked, and that it grants all of the wanted
+//key/value pairs. It returns everything the chain grants.
+func (bw *BW) VerifyPermissionChain(dc *objects.DChain, authority []byte, target []byte, want map[string]string) (map[string]string, error) {
+	return core.VerifyPermissionChain(dc, bw, authority, target, want)
+}
@@ -0,0 +1,301 @@
+package api
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/regsnap"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//The export walk stops after this many DOTs have been added
+const exportMaxDOTs = 100000
+
+//ExportRegistry returns a snapshot of the registry objects relevant to the
+//given namespaces: every access DOT on a namespace reachable from it (as in
+//TrustGraph) and the entities at either end, the access chains built on the
+//namespace that are cached, the aliases of all those entities, and the
+//namespace's designated router and its SRV record. Objects have the state
+//they resolve to now, so revoked and expired objects are included as such,
+//along with the revocations published for the entities and DOTs. The
+//snapshot is of the current block and can be written with Write.
+func (bw *BW) ExportRegistry(nsvks [][]byte) (*regsnap.Snapshot, error) {
+	num := bw.bchain.CurrentBlock()
+	hdr := bw.bchain.GetHeader(num)
+	if hdr == nil {
+		return nil, bwe.M(bwe.BlockChainGenericError, "Could not get the current block header")
+	}
+	s := regsnap.New(num, [32]byte(hdr.Hash()), time.Unix(hdr.Time.Int64(), 0))
+	addEntity := func(vk []byte) error {
+		if _, ok := s.Entities[bc.SliceToBytes32(vk)]; ok {
+			return nil
+		}
+		ent, state, err := bw.ResolveEntity(vk)
+		if err != nil {
+			return err
+		}
+		if ent != nil {
+			s.Add(ent, state)
+		}
+		return nil
+	}
+	for _, nsvk := range nsvks {
+		if err := addEntity(nsvk); err != nil {
+			return nil, err
+		}
+		visited := map[bc.Bytes32]bool{bc.SliceToBytes32(nsvk): true}
+		toVisit := list.New()
+		toVisit.PushBack(nsvk)
+		for toVisit.Front() != nil {
+			le := toVisit.Front()
+			toVisit.Remove(le)
+			dlz, err := bw.ResolveGrantedDOTs(le.Value.([]byte))
+			if err != nil {
+				return nil, err
+			}
+			for _, dl := range dlz {
+				d := dl.D
+				if d == nil || !d.IsAccess() || !bytes.Equal(d.GetAccessURIMVK(), nsvk) {
+					continue
+				}
+				if len(s.DOTs) >= exportMaxDOTs {
+					return nil, bwe.M(bwe.BadOperation, "Too many DOTs to export")
+				}
+				s.Add(d, dl.S)
+				to := d.GetReceiverVK()
+				if err := addEntity(to); err != nil {
+					return nil, err
+				}
+				if !visited[bc.SliceToBytes32(to)] {
+					visited[bc.SliceToBytes32(to)] = true
+					toVisit.PushBack(to)
+				}
+			}
+		}
+		for _, dc := range bw.cachedChains(nsvk) {
+			state := StateValid
+			for i := 0; i < dc.NumHashes(); i++ {
+				d, ds, err := bw.ResolveDOT(dc.GetDotHash(i))
+				if err != nil {
+					return nil, err
+				}
+				if d != nil {
+					s.Add(d, ds)
+				}
+				if ds != StateValid && state == StateValid {
+					state = ds
+				}
+			}
+			if err := s.Add(dc, state); err != nil {
+				return nil, err
+			}
+		}
+		if dr, err := bw.LookupDesignatedRouter(nsvk); err == nil {
+			s.Routers[bc.SliceToBytes32(nsvk)] = bc.SliceToBytes32(dr)
+			if err := addEntity(dr); err != nil {
+				return nil, err
+			}
+			if srv, err := bw.LookupDesignatedRouterSRV(dr); err == nil {
+				s.SRVs[bc.SliceToBytes32(dr)] = srv
+			}
+		}
+	}
+	targets := [][]byte{}
+	for vk := range s.Entities {
+		k, iszero, err := bw.registry().UnresolveAlias(context.TODO(), bc.Bytes32(vk))
+		if err != nil {
+			return nil, err
+		}
+		if !iszero {
+			s.Aliases[k] = vk
+		}
+		targets = append(targets, append([]byte{}, vk[:]...))
+	}
+	for hash := range s.DOTs {
+		targets = append(targets, append([]byte{}, hash[:]...))
+	}
+	rvks, err := bw.registry().FindRevocations(context.TODO(), targets)
+	if err != nil {
+		return nil, err
+	}
+	for _, r := range rvks {
+		s.Add(r, 0)
+	}
+	return s, nil
+}
+
+//cachedChains returns the access chains built on the namespace that are
+//in the cache
+func (bw *BW) cachedChains(nsvk []byte) []*objects.DChain {
+	bw.getlock()
+	defer bw.rellock()
+	rv := []*objects.DChain{}
+	for _, chains := range bw.rdata.chaincache[bc.SliceToBytes32(nsvk)] {
+		rv = append(rv, chains...)
+	}
+	return rv
+}
+
+//Imported returns the registry objects that have been imported, or nil
+func (bw *BW) Imported() *regsnap.Snapshot {
+	imp, _ := bw.imported.Load().(*regsnap.Snapshot)
+	return imp
+}
+
+//ImportRegistry adds the objects in a registry snapshot exported by
+//ExportRegistry, which must be signed by this router or one of the
+//Offline.TrustedSigners. Until the router restarts, registry lookups that
+//the chain cannot answer (because it has not synced that far, for example)
+//are answered from the imported objects. The resolution caches are then
+//preloaded with everything in the snapshot. The chain still takes
+//precedence for anything it knows about, except that an imported
+//revocation revokes an object the chain has not seen revoked yet, and the
+//subscriptions that depend on it are ended.
+func (bw *BW) ImportRegistry(snap *regsnap.Snapshot) error {
+	if !bytes.Equal(snap.SignerVK, bw.Entity.GetVK()) && !trustedSigner(snap.SignerVK, bw.Config.Offline.TrustedSigners) {
+		return bwe.M(bwe.BadOperation, "Snapshot is signed by "+crypto.FmtKey(snap.SignerVK)+" which is not trusted")
+	}
+	bw.impmu.Lock()
+	//Lookups may be using the old one, so merge into a copy
+	imp := regsnap.New(snap.Block, snap.BlockHash, snap.BlockTime)
+	if old := bw.Imported(); old != nil {
+		imp.Merge(old)
+	}
+	imp.Merge(snap)
+	bw.imported.Store(imp)
+	bw.impmu.Unlock()
+	log.Infof("imported registry snapshot of block %d signed by %s", snap.Block, crypto.FmtKey(snap.SignerVK))
+	//What was cached may have been revoked since
+	for target := range snap.Revocations {
+		if _, ok := snap.Entities[target]; ok {
+			bw.FlushEntity(target[:])
+		} else {
+			bw.FlushDOT(target[:])
+		}
+	}
+	for vk := range snap.Entities {
+		if _, _, err := bw.ResolveEntity(vk[:]); err != nil {
+			return err
+		}
+		if _, err := bw.ResolveGrantedDOTs(vk[:]); err != nil {
+			return err
+		}
+	}
+	for hash := range snap.DOTs {
+		if _, _, err := bw.ResolveDOT(hash[:]); err != nil {
+			return err
+		}
+	}
+	if len(snap.Revocations) > 0 {
+		bw.revalidateSubs()
+	}
+	return nil
+}
+
+//importedRegistry answers registry lookups from the imported objects when
+//the underlying registry does not know about them
+type importedRegistry struct {
+	r   registry
+	imp snapshotRegistry
+}
+
+func (ir importedRegistry) ResolveEntity(ctx context.Context, vk []byte) (*objects.Entity, int, error) {
+	ent, state, err := ir.r.ResolveEntity(ctx, vk)
+	if err == nil && state == StateUnknown {
+		return ir.imp.ResolveEntity(ctx, vk)
+	}
+	if err == nil && state == StateValid && ir.imp.s.Revoked(vk, ent) {
+		return ent, StateRevoked, nil
+	}
+	return ent, state, err
+}
+
+func (ir importedRegistry) ResolveDOT(ctx context.Context, dothash []byte) (*objects.DOT, int, error) {
+	dot, state, err := ir.r.ResolveDOT(ctx, dothash)
+	if err == nil && state == StateUnknown {
+		return ir.imp.ResolveDOT(ctx, dothash)
+	}
+	if err == nil && state == StateValid && ir.imp.s.Revoked(dothash, dot) {
+		return dot, StateRevoked, nil
+	}
+	return dot, state, err
+}
+
+func (ir importedRegistry) ResolveAccessDChain(ctx context.Context, chainhash []byte) (*objects.DChain, int, error) {
+	dc, state, err := ir.r.ResolveAccessDChain(ctx, chainhash)
+	if err == nil && state == StateUnknown {
+		return ir.imp.ResolveAccessDChain(ctx, chainhash)
+	}
+	return dc, state, err
+}
+
+//ResolveDOTsFromVK returns the DOTs that either knows about
+func (ir importedRegistry) ResolveDOTsFromVK(ctx context.Context, vk bc.Bytes32) ([]bc.Bytes32, error) {
+	rv, err := ir.r.ResolveDOTsFromVK(ctx, vk)
+	if err != nil {
+		return nil, err
+	}
+	have := make(map[bc.Bytes32]bool, len(rv))
+	for _, h := range rv {
+		have[h] = true
+	}
+	imp, _ := ir.imp.ResolveDOTsFromVK(ctx, vk)
+	for _, h := range imp {
+		if !have[h] {
+			rv = append(rv, h)
+		}
+	}
+	return rv, nil
+}
+
+func (ir importedRegistry) ResolveAlias(ctx context.Context, key bc.Bytes32) (bc.Bytes32, bool, error) {
+	v, iszero, err := ir.r.ResolveAlias(ctx, key)
+	if err == nil && iszero {
+		return ir.imp.ResolveAlias(ctx, key)
+	}
+	return v, iszero, err
+}
+
+func (ir importedRegistry) UnresolveAlias(ctx context.Context, value bc.Bytes32) (bc.Bytes32, bool, error) {
+	k, iszero, err := ir.r.UnresolveAlias(ctx, value)
+	if err == nil && iszero {
+		return ir.imp.UnresolveAlias(ctx, value)
+	}
+	return k, iszero, err
+}
+
+func (ir importedRegistry) GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error) {
+	dr, err := ir.r.GetDesignatedRouterFor(ctx, nsvk)
+	if err != nil {
+		if idr, ierr := ir.imp.GetDesignatedRouterFor(ctx, nsvk); ierr == nil {
+			return idr, nil
+		}
+	}
+	return dr, err
+}
+
+func (ir importedRegistry) GetSRVRecordFor(ctx context.Context, drvk []byte) (string, error) {
+	srv, err := ir.r.GetSRVRecordFor(ctx, drvk)
+	if err != nil {
+		if isrv, ierr := ir.imp.GetSRVRecordFor(ctx, drvk); ierr == nil {
+			return isrv, nil
+		}
+	}
+	return srv, err
+}
+
+//FindRevocations returns the revocations that either knows about
+func (ir importedRegistry) FindRevocations(ctx context.Context, targets [][]byte) ([]*objects.Revocation, error) {
+	rv, err := ir.r.FindRevocations(ctx, targets)
+	if err != nil {
+		return nil, err
+	}
+	imp, _ := ir.imp.FindRevocations(ctx, targets)
+	return append(rv, imp...), nil
+}
@@ -0,0 +1,87 @@
+package api
+
+import (
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/renew"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//RenewDOT returns a copy of the DOT with the given hash that expires at
+//the given time, signed by giver, which must be the DOT's giver. The
+//URI, permissions, publish limits, TTL, contact, comment and delegated
+//revokers are the same. The creation date is now, unless the DOT has none.
+//The DOT may have expired, but not been revoked.
+func (bw *BW) RenewDOT(hash []byte, giver *objects.Entity, expiry time.Time) (*objects.DOT, error) {
+	old, state, err := bw.ResolveDOT(hash)
+	if err != nil {
+		return nil, err
+	}
+	if old == nil || (state != StateValid && state != StateExpired) {
+		return nil, bwe.M(bwe.InvalidDOT, "Cannot renew DOT, state: "+bw.StateToString(state))
+	}
+	for _, vk := range [][]byte{old.GetGiverVK(), old.GetReceiverVK()} {
+		_, state, err := bw.ResolveEntity(vk)
+		if err != nil {
+			return nil, err
+		}
+		if state != StateValid {
+			return nil, bwe.M(bwe.InvalidEntity, "Cannot renew DOT, "+crypto.FmtKey(vk)+" state: "+bw.StateToString(state))
+		}
+	}
+	return renew.Clone(old, giver, expiry)
+}
+
+//RebuildChainsUsing discards the cached chains built with the DOT with the
+//given hash and builds them again, so that they use whatever replaces it.
+//It returns how many chain builds were redone.
+func (c *BosswaveClient) RebuildChainsUsing(hash []byte) int {
+	//The replacement is granted by the same VK, and the DOT may have just
+	//been revoked
+	if d, _, err := c.bw.ResolveDOT(hash); err == nil && d != nil {
+		c.bw.FlushGrantedFromCache(d.GetGiverVK())
+	}
+	c.bw.FlushDOT(hash)
+	khash := bc.SliceToBytes32(hash)
+	keys := []CacheKey{}
+	c.bw.getlock()
+	for _, nsmap := range c.bw.rdata.chaincache {
+		for k, chains := range nsmap {
+		nextkey:
+			for _, dc := range chains {
+				for i := 0; i < dc.NumHashes(); i++ {
+					if bc.SliceToBytes32(dc.GetDotHash(i)) == khash {
+						keys = append(keys, k)
+						delete(nsmap, k)
+						break nextkey
+					}
+				}
+			}
+		}
+	}
+	c.bw.rellock()
+	for _, k := range keys {
+		status := make(chan string, 10)
+		go func() {
+			for m := range status {
+				log.Debug("chain rebuild status: ", m)
+			}
+		}()
+		cb := NewChainBuilder(c, k.uri, k.perms, k.target[:], status)
+		if cb == nil {
+			close(status)
+			continue
+		}
+		chains, err := cb.Build()
+		if err != nil {
+			log.Warnf("could not rebuild chains on %s: %v", k.uri, err)
+			continue
+		}
+		log.Infof("rebuilt %d chains on %s that used DOT %s", len(chains), k.uri, crypto.FmtHash(hash))
+	}
+	return len(keys)
+}
@@ -0,0 +1,233 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/bc"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/regsnap"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
+)
+
+//registry is the part of the block chain provider that resolution uses.
+//While the chain is stale it can be answered from a registry snapshot
+//instead, see Offline in the config.
+type registry interface {
+	ResolveEntity(ctx context.Context, vk []byte) (*objects.Entity, int, error)
+	ResolveDOT(ctx context.Context, dothash []byte) (*objects.DOT, int, error)
+	ResolveAccessDChain(ctx context.Context, chainhash []byte) (*objects.DChain, int, error)
+	ResolveDOTsFromVK(ctx context.Context, vk bc.Bytes32) ([]bc.Bytes32, error)
+	ResolveAlias(ctx context.Context, key bc.Bytes32) (bc.Bytes32, bool, error)
+	UnresolveAlias(ctx context.Context, value bc.Bytes32) (bc.Bytes32, bool, error)
+	GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error)
+	GetSRVRecordFor(ctx context.Context, drvk []byte) (string, error)
+	FindRevocations(ctx context.Context, targets [][]byte) ([]*objects.Revocation, error)
+}
+
+//registry returns where registry lookups should go
+func (bw *BW) registry() registry {
+	var rv registry = bw.bchain
+	if bw.checkSnapshotUse() {
+		rv = snapshotRegistry{bw.snap}
+	}
+	if imp := bw.Imported(); imp != nil {
+		rv = importedRegistry{rv, snapshotRegistry{imp}}
+	}
+	return rv
+}
+
+//UsingSnapshot returns true if resolutions are being answered from the
+//registry snapshot because the chain is stale
+func (bw *BW) UsingSnapshot() bool {
+	return bw.snap != nil && bw.bchain.HeadBlockAge() > defaultMaxAge
+}
+
+//Snapshot returns the registry snapshot that was loaded, or nil
+func (bw *BW) Snapshot() *regsnap.Snapshot {
+	return bw.snap
+}
+
+//checkSnapshotUse returns UsingSnapshot, dropping the caches if that has
+//changed since they were filled from the other source
+func (bw *BW) checkSnapshotUse() bool {
+	use := bw.UsingSnapshot()
+	var v int32
+	if use {
+		v = 1
+	}
+	if atomic.SwapInt32(&bw.snapInUse, v) != v {
+		if use {
+			log.Warnf("chain is stale, resolving from the registry snapshot of block %d", bw.snap.Block)
+		} else {
+			log.Infof("chain is fresh, no longer resolving from the registry snapshot")
+		}
+		go bw.dropAllCaches()
+	}
+	return use
+}
+
+//loadSnapshot loads the configured registry snapshot. It must be signed by
+//a trusted VK, match the checkpoint if there is one, and if we have its
+//block, be of our chain.
+func (bw *BW) loadSnapshot() {
+	cfg := bw.Config.Offline
+	if cfg.Snapshot == "" {
+		return
+	}
+	snap, err := LoadSnapshot(cfg.Snapshot, cfg.TrustedSigners, cfg.Checkpoint)
+	if err != nil {
+		fmt.Println("Could not load registry snapshot:", err)
+		os.Exit(1)
+	}
+	if bw.bchain.CurrentBlock() >= snap.Block {
+		hdr := bw.bchain.GetHeader(snap.Block)
+		if hdr != nil && hdr.Hash() != common.Hash(snap.BlockHash) {
+			fmt.Printf("Registry snapshot is of block %d %x, which is not on our chain\n", snap.Block, snap.BlockHash)
+			os.Exit(1)
+		}
+	}
+	log.Infof("loaded registry snapshot of block %d (%s old) signed by %s",
+		snap.Block, snap.Age(), crypto.FmtKey(snap.SignerVK))
+	bw.snap = snap
+}
+
+//LoadSnapshot reads a registry snapshot, checking that it is signed by one
+//of the comma separated trusted VKs and, if checkpoint is not empty, that
+//it is of the block given as number:headerhash
+func LoadSnapshot(fname string, trusted string, checkpoint string) (*regsnap.Snapshot, error) {
+	f, err := os.Open(fname)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	snap, err := regsnap.Read(f)
+	if err != nil {
+		return nil, err
+	}
+	if !trustedSigner(snap.SignerVK, trusted) {
+		return nil, fmt.Errorf("snapshot is signed by %s which is not trusted", crypto.FmtKey(snap.SignerVK))
+	}
+	if checkpoint != "" {
+		parts := strings.SplitN(checkpoint, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("checkpoint should be number:headerhash")
+		}
+		num, err := strconv.ParseUint(parts[0], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("bad checkpoint block number: %v", err)
+		}
+		hash, err := hex.DecodeString(strings.TrimPrefix(parts[1], "0x"))
+		if err != nil || len(hash) != 32 {
+			return nil, fmt.Errorf("bad checkpoint header hash")
+		}
+		if num != snap.Block || !bytes.Equal(hash, snap.BlockHash[:]) {
+			return nil, fmt.Errorf("snapshot is of block %d %x, not the checkpoint", snap.Block, snap.BlockHash)
+		}
+	}
+	return snap, nil
+}
+
+//trustedSigner returns true if vk is in the comma separated list of VKs
+func trustedSigner(vk []byte, trusted string) bool {
+	for _, s := range strings.Split(trusted, ",") {
+		tvk, err := crypto.UnFmtKey(strings.TrimSpace(s))
+		if err != nil {
+			continue
+		}
+		if bytes.Equal(tvk, vk) {
+			return true
+		}
+	}
+	return false
+}
+
+//snapshotRegistry answers registry lookups from a snapshot. Objects it does
+//not have are unknown, as they would be on a chain that lacked them.
+type snapshotRegistry struct {
+	s *regsnap.Snapshot
+}
+
+func (sr snapshotRegistry) ResolveEntity(ctx context.Context, vk []byte) (*objects.Entity, int, error) {
+	o, ok := sr.s.Entities[bc.SliceToBytes32(vk)]
+	if !ok {
+		return nil, StateUnknown, nil
+	}
+	ent := o.RO.(*objects.Entity)
+	if o.State == StateValid && sr.s.Revoked(vk, ent) {
+		return ent, StateRevoked, nil
+	}
+	return ent, o.State, nil
+}
+
+func (sr snapshotRegistry) ResolveDOT(ctx context.Context, dothash []byte) (*objects.DOT, int, error) {
+	o, ok := sr.s.DOTs[bc.SliceToBytes32(dothash)]
+	if !ok {
+		return nil, StateUnknown, nil
+	}
+	dot := o.RO.(*objects.DOT)
+	if o.State == StateValid && sr.s.Revoked(dothash, dot) {
+		return dot, StateRevoked, nil
+	}
+	return dot, o.State, nil
+}
+
+func (sr snapshotRegistry) ResolveAccessDChain(ctx context.Context, chainhash []byte) (*objects.DChain, int, error) {
+	o, ok := sr.s.Chains[bc.SliceToBytes32(chainhash)]
+	if !ok {
+		return nil, StateUnknown, nil
+	}
+	return o.RO.(*objects.DChain), o.State, nil
+}
+
+func (sr snapshotRegistry) ResolveDOTsFromVK(ctx context.Context, vk bc.Bytes32) ([]bc.Bytes32, error) {
+	hashes := sr.s.GrantedFrom(vk[:])
+	rv := make([]bc.Bytes32, len(hashes))
+	for i, h := range hashes {
+		rv[i] = bc.Bytes32(h)
+	}
+	return rv, nil
+}
+
+func (sr snapshotRegistry) ResolveAlias(ctx context.Context, key bc.Bytes32) (bc.Bytes32, bool, error) {
+	v, ok := sr.s.Aliases[key]
+	return bc.Bytes32(v), !ok, nil
+}
+
+func (sr snapshotRegistry) UnresolveAlias(ctx context.Context, value bc.Bytes32) (bc.Bytes32, bool, error) {
+	k, ok := sr.s.AliasFor(value)
+	return bc.Bytes32(k), !ok, nil
+}
+
+func (sr snapshotRegistry) GetDesignatedRouterFor(ctx context.Context, nsvk []byte) ([]byte, error) {
+	dr, ok := sr.s.Routers[bc.SliceToBytes32(nsvk)]
+	if !ok {
+		return nil, bwe.M(bwe.BlockChainGenericError, "Designated router not found in registry snapshot")
+	}
+	return dr[:], nil
+}
+
+func (sr snapshotRegistry) GetSRVRecordFor(ctx context.Context, drvk []byte) (string, error) {
+	srv, ok := sr.s.SRVs[bc.SliceToBytes32(drvk)]
+	if !ok {
+		return "", bwe.M(bwe.BlockChainGenericError, "SRV record not found in registry snapshot")
+	}
+	return srv, nil
+}
+
+func (sr snapshotRegistry) FindRevocations(ctx context.Context, targets [][]byte) ([]*objects.Revocation, error) {
+	rv := []*objects.Revocation{}
+	for _, t := range targets {
+		rv = append(rv, sr.s.Revocations[bc.SliceToBytes32(t)]...)
+	}
+	return rv, nil
+}
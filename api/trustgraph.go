@@ -0,0 +1,17 @@
+package api
+
+import "github.com/immesys/bw2/internal/trust"
+
+//TrustGraphEdge is an access DOT in a trust graph
+type TrustGraphEdge = trust.Edge
+
+//TrustGraph is every access DOT reachable from a namespace
+type TrustGraph = trust.Graph
+
+//TrustGraph walks the access DOTs granted from the namespace, then from
+//their receivers and so on. If filter is not empty, only DOTs whose URI
+//intersects that subtree of the namespace are included. Expired and revoked
+//DOTs are included (and followed) so that they can be shown.
+func (bw *BW) TrustGraph(nsvk []byte, filter string) (*TrustGraph, error) {
+	return trust.Walk(trustResolver{bw}, nsvk, filter)
+}
@@ -0,0 +1,500 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2bind"
+	"github.com/urfave/cli"
+	yaml "gopkg.in/yaml.v2"
+)
+
+//A policy file describes the entities, access DOTs and aliases that should
+//exist. For example:
+//
+//   entities:
+//     admin:
+//       file: admin.ent
+//     thermostat:
+//       file: thermostat.ent   # created if it does not exist
+//       expiry: 365d
+//   dots:
+//     - from: admin
+//       to: thermostat         # a name from above, a VK, an alias or an entity file
+//       uri: bldg.ns/floor1/thermostat/*
+//       permissions: PC
+//       ttl: 0
+//       expiry: 30d
+//   aliases:
+//     bldg.thermostat: thermostat
+//   prune: true                # revoke DOTs from these entities that are not listed
+//
+//A DOT that is listed more than once (the same from, to, uri and
+//permissions) is only granted once.
+
+type policyEntity struct {
+	File    string `yaml:"file"`
+	Contact string `yaml:"contact"`
+	Comment string `yaml:"comment"`
+	Expiry  string `yaml:"expiry"`
+}
+
+type policyDOT struct {
+	From        string `yaml:"from"`
+	To          string `yaml:"to"`
+	URI         string `yaml:"uri"`
+	Permissions string `yaml:"permissions"`
+	TTL         int    `yaml:"ttl"`
+	Expiry      string `yaml:"expiry"`
+	Contact     string `yaml:"contact"`
+	Comment     string `yaml:"comment"`
+}
+
+type policy struct {
+	Entities map[string]*policyEntity `yaml:"entities"`
+	DOTs     []*policyDOT             `yaml:"dots"`
+	Aliases  map[string]string        `yaml:"aliases"`
+	Prune    bool                     `yaml:"prune"`
+}
+
+//applyEntity is an entity in the policy, loaded or created
+type applyEntity struct {
+	name    string
+	file    string
+	ent     *objects.Entity
+	created bool
+	//false if the entity is not in the registry
+	onChain bool
+}
+
+//applyPlan is everything that needs to change, in the order it must be
+//published
+type applyPlan struct {
+	entities    []*applyEntity
+	dots        []*objects.DOT
+	revocations []*objects.Revocation
+	aliasKeys   [][]byte
+	aliasVals   [][]byte
+	steps       []string
+}
+
+func (p *applyPlan) empty() bool {
+	return len(p.steps) == 0
+}
+
+func loadPolicyOrExit(fname string) *policy {
+	contents, err := ioutil.ReadFile(fname)
+	if err != nil {
+		fmt.Println("Could not read policy:", err)
+		os.Exit(1)
+	}
+	rv := &policy{}
+	if err := yaml.UnmarshalStrict(contents, rv); err != nil {
+		fmt.Println("Could not parse policy:", err)
+		os.Exit(1)
+	}
+	for name, e := range rv.Entities {
+		if e == nil || e.File == "" {
+			fmt.Printf("Entity '%s' needs a file\n", name)
+			os.Exit(1)
+		}
+	}
+	for i, d := range rv.DOTs {
+		if d.From == "" || d.To == "" || d.URI == "" || d.Permissions == "" {
+			fmt.Printf("DOT %d needs from, to, uri and permissions\n", i+1)
+			os.Exit(1)
+		}
+		if objects.GetADPSFromPermString(d.Permissions) == nil {
+			fmt.Printf("DOT %d has invalid permissions '%s'\n", i+1, d.Permissions)
+			os.Exit(1)
+		}
+		if d.TTL < 0 || d.TTL > 255 {
+			fmt.Printf("DOT %d has invalid TTL %d\n", i+1, d.TTL)
+			os.Exit(1)
+		}
+	}
+	return rv
+}
+
+func parseExpiryOrExit(what string, expiry string) *time.Duration {
+	dur, err := util.ParseDuration(expiry)
+	if err != nil {
+		fmt.Printf("Could not parse expiry of %s: %s\n", what, expiry)
+		os.Exit(1)
+	}
+	return dur
+}
+
+//loadPolicyEntities loads every entity in the policy, creating the ones
+//whose file does not exist, and checks which are in the registry
+func loadPolicyEntities(cl *bw2bind.BW2Client, pol *policy, dir string, plan *applyPlan) map[string]*applyEntity {
+	names := make([]string, 0, len(pol.Entities))
+	for name := range pol.Entities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	rv := make(map[string]*applyEntity)
+	for _, name := range names {
+		pe := pol.Entities[name]
+		ae := &applyEntity{name: name, file: pe.File}
+		if !filepath.IsAbs(ae.file) {
+			ae.file = filepath.Join(dir, ae.file)
+		}
+		contents, err := ioutil.ReadFile(ae.file)
+		if err != nil && !os.IsNotExist(err) {
+			fmt.Println("Could not read file", ae.file, ":", err.Error())
+			os.Exit(1)
+		}
+		if len(contents) != 0 {
+			enti, err := objects.NewEntity(int(contents[0]), contents[1:])
+			if err != nil {
+				fmt.Println("Could not decode file:", ae.file, ":", err.Error())
+				os.Exit(1)
+			}
+			ae.ent = enti.(*objects.Entity)
+			ro, _, err := cl.ResolveRegistry(crypto.FmtKey(ae.ent.GetVK()))
+			ae.onChain = err == nil && ro != nil
+		} else {
+			_, blob, err := cl.CreateEntity(&bw2bind.CreateEntityParams{
+				ExpiryDelta: parseExpiryOrExit("entity "+name, pe.Expiry),
+				Contact:     pe.Contact,
+				Comment:     pe.Comment,
+			})
+			if err != nil {
+				fmt.Println("Could not create entity:", err.Error())
+				os.Exit(1)
+			}
+			enti, err := objects.NewEntity(objects.ROEntityWKey, blob)
+			if err != nil {
+				panic(err)
+			}
+			ae.ent = enti.(*objects.Entity)
+			ae.created = true
+			plan.steps = append(plan.steps, fmt.Sprintf("create entity %s (%s) in %s", name, crypto.FmtKey(ae.ent.GetVK()), ae.file))
+		}
+		if !ae.onChain {
+			plan.entities = append(plan.entities, ae)
+			plan.steps = append(plan.steps, fmt.Sprintf("publish entity %s (%s)", name, crypto.FmtKey(ae.ent.GetVK())))
+		}
+		rv[name] = ae
+	}
+	return rv
+}
+
+//findDOTsOrExit returns the DOTs granted by vk and whether each is valid
+func findDOTsOrExit(ocl *oobClient, vk []byte) ([]*objects.DOT, []bool) {
+	f := objects.CreateFrame(objects.CmdFindDots, 0)
+	f.AddHeader("vk", crypto.FmtKey(vk))
+	var dots []*objects.DOT
+	var valid []bool
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		//The POs are pairs of DOT and state
+		for i := 0; i+1 < len(r.POs); i += 2 {
+			doti, err := objects.NewDOT(objects.ROAccessDOT, r.POs[i].PO.GetContent())
+			if err != nil {
+				continue
+			}
+			dots = append(dots, doti.(*objects.DOT))
+			valid = append(valid, string(r.POs[i+1].PO.GetContent()) == "Valid")
+		}
+	})
+	return dots, valid
+}
+
+func dotMatches(d *objects.DOT, mvk []byte, suffix string, perms string, ttl int, to []byte) bool {
+	return d.IsAccess() &&
+		bytes.Equal(d.GetAccessURIMVK(), mvk) &&
+		d.GetAccessURISuffix() == suffix &&
+		d.GetPermString() == perms &&
+		d.GetTTL() == ttl &&
+		bytes.Equal(d.GetReceiverVK(), to)
+}
+
+func signingEntityOrExit(ents map[string]*applyEntity, name string) *objects.Entity {
+	ae, ok := ents[name]
+	if !ok || len(ae.ent.GetSK()) == 0 {
+		fmt.Printf("'%s' must be an entity in the policy with a signing key\n", name)
+		os.Exit(1)
+	}
+	return ae.ent
+}
+
+func planApply(c *cli.Context, cl *bw2bind.BW2Client, ocl *oobClient, pol *policy, dir string) *applyPlan {
+	plan := &applyPlan{}
+	ents := loadPolicyEntities(cl, pol, dir, plan)
+	resolveVK := func(param string) []byte {
+		if ae, ok := ents[param]; ok {
+			return ae.ent.GetVK()
+		}
+		vks, ok := getEntityParamVK(cl, c, param)
+		if !ok {
+			fmt.Printf("Could not resolve '%s'\n", param)
+			os.Exit(1)
+		}
+		vk, _ := crypto.UnFmtKey(vks)
+		return vk
+	}
+
+	//The DOTs that already exist, for each entity that grants DOTs
+	type existing struct {
+		dots    []*objects.DOT
+		valid   []bool
+		matched []bool
+	}
+	granted := make(map[string]*existing)
+	namespaces := make(map[string]bool)
+	//The index of the first entry for each (from, to, uri, perms), so that
+	//an entry listed twice is only granted once
+	planned := make(map[string]int)
+	for i, pd := range pol.DOTs {
+		from := signingEntityOrExit(ents, pd.From)
+		to := resolveVK(pd.To)
+		parts := strings.SplitN(pd.URI, "/", 2)
+		if len(parts) != 2 {
+			fmt.Printf("DOT %d URI must be namespace/suffix\n", i+1)
+			os.Exit(1)
+		}
+		mvk := resolveVK(parts[0])
+		namespaces[string(mvk)] = true
+		perms := objects.GetADPSFromPermString(pd.Permissions).GetPermString()
+		key := strings.Join([]string{crypto.FmtKey(from.GetVK()), crypto.FmtKey(to), crypto.FmtKey(mvk), parts[1], perms}, "|")
+		if j, ok := planned[key]; ok {
+			if pol.DOTs[j].TTL != pd.TTL || pol.DOTs[j].Expiry != pd.Expiry {
+				fmt.Printf("DOT %d repeats DOT %d with a different ttl or expiry\n", i+1, j+1)
+				os.Exit(1)
+			}
+			continue
+		}
+		planned[key] = i
+		ex, ok := granted[pd.From]
+		if !ok {
+			ex = &existing{}
+			if ents[pd.From].onChain {
+				ex.dots, ex.valid = findDOTsOrExit(ocl, from.GetVK())
+			}
+			ex.matched = make([]bool, len(ex.dots))
+			granted[pd.From] = ex
+		}
+		found := false
+		for j, d := range ex.dots {
+			if ex.valid[j] && dotMatches(d, mvk, parts[1], perms, pd.TTL, to) {
+				ex.matched[j] = true
+				found = true
+			}
+		}
+		if found {
+			continue
+		}
+		cl.SetEntity(from.GetSigningBlob())
+		_, blob, err := cl.CreateDOT(&bw2bind.CreateDOTParams{
+			To:                crypto.FmtKey(to),
+			TTL:               uint8(pd.TTL),
+			ExpiryDelta:       parseExpiryOrExit(fmt.Sprintf("DOT %d", i+1), pd.Expiry),
+			Contact:           pd.Contact,
+			Comment:           pd.Comment,
+			URI:               crypto.FmtKey(mvk) + "/" + parts[1],
+			AccessPermissions: perms,
+		})
+		if err != nil {
+			fmt.Println("Could not create DOT:", err.Error())
+			os.Exit(1)
+		}
+		doti, err := objects.NewDOT(objects.ROAccessDOT, blob)
+		if err != nil {
+			fmt.Println("Could not decode DOT")
+			os.Exit(1)
+		}
+		dot := doti.(*objects.DOT)
+		plan.dots = append(plan.dots, dot)
+		plan.steps = append(plan.steps, fmt.Sprintf("grant %s on %s from %s to %s (DOT %s)",
+			perms, pd.URI, pd.From, pd.To, crypto.FmtHash(dot.GetHash())))
+	}
+
+	//DOTs granted by the policy entities that the policy no longer lists
+	froms := make([]string, 0, len(granted))
+	for name := range granted {
+		froms = append(froms, name)
+	}
+	sort.Strings(froms)
+	for _, name := range froms {
+		ex := granted[name]
+		for j, d := range ex.dots {
+			if !ex.valid[j] || ex.matched[j] || !d.IsAccess() || !namespaces[string(d.GetAccessURIMVK())] {
+				continue
+			}
+			desc := fmt.Sprintf("%s on %s/%s from %s to %s (DOT %s)", d.GetPermString(),
+				crypto.FmtKey(d.GetAccessURIMVK()), d.GetAccessURISuffix(), name,
+				crypto.FmtKey(d.GetReceiverVK()), crypto.FmtHash(d.GetHash()))
+			if !pol.Prune {
+				fmt.Println("Not in policy (set prune to revoke):", desc)
+				continue
+			}
+			cl.SetEntity(ents[name].ent.GetSigningBlob())
+			_, blob, err := cl.RevokeDOT(crypto.FmtHash(d.GetHash()), "removed from policy")
+			if err != nil {
+				fmt.Println("Could not create revocation:", err)
+				os.Exit(1)
+			}
+			rvki, err := objects.NewRevocation(objects.RORevocation, blob)
+			if err != nil {
+				fmt.Println("Got bad revocation object from agent")
+				os.Exit(1)
+			}
+			plan.revocations = append(plan.revocations, rvki.(*objects.Revocation))
+			plan.steps = append(plan.steps, "revoke "+desc)
+		}
+	}
+
+	keys := make([]string, 0, len(pol.Aliases))
+	for key := range pol.Aliases {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if len(key) > 32 {
+			fmt.Printf("Alias '%s' is longer than 32 bytes\n", key)
+			os.Exit(1)
+		}
+		vk := resolveVK(pol.Aliases[key])
+		res, zero, err := cl.ResolveLongAlias(key)
+		if err != nil {
+			fmt.Printf("Could not resolve alias '%s': %v\n", key, err)
+			os.Exit(1)
+		}
+		if !zero {
+			if !bytes.Equal(res[:], vk) {
+				fmt.Printf("Alias '%s' already exists with a different value, aliases cannot be changed\n", key)
+				os.Exit(1)
+			}
+			continue
+		}
+		plan.aliasKeys = append(plan.aliasKeys, []byte(key))
+		plan.aliasVals = append(plan.aliasVals, vk)
+		plan.steps = append(plan.steps, fmt.Sprintf("alias %s to %s", key, crypto.FmtKey(vk)))
+	}
+	return plan
+}
+
+func printPlanCost(ocl *oobClient, plan *applyPlan) {
+	f := objects.CreateFrame(objects.CmdEstimateCost, 0)
+	for _, ae := range plan.entities {
+		f.AddRoutingObject(ae.ent)
+	}
+	for _, d := range plan.dots {
+		f.AddRoutingObject(d)
+	}
+	for _, r := range plan.revocations {
+		f.AddRoutingObject(r)
+	}
+	for i := range plan.aliasKeys {
+		f.AddHeaderB("aliaskey", plan.aliasKeys[i])
+		f.AddHeaderB("aliasvalue", plan.aliasVals[i])
+	}
+	if err := ocl.request(f, func(r *objects.Frame) {
+		wei, _ := r.GetFirstHeader("wei")
+		unknown, _, _ := r.ParseFirstHeaderAsInt("unknown", 0)
+		weib, ok := new(big.Int).SetString(wei, 10)
+		if !ok {
+			return
+		}
+		ether := new(big.Float).Quo(new(big.Float).SetInt(weib), big.NewFloat(1e18))
+		fmt.Printf("Estimated cost: %s Ether\n", ether.Text('f', 6))
+		if unknown != 0 {
+			fmt.Printf("(%d operations depend on earlier ones and could not be estimated)\n", unknown)
+		}
+	}); err != nil {
+		fmt.Println("Could not estimate cost:", err)
+	}
+}
+
+func actionApply(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Expected the policy file name")
+		os.Exit(1)
+	}
+	fname := c.Args().Get(0)
+	pol := loadPolicyOrExit(fname)
+	bw2bind.SilenceLog()
+	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
+	cl.StatLine()
+	bankroll := getBankroll(c, cl)
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	plan := planApply(c, cl, ocl, pol, filepath.Dir(fname))
+	if plan.empty() {
+		fmt.Println("Nothing to do, the registry matches the policy")
+		return nil
+	}
+	fmt.Println("Plan:")
+	for _, s := range plan.steps {
+		fmt.Println("  " + s)
+	}
+	if c.Bool("dry-run") {
+		fmt.Println("New entities and DOTs are not saved in a dry run, so the VKs and hashes")
+		fmt.Println("above are placeholders that will differ when the policy is applied")
+	}
+	brenti, _ := objects.NewEntity(objects.ROEntityWKey, bankroll)
+	ocl.setEntityOrExit(brenti.(*objects.Entity))
+	printPlanCost(ocl, plan)
+	if c.Bool("dry-run") {
+		return nil
+	}
+
+	//New keys must be saved before anything refers to them on chain
+	for _, ae := range plan.entities {
+		if !ae.created {
+			continue
+		}
+		wrapped := make([]byte, len(ae.ent.GetSigningBlob())+1)
+		copy(wrapped[1:], ae.ent.GetSigningBlob())
+		wrapped[0] = objects.ROEntityWKey
+		if err := ioutil.WriteFile(ae.file, wrapped, 0600); err != nil {
+			fmt.Println("could not write entity to", ae.file, ":", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println("wrote key to file", ae.file)
+	}
+	//DOTs need their entities, and revocations their targets, to be
+	//published first
+	phases := [][]objects.RoutingObject{{}, {}}
+	for _, ae := range plan.entities {
+		phases[0] = append(phases[0], ae.ent)
+	}
+	for _, d := range plan.dots {
+		phases[1] = append(phases[1], d)
+	}
+	for _, r := range plan.revocations {
+		phases[1] = append(phases[1], r)
+	}
+	for _, ros := range phases {
+		if len(ros) == 0 {
+			continue
+		}
+		if err := pubObjs(ros, cl, c); err != nil {
+			fmt.Println("Stopping, later steps depend on these objects:", err)
+			os.Exit(1)
+		}
+	}
+	for i := range plan.aliasKeys {
+		key, val := plan.aliasKeys[i], plan.aliasVals[i]
+		dchan := make(chan string, 1)
+		go func() {
+			if err := cl.CreateLongAlias(0, key, val); err != nil {
+				dchan <- "Error creating alias: " + err.Error()
+			} else {
+				dchan <- fmt.Sprintf("Alias %s created and confirmed", string(key))
+			}
+		}()
+		doChainOp(cl, dchan)
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/immesys/bw2/internal/audit"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/urfave/cli"
+)
+
+func auditTimeOrExit(c *cli.Context, name string) time.Time {
+	if c.String(name) == "" {
+		return time.Time{}
+	}
+	t, err := parseTimeArg(c.String(name))
+	if err != nil {
+		fmt.Printf("Bad --%s: %v\n", name, err)
+		os.Exit(1)
+	}
+	return t
+}
+
+func actionAudit(c *cli.Context) error {
+	fname := c.String("file")
+	if fname == "" {
+		fname = core.LoadConfig(c.String("conf")).Audit.File
+	}
+	if fname == "" {
+		fmt.Println("Auditing is not enabled, set File in the [audit] section of the config")
+		os.Exit(1)
+	}
+	entity := ""
+	if c.String("entity") != "" {
+		entity = vkOrEntityFile(c.String("entity"))
+	}
+	ns := c.String("ns")
+	from := auditTimeOrExit(c, "from")
+	to := auditTimeOrExit(c, "to")
+	count := 0
+	err := audit.Scan(fname, func(r *audit.Record) bool {
+		if entity != "" && r.OriginVK != entity {
+			return true
+		}
+		if ns != "" && r.Namespace != ns {
+			return true
+		}
+		if !from.IsZero() && r.Time.Before(from) {
+			return true
+		}
+		if !to.IsZero() && r.Time.After(to) {
+			return true
+		}
+		if c.Bool("rejected") && r.Accepted {
+			return true
+		}
+		count++
+		if c.Bool("json") {
+			line, _ := json.Marshal(r)
+			fmt.Println(string(line))
+			return true
+		}
+		result := "accepted"
+		if !r.Accepted {
+			result = fmt.Sprintf("rejected [%03d] %s", r.Code, r.Reason)
+		}
+		fmt.Printf("%s %-9s %s\n", r.Time.Format(time.RFC3339), r.Type, result)
+		fmt.Printf("  URI: %s\n", r.URI)
+		if r.OriginVK != "" {
+			fmt.Printf("  Origin: %s\n", r.OriginVK)
+		}
+		if r.PAC != "" {
+			fmt.Printf("  PAC: %s\n", r.PAC)
+		}
+		if len(r.DOTs) != 0 {
+			fmt.Printf("  DOTs: %s\n", strings.Join(r.DOTs, "\n        "))
+		}
+		return true
+	})
+	if err != nil {
+		fmt.Println("Could not read audit log:", err)
+		os.Exit(1)
+	}
+	if !c.Bool("json") {
+		fmt.Printf("%d matching records\n", count)
+	}
+	return nil
+}
@@ -466,6 +466,36 @@ func (bcc *bcClient) CallOnChain(ctx context.Context, acc int, ufi UFI, value, g
 	return bcc.Transact(ctx, acc, addr.Hex(), value, gas, gasPrice, calldata)
 }
 
+//EstimateCallOnChain returns the gas that CallOnChain would use with the
+//same arguments, without sending a transaction
+func (bcc *bcClient) EstimateCallOnChain(ctx context.Context, acc int, ufi UFI, value string, params ...interface{}) (*big.Int, error) {
+	to, calldata, err := EncodeABICall(ufi, params...)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.InvalidUFI, "Invalid on-chain UFI call args", err)
+	}
+	from, err := bcc.GetAddress(acc)
+	if err != nil {
+		return nil, err
+	}
+	if value == "" {
+		value = "0"
+	}
+	valb, ok := big.NewInt(0).SetString(value, 0)
+	if !ok {
+		return nil, bwe.M(bwe.InvalidUFI, "Invalid on-chain UFI call value")
+	}
+	egas, err := bcc.bc.api_contract.EstimateGas(ctx, ethereum.CallMsg{
+		From:  common.Address(from),
+		To:    &to,
+		Value: valb,
+		Data:  calldata,
+	})
+	if err != nil {
+		return nil, bwe.WrapM(bwe.InvalidUFI, "Invalid gas estimation", err)
+	}
+	return egas, nil
+}
+
 func (bcc *bcClient) signAndSendTransaction(ctx context.Context, accidx int, tx *types.Transaction) (common.Hash, error) {
 	var chainID *big.Int
 	var cfg *params.ChainConfig
@@ -78,6 +78,15 @@ type BlockChainClient interface {
 	//Sets a full alias on the chain. Note that you cannot collide with
 	//short aliases, so don't have too many leading zeroes.
 	SetAlias(ctx context.Context, acc int, key Bytes32, val Bytes32, confirmed func(err error))
+
+	//Estimate the gas CallOnChain would use, without calling it
+	EstimateCallOnChain(ctx context.Context, acc int, ufi UFI, value string, params ...interface{}) (*big.Int, error)
+
+	//Estimate the gas needed to publish an entity, DOT or revocation
+	EstimatePublish(ctx context.Context, acc int, ro objects.RoutingObject) (*big.Int, error)
+
+	//Estimate the gas and value SetAlias would spend
+	EstimateSetAlias(ctx context.Context, acc int, key Bytes32, val Bytes32) (gas *big.Int, value *big.Int, err error)
 }
 
 type BlockChainProvider interface {
@@ -166,6 +175,9 @@ type BlockChainProvider interface {
 	//Get all the dot hashes granted from a specific VK
 	ResolveDOTsFromVK(ctx context.Context, vk Bytes32) ([]Bytes32, error)
 
+	//Find the revocations published for the given DOT hashes and entity VKs
+	FindRevocations(ctx context.Context, targets [][]byte) ([]*objects.Revocation, error)
+
 	//Resolve a short alias returning its contents. Note that
 	ResolveShortAlias(ctx context.Context, alias uint64) (res Bytes32, iszero bool, err error)
 
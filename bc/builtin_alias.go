@@ -104,6 +104,19 @@ func (bcc *bcClient) CreateShortAlias(ctx context.Context, acc int, val Bytes32,
 		})
 }
 
+//EstimateSetAlias returns the gas and the value (in wei) that SetAlias would
+//spend
+func (bcc *bcClient) EstimateSetAlias(ctx context.Context, acc int, key Bytes32, val Bytes32) (gas *big.Int, value *big.Int, err error) {
+	gprice, err := bcc.bc.GasPrice(ctx)
+	if err != nil {
+		return nil, nil, bwe.WrapM(bwe.AliasError, "Gas error: ", err)
+	}
+	value = big.NewInt(AliasCreateLongCost)
+	value = value.Mul(value, gprice)
+	gas, err = bcc.EstimateCallOnChain(ctx, acc, StringToUFI(UFI_Alias_SetAlias), value.Text(10), key, val)
+	return gas, value, err
+}
+
 func (bcc *bcClient) SetAlias(ctx context.Context, acc int, key Bytes32, val Bytes32, confirmed func(err error)) {
 	if val.Zero() {
 		confirmed(bwe.M(bwe.AliasError, "You cannot create an alias to zero"))
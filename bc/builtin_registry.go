@@ -6,6 +6,7 @@ import (
 
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util/bwe"
+	"github.com/immesys/bw2bc/common"
 )
 
 const (
@@ -364,3 +365,62 @@ func (bc *blockChain) ResolveDOTsFromVK(ctx context.Context, vk Bytes32) ([]Byte
 		rv = append(rv, hash)
 	}
 }
+
+//FindRevocations scans the registry logs for the revocations of the given
+//DOT hashes and entity VKs
+func (bc *blockChain) FindRevocations(ctx context.Context, targets [][]byte) ([]*objects.Revocation, error) {
+	if len(targets) == 0 {
+		return nil, nil
+	}
+	tgts := make([]common.Hash, len(targets))
+	for i, t := range targets {
+		tgts[i] = common.Hash(SliceToBytes32(t))
+	}
+	lgs, err := bc.FindLogsBetweenHeavy(ctx, 0, -1, common.Address(HexToAddress(UFI_Registry_Address)),
+		[][]common.Hash{
+			[]common.Hash{common.Hash(HexToBytes32(EventSig_Registry_NewDOTRevocation)),
+				common.Hash(HexToBytes32(EventSig_Registry_NewEntityRevocation))}, //sig
+			tgts, //target
+		})
+	if err != nil {
+		return nil, bwe.WrapM(bwe.BlockChainGenericError, "Could not scan logs:", err)
+	}
+	rv := []*objects.Revocation{}
+	for _, lg := range lgs {
+		//The object is the only dynamic argument
+		data := lg.Data()
+		if len(data) < 64 {
+			continue
+		}
+		ln := new(big.Int).SetBytes(data[32:64]).Int64()
+		if ln < 0 || int64(len(data)) < 64+ln {
+			continue
+		}
+		ro, err := objects.LoadRoutingObject(objects.RORevocation, data[64:64+ln])
+		if err != nil {
+			continue
+		}
+		rv = append(rv, ro.(*objects.Revocation))
+	}
+	return rv, nil
+}
+
+//EstimatePublish returns the gas needed to publish the given entity, DOT or
+//revocation. Objects that depend on others (a DOT on its entities, a
+//revocation on its target) can only be estimated once those are published.
+func (bcc *bcClient) EstimatePublish(ctx context.Context, acc int, ro objects.RoutingObject) (*big.Int, error) {
+	switch o := ro.(type) {
+	case *objects.Entity:
+		return bcc.EstimateCallOnChain(ctx, acc, StringToUFI(UFI_Registry_AddEntity), "", o.GetContent())
+	case *objects.DOT:
+		return bcc.EstimateCallOnChain(ctx, acc, StringToUFI(UFI_Registry_AddDOT), "", o.GetContent())
+	case *objects.Revocation:
+		if ob, _, _ := bcc.bc.ResolveDOT(ctx, o.GetTarget()); ob != nil {
+			return bcc.EstimateCallOnChain(ctx, acc, StringToUFI(UFI_Registry_RevokeDOT), "",
+				SliceToBytes32(ob.GetHash()), o.GetContent())
+		}
+		return bcc.EstimateCallOnChain(ctx, acc, StringToUFI(UFI_Registry_RevokeEntity), "",
+			SliceToBytes32(o.GetTarget()), o.GetContent())
+	}
+	return nil, bwe.M(bwe.BadOperation, "cannot publish this object")
+}
@@ -38,6 +38,76 @@ func TestBoxEncrypt(t *testing.T) {
 	}
 }
 
+func TestBoxManyEd25519(t *testing.T) {
+	ent := objects.CreateNewEntity("", "", nil)
+	omsg := []byte("helloworld234234234234")
+	bx := NewBox(ent, omsg)
+	ents := []*objects.Entity{}
+	for i := 0; i < 3; i++ {
+		enti := objects.CreateNewEntity("", "", nil)
+		bx.AddEd25519Keyhole(enti.GetVK())
+		ents = append(ents, enti)
+	}
+	contents, err := bx.Encrypt()
+	if err != nil {
+		t.Fatalf("unexpected error %v\n", err)
+	}
+	for i, enti := range ents {
+		msg, err := DecryptBoxWithEd25519(contents, enti)
+		if err != nil {
+			t.Fatalf("recipient %d: unexpected error %v\n", i, err)
+		}
+		if !bytes.Equal(msg, omsg) {
+			t.Fatalf("recipient %d: Message did not match", i)
+		}
+	}
+	_, err = DecryptBoxWithEd25519(contents, objects.CreateNewEntity("", "", nil))
+	if err == nil {
+		t.Fatalf("expected a stranger to fail to open the box")
+	}
+}
+
+func TestBoxPayloadObject(t *testing.T) {
+	ent := objects.CreateNewEntity("", "", nil)
+	ent2 := objects.CreateNewEntity("", "", nil)
+	pub, priv := ibe.Setup(rand.Reader)
+	id := []byte("ns/some/topic")
+	po, err := objects.CreateOpaquePayloadObject(objects.PONumString, []byte("hi"))
+	if err != nil {
+		t.Fatalf("unexpected error %v\n", err)
+	}
+	bpo, err := BoxPayloadObject(ent, po, [][]byte{ent2.GetVK()}, pub, id)
+	if err != nil {
+		t.Fatalf("unexpected error %v\n", err)
+	}
+	if bpo.GetPONum() != objects.PONumBoxedPayload {
+		t.Fatalf("boxed PO has the wrong PO number")
+	}
+	bin, err := ExtractIdentity(pub, priv, id).MarshalBinary()
+	if err != nil {
+		t.Fatalf("unexpected error %v\n", err)
+	}
+	bxid, err := UnmarshalBoxIdentity(bin)
+	if err != nil {
+		t.Fatalf("unexpected error %v\n", err)
+	}
+	for _, tc := range []struct {
+		ent *objects.Entity
+		ids []*BoxIdentity
+	}{{ent2, nil}, {nil, []*BoxIdentity{bxid}}} {
+		opo, err := OpenPayloadObject(bpo, tc.ent, tc.ids)
+		if err != nil {
+			t.Fatalf("unexpected error %v\n", err)
+		}
+		if opo.GetPONum() != objects.PONumString || !bytes.Equal(opo.GetContent(), []byte("hi")) {
+			t.Fatalf("opened PO did not match")
+		}
+	}
+	if _, err := OpenPayloadObject(bpo, ent, nil); err == nil {
+		t.Fatalf("expected the owner without a keyhole to fail to open the box")
+	}
+}
+
 func BenchmarkEncryptBox_1_IBE(b *testing.B) {
 	ent := objects.CreateNewEntity("", "", nil)
 	omsg := []byte("helloworld234234234234")
@@ -376,6 +376,7 @@ func (bx *BW2Box) Encrypt() ([]byte, error) {
 	for i := 0; i < len(bx.ed25519Keyholes); i++ {
 		keyhole_ciphertext := bx.makeEd25519Keyhole(bx.ed25519Keyholes[i], ciphertext[:16])
 		copy(out[off:], keyhole_ciphertext)
+		off += ed25519keyholesize
 	}
 	return out, nil
 }
@@ -0,0 +1,109 @@
+package box
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+
+	"github.com/immesys/bw2/objects"
+
+	"vuvuzela.io/crypto/ibe"
+)
+
+//A boxed payload object is a box (PO number PONumBoxedPayload) whose
+//contents are:
+// [4: original PO number] [4: content length] [content] [zero padding]
+//The padding is only there to satisfy the minimum box size
+
+//IdentityForURI returns the IBE identity that payload objects published
+//to the URI are boxed for. It is the full topic, the same as core.Message.Topic
+func IdentityForURI(mvk []byte, suffix string) []byte {
+	return []byte(base64.URLEncoding.EncodeToString(mvk) + "/" + suffix)
+}
+
+const boxedHeaderSize = 8
+const minBoxContents = 16
+
+//BoxPayloadObject seals the payload object into a box owned by the given
+//entity. It can be opened by any of the given VKs, and by the holder of
+//the IBE identity key for ibeid under ibepub if ibepub is not nil.
+func BoxPayloadObject(owner *objects.Entity, po objects.PayloadObject, vks [][]byte, ibepub *ibe.MasterPublicKey, ibeid []byte) (objects.PayloadObject, error) {
+	if len(vks) == 0 && ibepub == nil {
+		return nil, errors.New("a boxed payload needs at least one recipient")
+	}
+	content := po.GetContent()
+	ln := boxedHeaderSize + len(content)
+	if ln < minBoxContents {
+		ln = minBoxContents
+	}
+	plaintext := make([]byte, ln)
+	binary.LittleEndian.PutUint32(plaintext[0:], uint32(po.GetPONum()))
+	binary.LittleEndian.PutUint32(plaintext[4:], uint32(len(content)))
+	copy(plaintext[boxedHeaderSize:], content)
+	bx := NewBox(owner, plaintext)
+	for _, vk := range vks {
+		bx.AddEd25519Keyhole(vk)
+	}
+	if ibepub != nil {
+		bx.AddIBEKeyhole(ibepub, ibeid)
+	}
+	ct, err := bx.Encrypt()
+	if err != nil {
+		return nil, err
+	}
+	return objects.CreateOpaquePayloadObject(objects.PONumBoxedPayload, ct)
+}
+
+//OpenPayloadObject recovers the original payload object from a boxed
+//payload object using the entity (if not nil) or any of the identities
+func OpenPayloadObject(po objects.PayloadObject, ent *objects.Entity, ids []*BoxIdentity) (objects.PayloadObject, error) {
+	if po.GetPONum() != objects.PONumBoxedPayload {
+		return nil, errors.New("this is not a boxed payload object")
+	}
+	var plaintext []byte
+	var err error = errors.New("No keyhole fits")
+	if ent != nil && ent.GetSK() != nil {
+		plaintext, err = DecryptBoxWithEd25519(po.GetContent(), ent)
+	}
+	for i := 0; err != nil && i < len(ids); i++ {
+		plaintext, err = DecryptBoxWithIBEK(po.GetContent(), ids[i])
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(plaintext) < boxedHeaderSize {
+		return nil, errors.New("boxed payload is truncated")
+	}
+	ponum := int(binary.LittleEndian.Uint32(plaintext[0:]))
+	ln := int(binary.LittleEndian.Uint32(plaintext[4:]))
+	if ln > len(plaintext)-boxedHeaderSize {
+		return nil, errors.New("boxed payload is truncated")
+	}
+	return objects.LoadPayloadObject(ponum, plaintext[boxedHeaderSize:boxedHeaderSize+ln])
+}
+
+//MarshalBinary encodes the identity so that it can be given to a
+//subscriber
+func (id *BoxIdentity) MarshalBinary() ([]byte, error) {
+	pk, err := id.pk.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]byte, 16+len(pk))
+	copy(rv[:16], id.fp[:])
+	copy(rv[16:], pk)
+	return rv, nil
+}
+
+//UnmarshalBoxIdentity decodes an identity encoded with MarshalBinary
+func UnmarshalBoxIdentity(data []byte) (*BoxIdentity, error) {
+	if len(data) <= 16 {
+		return nil, errors.New("identity is too short")
+	}
+	rv := &BoxIdentity{pk: new(ibe.IdentityPrivateKey)}
+	copy(rv.fp[:], data[:16])
+	if err := rv.pk.UnmarshalBinary(data[16:]); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
@@ -26,6 +26,7 @@ import (
 	"github.com/immesys/bw2/adapter/oob"
 	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/metrics"
 	"github.com/immesys/bw2/iptep"
 	"github.com/immesys/bw2/util"
 	"github.com/urfave/cli"
@@ -65,6 +66,21 @@ func main() {
 		Name:  "outfile, o",
 		Usage: "save the result to this file",
 	}
+	confflag := cli.StringFlag{
+		Name:  "conf",
+		Usage: "override the default config file",
+	}
+	dbFlags := []cli.Flag{
+		confflag,
+		cli.StringFlag{
+			Name:  "backend",
+			Usage: "the storage backend, defaults to the config",
+		},
+		cli.StringFlag{
+			Name:  "dbpath",
+			Usage: "the database, defaults to the config",
+		},
+	}
 	app.Commands = []cli.Command{
 		{
 			Name:   "router",
@@ -77,6 +93,172 @@ func main() {
 				},
 			},
 		},
+		{
+			Name:  "db",
+			Usage: "export, import or migrate the router database. Stop the router first, it holds the database open",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "export [OPTIONS] archive",
+					Action: cli.ActionFunc(actionDBExport),
+					Flags:  dbFlags,
+				},
+				{
+					Name:   "import",
+					Usage:  "import [OPTIONS] archive (into an empty database)",
+					Action: cli.ActionFunc(actionDBImport),
+					Flags:  dbFlags,
+				},
+				{
+					Name:   "verify",
+					Usage:  "verify [OPTIONS] archive (check the database contains the archive)",
+					Action: cli.ActionFunc(actionDBVerify),
+					Flags:  dbFlags,
+				},
+				{
+					Name:   "migrate",
+					Usage:  "copy the stopped router's database to another backend or location",
+					Action: cli.ActionFunc(actionDBMigrate),
+					Flags: []cli.Flag{
+						confflag,
+						cli.StringFlag{
+							Name:  "from-backend",
+							Usage: "the source storage backend, defaults to the config",
+						},
+						cli.StringFlag{
+							Name:  "from-dbpath",
+							Usage: "the source database, defaults to the config",
+						},
+						cli.StringFlag{
+							Name:  "to-backend",
+							Usage: "the destination storage backend",
+						},
+						cli.StringFlag{
+							Name:  "to-dbpath",
+							Usage: "the destination database",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:  "registry",
+			Usage: "export or import the registry objects relevant to namespaces",
+			Subcommands: []cli.Command{
+				{
+					Name:   "export",
+					Usage:  "export a signed snapshot of the entities, DOTs, chains, aliases and affinity of namespaces",
+					Action: cli.ActionFunc(actionRegistryExport),
+					Flags: []cli.Flag{
+						cli.StringSliceFlag{
+							Name:  "ns",
+							Usage: "the namespace VK, alias or entity file (can be repeated)",
+						},
+						cli.StringFlag{
+							Name:  "signer",
+							Usage: "an entity file to sign the snapshot with, defaults to the router entity",
+						},
+						oflag,
+					},
+				},
+				{
+					Name:   "import",
+					Usage:  "import snapshot... (preload the agent's resolution caches)",
+					Action: cli.ActionFunc(actionRegistryImport),
+				},
+			},
+		},
+		{
+			Name:   "unpinpeer",
+			Usage:  "unpinpeer router (forget the key pinned for a designated router that changed it)",
+			Action: cli.ActionFunc(actionUnpinPeer),
+		},
+		{
+			Name:   "renew",
+			Usage:  "renew dothash (publish a copy of the DOT that expires later)",
+			Action: cli.ActionFunc(actionRenew),
+			Flags: []cli.Flag{
+				bflag,
+				cli.StringFlag{
+					Name:   "from, f",
+					Usage:  "the giver's entity file, if it is not the bankroll",
+					Value:  "",
+					EnvVar: "BW2_DEFAULT_ENTITY",
+				},
+				cli.StringFlag{
+					Name:   "expiry, e",
+					Value:  "90d",
+					Usage:  "set the new expiry measured from now e.g. 3d7h20m",
+					EnvVar: "BW2_DEFAULT_EXPIRY",
+				},
+				cli.BoolFlag{
+					Name:  "revoke",
+					Usage: "revoke the old DOT once the new one is confirmed",
+				},
+			},
+		},
+		{
+			Name:   "expiring",
+			Usage:  "list the DOTs granted by or to an entity, and the entities, that expire soon",
+			Action: cli.ActionFunc(actionExpiring),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:   "entity, e",
+					Usage:  "the entity (VK, alias or entity file)",
+					Value:  "",
+					EnvVar: "BW2_DEFAULT_ENTITY",
+				},
+				cli.StringFlag{
+					Name:  "within",
+					Usage: "how far ahead to look, e.g. 30d",
+					Value: "30d",
+				},
+				cli.StringSliceFlag{
+					Name:  "ns",
+					Usage: "also look for DOTs to the entity on this namespace (can be repeated)",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the result as JSON",
+				},
+			},
+		},
+		{
+			Name:   "audit",
+			Usage:  "show the router's log of accepted and rejected operations",
+			Action: cli.ActionFunc(actionAudit),
+			Flags: []cli.Flag{
+				confflag,
+				cli.StringFlag{
+					Name:  "file",
+					Usage: "the audit log, defaults to the config",
+				},
+				cli.StringFlag{
+					Name:  "entity, e",
+					Usage: "only show operations by this entity (VK or entity file)",
+				},
+				cli.StringFlag{
+					Name:  "ns",
+					Usage: "only show operations on this namespace (VK)",
+				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "only show operations after this time (RFC3339 or a duration ago like 2h)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "only show operations before this time (RFC3339 or a duration ago like 2h)",
+				},
+				cli.BoolFlag{
+					Name:  "rejected",
+					Usage: "only show rejected operations",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the raw records",
+				},
+			},
+		},
 		// {
 		// 	Name:   "dtrig",
 		// 	Usage:  "if you ever see this, email michael, he messed up",
@@ -497,12 +679,76 @@ func main() {
 				},
 				cli.StringFlag{
 					Name:  "srv",
-					Usage: "the srv record e.g. 100.12.42.23:4514",
+					Usage: "the srv record e.g. 100.12.42.23:4514. Use 100.12.42.23:4514,mux://100.12.42.23:4515 to prefer the multiplexed transport",
 					Value: "",
 				},
 				bflag,
 			},
 		},
+		{
+			Name:   "explain",
+			Usage:  "explain why a DOT chain cannot be built",
+			Action: cli.ActionFunc(actionExplain),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "uri, u",
+					Usage: "the URI to build a chain for",
+					Value: "",
+				},
+				cli.StringFlag{
+					Name:  "permissions, x",
+					Usage: "the permissions the chain must grant",
+					Value: "PC",
+				},
+				cli.StringFlag{
+					Name:   "to, t",
+					Usage:  "the VK, alias or entity file to build a chain to",
+					Value:  "",
+					EnvVar: "BW2_DEFAULT_ENTITY",
+				},
+				cli.IntFlag{
+					Name:  "max",
+					Usage: "the number of partial chains to show",
+					Value: 10,
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "print the explanation as JSON",
+				},
+			},
+		},
+		{
+			Name:   "graph",
+			Usage:  "export the DOTs reachable from a namespace as a GraphViz graph",
+			Action: cli.ActionFunc(actionTrustGraph),
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "ns",
+					Usage: "the namespace VK, alias or entity file",
+				},
+				cli.StringFlag{
+					Name:  "filter, f",
+					Usage: "only include DOTs that grant on this URI subtree (without the namespace)",
+				},
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "export JSON instead of GraphViz",
+				},
+				oflag,
+			},
+		},
+		{
+			Name:   "apply",
+			Usage:  "apply [OPTIONS] policy.yaml (create, publish and revoke entities, DOTs and aliases to match it)",
+			Action: cli.ActionFunc(actionApply),
+			Flags: []cli.Flag{
+				bflag,
+				cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "print the plan and its cost without changing anything",
+				},
+			},
+		},
 		{
 			Name:    "buildchain",
 			Aliases: []string{"bc"},
@@ -529,6 +775,15 @@ func main() {
 					Name:  "verbose, v",
 					Usage: "print out the contents of the chains",
 				},
+				cli.StringSliceFlag{
+					Name:  "permission",
+					Value: &cli.StringSlice{},
+					Usage: "build a permission chain granting key=value (may be repeated)",
+				},
+				cli.StringFlag{
+					Name:  "authority",
+					Usage: "the entity a permission chain must start at",
+				},
 				cli.BoolFlag{
 					Name:  "publish, p",
 					Usage: "publish inspected objects to the registry",
@@ -560,6 +815,14 @@ func main() {
 					Value:  "",
 					EnvVar: "BW2_DEFAULT_ENTITY",
 				},
+				cli.StringFlag{
+					Name:  "from",
+					Usage: "return history from this time (RFC3339 or a duration ago like 2h)",
+				},
+				cli.StringFlag{
+					Name:  "to",
+					Usage: "return history up to this time (RFC3339 or a duration ago like 2h)",
+				},
 			},
 		},
 		{
@@ -618,6 +881,9 @@ func actionRouter(c *cli.Context) error {
 	} else {
 		fmt.Println("not starting oob server: no listen address")
 	}
+	if bw.Config.Metrics.ListenOn != "" {
+		go metrics.Start(bw.Config.Metrics.ListenOn)
+	}
 	<-shd
 	fmt.Printf("got shutdown\n")
 	return nil
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"encoding/base64"
 	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"math/big"
@@ -16,6 +17,7 @@ import (
 	"unicode/utf8"
 
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
@@ -505,6 +507,10 @@ func actionUSRV(c *cli.Context) error {
 		fmt.Println("'srv' parameter required")
 		os.Exit(1)
 	}
+	if _, err := api.ParseSRVRecord(srv); err != nil {
+		fmt.Println("Bad SRV record:", err)
+		os.Exit(1)
+	}
 	if c.String("dr") == "" {
 		fmt.Println("'dr' parameter required")
 		os.Exit(1)
@@ -883,7 +889,10 @@ func inspectInterface(ro objects.RoutingObject, cl *bw2bind.BW2Client) {
 func pubObj(topub objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Context) {
 	pubObjs([]objects.RoutingObject{topub}, cl, c)
 }
-func pubObjs(topubz []objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Context) {
+
+//pubObjs publishes the objects concurrently and returns an error if any of
+//them failed to publish
+func pubObjs(topubz []objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Context) error {
 	cl.SetEntity(getBankroll(c, cl))
 	dmsg := make(chan string, 1)
 	wg := sync.WaitGroup{}
@@ -927,6 +936,10 @@ func pubObjs(topubz []objects.RoutingObject, cl *bw2bind.BW2Client, c *cli.Conte
 		}(vv)
 	}
 	doChainOp(cl, dmsg)
+	if problem {
+		return fmt.Errorf("some objects failed to publish")
+	}
+	return nil
 }
 func doChainOp(cl *bw2bind.BW2Client, done chan string) {
 	cip, err := cl.GetBCInteractionParams()
@@ -1148,6 +1161,10 @@ func actionBuildChain(c *cli.Context) error {
 		os.Exit(1)
 	}
 
+	if len(c.StringSlice("permission")) != 0 {
+		return buildPermissionChain(c, cl, toVK)
+	}
+
 	uri := c.String("uri")
 	if uri == "" {
 		fmt.Println("Need a 'uri' parameter")
@@ -1189,6 +1206,130 @@ func actionBuildChain(c *cli.Context) error {
 	}
 	return nil
 }
+
+//buildPermissionChain is buildchain --permission. It talks to the agent
+//directly as the bindings do not support permission chains
+func buildPermissionChain(c *cli.Context, cl *bw2bind.BW2Client, toVK string) error {
+	if c.String("authority") == "" {
+		fmt.Println("Need an 'authority' parameter")
+		os.Exit(1)
+	}
+	authVK, ok := getEntityParamVK(cl, c, c.String("authority"))
+	if !ok {
+		fmt.Println("Could not parse 'authority' parameter")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	f := objects.CreateFrame(objects.CmdBuildPermChain, 0)
+	f.AddHeader("authority", authVK)
+	f.AddHeader("to", toVK)
+	for _, p := range c.StringSlice("permission") {
+		if !strings.Contains(p, "=") {
+			fmt.Printf("Bad permission '%s', expected key=value\n", p)
+			os.Exit(1)
+		}
+		f.AddHeader("permission", p)
+	}
+	topub := []objects.RoutingObject{}
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		grants := r.GetAllHeaders("grants")
+		for i, po := range r.POs {
+			roi, err := objects.LoadRoutingObject(objects.ROPermissionDChain, po.PO.GetContent())
+			if err != nil {
+				panic(err)
+			}
+			dc := roi.(*objects.DChain)
+			topub = append(topub, dc)
+			fmt.Println(ifstring(2)+" DChain hash=", crypto.FmtHash(dc.GetChainHash()))
+			fmt.Println(istring(2) + " Grants: " + grants[i])
+			for j := 0; j < dc.NumHashes(); j++ {
+				fmt.Printf(istring(2)+" DOT[%d]: %s\n", j, crypto.FmtHash(dc.GetDotHash(j)))
+				if c.Bool("verbose") {
+					dodot(dc.GetDotHash(j), 3, cl)
+				}
+			}
+			resetTerm()
+		}
+	})
+	if len(topub) == 0 {
+		fmt.Println("No chains found")
+		os.Exit(1)
+	}
+	if c.Bool("publish") {
+		pubObjs(topub, cl, c)
+	}
+	return nil
+}
+func actionExplain(c *cli.Context) error {
+	uri := c.String("uri")
+	if uri == "" {
+		fmt.Println("Need a 'uri' parameter")
+		os.Exit(1)
+	}
+	if c.String("to") == "" {
+		fmt.Println("Need a 'to' parameter")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	f := objects.CreateFrame(objects.CmdExplainChain, 0)
+	f.AddHeader("uri", uri)
+	f.AddHeader("accesspermissions", c.String("permissions"))
+	f.AddHeader("to", vkOrEntityFile(c.String("to")))
+	f.AddHeader("max", strconv.Itoa(c.Int("max")))
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		for _, po := range r.POs {
+			if c.Bool("json") {
+				fmt.Println(string(po.PO.GetContent()))
+				continue
+			}
+			ex := &api.Explanation{}
+			if err := json.Unmarshal(po.PO.GetContent(), ex); err != nil {
+				fmt.Println("Could not decode explanation:", err)
+				os.Exit(1)
+			}
+			fmt.Print(ex.String())
+		}
+	})
+	return nil
+}
+
+func actionTrustGraph(c *cli.Context) error {
+	if c.String("ns") == "" {
+		fmt.Println("Need a 'ns' parameter")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	f := objects.CreateFrame(objects.CmdTrustGraph, 0)
+	f.AddHeader("namespace", vkOrEntityFile(c.String("ns")))
+	if c.String("filter") != "" {
+		f.AddHeader("filter", c.String("filter"))
+	}
+	var out []byte
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		for _, po := range r.POs {
+			if c.Bool("json") {
+				out = po.PO.GetContent()
+				continue
+			}
+			g := &api.TrustGraph{}
+			if err := json.Unmarshal(po.PO.GetContent(), g); err != nil {
+				fmt.Println("Could not decode graph:", err)
+				os.Exit(1)
+			}
+			out = []byte(g.GraphViz())
+		}
+	})
+	if c.String("outfile") == "" {
+		fmt.Println(string(out))
+		return nil
+	}
+	if err := ioutil.WriteFile(c.String("outfile"), out, 0644); err != nil {
+		fmt.Println("Could not write graph:", err)
+		os.Exit(1)
+	}
+	return nil
+}
+
 func actionXfer(c *cli.Context) error {
 	if c.String("bankroll") == "" {
 		fmt.Println("Need bankroll to transfer from")
@@ -1314,6 +1455,10 @@ func actionQuery(c *cli.Context) error {
 		os.Exit(1)
 	}
 	cl.SetEntity(e.GetSigningBlob())
+	if c.String("from") != "" || c.String("to") != "" {
+		queryHistory(c, e)
+		return nil
+	}
 	wg := sync.WaitGroup{}
 	wg.Add(len(c.Args()))
 	for _, uri := range c.Args() {
@@ -1334,6 +1479,80 @@ func actionQuery(c *cli.Context) error {
 	return nil
 }
 
+//parseTimeArg parses an RFC3339 time or a duration before now
+func parseTimeArg(s string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, s); err == nil {
+		return t, nil
+	}
+	d, err := util.ParseDuration(s)
+	if err != nil || d == nil {
+		return time.Time{}, fmt.Errorf("expected an RFC3339 time or a duration like 2h")
+	}
+	return time.Now().Add(-*d), nil
+}
+
+//vkOrEntityFile returns the VK of the entity file (with or without the
+//signing key) at param, or param itself if there is no such file, for the
+//router to resolve
+func vkOrEntityFile(param string) string {
+	if e := loadSigningEntityFile(param); e != nil {
+		return crypto.FmtKey(e.GetVK())
+	}
+	if e := loadPublicEntityFile(param); e != nil {
+		return crypto.FmtKey(e.GetVK())
+	}
+	return param
+}
+
+//loadPublicEntityFile loads an entity file that does not contain the
+//signing key, such as one shared by another user
+func loadPublicEntityFile(fpath string) *objects.Entity {
+	contents, err := ioutil.ReadFile(fpath)
+	if err != nil || len(contents) == 0 {
+		return nil
+	}
+	if contents[0] != objects.ROEntity {
+		return nil
+	}
+	enti, err := objects.NewEntity(int(contents[0]), contents[1:])
+	if err != nil {
+		return nil
+	}
+	ent, ok := enti.(*objects.Entity)
+	if !ok {
+		return nil
+	}
+	return ent
+}
+
+func queryHistory(c *cli.Context, e *objects.Entity) {
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	ocl.setEntityOrExit(e)
+	for _, uri := range c.Args() {
+		f := objects.CreateFrame(objects.CmdQuery, 0)
+		f.AddHeader("uri", uri)
+		f.AddHeader("autochain", "true")
+		f.AddHeader("unpack", "true")
+		for _, bound := range []string{"from", "to"} {
+			if c.String(bound) == "" {
+				continue
+			}
+			t, err := parseTimeArg(c.String(bound))
+			if err != nil {
+				fmt.Printf("Bad --%s: %v\n", bound, err)
+				os.Exit(1)
+			}
+			f.AddHeader(bound, t.Format(time.RFC3339Nano))
+		}
+		ocl.requestOrExit(f, func(r *objects.Frame) {
+			if _, ok := r.GetFirstHeader("uri"); ok && r.Cmd == objects.CmdResult {
+				dumpFrame(r)
+				fmt.Println()
+			}
+		})
+	}
+}
+
 func actionMset(c *cli.Context) error {
 	bw2bind.SilenceLog()
 	cl := bw2bind.ConnectOrExit(c.GlobalString("agent"))
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/db"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/urfave/cli"
+)
+
+// openDBOrExit opens the database named by the given backend and path
+// flags. Flags that are not given are taken from the router config. A
+// running router holds its database locked, so it must be stopped first.
+func openDBOrExit(c *cli.Context, backendFlag string, pathFlag string) (db.BWDB, string) {
+	backend := c.String(backendFlag)
+	dbpath := c.String(pathFlag)
+	if dbpath == "" {
+		config := core.LoadConfig(c.String("conf"))
+		dbpath = config.Router.DB
+		if backend == "" {
+			backend = config.Router.DBBackend
+		}
+	}
+	if backend == "" {
+		backend = store.DefaultBackend
+	}
+	h, err := db.Open(backend, dbpath)
+	if err != nil {
+		fmt.Println("Could not open database:", err)
+		os.Exit(1)
+	}
+	return h, backend + ":" + dbpath
+}
+
+func countObjects(h db.BWDB) int {
+	n, _ := db.ExportArchive(h, ioutil.Discard)
+	return n
+}
+
+// pipeArchive streams an export of src into fn
+func pipeArchive(src db.BWDB, fn func(r io.Reader) (int, error)) (int, error) {
+	pr, pw := io.Pipe()
+	go func() {
+		_, err := db.ExportArchive(src, pw)
+		pw.CloseWithError(err)
+	}()
+	n, err := fn(pr)
+	pr.Close()
+	return n, err
+}
+
+func archiveArgOrExit(c *cli.Context) string {
+	if c.NArg() != 1 {
+		fmt.Println("Expected the archive file name")
+		os.Exit(1)
+	}
+	return c.Args().Get(0)
+}
+
+func actionDBExport(c *cli.Context) error {
+	fname := archiveArgOrExit(c)
+	h, name := openDBOrExit(c, "backend", "dbpath")
+	f, err := os.Create(fname)
+	if err != nil {
+		fmt.Println("Could not create archive:", err)
+		os.Exit(1)
+	}
+	n, err := db.ExportArchive(h, f)
+	if err == nil {
+		err = f.Close()
+	}
+	if err != nil {
+		fmt.Println("Export failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Exported %d objects from %s to %s\n", n, name, fname)
+	verifyArchiveFileOrExit(h, fname)
+	return nil
+}
+
+func verifyArchiveFileOrExit(h db.BWDB, fname string) {
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Println("Could not open archive:", err)
+		os.Exit(1)
+	}
+	defer f.Close()
+	n, err := db.VerifyArchive(h, f)
+	if err != nil {
+		fmt.Println("Verification failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Verified %d objects\n", n)
+}
+
+func actionDBImport(c *cli.Context) error {
+	fname := archiveArgOrExit(c)
+	f, err := os.Open(fname)
+	if err != nil {
+		fmt.Println("Could not open archive:", err)
+		os.Exit(1)
+	}
+	//Check the whole archive before writing anything
+	if _, err := db.CheckArchive(f); err != nil {
+		fmt.Println("Archive is damaged:", err)
+		os.Exit(1)
+	}
+	h, name := openDBOrExit(c, "backend", "dbpath")
+	if countObjects(h) != 0 {
+		fmt.Printf("Refusing to import into %s, it is not empty\n", name)
+		os.Exit(1)
+	}
+	f.Seek(0, 0)
+	n, err := db.ImportArchive(h, f)
+	f.Close()
+	if err != nil {
+		fmt.Println("Import failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Imported %d objects from %s into %s\n", n, fname, name)
+	verifyArchiveFileOrExit(h, fname)
+	return nil
+}
+
+func actionDBMigrate(c *cli.Context) error {
+	if c.String("to-dbpath") == "" {
+		fmt.Println("Specify the destination with --to-dbpath")
+		os.Exit(1)
+	}
+	src, srcname := openDBOrExit(c, "from-backend", "from-dbpath")
+	dst, dstname := openDBOrExit(c, "to-backend", "to-dbpath")
+	if srcname == dstname {
+		fmt.Println("The source and destination are the same")
+		os.Exit(1)
+	}
+	if countObjects(dst) != 0 {
+		fmt.Printf("Refusing to migrate into %s, it is not empty\n", dstname)
+		os.Exit(1)
+	}
+	n, err := pipeArchive(src, func(r io.Reader) (int, error) {
+		return db.ImportArchive(dst, r)
+	})
+	if err != nil {
+		fmt.Println("Migration failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Copied %d objects from %s to %s\n", n, srcname, dstname)
+	vn, err := pipeArchive(src, func(r io.Reader) (int, error) {
+		return db.VerifyArchive(dst, r)
+	})
+	if err == nil && countObjects(dst) != vn {
+		err = fmt.Errorf("destination has extra objects")
+	}
+	if err != nil {
+		fmt.Println("Verification failed:", err)
+		os.Exit(1)
+	}
+	fmt.Printf("Verified %d objects\n", vn)
+	fmt.Println("Update DB and DBBackend in the [router] section of your config to use the new database")
+	return nil
+}
+
+func actionDBVerify(c *cli.Context) error {
+	fname := archiveArgOrExit(c)
+	h, name := openDBOrExit(c, "backend", "dbpath")
+	fmt.Printf("Checking %s against %s\n", fname, name)
+	verifyArchiveFileOrExit(h, fname)
+	return nil
+}
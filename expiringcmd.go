@@ -0,0 +1,52 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/immesys/bw2/api"
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+// actionExpiring lists the DOTs granted by or to an entity, and the
+// entities at either end of them, that expire within the given time
+func actionExpiring(c *cli.Context) error {
+	if c.String("entity") == "" {
+		fmt.Println("Need an 'entity' parameter")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	f := objects.CreateFrame(objects.CmdListExpiring, 0)
+	f.AddHeader("vk", vkOrEntityFile(c.String("entity")))
+	f.AddHeader("within", c.String("within"))
+	for _, ns := range c.StringSlice("ns") {
+		f.AddHeader("ns", vkOrEntityFile(ns))
+	}
+	var warnings []*api.ExpiryWarning
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		for _, po := range r.POs {
+			if po.PO.GetPONum() != objects.PONumJSON {
+				continue
+			}
+			if err := json.Unmarshal(po.PO.GetContent(), &warnings); err != nil {
+				fmt.Println("Could not decode the response:", err)
+				os.Exit(1)
+			}
+		}
+	})
+	if c.Bool("json") {
+		js, _ := json.MarshalIndent(warnings, "", "  ")
+		fmt.Println(string(js))
+		return nil
+	}
+	if len(warnings) == 0 {
+		fmt.Println("Nothing expires within", c.String("within"))
+		return nil
+	}
+	for _, w := range warnings {
+		fmt.Println(w)
+	}
+	return nil
+}
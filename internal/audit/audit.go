@@ -0,0 +1,181 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package audit keeps an append only log of access decisions. Each decision
+//is one JSON object per line. When the file reaches its maximum size it is
+//rotated to file.1, file.1 to file.2 and so on.
+package audit
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+)
+
+//Record is a single access decision
+type Record struct {
+	Time      time.Time `json:"time"`
+	Accepted  bool      `json:"accepted"`
+	Type      string    `json:"type"`
+	OriginVK  string    `json:"origin_vk,omitempty"`
+	Namespace string    `json:"namespace"`
+	URI       string    `json:"uri"`
+	PAC       string    `json:"pac,omitempty"`
+	DOTs      []string  `json:"dots,omitempty"`
+	Code      int       `json:"code,omitempty"`
+	Reason    string    `json:"reason,omitempty"`
+}
+
+var mu sync.Mutex
+var out *os.File
+var fname string
+var size int64
+var maxSize int64
+var keep int
+var publisher func(r *Record, line []byte)
+
+//Open starts logging to the given file. The file is rotated when it grows
+//past maxSize bytes, and at most keep rotated files are kept.
+func Open(filename string, maxsize int64, maxfiles int) error {
+	mu.Lock()
+	defer mu.Unlock()
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	out = f
+	fname = filename
+	size = st.Size()
+	maxSize = maxsize
+	keep = maxfiles
+	return nil
+}
+
+//Enabled returns true if decisions are being logged
+func Enabled() bool {
+	mu.Lock()
+	defer mu.Unlock()
+	return out != nil
+}
+
+//SetPublisher sets a function that is given every record after it is
+//written. It is called with the log locked, so it must not block.
+func SetPublisher(fn func(r *Record, line []byte)) {
+	mu.Lock()
+	publisher = fn
+	mu.Unlock()
+}
+
+//Log appends a record to the audit log
+func Log(r *Record) {
+	line, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("could not encode audit record: %v", err)
+		return
+	}
+	line = append(line, '\n')
+	mu.Lock()
+	defer mu.Unlock()
+	if out == nil {
+		return
+	}
+	if maxSize > 0 && size > 0 && size+int64(len(line)) > maxSize {
+		rotate()
+	}
+	n, err := out.Write(line)
+	size += int64(n)
+	if err != nil {
+		log.Errorf("could not write audit log: %v", err)
+	}
+	if publisher != nil {
+		publisher(r, line)
+	}
+}
+
+func rotatedName(filename string, i int) string {
+	return fmt.Sprintf("%s.%d", filename, i)
+}
+
+//must be called with mu held
+func rotate() {
+	out.Close()
+	if keep > 0 {
+		os.Remove(rotatedName(fname, keep))
+		for i := keep - 1; i >= 1; i-- {
+			os.Rename(rotatedName(fname, i), rotatedName(fname, i+1))
+		}
+		os.Rename(fname, rotatedName(fname, 1))
+	} else {
+		os.Remove(fname)
+	}
+	f, err := os.OpenFile(fname, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		log.Criticalf("could not reopen audit log, auditing stopped: %v", err)
+		out = nil
+		return
+	}
+	out = f
+	size = 0
+}
+
+//Scan calls fn for every record in the log and its rotated files, oldest
+//first, until fn returns false
+func Scan(filename string, fn func(r *Record) bool) error {
+	names := []string{}
+	for i := 1; ; i++ {
+		if _, err := os.Stat(rotatedName(filename, i)); err != nil {
+			break
+		}
+		names = append([]string{rotatedName(filename, i)}, names...)
+	}
+	names = append(names, filename)
+	for _, name := range names {
+		f, err := os.Open(name)
+		if err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 16*1024*1024)
+		for sc.Scan() {
+			r := &Record{}
+			if err := json.Unmarshal(sc.Bytes(), r); err != nil {
+				f.Close()
+				return fmt.Errorf("%s: %v", name, err)
+			}
+			if !fn(r) {
+				f.Close()
+				return nil
+			}
+		}
+		err = sc.Err()
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package audit_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/audit"
+)
+
+func TestRotateAndScan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	fname := path.Join(dir, "audit.log")
+	//Small enough that a few records fill a file
+	if err := audit.Open(fname, 1024, 2); err != nil {
+		t.Fatal(err)
+	}
+	if !audit.Enabled() {
+		t.Fatal("expected the log to be enabled")
+	}
+	published := 0
+	audit.SetPublisher(func(r *audit.Record, line []byte) {
+		published++
+	})
+	const total = 100
+	for i := 0; i < total; i++ {
+		audit.Log(&audit.Record{
+			Time:      time.Now(),
+			Accepted:  i%2 == 0,
+			Type:      "publish",
+			Namespace: "ns",
+			URI:       fmt.Sprintf("ns/a/%d", i),
+		})
+	}
+	if published != total {
+		t.Fatalf("published %d records, expected %d", published, total)
+	}
+	if _, err := os.Stat(fname + ".2"); err != nil {
+		t.Fatalf("expected two rotated files: %v", err)
+	}
+	if _, err := os.Stat(fname + ".3"); err == nil {
+		t.Fatal("expected at most two rotated files")
+	}
+	//The oldest records are gone, but the rest must come back in order
+	last := -1
+	count := 0
+	err = audit.Scan(fname, func(r *audit.Record) bool {
+		var i int
+		fmt.Sscanf(r.URI, "ns/a/%d", &i)
+		if i <= last {
+			t.Fatalf("record %d came after %d", i, last)
+		}
+		last = i
+		count++
+		return true
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last != total-1 {
+		t.Fatalf("last record was %d, expected %d", last, total-1)
+	}
+	if count == 0 || count == total {
+		t.Fatalf("scanned %d records, expected some to have been rotated away", count)
+	}
+}
@@ -32,16 +32,48 @@ type BWConfig struct {
 		Version int
 	}
 	Router struct {
-		Entity  string
-		DB      string
-		LogPath string
+		Entity    string
+		DB        string
+		DBBackend string
+		LogPath   string
 	}
 	Native struct {
-		ListenOn string
+		ListenOn    string
+		MuxListenOn string
+		CertFile    string
+		CertPinning string
 	}
 	OOB struct {
 		ListenOn string
 	}
+	Metrics struct {
+		ListenOn    string
+		PrefixDepth int
+	}
+	History struct {
+		Enabled  bool
+		MaxCount int
+		MaxAge   string
+	}
+	Audit struct {
+		File       string
+		MaxSize    int
+		MaxFiles   int
+		PublishURI string
+	}
+	Offline struct {
+		Snapshot       string
+		TrustedSigners string
+		Checkpoint     string
+	}
+	KeyAuthority struct {
+		Namespace string
+		KeyFile   string
+	}
+	Expiry struct {
+		WarnDays  int
+		StatusURI string
+	}
 	Altruism struct {
 		MaxLightPeers              int
 		MaxLightResourcePercentage int
@@ -0,0 +1,217 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package core
+
+// A durable queue writes every message to the store before it is handed
+// to the consumer, and only removes it when the consumer acknowledges it.
+// Recent messages are also kept in memory so the common case does not
+// touch the store on the read side. When the memory queue fills up, the
+// queue "spills": new messages are only written to the store and the
+// drain loop reads them back in order once the memory queue is empty.
+// Unacknowledged messages are delivered again the next time a queue with
+// the same name is opened, so delivery is at-least-once. The queue is only
+// kept for that if its client went away; it is removed from the store when
+// the subscription is unsubscribed or terminated.
+
+import (
+	"sync"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/util/bwe"
+	"golang.org/x/net/context"
+)
+
+//How many messages a durable queue keeps in memory before spilling
+const durableMemDepth = 1024
+
+//How many messages are read from the store at a time when draining
+const durableDrainBatch = 256
+
+type queuedMessage struct {
+	seq uint64
+	m   *Message
+}
+
+//DurableQueue is a message queue that survives slow consumers and
+//router restarts
+type DurableQueue struct {
+	name    string
+	tm      *Terminus
+	mu      sync.Mutex
+	head    uint64
+	spilled bool
+	mem     chan queuedMessage
+	notify  chan struct{}
+	ctx     context.Context
+	handler func(m *Message)
+	//Set when the subscription was ended rather than its client going
+	//away, so that the backlog is removed when the queue closes
+	discard bool
+	closed  bool
+}
+
+//OpenDurableQueue creates (or reopens) the named queue. Messages that were
+//not acknowledged before the queue was last closed are delivered first.
+//The handler is called with a copy of the message with QueueSeq set, and
+//with nil when ctx is cancelled. Only one instance of a queue may be open
+//at a time.
+func (tm *Terminus) OpenDurableQueue(ctx context.Context, name string, handler func(m *Message)) (*DurableQueue, error) {
+	tm.dq_lock.Lock()
+	defer tm.dq_lock.Unlock()
+	if _, ok := tm.dqueues[name]; ok {
+		return nil, bwe.M(bwe.DurableQueueError, "durable queue is already in use")
+	}
+	dq := &DurableQueue{
+		name:    name,
+		tm:      tm,
+		head:    store.GetQueueHead(name),
+		mem:     make(chan queuedMessage, durableMemDepth),
+		notify:  make(chan struct{}, 1),
+		ctx:     ctx,
+		handler: handler,
+	}
+	//Always start by draining whatever is left in the store
+	dq.spilled = true
+	tm.dqueues[name] = dq
+	go dq.drain()
+	return dq, nil
+}
+
+//Enqueue adds a message to the queue. It never blocks on the consumer
+func (dq *DurableQueue) Enqueue(m *Message) {
+	dq.mu.Lock()
+	if dq.closed {
+		dq.mu.Unlock()
+		return
+	}
+	seq := dq.head
+	dq.head++
+	store.EnqueueMessage(dq.name, seq, m.Encoded)
+	if !dq.spilled {
+		select {
+		case dq.mem <- queuedMessage{seq: seq, m: m}:
+		default:
+			log.Infof("durable queue %s spilling to disk", dq.name)
+			dq.spilled = true
+		}
+	}
+	dq.mu.Unlock()
+	select {
+	case dq.notify <- struct{}{}:
+	default:
+	}
+}
+
+//Ack acknowledges a message so that it will not be delivered again
+func (dq *DurableQueue) Ack(seq uint64) error {
+	if !store.AckQueueMessage(dq.name, seq) {
+		return bwe.M(bwe.DurableQueueError, "no such message in queue")
+	}
+	return nil
+}
+
+func (dq *DurableQueue) deliver(seq uint64, m *Message) {
+	mc := *m
+	mc.QueueSeq = seq
+	dq.handler(&mc)
+}
+
+//Discard marks the queue to be removed from the store when it closes,
+//instead of being kept for the next subscription with the same name
+func (dq *DurableQueue) Discard() {
+	dq.mu.Lock()
+	dq.discard = true
+	dq.mu.Unlock()
+}
+
+func (dq *DurableQueue) drain() {
+	var next uint64
+	defer func() {
+		dq.tm.dq_lock.Lock()
+		dq.mu.Lock()
+		dq.closed = true
+		if dq.discard {
+			store.DeleteQueue(dq.name)
+		}
+		dq.mu.Unlock()
+		delete(dq.tm.dqueues, dq.name)
+		dq.tm.dq_lock.Unlock()
+		dq.handler(nil)
+	}()
+	for {
+		if dq.ctx.Err() != nil {
+			return
+		}
+		dq.mu.Lock()
+		replay := dq.spilled && len(dq.mem) == 0
+		dq.mu.Unlock()
+		if replay {
+			batch := store.GetQueueMessages(dq.name, next, durableDrainBatch)
+			for _, qm := range batch {
+				if dq.ctx.Err() != nil {
+					return
+				}
+				m, err := LoadMessage(qm.Body)
+				if err != nil {
+					log.Criticalf("dropping corrupt message %d in durable queue %s: %v", qm.Seq, dq.name, err)
+					store.AckQueueMessage(dq.name, qm.Seq)
+				} else {
+					dq.deliver(qm.Seq, m)
+				}
+				next = qm.Seq + 1
+			}
+			if len(batch) < durableDrainBatch {
+				//We have caught up with the store. If nothing was enqueued
+				//while we were reading it, we can go back to memory
+				dq.mu.Lock()
+				if len(store.GetQueueMessages(dq.name, next, 1)) == 0 {
+					dq.spilled = false
+				}
+				dq.mu.Unlock()
+			}
+			continue
+		}
+		select {
+		case <-dq.ctx.Done():
+			return
+		case qm := <-dq.mem:
+			//Anything below next was already delivered during a replay
+			if qm.seq >= next {
+				dq.deliver(qm.seq, qm.m)
+				next = qm.seq + 1
+			}
+		case <-dq.notify:
+		}
+	}
+}
+
+//AckDurable acknowledges a message in the named durable queue
+func (tm *Terminus) AckDurable(name string, seq uint64) error {
+	tm.dq_lock.Lock()
+	dq, ok := tm.dqueues[name]
+	tm.dq_lock.Unlock()
+	if ok {
+		return dq.Ack(seq)
+	}
+	//The queue need not be open to acknowledge its messages
+	if !store.AckQueueMessage(name, seq) {
+		return bwe.M(bwe.DurableQueueError, "no such message in queue")
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package core_test
+
+import (
+	"context"
+	"encoding/base64"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/store"
+	"github.com/immesys/bw2/objects"
+)
+
+//mkPub returns an encoded publish message on suffix in ns's namespace
+func mkPub(t *testing.T, ns *objects.Entity, suffix string, body string) *core.Message {
+	po, err := objects.CreateOpaquePayloadObject(1, []byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &core.Message{
+		Type:           core.TypePublish,
+		MVK:            ns.GetVK(),
+		TopicSuffix:    suffix,
+		Topic:          base64.URLEncoding.EncodeToString(ns.GetVK()) + "/" + suffix,
+		PayloadObjects: []objects.PayloadObject{po},
+	}
+	m.Encode(ns.GetSK(), ns.GetVK())
+	return m
+}
+
+//subscribeDurable subscribes to topic through the durable queue until ctx
+//is done and returns the delivered messages, which end with nil when the
+//queue closes
+func subscribeDurable(t *testing.T, ctx context.Context, cl *core.Client, topic string, queue string) (core.UniqueMessageID, chan *core.Message) {
+	got := make(chan *core.Message, 100)
+	sub := mkSub(topic)
+	subid, err := cl.SubscribeDurable(ctx, sub, queue, func(m *core.Message) {
+		got <- m
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return subid, got
+}
+
+//expect reads the bodies of the next messages in got
+func expect(t *testing.T, got chan *core.Message, bodies ...string) []*core.Message {
+	rv := []*core.Message{}
+	for _, b := range bodies {
+		select {
+		case m := <-got:
+			if m == nil {
+				t.Fatalf("queue closed, expected %q", b)
+			}
+			if body := string(m.PayloadObjects[0].GetContent()); body != b {
+				t.Fatalf("expected %q, got %q", b, body)
+			}
+			rv = append(rv, m)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("did not get %q", b)
+		}
+	}
+	return rv
+}
+
+func expectClosed(t *testing.T, got chan *core.Message) {
+	select {
+	case m := <-got:
+		if m != nil {
+			t.Fatalf("expected the queue to close, got %q", m.PayloadObjects[0].GetContent())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("queue did not close")
+	}
+}
+
+func TestDurableRedelivery(t *testing.T) {
+	if err := store.Initialize("memory", ""); err != nil {
+		t.Fatal(err)
+	}
+	tm := core.CreateTerminus()
+	ns := objects.CreateNewEntity("", "", nil)
+	topic := base64.URLEncoding.EncodeToString(ns.GetVK()) + "/a"
+	pubcl := tm.CreateClient(context.Background(), "publisher")
+
+	ctx, disconnect := context.WithCancel(context.Background())
+	cl := tm.CreateClient(ctx, "first")
+	_, got := subscribeDurable(t, ctx, cl, topic, "q")
+	for _, b := range []string{"one", "two", "three"} {
+		pubcl.Publish(mkPub(t, ns, "a", b))
+	}
+	ms := expect(t, got, "one", "two", "three")
+	if err := cl.AckDurable("q", ms[0].QueueSeq); err != nil {
+		t.Fatal(err)
+	}
+	if err := cl.AckDurable("q", ms[0].QueueSeq); err == nil {
+		t.Fatal("a message was acknowledged twice")
+	}
+	disconnect()
+	expectClosed(t, got)
+
+	//While no one is subscribed, messages are not queued
+	pubcl.Publish(mkPub(t, ns, "a", "missed"))
+
+	//The unacknowledged messages are delivered again after a reconnect
+	cl = tm.CreateClient(context.Background(), "second")
+	subid, got := subscribeDurable(t, context.Background(), cl, topic, "q")
+	again := expect(t, got, "two", "three")
+	if again[0].QueueSeq != ms[1].QueueSeq || again[1].QueueSeq != ms[2].QueueSeq {
+		t.Fatalf("redelivered with different sequence numbers")
+	}
+	pubcl.Publish(mkPub(t, ns, "a", "four"))
+	expect(t, got, "four")
+
+	//Unsubscribing removes the queue
+	if err := cl.Unsubscribe(subid); err != nil {
+		t.Fatal(err)
+	}
+	expectClosed(t, got)
+	if store.GetQueueHead("q") != 0 || len(store.GetQueueMessages("q", 0, 10)) != 0 {
+		t.Fatal("queue was kept after unsubscribing")
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	_, got = subscribeDurable(t, ctx, cl, topic, "q")
+	select {
+	case m := <-got:
+		t.Fatalf("removed queue delivered %v", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	cancel()
+	expectClosed(t, got)
+}
@@ -0,0 +1,317 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package core
+
+// Access DOTs may carry PublishLimits. The designated router meters every
+// publish and persist against each DOT in the access chain that has them.
+// Bandwidth is a token bucket per DOT that holds txLimitWindow worth of
+// TxLimit. Stored bytes are the size of the latest persisted message on
+// each topic, charged to the limited DOTs of the chain that persisted it,
+// until that message expires. Older messages kept in the history are not
+// charged, the history of a topic is bounded by Retain instead. Usage is only kept in memory, so it starts
+// again from zero when the router restarts, and a DOT that has not been
+// used for limitIdle and has nothing stored is forgotten.
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//How much unused bandwidth a DOT can save up for a burst
+const txLimitWindow = 10 * time.Second
+
+//How long a DOT's usage is kept after it was last used
+const limitIdle = 10 * time.Minute
+
+//How often idle DOTs and expired stored messages are swept
+const limitSweepInterval = time.Minute
+
+//LimitUsage is the usage metered against a DOT with PublishLimits
+type LimitUsage struct {
+	DOT        string `json:"dot"`
+	TxLimit    int64  `json:"txlimit"`
+	StoreLimit int64  `json:"storelimit"`
+	Retain     int    `json:"retain"`
+	//Bytes published via the DOT since the router started
+	TxBytes int64 `json:"txbytes"`
+	//Bytes that may be published right now
+	TxAvailable int64 `json:"txavailable"`
+	StoredBytes int64 `json:"storedbytes"`
+	Rejected    int64 `json:"rejected"`
+}
+
+type dotUsage struct {
+	hash     []byte
+	lim      *objects.PublishLimits
+	tokens   float64
+	refilled time.Time
+	txbytes  int64
+	stored   int64
+	rejected int64
+	used     time.Time
+}
+
+type storedCharge struct {
+	dots    []string
+	size    int64
+	expires time.Time
+}
+
+func (sc *storedCharge) has(hash string) bool {
+	for _, h := range sc.dots {
+		if h == hash {
+			return true
+		}
+	}
+	return false
+}
+
+type limitMeter struct {
+	mu     sync.Mutex
+	dots   map[string]*dotUsage
+	topics map[string]*storedCharge
+	swept  time.Time
+	now    func() time.Time
+}
+
+func newLimitMeter() *limitMeter {
+	return &limitMeter{
+		dots:   make(map[string]*dotUsage),
+		topics: make(map[string]*storedCharge),
+		now:    time.Now,
+	}
+}
+
+//usage returns the usage for the DOT with its bandwidth allowance brought
+//up to date. The meter must be locked.
+func (lm *limitMeter) usage(d *objects.DOT, now time.Time) *dotUsage {
+	hash := crypto.FmtHash(d.GetHash())
+	lim := d.GetPublishLimits()
+	u, ok := lm.dots[hash]
+	if !ok {
+		u = &dotUsage{hash: d.GetHash(), lim: lim, refilled: now}
+		u.tokens = float64(lim.TxLimit) * txLimitWindow.Seconds()
+		lm.dots[hash] = u
+	}
+	if lim.TxLimit > 0 {
+		u.tokens += now.Sub(u.refilled).Seconds() * float64(lim.TxLimit)
+		if full := float64(lim.TxLimit) * txLimitWindow.Seconds(); u.tokens > full {
+			u.tokens = full
+		}
+	}
+	u.refilled = now
+	return u
+}
+
+//release uncharges the stored message on a topic from its DOTs. The meter
+//must be locked.
+func (lm *limitMeter) release(topic string) {
+	sc, ok := lm.topics[topic]
+	if !ok {
+		return
+	}
+	for _, h := range sc.dots {
+		if u, ok := lm.dots[h]; ok {
+			u.stored -= sc.size
+		}
+	}
+	delete(lm.topics, topic)
+}
+
+//sweep releases stored messages that have expired and forgets DOTs that
+//have been idle for limitIdle. The meter must be locked.
+func (lm *limitMeter) sweep(now time.Time) {
+	if now.Sub(lm.swept) < limitSweepInterval {
+		return
+	}
+	lm.swept = now
+	for topic, sc := range lm.topics {
+		if sc.expires.Before(now) {
+			lm.release(topic)
+		}
+	}
+	for hash, u := range lm.dots {
+		if u.stored <= 0 && now.Sub(u.used) > limitIdle {
+			delete(lm.dots, hash)
+		}
+	}
+}
+
+//limitedDOTs returns the DOTs in the message's access chain that have
+//PublishLimits
+func limitedDOTs(m *Message, res Resolver) ([]*objects.DOT, error) {
+	pac := m.PrimaryAccessChain
+	if pac == nil {
+		return nil, nil
+	}
+	pac = ElaborateDChain(pac, res)
+	if pac == nil {
+		return nil, bwe.M(bwe.Unresolvable, "could not elaborate the PAC hash")
+	}
+	var rv []*objects.DOT
+	for i := 0; i < pac.NumHashes(); i++ {
+		d := pac.GetDOT(i)
+		if d == nil {
+			var err error
+			d, _, err = res.ResolveDOT(pac.GetDotHash(i))
+			if err != nil {
+				return nil, bwe.WrapM(bwe.Unresolvable, "Could not resolve PAC DOT", err)
+			}
+		}
+		if d.GetPublishLimits() != nil {
+			rv = append(rv, d)
+		}
+	}
+	return rv, nil
+}
+
+func (lm *limitMeter) charge(m *Message, dots []*objects.DOT) error {
+	size := int64(len(m.Encoded))
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	now := lm.now()
+	lm.sweep(now)
+	prev := lm.topics[m.Topic]
+	usages := make([]*dotUsage, len(dots))
+	hashes := make([]string, len(dots))
+	retain := 0
+	//Check every DOT before charging any of them
+	for i, d := range dots {
+		u := lm.usage(d, now)
+		hash := crypto.FmtHash(u.hash)
+		usages[i], hashes[i] = u, hash
+		u.used = now
+		//It would never fit in the bucket, so don't make the client wait
+		if u.lim.TxLimit > 0 && float64(size) > float64(u.lim.TxLimit)*txLimitWindow.Seconds() {
+			u.rejected++
+			return bwe.M(bwe.PublishLimitExceeded, fmt.Sprintf("message is larger than the %d byte burst DOT %s allows",
+				int64(float64(u.lim.TxLimit)*txLimitWindow.Seconds()), hash))
+		}
+		if u.lim.TxLimit > 0 && u.tokens < float64(size) {
+			u.rejected++
+			return bwe.M(bwe.PublishLimitExceeded, fmt.Sprintf("DOT %s allows %d bytes per second", hash, u.lim.TxLimit))
+		}
+		if m.Type == TypePersist && u.lim.StoreLimit > 0 {
+			stored := u.stored + size
+			if prev != nil && prev.has(hash) {
+				stored -= prev.size
+			}
+			if stored > u.lim.StoreLimit {
+				u.rejected++
+				return bwe.M(bwe.PublishLimitExceeded, fmt.Sprintf("DOT %s allows %d bytes to be persisted", hash, u.lim.StoreLimit))
+			}
+		}
+		if u.lim.Retain > 0 && (retain == 0 || u.lim.Retain < retain) {
+			retain = u.lim.Retain
+		}
+	}
+	for _, u := range usages {
+		if u.lim.TxLimit > 0 {
+			u.tokens -= float64(size)
+		}
+		u.txbytes += size
+	}
+	if m.Type != TypePersist {
+		return nil
+	}
+	//The new message replaces whatever was persisted on the topic
+	lm.release(m.Topic)
+	if len(usages) != 0 {
+		for _, u := range usages {
+			u.stored += size
+		}
+		lm.topics[m.Topic] = &storedCharge{dots: hashes, size: size, expires: m.ExpireTime}
+	}
+	m.retain = retain
+	return nil
+}
+
+//ChargeLimits meters a publish or persist against the PublishLimits of the
+//DOTs in its access chain. If any limit would be exceeded nothing is
+//charged and a PublishLimitExceeded error is returned. It should be called
+//by the designated router just before the message is delivered.
+func (cl *Client) ChargeLimits(m *Message, res Resolver) error {
+	if m.Type != TypePublish && m.Type != TypePersist {
+		return nil
+	}
+	dots, err := limitedDOTs(m, res)
+	if err != nil {
+		m.Audit(err)
+		return err
+	}
+	//A persist may still need to release what the topic was charged before
+	if len(dots) == 0 && m.Type == TypePublish {
+		return nil
+	}
+	if err := cl.tm.limits.charge(m, dots); err != nil {
+		m.Audit(err)
+		return err
+	}
+	return nil
+}
+
+//LimitUsage returns the usage of the given DOTs, or of every DOT that has
+//been metered if none are given. DOTs that have not been used are omitted.
+func (tm *Terminus) LimitUsage(dothashes ...[]byte) []*LimitUsage {
+	lm := tm.limits
+	lm.mu.Lock()
+	defer lm.mu.Unlock()
+	now := lm.now()
+	rv := []*LimitUsage{}
+	for hash, u := range lm.dots {
+		if len(dothashes) != 0 {
+			found := false
+			for _, dh := range dothashes {
+				if bytes.Equal(dh, u.hash) {
+					found = true
+				}
+			}
+			if !found {
+				continue
+			}
+		}
+		avail := u.tokens
+		if u.lim.TxLimit > 0 {
+			avail += now.Sub(u.refilled).Seconds() * float64(u.lim.TxLimit)
+			if full := float64(u.lim.TxLimit) * txLimitWindow.Seconds(); avail > full {
+				avail = full
+			}
+		}
+		rv = append(rv, &LimitUsage{
+			DOT:         hash,
+			TxLimit:     u.lim.TxLimit,
+			StoreLimit:  u.lim.StoreLimit,
+			Retain:      u.lim.Retain,
+			TxBytes:     u.txbytes,
+			TxAvailable: int64(avail),
+			StoredBytes: u.stored,
+			Rejected:    u.rejected,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].DOT < rv[j].DOT
+	})
+	return rv
+}
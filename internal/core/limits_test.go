@@ -0,0 +1,178 @@
+package core
+
+import (
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//limitedDOT returns an access DOT with the given limits
+func limitedDOT(lim *objects.PublishLimits) *objects.DOT {
+	ns := objects.CreateNewEntity("", "", nil)
+	d := objects.CreateDOT(true, ns.GetVK(), ns.GetVK())
+	d.SetAccessURI(ns.GetVK(), "*")
+	d.SetPermString("P")
+	d.SetPublishLimits(lim)
+	d.Encode(ns.GetSK())
+	return d
+}
+
+func mkMsg(mtype uint8, topic string, size int, expires time.Time) *Message {
+	return &Message{Type: mtype, Topic: topic, Encoded: make([]byte, size), ExpireTime: expires}
+}
+
+//testMeter returns a meter whose clock only moves when told to
+func testMeter() (*Terminus, func(time.Duration)) {
+	tm := &Terminus{limits: newLimitMeter()}
+	now := time.Now()
+	tm.limits.now = func() time.Time {
+		return now
+	}
+	return tm, func(d time.Duration) {
+		now = now.Add(d)
+	}
+}
+
+func usageOf(t *testing.T, tm *Terminus, d *objects.DOT) *LimitUsage {
+	u := tm.LimitUsage(d.GetHash())
+	if len(u) != 1 {
+		t.Fatalf("expected usage for DOT %s", crypto.FmtHash(d.GetHash()))
+	}
+	return u[0]
+}
+
+func expectCharge(t *testing.T, lm *limitMeter, m *Message, dots []*objects.DOT, ok bool) {
+	err := lm.charge(m, dots)
+	if ok && err != nil {
+		t.Fatalf("unexpected rejection: %v", err)
+	}
+	if !ok && (err == nil || bwe.AsBW(err).Code != bwe.PublishLimitExceeded) {
+		t.Fatalf("expected the limit to be exceeded, got %v", err)
+	}
+}
+
+func TestLimitBurst(t *testing.T) {
+	tm, advance := testMeter()
+	lm := tm.limits
+	//A full bucket holds 1000 bytes
+	d := limitedDOT(&objects.PublishLimits{TxLimit: 100})
+	dots := []*objects.DOT{d}
+	forever := time.Now().Add(time.Hour)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 400, forever), dots, true)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 400, forever), dots, true)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 400, forever), dots, false)
+	u := usageOf(t, tm, d)
+	if u.TxBytes != 800 || u.TxAvailable != 200 || u.Rejected != 1 {
+		t.Fatalf("bad usage after the burst %+v", u)
+	}
+
+	//Two seconds refills 200 bytes
+	advance(2 * time.Second)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 400, forever), dots, true)
+	if u := usageOf(t, tm, d); u.TxAvailable != 0 {
+		t.Fatalf("expected the bucket to be empty, got %+v", u)
+	}
+
+	//The bucket does not fill past the burst
+	advance(time.Minute)
+	if u := usageOf(t, tm, d); u.TxAvailable != 1000 {
+		t.Fatalf("expected a full bucket, got %+v", u)
+	}
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 1000, forever), dots, true)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 1, forever), dots, false)
+
+	//A message that could never fit is rejected even with a full bucket
+	advance(time.Minute)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 1001, forever), dots, false)
+	if u := usageOf(t, tm, d); u.TxAvailable != 1000 || u.Rejected != 3 {
+		t.Fatalf("bad usage after rejecting a large message %+v", u)
+	}
+}
+
+func TestLimitChainAllOrNothing(t *testing.T) {
+	tm, _ := testMeter()
+	lm := tm.limits
+	wide := limitedDOT(&objects.PublishLimits{TxLimit: 1000})
+	narrow := limitedDOT(&objects.PublishLimits{TxLimit: 10})
+	forever := time.Now().Add(time.Hour)
+	expectCharge(t, lm, mkMsg(TypePublish, "a", 200, forever), []*objects.DOT{wide, narrow}, false)
+	if u := usageOf(t, tm, wide); u.TxBytes != 0 || u.TxAvailable != 10000 {
+		t.Fatalf("a rejected message was charged %+v", u)
+	}
+}
+
+func TestLimitStore(t *testing.T) {
+	tm, _ := testMeter()
+	lm := tm.limits
+	d := limitedDOT(&objects.PublishLimits{StoreLimit: 1000, Retain: 5})
+	other := limitedDOT(&objects.PublishLimits{Retain: 3})
+	dots := []*objects.DOT{d}
+	forever := time.Now().Add(time.Hour)
+
+	m := mkMsg(TypePersist, "a", 600, forever)
+	expectCharge(t, lm, m, []*objects.DOT{d, other}, true)
+	if m.retain != 3 {
+		t.Fatalf("expected the lowest retain, got %d", m.retain)
+	}
+	//A new message on the topic replaces the old one
+	expectCharge(t, lm, mkMsg(TypePersist, "a", 800, forever), dots, true)
+	if u := usageOf(t, tm, d); u.StoredBytes != 800 {
+		t.Fatalf("expected the persisted message to be replaced, got %+v", u)
+	}
+	if u := usageOf(t, tm, other); u.StoredBytes != 0 {
+		t.Fatalf("expected the replaced message to be released, got %+v", u)
+	}
+	expectCharge(t, lm, mkMsg(TypePersist, "b", 300, forever), dots, false)
+	//Publishes are not stored
+	expectCharge(t, lm, mkMsg(TypePublish, "b", 300, forever), dots, true)
+
+	//Persisting through a chain without limits releases the topic
+	expectCharge(t, lm, mkMsg(TypePersist, "a", 500, forever), nil, true)
+	if u := usageOf(t, tm, d); u.StoredBytes != 0 {
+		t.Fatalf("expected the topic to be released, got %+v", u)
+	}
+	expectCharge(t, lm, mkMsg(TypePersist, "b", 300, forever), dots, true)
+	if u := usageOf(t, tm, d); u.StoredBytes != 300 {
+		t.Fatalf("bad stored bytes %+v", u)
+	}
+}
+
+func TestLimitSweep(t *testing.T) {
+	tm, advance := testMeter()
+	lm := tm.limits
+	expiring := limitedDOT(&objects.PublishLimits{StoreLimit: 1000})
+	keeping := limitedDOT(&objects.PublishLimits{StoreLimit: 1000})
+	idle := limitedDOT(&objects.PublishLimits{TxLimit: 1000})
+	start := time.Now()
+	expectCharge(t, lm, mkMsg(TypePersist, "a", 100, start.Add(time.Minute)), []*objects.DOT{expiring}, true)
+	expectCharge(t, lm, mkMsg(TypePersist, "b", 100, start.Add(24*time.Hour)), []*objects.DOT{keeping}, true)
+	expectCharge(t, lm, mkMsg(TypePublish, "c", 100, start.Add(24*time.Hour)), []*objects.DOT{idle}, true)
+
+	//Nothing is swept until the next charge
+	advance(limitIdle + time.Minute)
+	if len(tm.LimitUsage()) != 3 {
+		t.Fatalf("expected three DOTs before the sweep")
+	}
+	expectCharge(t, lm, mkMsg(TypePublish, "d", 100, start.Add(24*time.Hour)), []*objects.DOT{idle}, true)
+	usage := tm.LimitUsage()
+	if len(usage) != 2 {
+		t.Fatalf("expected the expired DOT to be forgotten, got %+v", usage)
+	}
+	if u := usageOf(t, tm, keeping); u.StoredBytes != 100 {
+		t.Fatalf("a DOT with stored bytes was swept %+v", u)
+	}
+	usageOf(t, tm, idle)
+	if _, ok := lm.topics["a"]; ok {
+		t.Fatal("the expired message was not released")
+	}
+
+	//An idle DOT is forgotten too
+	advance(limitIdle + time.Minute)
+	expectCharge(t, lm, mkMsg(TypePublish, "d", 100, start.Add(24*time.Hour)), []*objects.DOT{keeping}, true)
+	if len(tm.LimitUsage(idle.GetHash())) != 0 {
+		t.Fatal("an idle DOT was kept")
+	}
+}
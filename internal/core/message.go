@@ -27,6 +27,8 @@ import (
 
 	log "github.com/cihub/seelog"
 	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/audit"
+	"github.com/immesys/bw2/internal/metrics"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2/util"
 	"github.com/immesys/bw2/util/bwe"
@@ -80,9 +82,16 @@ type Message struct {
 	PrimaryAccessChain *objects.DChain
 	checked            bool
 	VerifyResult       error
+	//The chain the verification was done with, for the audit log
+	auditPAC *objects.DChain
 	//status             StatusMessage
 	MergedTopic *string
 	UMid        UniqueMessageID
+	//Only set on messages delivered from a durable queue
+	QueueSeq uint64
+	//The history limit from the PublishLimits in the chain, set by
+	//ChargeLimits
+	retain int
 }
 
 //Encode generates the encoded array with signature.
@@ -371,6 +380,119 @@ func AnalyzeAccessDOTChain(mtype int, targetURI string, dc *objects.DChain) (err
 	return
 }
 
+//AnalyzePermissionDOTChain checks that a permission chain is connected end
+//to end and within its TTL. It returns the authority that the chain starts
+//at, the entity it ends at and the permissions it grants, which are the
+//key/value pairs present with the same value in every DOT.
+func AnalyzePermissionDOTChain(dc *objects.DChain) (authority []byte, holder []byte, kv map[string]string, err error) {
+	firstdot := dc.GetDOT(0)
+	if firstdot.IsAccess() {
+		return nil, nil, nil, bwe.M(bwe.InvalidDOT, "access DOT in a permission chain")
+	}
+	authority = firstdot.GetGiverVK()
+	holder = firstdot.GetReceiverVK()
+	kv = firstdot.GetPermissions()
+	ttl := firstdot.GetTTL()
+	for i := 1; i < dc.NumHashes(); i++ {
+		d := dc.GetDOT(i)
+		if d.IsAccess() {
+			return nil, nil, nil, bwe.M(bwe.InvalidDOT, "access DOT in a permission chain")
+		}
+		if ttl == 0 {
+			return nil, nil, nil, bwe.M(bwe.TTLExpired, "Chain TTL expired")
+		}
+		ttl--
+		if d.GetTTL() < ttl {
+			ttl = d.GetTTL()
+		}
+		if !bytes.Equal(holder, d.GetGiverVK()) {
+			return nil, nil, nil, bwe.M(bwe.BadLink, "Chain has bad link")
+		}
+		for k, v := range kv {
+			if dv, ok := d.GetPermission(k); !ok || dv != v {
+				delete(kv, k)
+			}
+		}
+		holder = d.GetReceiverVK()
+	}
+	return authority, holder, kv, nil
+}
+
+//ElaboratePermissionDChain returns the permission chain with all of its
+//DOTs. The registry keeps chains as a list of DOT hashes whatever they
+//grant, so a chain given by its hash is looked up there and rejected
+//unless every DOT in it is a permission DOT.
+func ElaboratePermissionDChain(dc *objects.DChain, res Resolver) (*objects.DChain, error) {
+	if dc.IsAccess() {
+		return nil, bwe.M(bwe.BadPermissions, "not a permission chain")
+	}
+	if !dc.IsElaborated() {
+		nchain, _, err := res.ResolveAccessDChain(dc.GetChainHash())
+		if err != nil || nchain == nil {
+			return nil, bwe.M(bwe.Unresolvable, "could not elaborate the chain hash")
+		}
+		dc = nchain
+	}
+	if dc.NumHashes() == 0 {
+		return nil, bwe.M(bwe.BadChainBuildParams, "empty chain")
+	}
+	dots := make([]*objects.DOT, dc.NumHashes())
+	for i := range dots {
+		d, _, err := res.ResolveDOT(dc.GetDotHash(i))
+		if err != nil {
+			return nil, bwe.WrapM(bwe.Unresolvable, "Could not resolve chain DOT", err)
+		}
+		if d.IsAccess() {
+			return nil, bwe.M(bwe.InvalidDOT, "access DOT in a permission chain")
+		}
+		dots[i] = d
+	}
+	rv, err := objects.CreateDChain(false, dots...)
+	if err != nil {
+		return nil, bwe.WrapM(bwe.InvalidDOT, "bad permission chain", err)
+	}
+	return rv, nil
+}
+
+//VerifyPermissionChain checks that the permission chain starts at the
+//authority, ends at the target (or everybody), that every DOT in it is
+//valid, unexpired and unrevoked, and that it grants all of the wanted
+//key/value pairs. It returns everything the chain grants.
+func VerifyPermissionChain(dc *objects.DChain, res Resolver, authority []byte, target []byte, want map[string]string) (map[string]string, error) {
+	dc, err := ElaboratePermissionDChain(dc, res)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < dc.NumHashes(); i++ {
+		_, state, err := res.ResolveDOT(dc.GetDotHash(i))
+		if err != nil {
+			return nil, bwe.WrapM(bwe.BadPermissions, "Could not verify DOT", err)
+		}
+		if state != StateValid {
+			return nil, bwe.M(bwe.BadPermissions, fmt.Sprintf("chain DOT %d invalid: %s", i, res.StateToString(state)))
+		}
+	}
+	if !dc.CheckAllSigs() {
+		return nil, bwe.M(bwe.InvalidSig, "chain contained invalid DOTs (sig)")
+	}
+	auth, holder, kv, err := AnalyzePermissionDOTChain(dc)
+	if err != nil {
+		return nil, err
+	}
+	if !bytes.Equal(auth, authority) {
+		return nil, bwe.M(bwe.BadPermissions, "chain does not start at the authority")
+	}
+	if !bytes.Equal(holder, target) && !bytes.Equal(holder, util.EverybodySlice) {
+		return nil, bwe.M(bwe.BadPermissions, "chain does not end at the target")
+	}
+	for k, v := range want {
+		if gv, ok := kv[k]; !ok || gv != v {
+			return nil, bwe.M(bwe.BadPermissions, fmt.Sprintf("chain does not grant %s=%s", k, v))
+		}
+	}
+	return kv, nil
+}
+
 const (
 	StateUnknown = iota
 	StateValid
@@ -379,11 +501,60 @@ const (
 	StateError
 )
 
+//CheckPACState re-resolves the DOTs in the message's access chain, the
+//entities they are granted between and the message's origin VK, and
+//returns an AccessRevoked error if one is no longer valid. It is cheaper
+//than Verify, which would return the cached result anyway, and is used to
+//find subscriptions that have lost their permissions. Objects that cannot
+//be resolved right now are skipped, the others are still checked.
+func (m *Message) CheckPACState(res Resolver) error {
+	vks := [][]byte{}
+	if m.PrimaryAccessChain != nil {
+		//Verify kept the DOTs, use them if the chain cannot be resolved
+		pac := m.auditPAC
+		if epac := ElaborateDChain(m.PrimaryAccessChain, res); epac != nil {
+			pac = epac
+		}
+		for i := 0; pac != nil && i < pac.NumHashes(); i++ {
+			hash := pac.GetDotHash(i)
+			d, state, err := res.ResolveDOT(hash)
+			if err != nil || d == nil {
+				d = pac.GetDOT(i)
+			} else if state == StateExpired || state == StateRevoked {
+				return bwe.M(bwe.AccessRevoked, fmt.Sprintf("PAC DOT %d (%s) is %s", i, crypto.FmtHash(hash), res.StateToString(state)))
+			}
+			if d != nil {
+				vks = append(vks, d.GetGiverVK(), d.GetReceiverVK())
+			}
+		}
+	}
+	if m.OriginVK != nil {
+		vks = append(vks, *m.OriginVK)
+	}
+	checked := make(map[string]bool, len(vks))
+	for _, vk := range vks {
+		if checked[string(vk)] || bytes.Equal(vk, util.EverybodySlice) {
+			continue
+		}
+		checked[string(vk)] = true
+		_, state, err := res.ResolveEntity(vk)
+		if err != nil {
+			continue
+		}
+		if state == StateExpired || state == StateRevoked {
+			return bwe.M(bwe.AccessRevoked, fmt.Sprintf("entity %s is %s", crypto.FmtKey(vk), res.StateToString(state)))
+		}
+	}
+	return nil
+}
+
 func (m *Message) Verify(res Resolver) error {
 
+	start := time.Now()
 	doret := func(err error) error {
 		m.checked = true
 		m.VerifyResult = err
+		metrics.ObserveVerify(time.Now().Sub(start), err)
 		return err
 	}
 
@@ -429,6 +600,7 @@ func (m *Message) Verify(res Resolver) error {
 		if pac == nil {
 			return doret(bwe.M(bwe.Unresolvable, "could not elaborate the PAC hash"))
 		}
+		m.auditPAC = pac
 
 		// not needed because we call getdot on each hash below
 		// resolved_ok := ResolveDotsInDChain(pac, m.RoutingObjects, res)
@@ -491,3 +663,71 @@ func (m *Message) Verify(res Resolver) error {
 
 	return doret(nil)
 }
+
+//VerifyEncoded decodes and verifies a message that the router built for
+//one of its clients before it is delivered or sent on. A rejection is
+//recorded in the audit log; acceptance is recorded where the message is
+//delivered.
+func VerifyEncoded(enc []byte, res Resolver) error {
+	m, err := LoadMessage(enc)
+	if err != nil {
+		log.Info("verification (phase 1) failed")
+		m.Audit(err)
+		return err
+	}
+	if err := m.Verify(res); err != nil {
+		log.Info("verification (phase 2) failed")
+		m.Audit(err)
+		return err
+	}
+	return nil
+}
+
+var auditTypeNames = map[uint8]string{
+	TypePublish:   "publish",
+	TypePersist:   "persist",
+	TypeSubscribe: "subscribe",
+	TypeTap:       "tap",
+	TypeQuery:     "query",
+	TypeTapQuery:  "tapquery",
+	TypeLS:        "list",
+}
+
+//Audit records in the audit log that the router accepted the message, or
+//rejected it with the given error. It should only be called where the
+//router makes that decision, not when a client checks a message
+func (m *Message) Audit(err error) {
+	if m.Type == TypeUnsubscribe || !audit.Enabled() {
+		return
+	}
+	pac := m.auditPAC
+	if pac == nil {
+		pac = m.PrimaryAccessChain
+	}
+	r := &audit.Record{
+		Time:      time.Now(),
+		Accepted:  err == nil,
+		Type:      auditTypeNames[m.Type],
+		Namespace: crypto.FmtKey(m.MVK),
+		URI:       m.Topic,
+	}
+	if m.OriginVK != nil {
+		r.OriginVK = crypto.FmtKey(*m.OriginVK)
+	}
+	if pac != nil {
+		r.PAC = crypto.FmtHash(pac.GetChainHash())
+		if pac.IsElaborated() {
+			for i := 0; i < pac.NumHashes(); i++ {
+				r.DOTs = append(r.DOTs, crypto.FmtHash(pac.GetDotHash(i)))
+			}
+		}
+	}
+	if err != nil {
+		r.Reason = err.Error()
+		if bwerr, ok := err.(*bwe.BWStatus); ok {
+			r.Code = bwerr.Code
+			r.Reason = bwerr.Msg
+		}
+	}
+	audit.Log(r)
+}
@@ -0,0 +1,165 @@
+package core_test
+
+import (
+	"testing"
+
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//permit adds a permission DOT granting kv to the resolver, decoded again
+//so that its signature is checked like one from the registry
+func (r *resolver) permit(t *testing.T, from *objects.Entity, to *objects.Entity, kv map[string]string, state int) *objects.DOT {
+	d := objects.CreateDOT(false, from.GetVK(), to.GetVK())
+	for k, v := range kv {
+		d.SetPermission(k, v)
+	}
+	d.SetTTL(5)
+	d.Encode(from.GetSK())
+	return r.add(t, objects.ROPermissionDOT, d, state)
+}
+
+func (r *resolver) add(t *testing.T, ronum int, d *objects.DOT, state int) *objects.DOT {
+	di, err := objects.NewDOT(ronum, d.GetContent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	d = di.(*objects.DOT)
+	r.dots[string(d.GetHash())] = d
+	r.states[string(d.GetHash())] = state
+	return d
+}
+
+//register adds the chain of the given DOTs to the registry and returns its
+//hash as a permission chain
+func (r *resolver) register(t *testing.T, dots ...*objects.DOT) *objects.DChain {
+	content := []byte{}
+	for _, d := range dots {
+		content = append(content, d.GetHash()...)
+	}
+	//The registry does not know what the chain grants
+	dci, err := objects.NewDChain(objects.ROAccessDChain, content)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dc := dci.(*objects.DChain)
+	r.chains[string(dc.GetChainHash())] = dc
+	hi, err := objects.NewDChain(objects.ROPermissionDChainHash, dc.GetChainHash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hi.(*objects.DChain)
+}
+
+func TestVerifyPermissionChain(t *testing.T) {
+	res := &resolver{
+		dots:   make(map[string]*objects.DOT),
+		states: make(map[string]int),
+		chains: make(map[string]*objects.DChain),
+	}
+	auth := objects.CreateNewEntity("", "", nil)
+	mid := objects.CreateNewEntity("", "", nil)
+	target := objects.CreateNewEntity("", "", nil)
+	toMid := res.permit(t, auth, mid, map[string]string{"room": "410", "floor": "4"}, core.StateValid)
+	toTarget := res.permit(t, mid, target, map[string]string{"room": "410", "floor": "5"}, core.StateValid)
+	revoked := res.permit(t, mid, target, map[string]string{"room": "410"}, core.StateRevoked)
+	access := objects.CreateDOT(true, auth.GetVK(), mid.GetVK())
+	access.SetAccessURI(auth.GetVK(), "*")
+	access.SetPermString("P")
+	access.SetTTL(5)
+	access.Encode(auth.GetSK())
+	access = res.add(t, objects.ROAccessDOT, access, core.StateValid)
+
+	elaborated, err := objects.CreateDChain(false, toMid, toTarget)
+	if err != nil {
+		t.Fatal(err)
+	}
+	accessChain, err := objects.CreateDChain(true, access)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unknown, _ := objects.NewDChain(objects.ROPermissionDChainHash, make([]byte, 32))
+	room := map[string]string{"room": "410"}
+	tests := []struct {
+		name      string
+		dc        *objects.DChain
+		authority *objects.Entity
+		want      map[string]string
+		code      int
+	}{
+		{"elaborated", elaborated, auth, room, 0},
+		{"by hash", res.register(t, toMid, toTarget), auth, room, 0},
+		{"access DOT in registry chain", res.register(t, access, toTarget), auth, room, bwe.InvalidDOT},
+		{"unknown hash", unknown.(*objects.DChain), auth, room, bwe.Unresolvable},
+		{"access chain", accessChain, auth, room, bwe.BadPermissions},
+		{"mismatched value", elaborated, auth, map[string]string{"floor": "4"}, bwe.BadPermissions},
+		{"wrong authority", elaborated, mid, room, bwe.BadPermissions},
+		{"revoked", res.register(t, toMid, revoked), auth, room, bwe.BadPermissions},
+	}
+	for _, tt := range tests {
+		kv, err := core.VerifyPermissionChain(tt.dc, res, tt.authority.GetVK(), target.GetVK(), tt.want)
+		if tt.code == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", tt.name, err)
+			} else if len(kv) != 1 || kv["room"] != "410" {
+				t.Errorf("%s: expected only room=410, got %v", tt.name, kv)
+			}
+			continue
+		}
+		if err == nil || bwe.AsBW(err).Code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+}
+
+func TestAnalyzePermissionDOTChain(t *testing.T) {
+	res := &resolver{dots: make(map[string]*objects.DOT), states: make(map[string]int)}
+	auth := objects.CreateNewEntity("", "", nil)
+	mid := objects.CreateNewEntity("", "", nil)
+	target := objects.CreateNewEntity("", "", nil)
+	toMid := res.permit(t, auth, mid, map[string]string{"room": "410"}, core.StateValid)
+	toTarget := res.permit(t, mid, target, map[string]string{"room": "410"}, core.StateValid)
+	skip := res.permit(t, auth, target, map[string]string{"room": "410"}, core.StateValid)
+	access := objects.CreateDOT(true, mid.GetVK(), target.GetVK())
+	access.SetAccessURI(auth.GetVK(), "*")
+	access.SetPermString("P")
+	access.Encode(mid.GetSK())
+
+	//mkChain builds the chain without the access/permission check that
+	//CreateDChain does, as a client could
+	mkChain := func(dots ...*objects.DOT) *objects.DChain {
+		content := []byte{}
+		for _, d := range dots {
+			content = append(content, d.GetHash()...)
+		}
+		dci, err := objects.NewDChain(objects.ROPermissionDChain, content)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dc := dci.(*objects.DChain)
+		for i, d := range dots {
+			dc.SetDOT(i, d)
+		}
+		return dc
+	}
+	a, holder, kv, err := core.AnalyzePermissionDOTChain(mkChain(toMid, toTarget))
+	if err != nil || string(a) != string(auth.GetVK()) || string(holder) != string(target.GetVK()) || kv["room"] != "410" {
+		t.Fatalf("bad analysis of a valid chain: %v", err)
+	}
+	tests := []struct {
+		name  string
+		chain *objects.DChain
+		code  int
+	}{
+		{"access DOT mixed in", mkChain(toMid, access), bwe.InvalidDOT},
+		{"access DOT first", mkChain(access, toTarget), bwe.InvalidDOT},
+		{"bad link", mkChain(skip, toTarget), bwe.BadLink},
+	}
+	for _, tt := range tests {
+		_, _, _, err := core.AnalyzePermissionDOTChain(tt.chain)
+		if err == nil || bwe.AsBW(err).Code != tt.code {
+			t.Errorf("%s: expected code %d, got %v", tt.name, tt.code, err)
+		}
+	}
+}
@@ -36,6 +36,7 @@ import (
 	"golang.org/x/net/context"
 
 	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/metrics"
 	"github.com/immesys/bw2/internal/store"
 	"github.com/immesys/bw2/util/bwe"
 )
@@ -47,6 +48,9 @@ type Client struct {
 	tm   *Terminus
 	name string
 	ctx  context.Context
+	//Why subscriptions were ended by TerminateSubs
+	termlock   sync.Mutex
+	terminated map[UniqueMessageID]error
 }
 
 type clientid uint32
@@ -79,8 +83,10 @@ type subscription struct {
 	client    *Client
 	tap       bool
 	uri       string
+	msg       *Message
 	created   time.Time
 	mqueue    chan *Message
+	dq        *DurableQueue
 	ctx       context.Context
 	ctxcancel func()
 }
@@ -100,6 +106,13 @@ type Terminus struct {
 	//map a subscription ID onto the snode that contains it
 	rstree_lock sync.RWMutex
 	rstree      map[UniqueMessageID]*subTreeNode
+
+	//map a durable queue name onto the open queue
+	dq_lock sync.Mutex
+	dqueues map[string]*DurableQueue
+
+	//usage of DOTs with PublishLimits
+	limits *limitMeter
 }
 
 //For a node in the tree, match the given subscription string and call visitor
@@ -163,6 +176,7 @@ func (s *subTreeNode) addSub(parts []string, sub *subscription) (UniqueMessageID
 //AddSub adds a subscription to terminus. It returns the unique message ID
 //of the actual subscription in the tree.
 func (tm *Terminus) AddSub(topic string, s *subscription) UniqueMessageID {
+	metrics.Subscribes.WithLabelValues(metrics.URIPrefix(topic)).Inc()
 	parts := strings.Split(topic, "/")
 	fmt.Println("Add subscription: ", parts)
 	subid, node := tm.stree.addSub(parts, s)
@@ -200,6 +214,9 @@ func CreateTerminus() *Terminus {
 	rv.cmap = make(map[clientid]*Client)
 	rv.stree = NewSnode()
 	rv.rstree = make(map[UniqueMessageID]*subTreeNode)
+	rv.dqueues = make(map[string]*DurableQueue)
+	rv.limits = newLimitMeter()
+	metrics.RegisterQueueDepth(rv.queuedMessages)
 	go func() {
 		for {
 			time.Sleep(5 * time.Second)
@@ -240,6 +257,7 @@ func (tm *Terminus) CreateClient(ctx context.Context, name string) *Client {
 		for _, subid := range c.subs {
 			node, ok := c.tm.rstree[subid]
 			if ok {
+				node.lock.Lock()
 				np := node.subz[:0]
 				for _, s := range node.subz {
 					if s.client.cid != c.cid {
@@ -247,6 +265,7 @@ func (tm *Terminus) CreateClient(ctx context.Context, name string) *Client {
 					}
 				}
 				node.subz = np
+				node.lock.Unlock()
 			}
 			delete(c.tm.rstree, subid)
 		}
@@ -262,7 +281,20 @@ func (tm *Terminus) CreateClient(ctx context.Context, name string) *Client {
 	return &c
 }
 
+//Publish admits a message for delivery to the matching subscriptions
 func (cl *Client) Publish(m *Message) {
+	m.Audit(nil)
+	cl.deliver(m)
+}
+
+//Forward delivers a message that another router has already admitted,
+//such as one received on an upstream subscription. It is not audited.
+func (cl *Client) Forward(m *Message) {
+	cl.deliver(m)
+}
+
+func (cl *Client) deliver(m *Message) {
+	metrics.Publishes.WithLabelValues(metrics.URIPrefix(m.Topic)).Inc()
 	var clientlist []*subscription
 	cl.tm.RMatchSubs(m.Topic, func(s *subscription) {
 		//fmt.Printf("sub match\n")
@@ -283,10 +315,16 @@ func (cl *Client) Publish(m *Message) {
 		if !sub.tap && m.Consumers != 0 && count >= m.Consumers {
 			continue //We hit limit
 		}
+		if sub.dq != nil {
+			sub.dq.Enqueue(m)
+			count++
+			continue
+		}
 		select {
 		case sub.mqueue <- m:
 		default:
 			fmt.Printf("UNSUBSCRIBING %v::%s QUEUE FULL\n", sub.client.name, sub.uri)
+			metrics.OverflowUnsubscribes.Inc()
 			sub.ctxcancel()
 		}
 		count++
@@ -297,6 +335,7 @@ func (cl *Client) Publish(m *Message) {
 //returns the identifier used for Unsubscribe
 //func (cl *Client) Subscribe(topic string, tap bool, meta interface{}) (uint32, bool) {
 func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)) UniqueMessageID {
+	m.Audit(nil)
 	cctx, cancel := context.WithCancel(ctx)
 	newsub := &subscription{subid: m.UMid,
 		tap:       m.Type == TypeTap,
@@ -305,6 +344,7 @@ func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)
 		mqueue:    make(chan *Message, 4096),
 		created:   time.Now(),
 		uri:       m.Topic,
+		msg:       m,
 		ctx:       cctx,
 		ctxcancel: cancel}
 
@@ -333,12 +373,58 @@ func (cl *Client) Subscribe(ctx context.Context, m *Message, cb func(m *Message)
 	return subid
 }
 
+//SubscribeDurable is like Subscribe, but messages are delivered via the
+//named durable queue rather than an in-memory queue, so a slow consumer
+//will not cause the subscription to be dropped. Messages are delivered
+//with QueueSeq set and must be acknowledged with AckDurable. The queue is
+//kept for the next subscription with the same name if the client goes
+//away, and removed if the subscription is unsubscribed or terminated.
+func (cl *Client) SubscribeDurable(ctx context.Context, m *Message, queue string, cb func(m *Message)) (UniqueMessageID, error) {
+	cctx, cancel := context.WithCancel(ctx)
+	dq, err := cl.tm.OpenDurableQueue(cctx, queue, cb)
+	if err != nil {
+		cancel()
+		m.Audit(err)
+		return UniqueMessageID{}, err
+	}
+	m.Audit(nil)
+	newsub := &subscription{subid: m.UMid,
+		tap:       m.Type == TypeTap,
+		client:    cl,
+		handler:   cb,
+		dq:        dq,
+		created:   time.Now(),
+		uri:       m.Topic,
+		msg:       m,
+		ctx:       cctx,
+		ctxcancel: cancel}
+	go func() {
+		<-newsub.ctx.Done()
+		//The client went away, so keep the backlog for when it is back
+		newsub.client.unsubscribe(newsub.subid, false)
+	}()
+	subid := cl.tm.AddSub(m.Topic, newsub)
+	cl.subs = append(cl.subs, subid)
+	return subid, nil
+}
+
+//AckDurable acknowledges a message delivered by a durable queue
+func (cl *Client) AckDurable(queue string, seq uint64) error {
+	return cl.tm.AckDurable(queue, seq)
+}
+
 func (cl *Client) Persist(m *Message) {
+	if m.RXTime.IsZero() {
+		m.RXTime = time.Now()
+	}
 	store.PutMessage(m.Topic, m.Encoded)
-	cl.Publish(m)
+	store.PutHistoryRetain(m.Topic, m.RXTime, m.Encoded, m.retain)
+	m.Audit(nil)
+	cl.deliver(m)
 }
 
 func (cl *Client) Query(m *Message, cb func(m *Message)) {
+	m.Audit(nil)
 	rc := make(chan store.SM, 3)
 	go store.GetMatchingMessage(m.Topic, rc)
 	for sm := range rc {
@@ -356,7 +442,28 @@ func (cl *Client) Query(m *Message, cb func(m *Message)) {
 	cb(nil)
 }
 
+//QueryHistory is like Query but returns every persisted message with a
+//receive time in [from, to] rather than only the latest. A zero time
+//leaves that end of the range open.
+func (cl *Client) QueryHistory(m *Message, from time.Time, to time.Time, cb func(m *Message)) {
+	m.Audit(nil)
+	rc := make(chan store.SM, 3)
+	go store.GetMatchingHistory(m.Topic, from, to, rc)
+	for sm := range rc {
+		m, err := LoadMessage(sm.Body)
+		if err != nil {
+			panic("Not expecting error from unpersist: " + err.Error())
+		}
+		m.RXTime = sm.RXTime
+		if !m.ExpireTime.Before(time.Now()) {
+			cb(m)
+		}
+	}
+	cb(nil)
+}
+
 func (cl *Client) List(m *Message, cb func(s string, ok bool)) {
+	m.Audit(nil)
 	rc := make(chan string, 3)
 	go store.ListChildren(m.Topic, rc)
 	for {
@@ -395,10 +502,105 @@ func (cl *Client) List(m *Message, cb func(s string, ok bool)) {
 // cl.tm.c_maplock.Unlock()
 //}
 
+//queuedMessages returns the number of messages waiting in the in-memory
+//queues of all subscriptions
+func (tm *Terminus) queuedMessages() int {
+	tm.rstree_lock.RLock()
+	defer tm.rstree_lock.RUnlock()
+	rv := 0
+	for mid, stn := range tm.rstree {
+		stn.lock.RLock()
+		if sub := stn.subForId(mid); sub != nil {
+			rv += len(sub.mqueue)
+		}
+		stn.lock.RUnlock()
+	}
+	return rv
+}
+
+//TerminateSubs calls check with the subscribe message of every active
+//subscription and terminates the ones it returns an error for, as if they
+//had been unsubscribed. The error is kept for TerminationError, which the
+//handler can call when it gets the final nil message (durable
+//subscriptions do not get one, so it is not kept for them). It returns the
+//number of subscriptions terminated.
+func (tm *Terminus) TerminateSubs(check func(m *Message) error) int {
+	tm.rstree_lock.RLock()
+	subs := make([]*subscription, 0, len(tm.rstree))
+	for mid, stn := range tm.rstree {
+		stn.lock.RLock()
+		if sub := stn.subForId(mid); sub != nil {
+			subs = append(subs, sub)
+		}
+		stn.lock.RUnlock()
+	}
+	tm.rstree_lock.RUnlock()
+	count := 0
+	for _, sub := range subs {
+		err := check(sub.msg)
+		if err == nil {
+			continue
+		}
+		//Durable queue handlers never get the final nil message
+		if sub.dq == nil {
+			sub.client.termlock.Lock()
+			if sub.client.terminated == nil {
+				sub.client.terminated = make(map[UniqueMessageID]error)
+			}
+			sub.client.terminated[sub.subid] = err
+			sub.client.termlock.Unlock()
+		}
+		if sub.client.Unsubscribe(sub.subid) != nil {
+			//It ended by itself in the meantime
+			sub.client.TerminationError(sub.subid)
+			continue
+		}
+		log.Infof("terminated subscription %s::%s: %v", sub.client.name, sub.uri, err)
+		metrics.TerminatedSubscriptions.Inc()
+		count++
+	}
+	return count
+}
+
+//SubscriptionDone returns a channel that is closed when the subscription
+//ends, which is already closed if there is no such subscription. It lets a
+//handler that blocks stop when the subscription does.
+func (cl *Client) SubscriptionDone(subid UniqueMessageID) <-chan struct{} {
+	var sub *subscription
+	cl.tm.rstree_lock.RLock()
+	if stn, ok := cl.tm.rstree[subid]; ok {
+		stn.lock.RLock()
+		sub = stn.subForId(subid)
+		stn.lock.RUnlock()
+	}
+	cl.tm.rstree_lock.RUnlock()
+	if sub == nil {
+		done := make(chan struct{})
+		close(done)
+		return done
+	}
+	return sub.ctx.Done()
+}
+
+//TerminationError returns the error the subscription was terminated with
+//by TerminateSubs, or nil if it was not. It only returns it once.
+func (cl *Client) TerminationError(subid UniqueMessageID) error {
+	cl.termlock.Lock()
+	defer cl.termlock.Unlock()
+	err := cl.terminated[subid]
+	delete(cl.terminated, subid)
+	return err
+}
+
 //Unsubscribe does what it says. For now the topic system is crude
 //so this doesn't seem necessary to have the subid instead of topic
-//but it will make sense when we are doing wildcards later.
+//but it will make sense when we are doing wildcards later. The durable
+//queue of the subscription, if any, is removed.
 func (cl *Client) Unsubscribe(subid UniqueMessageID) error {
+	return cl.unsubscribe(subid, true)
+}
+
+func (cl *Client) unsubscribe(subid UniqueMessageID, discard bool) error {
 	cl.tm.rstree_lock.Lock()
 	node, ok := cl.tm.rstree[subid]
 	if !ok {
@@ -407,6 +609,7 @@ func (cl *Client) Unsubscribe(subid UniqueMessageID) error {
 	}
 	toTerm := []*subscription{}
 	//delete(node.subs, cl.cid)
+	node.lock.Lock()
 	np := node.subz[:0]
 	for _, s := range node.subz {
 		if s.subid != subid {
@@ -416,12 +619,16 @@ func (cl *Client) Unsubscribe(subid UniqueMessageID) error {
 		}
 	}
 	node.subz = np
+	node.lock.Unlock()
 	delete(cl.tm.rstree, subid)
 	//TODO we don't clean up the tree!
 	// meaning there are intermediate nodes with no leaves
 	// that is probably ok
 	cl.tm.rstree_lock.Unlock()
 	for _, tt := range toTerm {
+		if discard && tt.dq != nil {
+			tt.dq.Discard()
+		}
 		tt.ctxcancel()
 	}
 	return nil
@@ -0,0 +1,254 @@
+package core_test
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/audit"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+type resolver struct {
+	dots     map[string]*objects.DOT
+	states   map[string]int
+	entities map[string]int
+	chains   map[string]*objects.DChain
+}
+
+func (r *resolver) ResolveDOT(hash []byte) (*objects.DOT, int, error) {
+	d, ok := r.dots[string(hash)]
+	if !ok {
+		return nil, core.StateUnknown, errors.New("no such DOT")
+	}
+	return d, r.states[string(hash)], nil
+}
+func (r *resolver) ResolveEntity(vk []byte) (*objects.Entity, int, error) {
+	state, ok := r.entities[string(vk)]
+	if !ok {
+		return nil, core.StateUnknown, errors.New("no such entity")
+	}
+	return nil, state, nil
+}
+func (r *resolver) ResolveAccessDChain(hash []byte) (*objects.DChain, int, error) {
+	dc, ok := r.chains[string(hash)]
+	if !ok {
+		return nil, core.StateUnknown, errors.New("no such chain")
+	}
+	return dc, core.StateValid, nil
+}
+func (r *resolver) StateToString(state int) string {
+	switch state {
+	case core.StateValid:
+		return "Valid"
+	case core.StateExpired:
+		return "Expired"
+	case core.StateRevoked:
+		return "Revoked"
+	}
+	return "Unknown"
+}
+
+var nextMid uint64
+
+//mkSub returns a subscribe message on uri
+func mkSub(uri string) *core.Message {
+	nextMid++
+	return &core.Message{
+		Type:  core.TypeSubscribe,
+		Topic: uri,
+		UMid:  core.UniqueMessageID{Mid: nextMid, Sig: nextMid},
+	}
+}
+
+//subscribe subscribes with m and returns a channel that is closed when
+//the handler gets the final nil message
+func subscribe(cl *core.Client, m *core.Message) chan struct{} {
+	ended := make(chan struct{})
+	cl.Subscribe(context.Background(), m, func(m *core.Message) {
+		if m == nil {
+			close(ended)
+		}
+	})
+	return ended
+}
+
+func waitEnded(t *testing.T, ended chan struct{}, name string) {
+	select {
+	case <-ended:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("%s did not end", name)
+	}
+}
+
+func TestTerminateSubs(t *testing.T) {
+	tm := core.CreateTerminus()
+	cl := tm.CreateClient(context.Background(), "test")
+	keep, drop := mkSub("ns/keep"), mkSub("ns/drop")
+	keepEnded := subscribe(cl, keep)
+	dropEnded := subscribe(cl, drop)
+	revoked := bwe.M(bwe.AccessRevoked, "revoked")
+	n := tm.TerminateSubs(func(m *core.Message) error {
+		if m == drop {
+			return revoked
+		}
+		return nil
+	})
+	if n != 1 {
+		t.Fatalf("expected 1 subscription to be terminated, got %d", n)
+	}
+	waitEnded(t, dropEnded, "terminated subscription")
+	if err := cl.TerminationError(drop.UMid); err != revoked {
+		t.Fatalf("expected the termination error, got %v", err)
+	}
+	if err := cl.TerminationError(drop.UMid); err != nil {
+		t.Fatalf("termination error was returned twice: %v", err)
+	}
+	select {
+	case <-keepEnded:
+		t.Fatal("subscription that passed the check was ended")
+	default:
+	}
+	if n := tm.TerminateSubs(func(m *core.Message) error { return nil }); n != 0 {
+		t.Fatalf("expected nothing to be terminated, got %d", n)
+	}
+	if err := cl.Unsubscribe(keep.UMid); err != nil {
+		t.Fatal(err)
+	}
+	waitEnded(t, keepEnded, "unsubscribed subscription")
+	if err := cl.TerminationError(keep.UMid); err != nil {
+		t.Fatalf("unsubscribe gave a termination error: %v", err)
+	}
+}
+
+func TestCheckPACState(t *testing.T) {
+	ns := objects.CreateNewEntity("", "", nil)
+	mid := objects.CreateNewEntity("", "", nil)
+	holder := objects.CreateNewEntity("", "", nil)
+	origin := objects.CreateNewEntity("", "", nil)
+	mkDOT := func(from, to *objects.Entity) *objects.DOT {
+		d := objects.CreateDOT(true, from.GetVK(), to.GetVK())
+		d.SetAccessURI(ns.GetVK(), "a/*")
+		d.SetPermString("C")
+		d.Encode(from.GetSK())
+		return d
+	}
+	d1, d2 := mkDOT(ns, mid), mkDOT(mid, holder)
+	dc, err := objects.CreateDChain(true, d1, d2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ovk := origin.GetVK()
+
+	for _, tc := range []struct {
+		name  string
+		setup func(r *resolver)
+		code  int
+	}{
+		{"valid", func(r *resolver) {}, bwe.Okay},
+		{"DOT revoked", func(r *resolver) { r.states[string(d2.GetHash())] = core.StateRevoked }, bwe.AccessRevoked},
+		{"DOT expired", func(r *resolver) { r.states[string(d1.GetHash())] = core.StateExpired }, bwe.AccessRevoked},
+		{"giver revoked", func(r *resolver) { r.entities[string(mid.GetVK())] = core.StateRevoked }, bwe.AccessRevoked},
+		{"receiver expired", func(r *resolver) { r.entities[string(holder.GetVK())] = core.StateExpired }, bwe.AccessRevoked},
+		{"origin revoked", func(r *resolver) { r.entities[string(ovk)] = core.StateRevoked }, bwe.AccessRevoked},
+		{"unresolvable DOT", func(r *resolver) { delete(r.dots, string(d1.GetHash())) }, bwe.Okay},
+		{"unresolvable DOT, revoked entity", func(r *resolver) {
+			delete(r.dots, string(d1.GetHash()))
+			r.entities[string(ns.GetVK())] = core.StateRevoked
+		}, bwe.AccessRevoked},
+		{"unresolvable entity, revoked DOT", func(r *resolver) {
+			delete(r.entities, string(mid.GetVK()))
+			r.states[string(d2.GetHash())] = core.StateRevoked
+		}, bwe.AccessRevoked},
+	} {
+		r := &resolver{
+			dots:   map[string]*objects.DOT{string(d1.GetHash()): d1, string(d2.GetHash()): d2},
+			states: map[string]int{string(d1.GetHash()): core.StateValid, string(d2.GetHash()): core.StateValid},
+			entities: map[string]int{string(ns.GetVK()): core.StateValid, string(mid.GetVK()): core.StateValid,
+				string(holder.GetVK()): core.StateValid, string(ovk): core.StateValid},
+		}
+		tc.setup(r)
+		m := mkSub("ns/a/b")
+		m.PrimaryAccessChain = dc
+		m.OriginVK = &ovk
+		err := m.CheckPACState(r)
+		if tc.code == bwe.Okay {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil || bwe.AsBW(err).Code != tc.code {
+			t.Errorf("%s: expected error %d, got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+func TestVerifyEncodedAudit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwaudit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := audit.Open(path.Join(dir, "audit.log"), 0, 0); err != nil {
+		t.Fatal(err)
+	}
+	records := []*audit.Record{}
+	audit.SetPublisher(func(r *audit.Record, line []byte) {
+		records = append(records, r)
+	})
+	defer audit.SetPublisher(nil)
+
+	ns := objects.CreateNewEntity("", "", nil)
+	holder := objects.CreateNewEntity("", "", nil)
+	d := objects.CreateDOT(true, ns.GetVK(), holder.GetVK())
+	d.SetAccessURI(ns.GetVK(), "a/*")
+	d.SetPermString("P")
+	d.Encode(ns.GetSK())
+	dc, err := objects.CreateDChain(true, d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := &core.Message{
+		Type:           core.TypePublish,
+		MVK:            ns.GetVK(),
+		TopicSuffix:    "a/b",
+		Topic:          base64.URLEncoding.EncodeToString(ns.GetVK()) + "/a/b",
+		RoutingObjects: []objects.RoutingObject{dc},
+	}
+	m.Encode(holder.GetSK(), holder.GetVK())
+	r := &resolver{
+		dots:     map[string]*objects.DOT{string(d.GetHash()): d},
+		states:   map[string]int{string(d.GetHash()): core.StateValid},
+		entities: map[string]int{},
+	}
+
+	//Accepting is recorded when the message is delivered
+	if err := core.VerifyEncoded(m.Encoded, r); err != nil {
+		t.Fatal(err)
+	}
+	if len(records) != 0 {
+		t.Fatalf("accepted message was recorded %d times", len(records))
+	}
+	r.states[string(d.GetHash())] = core.StateRevoked
+	err = core.VerifyEncoded(m.Encoded, r)
+	if err == nil {
+		t.Fatal("expected the message to be rejected")
+	}
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %d", len(records))
+	}
+	rec := records[0]
+	if rec.Accepted || rec.Type != "publish" || rec.URI != m.Topic || rec.Code != bwe.AsBW(err).Code ||
+		len(rec.DOTs) != 1 || rec.DOTs[0] != crypto.FmtHash(d.GetHash()) {
+		t.Fatalf("unexpected record %+v", rec)
+	}
+}
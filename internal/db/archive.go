@@ -0,0 +1,224 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package db
+
+//An archive holds every object of every column family so that a database
+//can be moved between backends. The format is
+//
+//  "BW2DBARC" | format version (u16)
+//  records:    cf (u8, nonzero) | uvarint keylen | key | uvarint vallen | val
+//  trailer:    0 (u8) | record count (u64) | sha256 of everything before it
+//
+//All integers are big endian. Records are copied as they are, so an archive
+//can only be imported by a router with the same key layout. Version 1
+//archives also had a key layout version after the format version, which
+//was always 1 and is skipped.
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"io"
+)
+
+const archiveMagic = "BW2DBARC"
+
+//No key or value is this big, so a larger length means the archive is damaged
+const maxArchiveChunk = 1 << 28
+
+//ArchiveVersion is the version of the archive format itself
+const ArchiveVersion = 2
+
+//ExportArchive writes every object in src to w and returns the number of
+//objects written
+func ExportArchive(src BWDB, w io.Writer) (int, error) {
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	hdr := make([]byte, len(archiveMagic)+2)
+	copy(hdr, archiveMagic)
+	binary.BigEndian.PutUint16(hdr[len(archiveMagic):], ArchiveVersion)
+	if _, err := bw.Write(hdr); err != nil {
+		return 0, err
+	}
+	count := 0
+	lenbuf := make([]byte, binary.MaxVarintLen64)
+	for cf := 1; cf <= CFMax; cf++ {
+		it := src.CreateIterator(cf, []byte{})
+		for it.OK() {
+			k, v := it.Key(), it.Value()
+			bw.WriteByte(byte(cf))
+			ln := binary.PutUvarint(lenbuf, uint64(len(k)))
+			bw.Write(lenbuf[:ln])
+			bw.Write(k)
+			ln = binary.PutUvarint(lenbuf, uint64(len(v)))
+			bw.Write(lenbuf[:ln])
+			if _, err := bw.Write(v); err != nil {
+				it.Release()
+				return count, err
+			}
+			count++
+			it.Next()
+		}
+		it.Release()
+	}
+	trailer := make([]byte, 9)
+	binary.BigEndian.PutUint64(trailer[1:], uint64(count))
+	bw.Write(trailer)
+	if err := bw.Flush(); err != nil {
+		return count, err
+	}
+	if _, err := w.Write(h.Sum(nil)); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+//hashingReader hashes every byte that is read through it
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+//readArchive calls fn for every record in the archive. It returns an error
+//if the archive is malformed, or once all records have been read, if the
+//checksum or record count do not match.
+func readArchive(r io.Reader, fn func(cf int, key []byte, val []byte) error) (int, error) {
+	hr := &hashingReader{r: bufio.NewReader(r), h: sha256.New()}
+	hdr := make([]byte, len(archiveMagic)+2)
+	if _, err := io.ReadFull(hr, hdr); err != nil {
+		return 0, fmt.Errorf("reading archive header: %v", err)
+	}
+	if string(hdr[:len(archiveMagic)]) != archiveMagic {
+		return 0, fmt.Errorf("not a database archive")
+	}
+	switch v := binary.BigEndian.Uint16(hdr[len(archiveMagic):]); v {
+	case ArchiveVersion:
+	case 1:
+		layout := make([]byte, 2)
+		if _, err := io.ReadFull(hr, layout); err != nil {
+			return 0, fmt.Errorf("reading archive header: %v", err)
+		}
+		if binary.BigEndian.Uint16(layout) != 1 {
+			return 0, fmt.Errorf("unsupported key layout %d", binary.BigEndian.Uint16(layout))
+		}
+	default:
+		return 0, fmt.Errorf("unsupported archive version %d", v)
+	}
+	readChunk := func() ([]byte, error) {
+		ln, err := binary.ReadUvarint(hr)
+		if err != nil {
+			return nil, err
+		}
+		if ln > maxArchiveChunk {
+			return nil, fmt.Errorf("object of %d bytes is too large", ln)
+		}
+		rv := make([]byte, ln)
+		_, err = io.ReadFull(hr, rv)
+		return rv, err
+	}
+	count := 0
+	for {
+		cf, err := hr.ReadByte()
+		if err != nil {
+			return count, fmt.Errorf("truncated archive: %v", err)
+		}
+		if cf == 0 {
+			break
+		}
+		if int(cf) > CFMax {
+			return count, fmt.Errorf("bad column family %d in archive", cf)
+		}
+		k, err := readChunk()
+		if err != nil {
+			return count, fmt.Errorf("truncated archive: %v", err)
+		}
+		v, err := readChunk()
+		if err != nil {
+			return count, fmt.Errorf("truncated archive: %v", err)
+		}
+		if err := fn(int(cf), k, v); err != nil {
+			return count, err
+		}
+		count++
+	}
+	cbuf := make([]byte, 8)
+	if _, err := io.ReadFull(hr, cbuf); err != nil {
+		return count, fmt.Errorf("truncated archive: %v", err)
+	}
+	expected := hr.h.Sum(nil)
+	sum := make([]byte, len(expected))
+	if _, err := io.ReadFull(hr.r, sum); err != nil {
+		return count, fmt.Errorf("truncated archive: %v", err)
+	}
+	if !bytes.Equal(sum, expected) {
+		return count, fmt.Errorf("archive checksum mismatch")
+	}
+	if n := binary.BigEndian.Uint64(cbuf); n != uint64(count) {
+		return count, fmt.Errorf("archive has %d records, trailer says %d", count, n)
+	}
+	return count, nil
+}
+
+//CheckArchive reads the whole archive and returns an error if it is
+//damaged
+func CheckArchive(r io.Reader) (int, error) {
+	return readArchive(r, func(cf int, key []byte, val []byte) error {
+		return nil
+	})
+}
+
+//ImportArchive writes every object in the archive into dst. Objects are
+//written as they are read, so if an error is returned dst may contain part
+//of the archive. Import into an empty database.
+func ImportArchive(dst BWDB, r io.Reader) (int, error) {
+	return readArchive(r, func(cf int, key []byte, val []byte) error {
+		dst.PutObject(cf, key, val)
+		return nil
+	})
+}
+
+//VerifyArchive checks that the archive is intact and that every object in
+//it is present in h with the same value
+func VerifyArchive(h BWDB, r io.Reader) (int, error) {
+	return readArchive(r, func(cf int, key []byte, val []byte) error {
+		v, err := h.GetObject(cf, key)
+		if err != nil {
+			return fmt.Errorf("cf %d key %x: %v", cf, key, err)
+		}
+		if !bytes.Equal(v, val) {
+			return fmt.Errorf("cf %d key %x: value differs", cf, key)
+		}
+		return nil
+	})
+}
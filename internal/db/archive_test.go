@@ -0,0 +1,94 @@
+package db_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/immesys/bw2/internal/db"
+)
+
+func TestArchiveRoundTrip(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bwdb-archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src, err := db.Open("level", dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for cf := 1; cf <= db.CFMax; cf++ {
+		for i := 0; i < 100; i++ {
+			src.PutObject(cf, []byte{byte(cf), byte(i), 0, byte(i)}, bytes.Repeat([]byte{byte(i)}, i))
+		}
+	}
+	buf := &bytes.Buffer{}
+	n, err := db.ExportArchive(src, buf)
+	if err != nil || n != 100*db.CFMax {
+		t.Fatalf("export: %d %v", n, err)
+	}
+	archive := buf.Bytes()
+
+	dst, _ := db.Open("memory", "")
+	if n, err := db.ImportArchive(dst, bytes.NewReader(archive)); err != nil || n != 100*db.CFMax {
+		t.Fatalf("import: %d %v", n, err)
+	}
+	if _, err := db.VerifyArchive(dst, bytes.NewReader(archive)); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+	dst.PutObject(db.CFMsg, []byte{db.CFMsg, 5, 0, 5}, []byte("changed"))
+	if _, err := db.VerifyArchive(dst, bytes.NewReader(archive)); err == nil {
+		t.Fatal("verify did not notice a changed value")
+	}
+}
+
+func TestArchiveCorruption(t *testing.T) {
+	src, _ := db.Open("memory", "")
+	src.PutObject(db.CFDot, []byte("key"), []byte("value"))
+	buf := &bytes.Buffer{}
+	db.ExportArchive(src, buf)
+	archive := buf.Bytes()
+
+	flipped := append([]byte{}, archive...)
+	flipped[len(flipped)-40] ^= 1
+	truncated := archive[:len(archive)-10]
+	badmagic := append([]byte{}, archive...)
+	badmagic[0] = 'X'
+	badversion := append([]byte{}, archive...)
+	badversion[9] = 9
+	for name, a := range map[string][]byte{"flipped": flipped, "truncated": truncated, "badmagic": badmagic, "badversion": badversion} {
+		dst, _ := db.Open("memory", "")
+		if _, err := db.ImportArchive(dst, bytes.NewReader(a)); err == nil {
+			t.Errorf("%s archive was accepted", name)
+		}
+	}
+}
+
+//Version 1 archives have a key layout version after the format version
+func TestArchiveVersion1(t *testing.T) {
+	src, _ := db.Open("memory", "")
+	src.PutObject(db.CFDot, []byte("key"), []byte("value"))
+	buf := &bytes.Buffer{}
+	db.ExportArchive(src, buf)
+	v2 := buf.Bytes()
+	v1 := func(layout byte) []byte {
+		body := append([]byte("BW2DBARC\x00\x01\x00"), layout)
+		body = append(body, v2[10:len(v2)-sha256.Size]...)
+		sum := sha256.Sum256(body)
+		return append(body, sum[:]...)
+	}
+	dst, _ := db.Open("memory", "")
+	if n, err := db.ImportArchive(dst, bytes.NewReader(v1(1))); err != nil || n != 1 {
+		t.Fatalf("import: %d %v", n, err)
+	}
+	if v, err := dst.GetObject(db.CFDot, []byte("key")); err != nil || string(v) != "value" {
+		t.Fatalf("got %q %v", v, err)
+	}
+	if _, err := db.ImportArchive(dst, bytes.NewReader(v1(2))); err == nil || !strings.Contains(err.Error(), "key layout") {
+		t.Fatalf("archive with another key layout was not refused for it: %v", err)
+	}
+}
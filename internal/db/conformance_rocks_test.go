@@ -0,0 +1,7 @@
+// +build rocksdb
+
+package db_test
+
+import (
+	_ "github.com/immesys/bw2/internal/rocks"
+)
@@ -0,0 +1,161 @@
+package db_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/immesys/bw2/internal/db"
+	_ "github.com/immesys/bw2/internal/level"
+	_ "github.com/immesys/bw2/internal/mem"
+)
+
+//Every registered backend must pass these tests
+func TestConformance(t *testing.T) {
+	for _, name := range db.Backends() {
+		dir, err := ioutil.TempDir("", "bwdb-"+name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		h, err := db.Open(name, dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Run(name+"/PutGet", func(t *testing.T) { testPutGet(t, h) })
+		t.Run(name+"/ColumnFamilies", func(t *testing.T) { testColumnFamilies(t, h) })
+		t.Run(name+"/Delete", func(t *testing.T) { testDelete(t, h) })
+		t.Run(name+"/Iterator", func(t *testing.T) { testIterator(t, h) })
+	}
+}
+
+func TestUnknownBackend(t *testing.T) {
+	if _, err := db.Open("nosuchbackend", ""); err == nil {
+		t.Fatal("expected an error")
+	}
+}
+
+func testPutGet(t *testing.T, h db.BWDB) {
+	k := []byte("pg/key")
+	v := []byte("value")
+	h.PutObject(db.CFDot, k, v)
+	//The backend must not hold on to our slices
+	v[0] = 'X'
+	rv, err := h.GetObject(db.CFDot, k)
+	if err != nil || string(rv) != "value" {
+		t.Fatalf("got %q %v", rv, err)
+	}
+	rv[0] = 'Y'
+	rv, _ = h.GetObject(db.CFDot, k)
+	if string(rv) != "value" {
+		t.Fatalf("returned value aliases the database: %q", rv)
+	}
+	h.PutObject(db.CFDot, k, []byte("other"))
+	rv, _ = h.GetObject(db.CFDot, k)
+	if string(rv) != "other" {
+		t.Fatalf("overwrite failed: %q", rv)
+	}
+	h.PutObject(db.CFDot, []byte("pg/empty"), []byte{})
+	rv, err = h.GetObject(db.CFDot, []byte("pg/empty"))
+	if err != nil || len(rv) != 0 {
+		t.Fatalf("empty value: got %q %v", rv, err)
+	}
+	rv, err = h.GetObject(db.CFDot, []byte("pg/missing"))
+	if err != db.ErrObjNotFound || rv != nil {
+		t.Fatalf("missing key: got %q %v", rv, err)
+	}
+	if !h.Exists(db.CFDot, k) || h.Exists(db.CFDot, []byte("pg/missing")) {
+		t.Fatal("Exists is wrong")
+	}
+}
+
+func testColumnFamilies(t *testing.T, h db.BWDB) {
+	k := []byte("cf/key")
+	for cf := 1; cf <= db.CFMax; cf++ {
+		h.PutObject(cf, k, []byte{byte(cf)})
+	}
+	for cf := 1; cf <= db.CFMax; cf++ {
+		rv, err := h.GetObject(cf, k)
+		if err != nil || !bytes.Equal(rv, []byte{byte(cf)}) {
+			t.Fatalf("cf %d: got %v %v", cf, rv, err)
+		}
+		h.DeleteObject(cf, k)
+	}
+}
+
+func testDelete(t *testing.T, h db.BWDB) {
+	k := []byte("del/key")
+	h.PutObject(db.CFMsg, k, []byte("v"))
+	h.PutObject(db.CFMsgI, k, []byte("v"))
+	h.DeleteObject(db.CFMsg, k)
+	if h.Exists(db.CFMsg, k) {
+		t.Fatal("object still exists")
+	}
+	if _, err := h.GetObject(db.CFMsg, k); err != db.ErrObjNotFound {
+		t.Fatalf("got %v", err)
+	}
+	if !h.Exists(db.CFMsgI, k) {
+		t.Fatal("delete affected another column family")
+	}
+	//Deleting something that does not exist is fine
+	h.DeleteObject(db.CFMsg, k)
+}
+
+func testIterator(t *testing.T, h db.BWDB) {
+	for _, k := range []string{"it/b", "it/a/2", "it/a/1", "it/c", "iu/a", "is/a"} {
+		h.PutObject(db.CFEntity, []byte(k), []byte("v("+k+")"))
+	}
+	collect := func(prefix string) []string {
+		rv := []string{}
+		it := h.CreateIterator(db.CFEntity, []byte(prefix))
+		for it.OK() {
+			k := string(it.Key())
+			if string(it.Value()) != "v("+k+")" {
+				t.Fatalf("bad value for %s: %q", k, it.Value())
+			}
+			rv = append(rv, k)
+			it.Next()
+		}
+		it.Release()
+		return rv
+	}
+	expect := func(prefix string, want ...string) {
+		got := collect(prefix)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("prefix %q: got %v want %v", prefix, got, want)
+		}
+	}
+	expect("it/", "it/a/1", "it/a/2", "it/b", "it/c")
+	expect("it/a/", "it/a/1", "it/a/2")
+	expect("it/c", "it/c")
+	expect("nothing")
+	expect("", "is/a", "it/a/1", "it/a/2", "it/b", "it/c", "iu/a")
+	from := func(prefix, start string, want ...string) {
+		got := []string{}
+		it := h.CreateIteratorFrom(db.CFEntity, []byte(prefix), []byte(start))
+		for it.OK() {
+			got = append(got, string(it.Key()))
+			it.Next()
+		}
+		it.Release()
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("prefix %q from %q: got %v want %v", prefix, start, got, want)
+		}
+	}
+	from("it/", "it/a/2", "it/a/2", "it/b", "it/c")
+	from("it/", "it/a/3", "it/b", "it/c")
+	from("it/", "i", "it/a/1", "it/a/2", "it/b", "it/c")
+	from("it/", "it/d")
+	//Keys and values belong to the caller, so they must survive Next
+	it := h.CreateIterator(db.CFEntity, []byte("it/"))
+	k, v := it.Key(), it.Value()
+	for it.OK() {
+		it.Next()
+	}
+	it.Release()
+	if string(k) != "it/a/1" || string(v) != "v(it/a/1)" {
+		t.Fatalf("iterator reused the buffers: %q %q", k, v)
+	}
+}
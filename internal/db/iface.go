@@ -17,24 +17,47 @@
 
 package db
 
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+)
+
 const (
 	CFDot    = 1
 	CFDChain = 2
 	CFMsg    = 3
 	CFMsgI   = 4
 	CFEntity = 5
+	CFQueue  = 6
+	CFHist   = 7
+	CFPeer   = 8
 )
 
-/*
+//CFMax is the highest column family. Backends must provide every column
+//family from 1 to CFMax
+const CFMax = CFPeer
+
+//ErrObjNotFound is returned from GetObject if the object cannot be found
+var ErrObjNotFound = errors.New("Object Not Found")
+
+//BWDB is the interface implemented by storage backends. Keys and values
+//passed to PutObject must not be retained by the backend, and values
+//returned from GetObject and the iterators belong to the caller.
 type BWDB interface {
 	Initialize(dbname string)
 	PutObject(cf int, key []byte, val []byte)
 	GetObject(cf int, key []byte) ([]byte, error)
 	DeleteObject(cf int, key []byte)
 	Exists(cf int, key []byte) bool
+	//CreateIterator returns an iterator over the keys with the given
+	//prefix, in lexicographic order. It is positioned on the first key.
 	CreateIterator(cf int, prefix []byte) BWDBIterator
+	//CreateIteratorFrom is like CreateIterator, but it is positioned on
+	//the first key with the prefix that is not before start
+	CreateIteratorFrom(cf int, prefix []byte, start []byte) BWDBIterator
 }
-*/
 
 type BWDBIterator interface {
 	Next()
@@ -43,3 +66,42 @@ type BWDBIterator interface {
 	Value() []byte
 	Release()
 }
+
+var backends = make(map[string]func() BWDB)
+var backendsLock sync.Mutex
+
+//Register makes a storage backend available under the given name. The
+//constructor must return a new, uninitialized database each time.
+func Register(name string, ctor func() BWDB) {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	if _, ok := backends[name]; ok {
+		panic("duplicate storage backend " + name)
+	}
+	backends[name] = ctor
+}
+
+//Backends returns the names of the registered storage backends
+func Backends() []string {
+	backendsLock.Lock()
+	defer backendsLock.Unlock()
+	rv := make([]string, 0, len(backends))
+	for k := range backends {
+		rv = append(rv, k)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+//Open creates and initializes a database using the named backend
+func Open(backend string, dbname string) (BWDB, error) {
+	backendsLock.Lock()
+	ctor, ok := backends[backend]
+	backendsLock.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("unknown storage backend %q (have %v)", backend, Backends())
+	}
+	rv := ctor()
+	rv.Initialize(dbname)
+	return rv, nil
+}
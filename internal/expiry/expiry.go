@@ -0,0 +1,280 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package expiry finds the DOTs and entities that expire soon and keeps
+//track of the warnings the router has given about them. Finding the
+//objects to look at is done by the router in api.
+package expiry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+)
+
+//Warning is a DOT or entity that expires soon
+type Warning struct {
+	//"dot" or "entity"
+	Kind string `json:"kind"`
+	//The DOT hash or entity VK
+	ID     string    `json:"id"`
+	Expiry time.Time `json:"expiry"`
+	State  string    `json:"state"`
+	//The giver, receiver and URI of a DOT
+	From string `json:"from,omitempty"`
+	To   string `json:"to,omitempty"`
+	URI  string `json:"uri,omitempty"`
+}
+
+func (w *Warning) String() string {
+	left := w.Expiry.Sub(time.Now())
+	when := fmt.Sprintf("expires in %s", left.Truncate(time.Minute))
+	if left <= 0 {
+		when = "expired"
+	}
+	if w.Kind == "dot" {
+		return fmt.Sprintf("DOT %s %s (%s) on %s %s -> %s", w.ID, when, w.Expiry.Format(time.RFC3339), w.URI, w.From, w.To)
+	}
+	return fmt.Sprintf("entity %s %s (%s)", w.ID, when, w.Expiry.Format(time.RFC3339))
+}
+
+//Sort sorts warnings soonest first
+func Sort(w []*Warning) {
+	sort.Slice(w, func(i, j int) bool {
+		if w[i].Expiry.Equal(w[j].Expiry) {
+			return w[i].ID < w[j].ID
+		}
+		return w[i].Expiry.Before(w[j].Expiry)
+	})
+}
+
+//Link is a DOT and its registry state
+type Link struct {
+	D *objects.DOT
+	S int
+}
+
+//Resolver resolves the entities at either end of the DOTs
+type Resolver interface {
+	ResolveEntity(vk []byte) (*objects.Entity, int, error)
+	StateToString(state int) string
+}
+
+func dotWarning(d *objects.DOT, state string) *Warning {
+	rv := &Warning{
+		Kind:   "dot",
+		ID:     crypto.FmtHash(d.GetHash()),
+		Expiry: *d.GetExpiry(),
+		State:  state,
+		From:   crypto.FmtKey(d.GetGiverVK()),
+		To:     crypto.FmtKey(d.GetReceiverVK()),
+	}
+	if d.IsAccess() {
+		rv.URI = crypto.FmtKey(d.GetAccessURIMVK()) + "/" + d.GetAccessURISuffix()
+	}
+	return rv
+}
+
+//Expiring returns the warnings for the DOTs, the entities at either end of
+//them and the given entities that expire before the deadline, including
+//those that have already expired, soonest first. It fails if an entity
+//cannot be resolved.
+func Expiring(dots []Link, vks [][]byte, deadline time.Time, res Resolver) ([]*Warning, error) {
+	rv := []*Warning{}
+	entities := [][]byte{}
+	seen := make(map[string]bool)
+	addEntity := func(vk []byte) {
+		if !seen[string(vk)] {
+			seen[string(vk)] = true
+			entities = append(entities, vk)
+		}
+	}
+	for _, vk := range vks {
+		addEntity(vk)
+	}
+	seenDOT := make(map[string]bool)
+	for _, dl := range dots {
+		if seenDOT[string(dl.D.GetHash())] {
+			continue
+		}
+		seenDOT[string(dl.D.GetHash())] = true
+		if ex := dl.D.GetExpiry(); ex != nil && ex.Before(deadline) {
+			rv = append(rv, dotWarning(dl.D, res.StateToString(dl.S)))
+		}
+		addEntity(dl.D.GetGiverVK())
+		addEntity(dl.D.GetReceiverVK())
+	}
+	for _, vk := range entities {
+		e, state, err := res.ResolveEntity(vk)
+		if err != nil {
+			return nil, err
+		}
+		if e == nil {
+			continue
+		}
+		if ex := e.GetExpiry(); ex != nil && ex.Before(deadline) {
+			rv = append(rv, &Warning{
+				Kind:   "entity",
+				ID:     crypto.FmtKey(e.GetVK()),
+				Expiry: *ex,
+				State:  res.StateToString(state),
+			})
+		}
+	}
+	Sort(rv)
+	return rv, nil
+}
+
+//Watch keeps the current warnings, tells watchers about new ones and
+//remembers the entities that clients have set
+type Watch struct {
+	mu       sync.Mutex
+	current  map[string]*Warning
+	watchers map[int]func(w *Warning)
+	nextid   int
+	//The entities that clients have set, and how many times
+	loaded map[string]*objects.Entity
+	refs   map[string]int
+	//Held while watchers are being called, so that each sees the
+	//warnings once and in order
+	notifymu sync.Mutex
+}
+
+//NewWatch returns a Watch with no warnings
+func NewWatch() *Watch {
+	return &Watch{
+		current:  make(map[string]*Warning),
+		watchers: make(map[int]func(w *Warning)),
+		loaded:   make(map[string]*objects.Entity),
+		refs:     make(map[string]int),
+	}
+}
+
+//Note adds an entity that a client has set to the loaded ones until ctx,
+//the client's context, is done
+func (w *Watch) Note(ctx context.Context, e *objects.Entity) {
+	if e.GetExpiry() == nil {
+		return
+	}
+	k := string(e.GetVK())
+	w.mu.Lock()
+	w.loaded[k] = e
+	w.refs[k]++
+	w.mu.Unlock()
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		w.refs[k]--
+		if w.refs[k] <= 0 {
+			delete(w.refs, k)
+			delete(w.loaded, k)
+		}
+		w.mu.Unlock()
+	}()
+}
+
+//Loaded returns the VKs of the entities that clients have set
+func (w *Watch) Loaded() [][]byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	rv := make([][]byte, 0, len(w.loaded))
+	for _, e := range w.loaded {
+		rv = append(rv, e.GetVK())
+	}
+	return rv
+}
+
+//Update replaces the current warnings. The watchers are called with the
+//ones that are new, soonest first, before it returns them. changed is true
+//if the warnings are not the same as before.
+func (w *Watch) Update(warnings []*Warning) (fresh []*Warning, changed bool) {
+	w.notifymu.Lock()
+	defer w.notifymu.Unlock()
+	w.mu.Lock()
+	next := make(map[string]*Warning, len(warnings))
+	fresh = []*Warning{}
+	for _, wn := range warnings {
+		next[wn.ID] = wn
+		if _, ok := w.current[wn.ID]; !ok {
+			fresh = append(fresh, wn)
+		}
+	}
+	changed = len(fresh) > 0 || len(next) != len(w.current)
+	w.current = next
+	cbs := w.sortedWatchers()
+	w.mu.Unlock()
+	Sort(fresh)
+	for _, wn := range fresh {
+		for _, cb := range cbs {
+			cb(wn)
+		}
+	}
+	return fresh, changed
+}
+
+//sortedWatchers returns the watchers in the order they were added. The
+//lock must be held.
+func (w *Watch) sortedWatchers() []func(w *Warning) {
+	ids := make([]int, 0, len(w.watchers))
+	for id := range w.watchers {
+		ids = append(ids, id)
+	}
+	sort.Ints(ids)
+	rv := make([]func(w *Warning), len(ids))
+	for i, id := range ids {
+		rv[i] = w.watchers[id]
+	}
+	return rv
+}
+
+//Current returns the current warnings, soonest first
+func (w *Watch) Current() []*Warning {
+	w.mu.Lock()
+	rv := make([]*Warning, 0, len(w.current))
+	for _, wn := range w.current {
+		rv = append(rv, wn)
+	}
+	w.mu.Unlock()
+	Sort(rv)
+	return rv
+}
+
+//Watch calls cb with every current warning, and then with each new one
+//until ctx is done
+func (w *Watch) Watch(ctx context.Context, cb func(w *Warning)) {
+	w.notifymu.Lock()
+	defer w.notifymu.Unlock()
+	w.mu.Lock()
+	id := w.nextid
+	w.nextid++
+	w.watchers[id] = cb
+	w.mu.Unlock()
+	for _, wn := range w.Current() {
+		cb(wn)
+	}
+	go func() {
+		<-ctx.Done()
+		w.mu.Lock()
+		delete(w.watchers, id)
+		w.mu.Unlock()
+	}()
+}
@@ -0,0 +1,189 @@
+package expiry_test
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/expiry"
+	"github.com/immesys/bw2/objects"
+)
+
+type resolver struct {
+	entities map[string]*objects.Entity
+}
+
+func (r *resolver) ResolveEntity(vk []byte) (*objects.Entity, int, error) {
+	e, ok := r.entities[string(vk)]
+	if !ok {
+		return nil, 0, errors.New("no such entity")
+	}
+	return e, 1, nil
+}
+func (r *resolver) StateToString(state int) string {
+	if state == 1 {
+		return "Valid"
+	}
+	return "Expired"
+}
+
+func mkEntity(res *resolver, expires time.Time) *objects.Entity {
+	e := objects.CreateNewEntity("", "", nil)
+	if !expires.IsZero() {
+		e.SetExpiry(expires)
+	}
+	res.entities[string(e.GetVK())] = e
+	return e
+}
+
+func mkDOT(from, to *objects.Entity, expires time.Time) *objects.DOT {
+	d := objects.CreateDOT(true, from.GetVK(), to.GetVK())
+	d.SetAccessURI(from.GetVK(), "a/*")
+	d.SetPermString("C")
+	if !expires.IsZero() {
+		d.SetExpiry(expires)
+	}
+	d.Encode(from.GetSK())
+	return d
+}
+
+func TestExpiring(t *testing.T) {
+	now := time.Now()
+	res := &resolver{entities: make(map[string]*objects.Entity)}
+	ns := mkEntity(res, now.Add(48*time.Hour))
+	soon := mkEntity(res, now.Add(time.Hour))
+	late := mkEntity(res, now.Add(30*24*time.Hour))
+	never := mkEntity(res, time.Time{})
+	expired := mkEntity(res, now.Add(-time.Hour))
+	d1 := mkDOT(ns, soon, now.Add(2*time.Hour))
+	d2 := mkDOT(ns, late, now.Add(30*24*time.Hour))
+	d3 := mkDOT(ns, never, time.Time{})
+	dots := []expiry.Link{{D: d1, S: 1}, {D: d2, S: 1}, {D: d3, S: 1}, {D: d1, S: 1}}
+
+	ws, err := expiry.Expiring(dots, [][]byte{expired.GetVK(), ns.GetVK()}, now.Add(72*time.Hour), res)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []struct {
+		kind string
+		id   string
+	}{
+		{"entity", crypto.FmtKey(expired.GetVK())},
+		{"entity", crypto.FmtKey(soon.GetVK())},
+		{"dot", crypto.FmtHash(d1.GetHash())},
+		{"entity", crypto.FmtKey(ns.GetVK())},
+	}
+	if len(ws) != len(expect) {
+		t.Fatalf("expected %d warnings, got %d: %v", len(expect), len(ws), ws)
+	}
+	for i, e := range expect {
+		if ws[i].Kind != e.kind || ws[i].ID != e.id {
+			t.Fatalf("warning %d is %s %s, expected %s %s", i, ws[i].Kind, ws[i].ID, e.kind, e.id)
+		}
+	}
+	if ws[2].From != crypto.FmtKey(ns.GetVK()) || ws[2].To != crypto.FmtKey(soon.GetVK()) ||
+		ws[2].URI != crypto.FmtKey(ns.GetVK())+"/a/*" || ws[2].State != "Valid" {
+		t.Fatalf("DOT warning is wrong: %+v", ws[2])
+	}
+
+	stranger := objects.CreateNewEntity("", "", nil)
+	if _, err := expiry.Expiring(nil, [][]byte{stranger.GetVK()}, now, res); err == nil {
+		t.Fatal("expected an entity that cannot be resolved to fail")
+	}
+}
+
+func warning(id string, in time.Duration) *expiry.Warning {
+	return &expiry.Warning{Kind: "entity", ID: id, Expiry: time.Now().Add(in)}
+}
+
+func TestWatchUpdate(t *testing.T) {
+	w := expiry.NewWatch()
+	a, b, c := warning("a", time.Hour), warning("b", 2*time.Hour), warning("c", 30*time.Minute)
+	got := []string{}
+	ctx, cancel := context.WithCancel(context.Background())
+	w.Watch(ctx, func(wn *expiry.Warning) {
+		got = append(got, "1"+wn.ID)
+	})
+	w.Watch(context.Background(), func(wn *expiry.Warning) {
+		got = append(got, "2"+wn.ID)
+	})
+
+	check := func(name string, ws []*expiry.Warning, fresh int, changed bool, calls ...string) {
+		got = got[:0]
+		f, ch := w.Update(ws)
+		if len(f) != fresh || ch != changed {
+			t.Fatalf("%s: expected %d new and changed=%v, got %d and %v", name, fresh, changed, len(f), ch)
+		}
+		if len(got) != len(calls) {
+			t.Fatalf("%s: expected watchers to be called %v, got %v", name, calls, got)
+		}
+		for i := range calls {
+			if got[i] != calls[i] {
+				t.Fatalf("%s: expected watchers to be called %v, got %v", name, calls, got)
+			}
+		}
+	}
+	check("first", []*expiry.Warning{b, a}, 2, true, "1a", "2a", "1b", "2b")
+	check("same", []*expiry.Warning{a, b}, 0, false)
+	check("one new", []*expiry.Warning{a, b, c}, 1, true, "1c", "2c")
+	check("one gone", []*expiry.Warning{a, c}, 0, true)
+	check("gone and new", []*expiry.Warning{a, b}, 1, true, "1b", "2b")
+
+	cur := w.Current()
+	if len(cur) != 2 || cur[0] != a || cur[1] != b {
+		t.Fatalf("current warnings are wrong: %v", cur)
+	}
+	//A new watcher gets the current ones first
+	late := []string{}
+	w.Watch(context.Background(), func(wn *expiry.Warning) {
+		late = append(late, wn.ID)
+	})
+	if len(late) != 2 || late[0] != "a" || late[1] != "b" {
+		t.Fatalf("new watcher got %v", late)
+	}
+
+	cancel()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got = got[:0]
+		d := warning("d", time.Minute)
+		w.Update([]*expiry.Warning{a, b, d})
+		if len(got) == 1 && got[0] == "2d" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("cancelled watcher was still called: %v", got)
+		}
+		w.Update([]*expiry.Warning{a, b})
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestNote(t *testing.T) {
+	w := expiry.NewWatch()
+	e := objects.CreateNewEntity("", "", nil)
+	e.SetExpiry(time.Now().Add(time.Hour))
+	w.Note(context.Background(), objects.CreateNewEntity("", "", nil))
+	ctx1, cancel1 := context.WithCancel(context.Background())
+	ctx2, cancel2 := context.WithCancel(context.Background())
+	w.Note(ctx1, e)
+	w.Note(ctx2, e)
+	if l := w.Loaded(); len(l) != 1 {
+		t.Fatalf("expected only the entity with an expiry to be loaded, got %d", len(l))
+	}
+	cancel1()
+	time.Sleep(50 * time.Millisecond)
+	if len(w.Loaded()) != 1 {
+		t.Fatal("entity was forgotten while another client still has it set")
+	}
+	cancel2()
+	deadline := time.Now().Add(5 * time.Second)
+	for len(w.Loaded()) != 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("entity was not forgotten when the clients closed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
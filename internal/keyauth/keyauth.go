@@ -0,0 +1,103 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package keyauth decides whether an IBE key authority issues the identity
+//key for a URI to a requester. Receiving the requests and publishing the
+//responses is done by the key authority in api.
+package keyauth
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+
+	"github.com/immesys/bw2/box"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+	"vuvuzela.io/crypto/ibe"
+)
+
+//Authority issues the identity keys for the URIs in one namespace
+type Authority struct {
+	MVK  []byte
+	Pub  *ibe.MasterPublicKey
+	Priv *ibe.MasterPrivateKey
+	Res  core.Resolver
+}
+
+//Issue returns the base64 encoded identity key for the URI suffix (see
+//box.UnmarshalBoxIdentity) if the access chain with the given hash grants
+//the requester C on it
+func (a *Authority) Issue(uri string, chain string, requester []byte) (string, error) {
+	if err := a.CheckConsume(uri, chain, requester); err != nil {
+		return "", err
+	}
+	id := box.ExtractIdentity(a.Pub, a.Priv, box.IdentityForURI(a.MVK, uri))
+	bin, err := id.MarshalBinary()
+	if err != nil {
+		panic(err)
+	}
+	return base64.URLEncoding.EncodeToString(bin), nil
+}
+
+//CheckConsume verifies that the access chain with the given hash grants
+//the requester C on the URI suffix
+func (a *Authority) CheckConsume(uri string, chain string, requester []byte) error {
+	valid, star, plus, _ := util.AnalyzeSuffix(uri)
+	if !valid || star || plus {
+		return bwe.M(bwe.BadURI, "identity keys are only issued for URIs without wildcards")
+	}
+	hash, err := crypto.UnFmtHash(chain)
+	if err != nil {
+		return bwe.M(bwe.MalformedMessage, "bad chain hash")
+	}
+	dci, err := objects.NewDChain(objects.ROAccessDChainHash, hash)
+	if err != nil {
+		return bwe.WrapM(bwe.MalformedMessage, "bad chain hash", err)
+	}
+	dc := core.ElaborateDChain(dci.(*objects.DChain), a.Res)
+	if dc == nil {
+		return bwe.M(bwe.Unresolvable, "could not elaborate the chain hash")
+	}
+	for i := 0; i < dc.NumHashes(); i++ {
+		d, state, err := a.Res.ResolveDOT(dc.GetDotHash(i))
+		if err != nil {
+			return bwe.WrapM(bwe.BadPermissions, "Could not verify DOT", err)
+		}
+		if state != core.StateValid {
+			return bwe.M(bwe.BadPermissions, fmt.Sprintf("chain DOT %d invalid: %s", i, a.Res.StateToString(state)))
+		}
+		dc.SetDOT(i, d)
+	}
+	if !dc.CheckAllSigs() {
+		return bwe.M(bwe.InvalidSig, "chain contained invalid DOTs (sig)")
+	}
+	err, mvk, _, _, _, _, holder := core.AnalyzeAccessDOTChain(core.TypeSubscribe, uri, dc)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(mvk, a.MVK) {
+		return bwe.M(bwe.MVKMismatch, "chain namespace doesn't match the key authority")
+	}
+	if !bytes.Equal(holder, requester) && !bytes.Equal(holder, util.EverybodySlice) {
+		return bwe.M(bwe.BadPermissions, "chain does not grant the requester")
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+package keyauth_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"testing"
+
+	"github.com/immesys/bw2/box"
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/keyauth"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+	"vuvuzela.io/crypto/ibe"
+)
+
+type resolver struct {
+	dots   map[string]*objects.DOT
+	states map[string]int
+	chains map[string]*objects.DChain
+}
+
+func (r *resolver) ResolveDOT(hash []byte) (*objects.DOT, int, error) {
+	d, ok := r.dots[string(hash)]
+	if !ok {
+		return nil, core.StateUnknown, errors.New("no such DOT")
+	}
+	return d, r.states[string(hash)], nil
+}
+func (r *resolver) ResolveEntity(vk []byte) (*objects.Entity, int, error) {
+	return nil, core.StateUnknown, errors.New("no such entity")
+}
+func (r *resolver) ResolveAccessDChain(hash []byte) (*objects.DChain, int, error) {
+	dc, ok := r.chains[string(hash)]
+	if !ok {
+		return nil, core.StateUnknown, errors.New("no such chain")
+	}
+	return dc, core.StateValid, nil
+}
+func (r *resolver) StateToString(state int) string {
+	switch state {
+	case core.StateValid:
+		return "Valid"
+	case core.StateExpired:
+		return "Expired"
+	case core.StateRevoked:
+		return "Revoked"
+	}
+	return "Unknown"
+}
+
+//mkAuthority returns an authority for a new namespace that has granted
+//the requester perms on uri, and the hash of the chain that does so
+func mkAuthority(t *testing.T, requester []byte, perms string, uri string) (*keyauth.Authority, *resolver, string) {
+	ns := objects.CreateNewEntity("", "", nil)
+	dot := objects.CreateDOT(true, ns.GetVK(), requester)
+	dot.SetAccessURI(ns.GetVK(), uri)
+	dot.SetPermString(perms)
+	dot.Encode(ns.GetSK())
+	dc, err := objects.CreateDChain(true, dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res := &resolver{
+		dots:   map[string]*objects.DOT{string(dot.GetHash()): dot},
+		states: map[string]int{string(dot.GetHash()): core.StateValid},
+		chains: map[string]*objects.DChain{string(dc.GetChainHash()): dc},
+	}
+	pub, priv := ibe.Setup(rand.Reader)
+	return &keyauth.Authority{MVK: ns.GetVK(), Pub: pub, Priv: priv, Res: res}, res, crypto.FmtHash(dc.GetChainHash())
+}
+
+func TestIssueOpensBox(t *testing.T) {
+	requester := objects.CreateNewEntity("", "", nil)
+	a, _, chain := mkAuthority(t, requester.GetVK(), "C", "a/*")
+	id, err := a.Issue("a/b", chain, requester.GetVK())
+	if err != nil {
+		t.Fatal(err)
+	}
+	bin, err := base64.URLEncoding.DecodeString(id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bxid, err := box.UnmarshalBoxIdentity(bin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumString, []byte("hi"))
+	publisher := objects.CreateNewEntity("", "", nil)
+	for _, uri := range []string{"a/b", "a/c"} {
+		bpo, err := box.BoxPayloadObject(publisher, po, nil, a.Pub, box.IdentityForURI(a.MVK, uri))
+		if err != nil {
+			t.Fatal(err)
+		}
+		opo, err := box.OpenPayloadObject(bpo, nil, []*box.BoxIdentity{bxid})
+		if uri == "a/b" {
+			if err != nil || !bytes.Equal(opo.GetContent(), []byte("hi")) {
+				t.Fatalf("identity for a/b could not open a box for a/b: %v", err)
+			}
+		} else if err == nil {
+			t.Fatalf("identity for a/b opened a box for %s", uri)
+		}
+	}
+}
+
+func TestCheckConsume(t *testing.T) {
+	requester := objects.CreateNewEntity("", "", nil)
+	stranger := objects.CreateNewEntity("", "", nil)
+	a, _, chain := mkAuthority(t, requester.GetVK(), "C", "a/*")
+	_, _, pchain := mkAuthority(t, requester.GetVK(), "P", "a/*")
+	_, ores, ochain := mkAuthority(t, requester.GetVK(), "C", "a/*")
+	//Let the authority see the chain in the other namespace
+	res := a.Res.(*resolver)
+	for k, v := range ores.dots {
+		res.dots[k], res.states[k] = v, core.StateValid
+	}
+	for k, v := range ores.chains {
+		res.chains[k] = v
+	}
+
+	for _, tc := range []struct {
+		name      string
+		uri       string
+		chain     string
+		requester []byte
+		code      int
+	}{
+		{"granted", "a/b", chain, requester.GetVK(), bwe.Okay},
+		{"wildcard", "a/*", chain, requester.GetVK(), bwe.BadURI},
+		{"plus", "a/+", chain, requester.GetVK(), bwe.BadURI},
+		{"outside the grant", "b/c", chain, requester.GetVK(), bwe.BadURI},
+		{"not the holder", "a/b", chain, stranger.GetVK(), bwe.BadPermissions},
+		{"bad hash", "a/b", "notahash", requester.GetVK(), bwe.MalformedMessage},
+		{"unknown chain", "a/b", pchain, requester.GetVK(), bwe.Unresolvable},
+		{"other namespace", "a/b", ochain, requester.GetVK(), bwe.MVKMismatch},
+	} {
+		err := a.CheckConsume(tc.uri, tc.chain, tc.requester)
+		if tc.code == bwe.Okay {
+			if err != nil {
+				t.Errorf("%s: unexpected error %v", tc.name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expected error %d", tc.name, tc.code)
+			continue
+		}
+		if bwe.AsBW(err).Code != tc.code {
+			t.Errorf("%s: expected error %d, got %v", tc.name, tc.code, err)
+		}
+	}
+}
+
+func TestCheckConsumeRevoked(t *testing.T) {
+	requester := objects.CreateNewEntity("", "", nil)
+	a, res, chain := mkAuthority(t, requester.GetVK(), "C", "a/*")
+	for h := range res.states {
+		res.states[h] = core.StateRevoked
+	}
+	if _, err := a.Issue("a/b", chain, requester.GetVK()); err == nil || bwe.AsBW(err).Code != bwe.BadPermissions {
+		t.Fatalf("expected a revoked DOT to be refused, got %v", err)
+	}
+}
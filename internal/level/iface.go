@@ -18,56 +18,57 @@
 package level
 
 import (
-	"errors"
 	"fmt"
 	"os"
 	"path"
 	"strconv"
 
+	"github.com/immesys/bw2/internal/db"
 	"github.com/syndtr/goleveldb/leveldb"
 	"github.com/syndtr/goleveldb/leveldb/iterator"
 	"github.com/syndtr/goleveldb/leveldb/util"
 )
 
-var doneInit bool
-var dbh []*leveldb.DB
+func init() {
+	db.Register("level", func() db.BWDB {
+		return &DB{}
+	})
+}
+
+//DB is a pure go backend that keeps each column family in a separate
+//LevelDB database
+type DB struct {
+	dbh []*leveldb.DB
+}
 
-func RawInitialize(dbname string) {
-	if doneInit {
+func (d *DB) Initialize(dbname string) {
+	if d.dbh != nil {
 		return
 	}
 	os.MkdirAll(dbname, 0755)
-	for i := 0; i < CFEntity; i++ {
-		db, err := leveldb.OpenFile(path.Join(dbname, strconv.Itoa(i)), nil)
+	for i := 0; i < db.CFMax; i++ {
+		h, err := leveldb.OpenFile(path.Join(dbname, strconv.Itoa(i)), nil)
 		if err != nil {
 			fmt.Println("DB error: ", err)
+			fmt.Println("(the database can only be open in one process, is a router using it?)")
 			os.Exit(1)
 		}
-		dbh = append(dbh, db)
+		d.dbh = append(d.dbh, h)
 	}
-	doneInit = true
 }
 
-const (
-	CFDot    = 1
-	CFDChain = 2
-	CFMsg    = 3
-	CFMsgI   = 4
-	CFEntity = 5
-)
-
 //ErrObjNotFound is returned from GetObject if the object cannot be found
-var ErrObjNotFound = errors.New("Object Not Found")
+var ErrObjNotFound = db.ErrObjNotFound
 
-func PutObject(cf int, key []byte, val []byte) {
-	err := dbh[cf-1].Put(key, val, nil)
+func (d *DB) PutObject(cf int, key []byte, val []byte) {
+	err := d.dbh[cf-1].Put(key, val, nil)
 	if err != nil {
 		panic(err)
 	}
 }
 
-func GetObject(cf int, key []byte) ([]byte, error) {
-	rv, err := dbh[cf-1].Get(key, nil)
+func (d *DB) GetObject(cf int, key []byte) ([]byte, error) {
+	rv, err := d.dbh[cf-1].Get(key, nil)
 	if err == leveldb.ErrNotFound {
 		return nil, ErrObjNotFound
 	}
@@ -77,12 +78,12 @@ func GetObject(cf int, key []byte) ([]byte, error) {
 	return rv, nil
 }
 
-func DeleteObject(cf int, key []byte) {
-	dbh[cf-1].Delete(key, nil)
+func (d *DB) DeleteObject(cf int, key []byte) {
+	d.dbh[cf-1].Delete(key, nil)
 }
 
-func Exists(cf int, key []byte) bool {
-	rv, err := dbh[cf-1].Has(key, nil)
+func (d *DB) Exists(cf int, key []byte) bool {
+	rv, err := d.dbh[cf-1].Has(key, nil)
 	if err != nil {
 		panic(err)
 	}
@@ -94,23 +95,32 @@ type Iterator struct {
 	state  iterator.Iterator
 }
 
-func CreateIterator(cf int, prefix []byte) *Iterator {
-	it := dbh[cf-1].NewIterator(util.BytesPrefix(prefix), nil)
+func (d *DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	it := d.dbh[cf-1].NewIterator(util.BytesPrefix(prefix), nil)
 	it.Next()
 	return &Iterator{prefix: prefix, state: it}
 }
 
+func (d *DB) CreateIteratorFrom(cf int, prefix []byte, start []byte) db.BWDBIterator {
+	it := d.dbh[cf-1].NewIterator(util.BytesPrefix(prefix), nil)
+	//Seek stays within the prefix range
+	it.Seek(start)
+	return &Iterator{prefix: prefix, state: it}
+}
+
 func (i *Iterator) Next() {
 	i.state.Next()
 }
 func (i *Iterator) OK() bool {
 	return i.state.Valid()
 }
+//LevelDB reuses the key and value buffers when the iterator moves, so
+//they are copied
 func (i *Iterator) Key() []byte {
-	return i.state.Key()
+	return append([]byte{}, i.state.Key()...)
 }
 func (i *Iterator) Value() []byte {
-	return i.state.Value()
+	return append([]byte{}, i.state.Value()...)
 }
 func (i *Iterator) Release() {
 	i.state.Release()
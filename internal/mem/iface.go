@@ -0,0 +1,131 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package mem
+
+//This is a storage backend that keeps everything in memory. Nothing
+//survives a restart, so it is only really useful for tests.
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/immesys/bw2/internal/db"
+)
+
+func init() {
+	db.Register("memory", func() db.BWDB {
+		return &DB{}
+	})
+}
+
+type DB struct {
+	mu  sync.RWMutex
+	cfs []map[string][]byte
+}
+
+func (d *DB) Initialize(dbname string) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.cfs != nil {
+		return
+	}
+	for i := 0; i < db.CFMax; i++ {
+		d.cfs = append(d.cfs, make(map[string][]byte))
+	}
+}
+
+func dup(b []byte) []byte {
+	rv := make([]byte, len(b))
+	copy(rv, b)
+	return rv
+}
+
+func (d *DB) PutObject(cf int, key []byte, val []byte) {
+	d.mu.Lock()
+	d.cfs[cf-1][string(key)] = dup(val)
+	d.mu.Unlock()
+}
+
+func (d *DB) GetObject(cf int, key []byte) ([]byte, error) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	v, ok := d.cfs[cf-1][string(key)]
+	if !ok {
+		return nil, db.ErrObjNotFound
+	}
+	return dup(v), nil
+}
+
+func (d *DB) DeleteObject(cf int, key []byte) {
+	d.mu.Lock()
+	delete(d.cfs[cf-1], string(key))
+	d.mu.Unlock()
+}
+
+func (d *DB) Exists(cf int, key []byte) bool {
+	d.mu.RLock()
+	_, ok := d.cfs[cf-1][string(key)]
+	d.mu.RUnlock()
+	return ok
+}
+
+//Iterator works on a snapshot of the matching keys taken when it is
+//created, like the iterators of the other backends
+type Iterator struct {
+	keys []string
+	vals [][]byte
+	idx  int
+}
+
+func (d *DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	return d.CreateIteratorFrom(cf, prefix, prefix)
+}
+
+func (d *DB) CreateIteratorFrom(cf int, prefix []byte, start []byte) db.BWDBIterator {
+	p, st := string(prefix), string(start)
+	d.mu.RLock()
+	keys := []string{}
+	for k := range d.cfs[cf-1] {
+		if strings.HasPrefix(k, p) && k >= st {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	vals := make([][]byte, len(keys))
+	for i, k := range keys {
+		vals[i] = d.cfs[cf-1][k]
+	}
+	d.mu.RUnlock()
+	return &Iterator{keys: keys, vals: vals}
+}
+
+func (i *Iterator) Next() {
+	i.idx++
+}
+func (i *Iterator) OK() bool {
+	return i.idx < len(i.keys)
+}
+func (i *Iterator) Key() []byte {
+	return []byte(i.keys[i.idx])
+}
+func (i *Iterator) Value() []byte {
+	return dup(i.vals[i.idx])
+}
+func (i *Iterator) Release() {
+}
@@ -0,0 +1,250 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package metrics holds the prometheus metrics exported by the router
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/util/bwe"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "bw2"
+
+//PrefixDepth is how many URI elements after the namespace are used to
+//label per-URI metrics. Larger values give finer detail but more series.
+var PrefixDepth = 1
+
+var (
+	Publishes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "terminus",
+		Name:      "publish_total",
+		Help:      "Messages published into the terminus, by URI prefix",
+	}, []string{"prefix"})
+	Subscribes = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "terminus",
+		Name:      "subscribe_total",
+		Help:      "Subscriptions created in the terminus, by URI prefix",
+	}, []string{"prefix"})
+	QueueDepth = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "terminus",
+		Name:      "subscription_queue_depth",
+		Help:      "Messages waiting in the queues of all subscriptions",
+	}, func() float64 {
+		return float64(sources().queued())
+	})
+	OverflowUnsubscribes = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "terminus",
+		Name:      "overflow_unsubscribes_total",
+		Help:      "Subscriptions dropped because their queue was full",
+	})
+	TerminatedSubscriptions = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "terminus",
+		Name:      "terminated_subscriptions_total",
+		Help:      "Subscriptions ended because their access chain became invalid",
+	})
+	VerifyLatency = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Subsystem: "message",
+		Name:      "verify_seconds",
+		Help:      "Time taken to verify a message",
+	})
+	VerifyFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "message",
+		Name:      "verify_failures_total",
+		Help:      "Messages that failed verification, by status code",
+	}, []string{"code"})
+	CacheLookups = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "resolution",
+		Name:      "cache_lookups_total",
+		Help:      "Resolution cache lookups, by cache and result",
+	}, []string{"cache", "result"})
+	PeerConnected = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "connected",
+		Help:      "1 if the connection to the peer router is up",
+	}, []string{"target"})
+	PeerReconnects = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "reconnects_total",
+		Help:      "Times the connection to the peer router was reestablished",
+	}, []string{"target"})
+	PeerThrottles = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "throttled_total",
+		Help:      "Times a peer subscription ran out of flow control credit",
+	}, []string{"peer"})
+	PeerCertChanges = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Subsystem: "peer",
+		Name:      "cert_changes_total",
+		Help:      "Times a peer router presented a different certificate to the one pinned",
+	}, []string{"target", "accepted"})
+	ChainHeadAge = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "chain",
+		Name:      "head_age_seconds",
+		Help:      "Age of the latest block",
+	}, func() float64 {
+		return float64(sources().headAge())
+	})
+	ChainHead = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "chain",
+		Name:      "head_block",
+		Help:      "Number of the latest block",
+	}, func() float64 {
+		return float64(sources().head())
+	})
+	ChainConfirmed = prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Subsystem: "chain",
+		Name:      "confirmed_block",
+		Help:      "Number of the latest block with enough confirmations to be acted on",
+	}, func() float64 {
+		return float64(sources().confirmed())
+	})
+)
+
+//The gauges that are read from the router rather than set are registered
+//once, and read from whichever router set its sources last. A process can
+//open more than one BW context.
+type gaugeSources struct {
+	queued    func() int
+	headAge   func() int64
+	head      func() uint64
+	confirmed func() uint64
+}
+
+var srcmu sync.Mutex
+var src = gaugeSources{
+	queued:    func() int { return 0 },
+	headAge:   func() int64 { return 0 },
+	head:      func() uint64 { return 0 },
+	confirmed: func() uint64 { return 0 },
+}
+
+func sources() gaugeSources {
+	srcmu.Lock()
+	defer srcmu.Unlock()
+	return src
+}
+
+func init() {
+	prometheus.MustRegister(Publishes, Subscribes, QueueDepth, OverflowUnsubscribes, TerminatedSubscriptions,
+		VerifyLatency, VerifyFailures, CacheLookups, PeerConnected, PeerReconnects,
+		PeerThrottles, PeerCertChanges)
+}
+
+//register is like prometheus.MustRegister, but a collector that is
+//already registered is not an error
+func register(cs ...prometheus.Collector) {
+	for _, c := range cs {
+		if err := prometheus.Register(c); err != nil {
+			if _, ok := err.(prometheus.AlreadyRegisteredError); !ok {
+				log.Warnf("could not register metric: %v", err)
+			}
+		}
+	}
+}
+
+//URIPrefix returns the label for a topic of the form namespace/suffix
+func URIPrefix(topic string) string {
+	parts := strings.SplitN(topic, "/", PrefixDepth+2)
+	if len(parts) > PrefixDepth+1 {
+		parts = parts[:PrefixDepth+1]
+	}
+	return strings.Join(parts, "/")
+}
+
+//ObserveVerify records the outcome of verifying a message
+func ObserveVerify(took time.Duration, err error) {
+	VerifyLatency.Observe(took.Seconds())
+	if err == nil {
+		return
+	}
+	code := "other"
+	if bwerr, ok := err.(*bwe.BWStatus); ok {
+		code = strconv.Itoa(bwerr.Code)
+	}
+	VerifyFailures.WithLabelValues(code).Inc()
+}
+
+//CacheLookup records a hit or miss on one of the resolution caches
+func CacheLookup(cache string, hit bool) {
+	result := "miss"
+	if hit {
+		result = "hit"
+	}
+	CacheLookups.WithLabelValues(cache, result).Inc()
+}
+
+//SetPeerConnected records the state of the connection to a peer router
+func SetPeerConnected(target string, up bool) {
+	v := 0.0
+	if up {
+		v = 1
+	}
+	PeerConnected.WithLabelValues(target).Set(v)
+}
+
+//RegisterQueueDepth sets where the subscription queue depth is read from
+func RegisterQueueDepth(queued func() int) {
+	srcmu.Lock()
+	src.queued = queued
+	srcmu.Unlock()
+}
+
+//RegisterChainLag exports the age of the head block in seconds, which is
+//how far behind the chain we are, the head block number and the latest
+//confirmed block number
+func RegisterChainLag(headAge func() int64, head func() uint64, confirmed func() uint64) {
+	srcmu.Lock()
+	src.headAge = headAge
+	src.head = head
+	src.confirmed = confirmed
+	srcmu.Unlock()
+	register(ChainHeadAge, ChainHead, ChainConfirmed)
+}
+
+//Start serves the metrics on /metrics. It uses its own mux so that it
+//does not clash with iptep.
+func Start(listenOn string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	log.Infof("serving metrics on %s", listenOn)
+	err := http.ListenAndServe(listenOn, mux)
+	log.Criticalf("metrics server failed: %v", err)
+}
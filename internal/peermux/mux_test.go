@@ -0,0 +1,173 @@
+package peermux_test
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/peermux"
+)
+
+//pair returns a client session and the server side of it
+func pair(t *testing.T, sv *peermux.Server) (*peermux.Session, *peermux.Session, net.Conn) {
+	c, s := net.Pipe()
+	type res struct {
+		s   *peermux.Session
+		err error
+	}
+	ch := make(chan res, 1)
+	go func() {
+		ss, isNew, err := sv.Serve(s)
+		if err == nil && !isNew {
+			t.Error("expected a new session")
+		}
+		ch <- res{ss, err}
+	}()
+	cs, err := peermux.Client(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := <-ch
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	return cs, r.s, c
+}
+
+func echo(ss *peermux.Session) {
+	for {
+		st, err := ss.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			io.Copy(st, st)
+			st.Close()
+		}()
+	}
+}
+
+func TestEchoManyStreams(t *testing.T) {
+	cs, ss, _ := pair(t, peermux.NewServer())
+	defer cs.Close()
+	go echo(ss)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			st, err := cs.Open()
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer st.Close()
+			msg := bytes.Repeat([]byte{byte(i)}, 100000+i)
+			go st.Write(msg)
+			got := make([]byte, len(msg))
+			if _, err := io.ReadFull(st, got); err != nil {
+				t.Error(err)
+				return
+			}
+			if !bytes.Equal(got, msg) {
+				t.Errorf("stream %d did not echo", i)
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestStalledStream(t *testing.T) {
+	cs, ss, _ := pair(t, peermux.NewServer())
+	defer cs.Close()
+	//Nobody reads the first stream, so its window fills
+	stalled, err := cs.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ss.Accept(); err != nil {
+		t.Fatal(err)
+	}
+	stalled.SetWriteDeadline(time.Now().Add(200 * time.Millisecond))
+	if _, err := stalled.Write(make([]byte, 2*peermux.InitialWindow)); err == nil {
+		t.Fatal("expected the write to time out")
+	}
+	go echo(ss)
+	st, err := cs.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := st.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(st, got); err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("got %q", got)
+	}
+}
+
+func TestResume(t *testing.T) {
+	sv := peermux.NewServer()
+	cs, ss, conn := pair(t, sv)
+	defer cs.Close()
+	go echo(ss)
+	st, err := cs.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg := make([]byte, 4*peermux.InitialWindow)
+	for i := range msg {
+		msg[i] = byte(i * 7)
+	}
+	go func() {
+		if _, err := st.Write(msg); err != nil {
+			t.Error(err)
+		}
+	}()
+	got := make([]byte, len(msg))
+	if _, err := io.ReadFull(st, got[:len(msg)/3]); err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	<-cs.Broken()
+	c, s := net.Pipe()
+	go func() {
+		rs, isNew, err := sv.Serve(s)
+		if err != nil || isNew || rs != ss {
+			t.Errorf("expected the session to be resumed: %v", err)
+		}
+	}()
+	if err := cs.Resume(c); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(st, got[len(msg)/3:]); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, msg) {
+		t.Fatal("data was lost or corrupted over the resume")
+	}
+}
+
+func TestResumeUnknown(t *testing.T) {
+	cs, _, conn := pair(t, peermux.NewServer())
+	defer cs.Close()
+	conn.Close()
+	<-cs.Broken()
+	c, s := net.Pipe()
+	go peermux.NewServer().Serve(s)
+	if err := cs.Resume(c); err != peermux.ErrUnknownSession {
+		t.Fatalf("expected ErrUnknownSession, got %v", err)
+	}
+	select {
+	case <-cs.Done():
+	default:
+		t.Fatal("expected the session to be closed")
+	}
+}
@@ -0,0 +1,664 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package peermux multiplexes independent streams over one connection
+//between two routers, so that a large transfer on one stream does not hold
+//up the others. Each stream has its own flow control window, and data is
+//sent in small chunks so that streams interleave.
+//
+//A session outlives its connection. Frames are kept until the other side
+//acknowledges them, so if the connection breaks the client can resume the
+//session over a new connection (from a new address, even) and anything
+//lost in the break is sent again. Streams see no interruption.
+package peermux
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+//Frame header is [1 type][4 stream id][4 payload length]
+const headerSize = 9
+
+const (
+	//Payload is stream data
+	frameData = 1
+	//Opens the stream
+	frameOpen = 2
+	//The sender will not read or write the stream again
+	frameClose = 3
+	//Payload is a little endian uint32 of further bytes the sender
+	//can receive on the stream
+	frameWindow = 4
+	//Payload is the little endian uint64 count of bytes received on the
+	//session. Acks are not counted or kept for replay.
+	frameAck = 5
+)
+
+//The largest data frame. Smaller frames interleave streams more finely
+const maxChunk = 16 * 1024
+
+//InitialWindow is how much a stream may send before the receiver must
+//say it has read some of it
+const InitialWindow = 256 * 1024
+
+//How much may be sent but not acknowledged before writers block
+const maxReplay = 16 * 1024 * 1024
+
+//Acknowledge after this much has been received, or every ackInterval
+const ackEvery = 64 * 1024
+const ackInterval = time.Second
+
+//ResumeTimeout is how long the server keeps a session whose connection
+//has broken, waiting for the client to resume it
+var ResumeTimeout = 2 * time.Minute
+
+//ErrClosed is returned from operations on a closed session or stream
+var ErrClosed = errors.New("peermux: closed")
+
+//ErrUnknownSession is returned from Resume if the server no longer has
+//the session, so a new one must be started
+var ErrUnknownSession = errors.New("peermux: unknown session")
+
+type frame struct {
+	typ     uint8
+	id      uint32
+	payload []byte
+}
+
+func (f *frame) encode() []byte {
+	rv := make([]byte, headerSize+len(f.payload))
+	rv[0] = f.typ
+	binary.LittleEndian.PutUint32(rv[1:], f.id)
+	binary.LittleEndian.PutUint32(rv[5:], uint32(len(f.payload)))
+	copy(rv[headerSize:], f.payload)
+	return rv
+}
+
+//Session is one end of a multiplexed connection
+type Session struct {
+	id     [16]byte
+	client bool
+	//Held while writing to the connection, taken before mu
+	wmu sync.Mutex
+	//Protects everything below
+	mu   sync.Mutex
+	cond *sync.Cond
+	conn net.Conn
+	//Closed when conn breaks
+	broken chan struct{}
+	closed bool
+	done   chan struct{}
+	//Frames sent since base that have not been acknowledged
+	replay []byte
+	base   uint64
+	//Bytes received, and whether the peer needs to be told
+	rcvd     uint64
+	ackDue   bool
+	lastAck  uint64
+	windows  map[uint32]uint32
+	streams  map[uint32]*Stream
+	nextID   uint32
+	accepts  []*Stream
+	onClosed func()
+	sendq    chan *frame
+	kick     chan struct{}
+}
+
+func newSession(id [16]byte, client bool) *Session {
+	s := &Session{
+		id:      id,
+		client:  client,
+		broken:  make(chan struct{}),
+		done:    make(chan struct{}),
+		windows: make(map[uint32]uint32),
+		streams: make(map[uint32]*Stream),
+		sendq:   make(chan *frame, 64),
+		kick:    make(chan struct{}, 1),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	//Client streams are odd and server streams are even
+	s.nextID = 2
+	if client {
+		s.nextID = 1
+	}
+	close(s.broken)
+	go s.sendLoop()
+	return s
+}
+
+//Client starts a new session over the connection
+func Client(conn net.Conn) (*Session, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return nil, err
+	}
+	s := newSession(id, true)
+	if err := s.clientHandshake(conn, opNew); err != nil {
+		s.Close()
+		return nil, err
+	}
+	return s, nil
+}
+
+//Resume continues the session over a new connection. The old one is
+//closed if it is still open. If the server has forgotten the session
+//ErrUnknownSession is returned and the session is closed.
+func (s *Session) Resume(conn net.Conn) error {
+	if !s.client {
+		return errors.New("peermux: only the client can resume")
+	}
+	err := s.clientHandshake(conn, opResume)
+	if err == ErrUnknownSession {
+		s.Close()
+	}
+	return err
+}
+
+//Broken returns a channel that is closed when the current connection
+//breaks, or immediately if there is none
+func (s *Session) Broken() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.broken
+}
+
+//Done returns a channel that is closed when the session is closed
+func (s *Session) Done() <-chan struct{} {
+	return s.done
+}
+
+//RemoteAddr returns the address of the current connection, or nil
+func (s *Session) RemoteAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.RemoteAddr()
+}
+
+//LocalAddr returns the local address of the current connection, or nil
+func (s *Session) LocalAddr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn == nil {
+		return nil
+	}
+	return s.conn.LocalAddr()
+}
+
+//Close closes the session, its streams and its connection
+func (s *Session) Close() error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil
+	}
+	s.closed = true
+	close(s.done)
+	for _, st := range s.streams {
+		st.rclosed = true
+		st.wclosed = true
+	}
+	s.streams = nil
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+		close(s.broken)
+	}
+	onClosed := s.onClosed
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	if onClosed != nil {
+		onClosed()
+	}
+	return nil
+}
+
+//Open opens a new stream
+func (s *Session) Open() (*Stream, error) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return nil, ErrClosed
+	}
+	st := newStream(s, s.nextID)
+	s.nextID += 2
+	s.streams[st.id] = st
+	s.mu.Unlock()
+	if err := s.send(&frame{typ: frameOpen, id: st.id}); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+//Accept waits for the other side to open a stream
+func (s *Session) Accept() (*Stream, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for len(s.accepts) == 0 && !s.closed {
+		s.cond.Wait()
+	}
+	if s.closed {
+		return nil, ErrClosed
+	}
+	st := s.accepts[0]
+	s.accepts = s.accepts[1:]
+	return st, nil
+}
+
+//send queues a frame to be sent, blocking if the queue is full
+func (s *Session) send(f *frame) error {
+	select {
+	case s.sendq <- f:
+		return nil
+	case <-s.done:
+		return ErrClosed
+	}
+}
+
+func (s *Session) wake() {
+	select {
+	case s.kick <- struct{}{}:
+	default:
+	}
+}
+
+//sendLoop is the only writer of frames apart from attach. Window and ack
+//frames are never queued behind data, so that a blocked writer cannot
+//stop the other side from making progress.
+func (s *Session) sendLoop() {
+	ticker := time.NewTicker(ackInterval)
+	defer ticker.Stop()
+	for {
+		s.mu.Lock()
+		q := s.sendq
+		if len(s.replay) >= maxReplay {
+			//Wait for acks before sending more
+			q = nil
+		}
+		s.mu.Unlock()
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.mu.Lock()
+			if s.rcvd != s.lastAck {
+				s.ackDue = true
+			}
+			s.mu.Unlock()
+			s.flushControl()
+		case <-s.kick:
+			s.flushControl()
+		case f := <-q:
+			s.flushControl()
+			s.write(f.encode(), true)
+		}
+	}
+}
+
+//flushControl sends pending window updates and acks
+func (s *Session) flushControl() {
+	s.mu.Lock()
+	var frames []*frame
+	for id, n := range s.windows {
+		p := make([]byte, 4)
+		binary.LittleEndian.PutUint32(p, n)
+		frames = append(frames, &frame{typ: frameWindow, id: id, payload: p})
+	}
+	s.windows = make(map[uint32]uint32)
+	ack := s.ackDue
+	s.ackDue = false
+	s.mu.Unlock()
+	for _, f := range frames {
+		s.write(f.encode(), true)
+	}
+	if ack {
+		s.mu.Lock()
+		p := make([]byte, 8)
+		binary.LittleEndian.PutUint64(p, s.rcvd)
+		s.lastAck = s.rcvd
+		s.mu.Unlock()
+		s.write((&frame{typ: frameAck, payload: p}).encode(), false)
+	}
+}
+
+//write sends encoded frames on the current connection. If keep is set
+//they are kept until acknowledged, and will be sent when the session is
+//resumed if there is no connection.
+func (s *Session) write(b []byte, keep bool) {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return
+	}
+	if keep {
+		s.replay = append(s.replay, b...)
+	}
+	conn := s.conn
+	s.mu.Unlock()
+	if conn == nil {
+		return
+	}
+	if _, err := conn.Write(b); err != nil {
+		s.connLost(conn)
+	}
+}
+
+//attach makes conn the session's connection, once the handshake is done.
+//peerRcvd is how much of what we have sent the other side received.
+func (s *Session) attach(conn net.Conn, peerRcvd uint64) error {
+	s.wmu.Lock()
+	defer s.wmu.Unlock()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrClosed
+	}
+	if peerRcvd < s.base || peerRcvd > s.base+uint64(len(s.replay)) {
+		s.mu.Unlock()
+		conn.Close()
+		return errors.New("peermux: cannot resume, data was lost")
+	}
+	s.trim(peerRcvd)
+	if s.conn != nil {
+		s.conn.Close()
+	} else {
+		s.broken = make(chan struct{})
+	}
+	s.conn = conn
+	pending := append([]byte{}, s.replay...)
+	s.mu.Unlock()
+	go s.readLoop(conn)
+	if len(pending) > 0 {
+		if _, err := conn.Write(pending); err != nil {
+			s.connLost(conn)
+		}
+	}
+	return nil
+}
+
+//trim drops replay data the peer has received. mu must be held
+func (s *Session) trim(peerRcvd uint64) {
+	if peerRcvd <= s.base {
+		return
+	}
+	n := peerRcvd - s.base
+	if n > uint64(len(s.replay)) {
+		n = uint64(len(s.replay))
+	}
+	s.replay = append([]byte{}, s.replay[n:]...)
+	s.base += n
+	s.cond.Broadcast()
+	s.wake()
+}
+
+//connLost is called when conn fails. The server closes the session if it
+//is not resumed in time.
+func (s *Session) connLost(conn net.Conn) {
+	s.mu.Lock()
+	if s.conn != conn {
+		s.mu.Unlock()
+		return
+	}
+	conn.Close()
+	s.conn = nil
+	close(s.broken)
+	broken := s.broken
+	s.mu.Unlock()
+	if !s.client {
+		go func() {
+			select {
+			case <-time.After(ResumeTimeout):
+				s.mu.Lock()
+				resumed := s.broken != broken
+				s.mu.Unlock()
+				if !resumed {
+					s.Close()
+				}
+			case <-s.done:
+			}
+		}()
+	}
+}
+
+func (s *Session) readLoop(conn net.Conn) {
+	hdr := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(conn, hdr); err != nil {
+			s.connLost(conn)
+			return
+		}
+		ln := binary.LittleEndian.Uint32(hdr[5:])
+		if ln > maxChunk {
+			s.connLost(conn)
+			return
+		}
+		payload := make([]byte, ln)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			s.connLost(conn)
+			return
+		}
+		if !s.handle(conn, hdr[0], binary.LittleEndian.Uint32(hdr[1:]), payload) {
+			s.Close()
+			return
+		}
+	}
+}
+
+//handle processes a received frame, returning false if the peer broke
+//the protocol
+func (s *Session) handle(conn net.Conn, typ uint8, id uint32, payload []byte) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.conn != conn {
+		//This connection has been replaced
+		return true
+	}
+	if typ == frameAck {
+		if len(payload) != 8 {
+			return false
+		}
+		s.trim(binary.LittleEndian.Uint64(payload))
+		return true
+	}
+	s.rcvd += uint64(headerSize + len(payload))
+	if s.rcvd-s.lastAck >= ackEvery {
+		s.ackDue = true
+		s.wake()
+	}
+	st := s.streams[id]
+	switch typ {
+	case frameOpen:
+		if st != nil || id%2 == s.nextID%2 {
+			return false
+		}
+		st = newStream(s, id)
+		s.streams[id] = st
+		s.accepts = append(s.accepts, st)
+	case frameData:
+		if st == nil {
+			//We closed it already
+			return true
+		}
+		if st.rbuf.Len()+len(payload) > InitialWindow {
+			return false
+		}
+		st.rbuf.Write(payload)
+	case frameWindow:
+		if st == nil {
+			return true
+		}
+		if len(payload) != 4 {
+			return false
+		}
+		st.sendWindow += int(binary.LittleEndian.Uint32(payload))
+	case frameClose:
+		if st == nil {
+			return true
+		}
+		st.rclosed = true
+		st.wclosed = true
+		delete(s.streams, id)
+	default:
+		return false
+	}
+	s.cond.Broadcast()
+	return true
+}
+
+//Handshake is "BWMX" [1 version] [1 op or status] [16 session id] [8 rcvd]
+const handshakeSize = 30
+const muxVersion = 1
+const (
+	opNew    = 0
+	opResume = 1
+
+	statusOK      = 0
+	statusUnknown = 1
+)
+
+func encodeHandshake(op uint8, id [16]byte, rcvd uint64) []byte {
+	rv := make([]byte, handshakeSize)
+	copy(rv, "BWMX")
+	rv[4] = muxVersion
+	rv[5] = op
+	copy(rv[6:], id[:])
+	binary.LittleEndian.PutUint64(rv[22:], rcvd)
+	return rv
+}
+
+func readHandshake(conn net.Conn) (op uint8, id [16]byte, rcvd uint64, err error) {
+	b := make([]byte, handshakeSize)
+	if _, err = io.ReadFull(conn, b); err != nil {
+		return
+	}
+	if string(b[:4]) != "BWMX" || b[4] != muxVersion {
+		err = errors.New("peermux: bad handshake")
+		return
+	}
+	op = b[5]
+	copy(id[:], b[6:])
+	rcvd = binary.LittleEndian.Uint64(b[22:])
+	return
+}
+
+func (s *Session) clientHandshake(conn net.Conn, op uint8) error {
+	s.mu.Lock()
+	rcvd := s.rcvd
+	s.mu.Unlock()
+	if _, err := conn.Write(encodeHandshake(op, s.id, rcvd)); err != nil {
+		conn.Close()
+		return err
+	}
+	status, _, peerRcvd, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	if status == statusUnknown {
+		conn.Close()
+		return ErrUnknownSession
+	}
+	if status != statusOK {
+		conn.Close()
+		return errors.New("peermux: bad handshake")
+	}
+	return s.attach(conn, peerRcvd)
+}
+
+//Server keeps the sessions that clients may resume
+type Server struct {
+	mu       sync.Mutex
+	sessions map[[16]byte]*Session
+}
+
+//NewServer returns a server with no sessions
+func NewServer() *Server {
+	return &Server{sessions: make(map[[16]byte]*Session)}
+}
+
+//Serve handles the handshake on a new connection. If the client started
+//a new session it is returned with isNew set, and the caller should
+//Accept streams from it. Otherwise the connection has been given to the
+//session the client resumed.
+func (sv *Server) Serve(conn net.Conn) (s *Session, isNew bool, err error) {
+	op, id, peerRcvd, err := readHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, false, err
+	}
+	switch op {
+	case opNew:
+		s = newSession(id, false)
+		sv.mu.Lock()
+		if _, ok := sv.sessions[id]; ok {
+			sv.mu.Unlock()
+			s.Close()
+			conn.Close()
+			return nil, false, errors.New("peermux: duplicate session")
+		}
+		sv.sessions[id] = s
+		sv.mu.Unlock()
+		s.onClosed = func() {
+			sv.mu.Lock()
+			delete(sv.sessions, id)
+			sv.mu.Unlock()
+		}
+		isNew = true
+	case opResume:
+		sv.mu.Lock()
+		s = sv.sessions[id]
+		sv.mu.Unlock()
+		if s == nil {
+			conn.Write(encodeHandshake(statusUnknown, id, 0))
+			conn.Close()
+			return nil, false, ErrUnknownSession
+		}
+	default:
+		conn.Close()
+		return nil, false, errors.New("peermux: bad handshake")
+	}
+	//Nothing is written to conn until it is attached, so the reply
+	//cannot be overtaken
+	s.mu.Lock()
+	rcvd := s.rcvd
+	s.mu.Unlock()
+	if _, err := conn.Write(encodeHandshake(statusOK, id, rcvd)); err != nil {
+		conn.Close()
+		if isNew {
+			s.Close()
+		}
+		return nil, false, err
+	}
+	if err := s.attach(conn, peerRcvd); err != nil {
+		if isNew {
+			s.Close()
+		}
+		return nil, false, err
+	}
+	return s, isNew, nil
+}
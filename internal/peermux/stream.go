@@ -0,0 +1,209 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package peermux
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"time"
+)
+
+var errTimeout = &timeoutError{}
+
+type timeoutError struct{}
+
+func (e *timeoutError) Error() string   { return "peermux: i/o timeout" }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+//Stream is one of the streams in a session. It implements net.Conn
+type Stream struct {
+	s  *Session
+	id uint32
+	//The rest is protected by s.mu
+	rbuf bytes.Buffer
+	//Bytes read but not yet given back to the sender as window
+	consumed   int
+	sendWindow int
+	rclosed    bool
+	wclosed    bool
+	rdeadline  time.Time
+	wdeadline  time.Time
+	rtimer     *time.Timer
+	wtimer     *time.Timer
+}
+
+func newStream(s *Session, id uint32) *Stream {
+	return &Stream{s: s, id: id, sendWindow: InitialWindow}
+}
+
+//ID returns the stream's identifier, which is unique within the session
+func (st *Stream) ID() uint32 {
+	return st.id
+}
+
+//Read reads data from the stream, returning io.EOF once the other side
+//has closed it and everything it sent has been read
+func (st *Stream) Read(b []byte) (int, error) {
+	s := st.s
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for st.rbuf.Len() == 0 {
+		if st.rclosed {
+			return 0, io.EOF
+		}
+		if !st.rdeadline.IsZero() && !time.Now().Before(st.rdeadline) {
+			return 0, errTimeout
+		}
+		s.cond.Wait()
+	}
+	n, _ := st.rbuf.Read(b)
+	st.consumed += n
+	if st.consumed >= InitialWindow/2 && !st.rclosed {
+		s.windows[st.id] += uint32(st.consumed)
+		st.consumed = 0
+		s.wake()
+	}
+	return n, nil
+}
+
+//Write writes data to the stream, blocking while the other side's
+//window is full
+func (st *Stream) Write(b []byte) (int, error) {
+	s := st.s
+	written := 0
+	for written < len(b) {
+		s.mu.Lock()
+		for st.sendWindow == 0 && !st.wclosed {
+			if !st.wdeadline.IsZero() && !time.Now().Before(st.wdeadline) {
+				s.mu.Unlock()
+				return written, errTimeout
+			}
+			s.cond.Wait()
+		}
+		if st.wclosed {
+			s.mu.Unlock()
+			return written, ErrClosed
+		}
+		n := len(b) - written
+		if n > maxChunk {
+			n = maxChunk
+		}
+		if n > st.sendWindow {
+			n = st.sendWindow
+		}
+		st.sendWindow -= n
+		s.mu.Unlock()
+		p := make([]byte, n)
+		copy(p, b[written:])
+		if err := s.send(&frame{typ: frameData, id: st.id, payload: p}); err != nil {
+			return written, err
+		}
+		written += n
+	}
+	return written, nil
+}
+
+//Close closes the stream in both directions
+func (st *Stream) Close() error {
+	s := st.s
+	s.mu.Lock()
+	if s.streams[st.id] != st {
+		//Already closed by either side
+		st.rclosed = true
+		st.wclosed = true
+		s.cond.Broadcast()
+		s.mu.Unlock()
+		return nil
+	}
+	delete(s.streams, st.id)
+	st.rclosed = true
+	st.wclosed = true
+	s.cond.Broadcast()
+	s.mu.Unlock()
+	return s.send(&frame{typ: frameClose, id: st.id})
+}
+
+//LocalAddr returns the local address of the session's connection
+func (st *Stream) LocalAddr() net.Addr {
+	return addr{st.s.LocalAddr()}
+}
+
+//RemoteAddr returns the remote address of the session's connection
+func (st *Stream) RemoteAddr() net.Addr {
+	return addr{st.s.RemoteAddr()}
+}
+
+//The session's connection may change or be missing
+type addr struct {
+	a net.Addr
+}
+
+func (a addr) Network() string {
+	return "peermux"
+}
+func (a addr) String() string {
+	if a.a == nil {
+		return "<disconnected>"
+	}
+	return a.a.String()
+}
+
+//SetDeadline sets the read and write deadlines
+func (st *Stream) SetDeadline(t time.Time) error {
+	st.SetReadDeadline(t)
+	return st.SetWriteDeadline(t)
+}
+
+//SetReadDeadline sets the time after which Read fails with a timeout
+func (st *Stream) SetReadDeadline(t time.Time) error {
+	st.s.mu.Lock()
+	defer st.s.mu.Unlock()
+	st.rdeadline = t
+	st.rtimer = st.resetTimer(st.rtimer, t)
+	return nil
+}
+
+//SetWriteDeadline sets the time after which a blocked Write fails with a
+//timeout
+func (st *Stream) SetWriteDeadline(t time.Time) error {
+	st.s.mu.Lock()
+	defer st.s.mu.Unlock()
+	st.wdeadline = t
+	st.wtimer = st.resetTimer(st.wtimer, t)
+	return nil
+}
+
+//resetTimer wakes waiters when the deadline passes. s.mu must be held
+func (st *Stream) resetTimer(tm *time.Timer, t time.Time) *time.Timer {
+	if tm != nil {
+		tm.Stop()
+	}
+	st.s.cond.Broadcast()
+	if t.IsZero() {
+		return nil
+	}
+	return time.AfterFunc(time.Until(t), func() {
+		st.s.mu.Lock()
+		st.s.cond.Broadcast()
+		st.s.mu.Unlock()
+	})
+}
+
+var _ net.Conn = (*Stream)(nil)
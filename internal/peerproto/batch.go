@@ -0,0 +1,107 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package peerproto
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+//CmdBatch carries several encoded publish or persist messages in one
+//frame. It is only sent if CapBatching was negotiated. The body is a
+//little endian uint32 count followed by that many messages, each prefixed
+//with its length as a little endian uint32.
+const CmdBatch = 13
+
+//CmdBatchStatus is the reply to CmdBatch. The body is a little endian
+//uint32 count followed by a little endian uint16 status code for each
+//message, in the order they were in the batch.
+const CmdBatchStatus = 14
+
+//MaxBatch is the most messages that may be sent in one batch
+const MaxBatch = 1024
+
+//EncodeBatch returns the body of a batch frame
+func EncodeBatch(msgs [][]byte) []byte {
+	ln := 4
+	for _, m := range msgs {
+		ln += 4 + len(m)
+	}
+	rv := make([]byte, ln)
+	binary.LittleEndian.PutUint32(rv, uint32(len(msgs)))
+	off := 4
+	for _, m := range msgs {
+		binary.LittleEndian.PutUint32(rv[off:], uint32(len(m)))
+		off += 4
+		off += copy(rv[off:], m)
+	}
+	return rv
+}
+
+//DecodeBatch parses the body of a batch frame. The messages refer to
+//the body rather than being copied.
+func DecodeBatch(body []byte) ([][]byte, error) {
+	if len(body) < 4 {
+		return nil, errors.New("short batch frame")
+	}
+	n := int(binary.LittleEndian.Uint32(body))
+	if n > MaxBatch {
+		return nil, errors.New("batch is too large")
+	}
+	rv := make([][]byte, n)
+	body = body[4:]
+	for i := range rv {
+		if len(body) < 4 {
+			return nil, errors.New("short batch frame")
+		}
+		ln := int(binary.LittleEndian.Uint32(body))
+		body = body[4:]
+		if ln > len(body) {
+			return nil, errors.New("short batch frame")
+		}
+		rv[i] = body[:ln]
+		body = body[ln:]
+	}
+	return rv, nil
+}
+
+//EncodeStatuses returns the body of a batch status frame
+func EncodeStatuses(codes []int) []byte {
+	rv := make([]byte, 4+2*len(codes))
+	binary.LittleEndian.PutUint32(rv, uint32(len(codes)))
+	for i, c := range codes {
+		binary.LittleEndian.PutUint16(rv[4+2*i:], uint16(c))
+	}
+	return rv
+}
+
+//DecodeStatuses parses the body of a batch status frame
+func DecodeStatuses(body []byte) ([]int, error) {
+	if len(body) < 4 {
+		return nil, errors.New("short batch status frame")
+	}
+	n := int(binary.LittleEndian.Uint32(body))
+	if n > MaxBatch || len(body) < 4+2*n {
+		return nil, errors.New("short batch status frame")
+	}
+	rv := make([]int, n)
+	for i := range rv {
+		rv[i] = int(binary.LittleEndian.Uint16(body[4+2*i:]))
+	}
+	return rv, nil
+}
@@ -0,0 +1,46 @@
+package peerproto_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/immesys/bw2/internal/peerproto"
+)
+
+func TestBatchRoundTrip(t *testing.T) {
+	msgs := [][]byte{[]byte("first"), {}, bytes.Repeat([]byte{7}, 5000)}
+	got, err := peerproto.DecodeBatch(peerproto.EncodeBatch(msgs))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != len(msgs) {
+		t.Fatalf("expected %d messages, got %d", len(msgs), len(got))
+	}
+	for i := range msgs {
+		if !bytes.Equal(got[i], msgs[i]) {
+			t.Fatalf("message %d did not round trip", i)
+		}
+	}
+	codes := []int{200, 404, 439}
+	gcodes, err := peerproto.DecodeStatuses(peerproto.EncodeStatuses(codes))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := range codes {
+		if gcodes[i] != codes[i] {
+			t.Fatalf("status %d did not round trip", i)
+		}
+	}
+}
+
+func TestBatchTruncated(t *testing.T) {
+	enc := peerproto.EncodeBatch([][]byte{[]byte("first"), []byte("second")})
+	for i := 0; i < len(enc); i++ {
+		if _, err := peerproto.DecodeBatch(enc[:i]); err == nil {
+			t.Fatalf("truncated batch of %d bytes decoded", i)
+		}
+	}
+	if _, err := peerproto.DecodeStatuses(peerproto.EncodeStatuses([]int{200, 200})[:6]); err == nil {
+		t.Fatal("truncated statuses decoded")
+	}
+}
@@ -0,0 +1,67 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package peerproto
+
+import (
+	"errors"
+
+	"github.com/golang/snappy"
+)
+
+//CmdCompressed is set on the command of a frame whose body is snappy
+//compressed. It is only sent if CapCompression was negotiated. Messages
+//are compressed as a whole frame body, so their signatures are unaffected.
+const CmdCompressed = 0x80
+
+//CompressThreshold is the smallest body that is worth compressing
+const CompressThreshold = 1024
+
+//MaxDecompressedSize is the largest body we will decompress
+const MaxDecompressedSize = 256 * 1024 * 1024
+
+//Compress returns the command and body to send, with the body compressed
+//if it is large enough and compressing it helps
+func Compress(cmd uint8, body []byte) (uint8, []byte) {
+	if len(body) < CompressThreshold {
+		return cmd, body
+	}
+	z := snappy.Encode(nil, body)
+	if len(z) >= len(body) {
+		return cmd, body
+	}
+	return cmd | CmdCompressed, z
+}
+
+//Decompress undoes Compress
+func Decompress(cmd uint8, body []byte) (uint8, []byte, error) {
+	if cmd&CmdCompressed == 0 {
+		return cmd, body, nil
+	}
+	n, err := snappy.DecodedLen(body)
+	if err != nil {
+		return cmd, nil, err
+	}
+	if n > MaxDecompressedSize {
+		return cmd, nil, errors.New("compressed frame is too large")
+	}
+	rv, err := snappy.Decode(nil, body)
+	if err != nil {
+		return cmd, nil, err
+	}
+	return cmd &^ CmdCompressed, rv, nil
+}
@@ -0,0 +1,80 @@
+package peerproto_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"testing"
+
+	"github.com/immesys/bw2/internal/peerproto"
+)
+
+// A spawnpoint style YAML config, which is typical of large payloads
+func yamlPayload(size int) []byte {
+	buf := bytes.Buffer{}
+	for i := 0; buf.Len() < size; i++ {
+		fmt.Fprintf(&buf, "service%d:\n  entity: /srv/keys/service%d.ent\n  image: immesys/spawnpoint:amd64\n  memAlloc: 512M\n  cpuShares: 1024\n  run: [bash, -c, \"./service --id %d\"]\n", i, i, i)
+	}
+	return buf.Bytes()[:size]
+}
+
+func randomPayload(size int) []byte {
+	rv := make([]byte, size)
+	rand.Read(rv)
+	return rv
+}
+
+func TestCompressRoundTrip(t *testing.T) {
+	for _, body := range [][]byte{[]byte("small"), yamlPayload(64 * 1024), randomPayload(8 * 1024)} {
+		cmd, z := peerproto.Compress(1, body)
+		rcmd, rbody, err := peerproto.Decompress(cmd, z)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rcmd != 1 || !bytes.Equal(rbody, body) {
+			t.Fatalf("round trip of %d bytes did not match", len(body))
+		}
+	}
+	if cmd, _ := peerproto.Compress(1, []byte("small")); cmd != 1 {
+		t.Fatal("small bodies should not be compressed")
+	}
+	if cmd, _ := peerproto.Compress(1, randomPayload(8*1024)); cmd != 1 {
+		t.Fatal("incompressible bodies should be sent as they are")
+	}
+	if cmd, z := peerproto.Compress(1, yamlPayload(64*1024)); cmd != 1|peerproto.CmdCompressed || len(z) >= 64*1024 {
+		t.Fatal("expected YAML to compress")
+	}
+}
+
+// benchmarkFrames measures writing and reading back frames with or
+// without compression. The bytes per second are of the uncompressed body.
+func benchmarkFrames(b *testing.B, body []byte, compress bool) {
+	buf := bytes.Buffer{}
+	wire := 0
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		cmd, z := uint8(1), body
+		if compress {
+			cmd, z = peerproto.Compress(cmd, body)
+		}
+		if err := peerproto.WriteFrame(&buf, 1, cmd, z); err != nil {
+			b.Fatal(err)
+		}
+		wire = buf.Len()
+		_, rcmd, rz, err := peerproto.ReadFrame(&buf, peerproto.MaxDecompressedSize)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if _, _, err := peerproto.Decompress(rcmd, rz); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(wire), "wirebytes/op")
+}
+
+func BenchmarkFrameYAMLPlain(b *testing.B)    { benchmarkFrames(b, yamlPayload(64*1024), false) }
+func BenchmarkFrameYAMLSnappy(b *testing.B)   { benchmarkFrames(b, yamlPayload(64*1024), true) }
+func BenchmarkFrameRandomPlain(b *testing.B)  { benchmarkFrames(b, randomPayload(64*1024), false) }
+func BenchmarkFrameRandomSnappy(b *testing.B) { benchmarkFrames(b, randomPayload(64*1024), true) }
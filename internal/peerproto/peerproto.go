@@ -0,0 +1,179 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package peerproto is the handshake that native peers do once the TLS
+//connection is made and the router has proven its VK. The client sends a
+//hello frame with its protocol version and capabilities. A router that
+//understands it replies with its own hello and both sides then use the
+//lower version and the capabilities they have in common. Routers from
+//before the handshake reply to the unknown command with an error status,
+//so the client falls back to Legacy. A router treats a client that does not
+//send a hello as Legacy too.
+package peerproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+//HeaderSize is the size of a native frame header: the body length and
+//sequence number (both little endian uint64) and the command
+const HeaderSize = 17
+
+//CmdHello is the native frame command for the handshake. It is always sent
+//with sequence number zero, which is never used for a request.
+const CmdHello = 11
+
+//Version is the protocol version spoken by this router
+const Version = 1
+
+//The largest hello body we will read, to allow for future fields
+const maxHelloSize = 4096
+
+//Caps is a set of optional protocol features
+type Caps uint64
+
+const (
+	//Time range queries of message history
+	CapHistory Caps = 1 << iota
+	//Frame bodies may be compressed
+	CapCompression
+	//Several messages may be sent in one frame
+	CapBatching
+	//Credit based flow control
+	CapFlowControl
+)
+
+//Supported is the set of capabilities implemented by this router
+var Supported = CapHistory | CapCompression | CapBatching | CapFlowControl
+
+//Hello is what a peer says it can do
+type Hello struct {
+	Version uint16
+	Caps    Caps
+}
+
+//Legacy is what a peer from before the handshake can do
+var Legacy = Hello{}
+
+//Ours is what this router can do
+func Ours() Hello {
+	return Hello{Version: Version, Caps: Supported}
+}
+
+//Has returns true if all of the given capabilities are present
+func (h Hello) Has(c Caps) bool {
+	return h.Caps&c == c
+}
+
+func (h Hello) String() string {
+	return fmt.Sprintf("v%d caps=%#x", h.Version, uint64(h.Caps))
+}
+
+//Encode returns the body of a hello frame
+func (h Hello) Encode() []byte {
+	rv := make([]byte, 10)
+	binary.LittleEndian.PutUint16(rv, h.Version)
+	binary.LittleEndian.PutUint64(rv[2:], uint64(h.Caps))
+	return rv
+}
+
+//DecodeHello parses the body of a hello frame. Anything after the fields
+//we know about is ignored so that later versions can add to it.
+func DecodeHello(body []byte) (Hello, error) {
+	if len(body) < 10 {
+		return Legacy, errors.New("short hello frame")
+	}
+	return Hello{
+		Version: binary.LittleEndian.Uint16(body),
+		Caps:    Caps(binary.LittleEndian.Uint64(body[2:])),
+	}, nil
+}
+
+//Negotiate returns what two peers can both use
+func Negotiate(a, b Hello) Hello {
+	rv := Hello{Version: a.Version, Caps: a.Caps & b.Caps}
+	if b.Version < rv.Version {
+		rv.Version = b.Version
+	}
+	return rv
+}
+
+//WriteFrame writes a native frame
+func WriteFrame(w io.Writer, seqno uint64, cmd uint8, body []byte) error {
+	hdr := make([]byte, HeaderSize)
+	binary.LittleEndian.PutUint64(hdr, uint64(len(body)))
+	binary.LittleEndian.PutUint64(hdr[8:], seqno)
+	hdr[16] = cmd
+	if _, err := w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := w.Write(body)
+	return err
+}
+
+//ReadFrame reads a native frame whose body is at most maxlen bytes
+func ReadFrame(r io.Reader, maxlen int) (seqno uint64, cmd uint8, body []byte, err error) {
+	hdr := make([]byte, HeaderSize)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	ln := binary.LittleEndian.Uint64(hdr)
+	if ln > uint64(maxlen) {
+		err = fmt.Errorf("frame of %d bytes is too large", ln)
+		return
+	}
+	seqno = binary.LittleEndian.Uint64(hdr[8:])
+	cmd = hdr[16]
+	body = make([]byte, ln)
+	_, err = io.ReadFull(r, body)
+	return
+}
+
+//ClientHandshake sends our hello and waits for the router's reply,
+//returning what has been negotiated. Nothing else may use the connection
+//until it returns.
+func ClientHandshake(rw io.ReadWriter, ours Hello) (Hello, error) {
+	if err := WriteFrame(rw, 0, CmdHello, ours.Encode()); err != nil {
+		return Legacy, err
+	}
+	_, cmd, body, err := ReadFrame(rw, maxHelloSize)
+	if err != nil {
+		return Legacy, err
+	}
+	if cmd != CmdHello {
+		//An older router rejects the command it does not know
+		return Legacy, nil
+	}
+	theirs, err := DecodeHello(body)
+	if err != nil {
+		return Legacy, err
+	}
+	return Negotiate(ours, theirs), nil
+}
+
+//ServerHandshake handles the body of a hello frame from a client,
+//returning the body of our reply and what has been negotiated
+func ServerHandshake(body []byte, ours Hello) ([]byte, Hello, error) {
+	theirs, err := DecodeHello(body)
+	if err != nil {
+		return nil, Legacy, err
+	}
+	return ours.Encode(), Negotiate(ours, theirs), nil
+}
@@ -0,0 +1,131 @@
+package peerproto_test
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+
+	"github.com/immesys/bw2/internal/peerproto"
+)
+
+//The frames an old router sends, from before the handshake
+const (
+	oldCmdMessage = 1
+	oldCmdRStatus = 6
+)
+
+//oldServer emulates a router from before the handshake. It rejects any
+//command other than a message with an error status, and answers messages
+//with an okay status.
+func oldServer(t *testing.T, conn net.Conn) {
+	defer conn.Close()
+	for {
+		seqno, cmd, _, err := peerproto.ReadFrame(conn, 1<<20)
+		if err != nil {
+			return
+		}
+		code, msg := 200, ""
+		if cmd != oldCmdMessage {
+			code, msg = 409, "what command is this?"
+		}
+		body := make([]byte, 2+len(msg))
+		binary.LittleEndian.PutUint16(body, uint16(code))
+		copy(body[2:], msg)
+		if err := peerproto.WriteFrame(conn, seqno, oldCmdRStatus, body); err != nil {
+			t.Errorf("old server write: %v", err)
+			return
+		}
+	}
+}
+
+//newServer emulates a router that does the handshake with the given hello
+func newServer(t *testing.T, conn net.Conn, ours peerproto.Hello) {
+	defer conn.Close()
+	seqno, cmd, body, err := peerproto.ReadFrame(conn, 1<<20)
+	if err != nil {
+		t.Errorf("new server read: %v", err)
+		return
+	}
+	if cmd != peerproto.CmdHello || seqno != 0 {
+		t.Errorf("expected a hello first, got cmd %d seqno %d", cmd, seqno)
+		return
+	}
+	reply, _, err := peerproto.ServerHandshake(body, ours)
+	if err != nil {
+		t.Errorf("new server handshake: %v", err)
+		return
+	}
+	if err := peerproto.WriteFrame(conn, 0, peerproto.CmdHello, reply); err != nil {
+		t.Errorf("new server write: %v", err)
+	}
+}
+
+func TestHandshakeOldServer(t *testing.T) {
+	cl, sv := net.Pipe()
+	defer cl.Close()
+	go oldServer(t, sv)
+	h, err := peerproto.ClientHandshake(cl, peerproto.Ours())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != peerproto.Legacy {
+		t.Fatalf("expected to fall back to legacy, got %s", h)
+	}
+	//The connection must still be usable afterwards
+	if err := peerproto.WriteFrame(cl, 1, oldCmdMessage, []byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	seqno, cmd, body, err := peerproto.ReadFrame(cl, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if seqno != 1 || cmd != oldCmdRStatus || binary.LittleEndian.Uint16(body) != 200 {
+		t.Fatalf("unexpected reply after fallback: seqno %d cmd %d body %x", seqno, cmd, body)
+	}
+}
+
+func TestHandshakeNewServer(t *testing.T) {
+	cl, sv := net.Pipe()
+	defer cl.Close()
+	go newServer(t, sv, peerproto.Ours())
+	h, err := peerproto.ClientHandshake(cl, peerproto.Ours())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != peerproto.Ours() {
+		t.Fatalf("expected %s, got %s", peerproto.Ours(), h)
+	}
+}
+
+func TestHandshakeNegotiatesDown(t *testing.T) {
+	cl, sv := net.Pipe()
+	defer cl.Close()
+	//A later router with capabilities we have never heard of
+	future := peerproto.Hello{Version: peerproto.Version + 1, Caps: peerproto.CapHistory | peerproto.CapBatching | 1<<40}
+	go newServer(t, sv, future)
+	ours := peerproto.Hello{Version: peerproto.Version, Caps: peerproto.CapHistory | peerproto.CapCompression}
+	h, err := peerproto.ClientHandshake(cl, ours)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Version != peerproto.Version {
+		t.Fatalf("expected version %d, got %d", peerproto.Version, h.Version)
+	}
+	if !h.Has(peerproto.CapHistory) || h.Has(peerproto.CapCompression) || h.Has(peerproto.CapBatching) {
+		t.Fatalf("expected only the common capabilities, got %s", h)
+	}
+}
+
+func TestDecodeHelloIgnoresTrailingFields(t *testing.T) {
+	body := append(peerproto.Ours().Encode(), 1, 2, 3, 4)
+	h, err := peerproto.DecodeHello(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h != peerproto.Ours() {
+		t.Fatalf("expected %s, got %s", peerproto.Ours(), h)
+	}
+	if _, err := peerproto.DecodeHello(body[:5]); err == nil {
+		t.Fatal("expected a short hello to be rejected")
+	}
+}
@@ -0,0 +1,113 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package peerproto
+
+import (
+	"encoding/binary"
+	"errors"
+	"sync"
+)
+
+//CmdCredit is sent by the subscriber with the sequence number of a
+//subscription to allow the router to send it more results. The body is
+//the number of results as a little endian uint32.
+const CmdCredit = 12
+
+//InitialCredit is how many results a router may send on a flow
+//controlled subscription before it must wait for credit
+const InitialCredit = 256
+
+//EncodeCredit returns the body of a credit frame
+func EncodeCredit(n int) []byte {
+	rv := make([]byte, 4)
+	binary.LittleEndian.PutUint32(rv, uint32(n))
+	return rv
+}
+
+//DecodeCredit parses the body of a credit frame
+func DecodeCredit(body []byte) (int, error) {
+	if len(body) < 4 {
+		return 0, errors.New("short credit frame")
+	}
+	return int(binary.LittleEndian.Uint32(body)), nil
+}
+
+//Window is the flow control credit of one subscription on the sending side
+type Window struct {
+	mu     sync.Mutex
+	avail  int
+	closed bool
+	wake   chan struct{}
+}
+
+//NewWindow returns a window with the given credit
+func NewWindow(credit int) *Window {
+	return &Window{avail: credit, wake: make(chan struct{}, 1)}
+}
+
+//Take uses one credit, waiting for more if there is none. If it has to
+//wait, onWait is called first. It returns false if the window is closed or
+//done is closed while waiting. Only one goroutine may Take at a time.
+func (w *Window) Take(done <-chan struct{}, onWait func()) bool {
+	waited := false
+	for {
+		w.mu.Lock()
+		if w.closed {
+			w.mu.Unlock()
+			return false
+		}
+		if w.avail > 0 {
+			w.avail--
+			w.mu.Unlock()
+			return true
+		}
+		w.mu.Unlock()
+		if !waited {
+			waited = true
+			onWait()
+		}
+		select {
+		case <-done:
+			return false
+		case <-w.wake:
+		}
+	}
+}
+
+//Add gives the window more credit
+func (w *Window) Add(credit int) {
+	w.mu.Lock()
+	w.avail += credit
+	w.mu.Unlock()
+	w.signal()
+}
+
+//Close wakes up Take and makes it return false from then on
+func (w *Window) Close() {
+	w.mu.Lock()
+	w.closed = true
+	w.mu.Unlock()
+	w.signal()
+}
+
+func (w *Window) signal() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
@@ -0,0 +1,64 @@
+package peerproto_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/peerproto"
+)
+
+func TestWindowWaitsForCredit(t *testing.T) {
+	w := peerproto.NewWindow(2)
+	done := make(chan struct{})
+	waits := 0
+	onWait := func() { waits++ }
+	for i := 0; i < 2; i++ {
+		if !w.Take(done, onWait) {
+			t.Fatal("expected initial credit")
+		}
+	}
+	if waits != 0 {
+		t.Fatal("should not have waited with credit available")
+	}
+	got := make(chan bool)
+	go func() {
+		got <- w.Take(done, onWait)
+	}()
+	select {
+	case <-got:
+		t.Fatal("took without credit")
+	case <-time.After(50 * time.Millisecond):
+	}
+	n, err := peerproto.DecodeCredit(peerproto.EncodeCredit(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add(n)
+	if !<-got {
+		t.Fatal("expected to take the added credit")
+	}
+	if waits != 1 {
+		t.Fatalf("expected onWait once, got %d", waits)
+	}
+}
+
+func TestWindowClose(t *testing.T) {
+	w := peerproto.NewWindow(0)
+	done := make(chan struct{})
+	got := make(chan bool)
+	go func() {
+		got <- w.Take(done, func() {})
+	}()
+	w.Close()
+	if <-got {
+		t.Fatal("expected a closed window to refuse")
+	}
+	w2 := peerproto.NewWindow(0)
+	go func() {
+		got <- w2.Take(done, func() {})
+	}()
+	close(done)
+	if <-got {
+		t.Fatal("expected take to give up when done")
+	}
+}
@@ -0,0 +1,428 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package regsnap reads and writes registry snapshots. A snapshot holds the
+//registry state that matters to some namespaces as of one block, so that a
+//router that cannot sync the chain can still resolve routing objects. The
+//format is
+//
+//  "BW2RSNAP" | version (u16) | block (u64) | block hash (32) | block time (i64)
+//  records:    kind (u8, nonzero) | uvarint len | body
+//  trailer:    0 (u8) | record count (u64) | signer VK (32) | signature (64)
+//
+//The signature is over the sha256 of everything before it. Integers are big
+//endian and the block time is in unix nanoseconds.
+package regsnap
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+)
+
+const magic = "BW2RSNAP"
+
+//Version is the version of the snapshot format
+const Version = 1
+
+//No record is this big, so a larger length means the snapshot is damaged
+const maxRecord = 1 << 24
+
+//The kinds of record
+const (
+	//ronum (u8) | state (u8) | content
+	kindObject = 1
+	//key (32) | value (32)
+	kindAlias = 2
+	//nsvk (32) | drvk (32)
+	kindRouter = 3
+	//drvk (32) | SRV record
+	kindSRV = 4
+)
+
+//Object is a routing object and its registry state (one of the api
+//State constants) when the snapshot was taken
+type Object struct {
+	RO    objects.RoutingObject
+	State int
+}
+
+//Snapshot is the registry state at a block
+type Snapshot struct {
+	Block     uint64
+	BlockHash [32]byte
+	BlockTime time.Time
+	//Entities by VK
+	Entities map[[32]byte]Object
+	//DOTs and access chains by hash
+	DOTs   map[[32]byte]Object
+	Chains map[[32]byte]Object
+	//Revocations by the hash of their target
+	Revocations map[[32]byte][]*objects.Revocation
+	Aliases     map[[32]byte][32]byte
+	//The designated router of each namespace
+	Routers map[[32]byte][32]byte
+	//The SRV record of each designated router
+	SRVs map[[32]byte]string
+	//The VK that signed the snapshot, set by Read
+	SignerVK []byte
+}
+
+//New returns an empty snapshot of the given block
+func New(block uint64, blockHash [32]byte, blockTime time.Time) *Snapshot {
+	return &Snapshot{
+		Block:       block,
+		BlockHash:   blockHash,
+		BlockTime:   blockTime,
+		Entities:    make(map[[32]byte]Object),
+		DOTs:        make(map[[32]byte]Object),
+		Chains:      make(map[[32]byte]Object),
+		Revocations: make(map[[32]byte][]*objects.Revocation),
+		Aliases:     make(map[[32]byte][32]byte),
+		Routers:     make(map[[32]byte][32]byte),
+		SRVs:        make(map[[32]byte]string),
+	}
+}
+
+func key(b []byte) [32]byte {
+	rv := [32]byte{}
+	copy(rv[:], b)
+	return rv
+}
+
+//Add adds an entity, DOT, access chain or revocation. The state of a
+//revocation is ignored.
+func (s *Snapshot) Add(ro objects.RoutingObject, state int) error {
+	switch o := ro.(type) {
+	case *objects.Entity:
+		s.Entities[key(o.GetVK())] = Object{RO: o, State: state}
+	case *objects.DOT:
+		s.DOTs[key(o.GetHash())] = Object{RO: o, State: state}
+	case *objects.DChain:
+		if !o.IsAccess() {
+			return errors.New("only access chains can be added to a snapshot")
+		}
+		//Chains are kept as hashes, their DOTs are in the snapshot
+		if o.GetRONum() != objects.ROAccessDChainHash {
+			var err error
+			if o, err = o.ConvertToDChainHash(); err != nil {
+				return err
+			}
+		}
+		s.Chains[key(o.GetChainHash())] = Object{RO: o, State: state}
+	case *objects.Revocation:
+		k := key(o.GetTarget())
+		for _, r := range s.Revocations[k] {
+			if bytes.Equal(r.GetHash(), o.GetHash()) {
+				return nil
+			}
+		}
+		s.Revocations[k] = append(s.Revocations[k], o)
+	default:
+		return fmt.Errorf("routing object %d cannot be added to a snapshot", ro.GetRONum())
+	}
+	return nil
+}
+
+//Revoked returns true if the snapshot has a valid revocation for ro, the
+//entity or DOT with the given VK or hash
+func (s *Snapshot) Revoked(target []byte, ro objects.RoutingObject) bool {
+	for _, r := range s.Revocations[key(target)] {
+		if r.IsValidFor(ro) {
+			return true
+		}
+	}
+	return false
+}
+
+//GrantedFrom returns the hashes of the DOTs in the snapshot granted by vk
+func (s *Snapshot) GrantedFrom(vk []byte) [][32]byte {
+	rv := [][32]byte{}
+	for h, o := range s.DOTs {
+		if bytes.Equal(o.RO.(*objects.DOT).GetGiverVK(), vk) {
+			rv = append(rv, h)
+		}
+	}
+	sortKeys(rv)
+	return rv
+}
+
+//AliasFor returns the lowest alias key that resolves to value
+func (s *Snapshot) AliasFor(value [32]byte) ([32]byte, bool) {
+	keys := [][32]byte{}
+	for k, v := range s.Aliases {
+		if v == value {
+			keys = append(keys, k)
+		}
+	}
+	if len(keys) == 0 {
+		return [32]byte{}, false
+	}
+	sortKeys(keys)
+	return keys[0], true
+}
+
+//Merge adds everything in o to s. Where both have a record, o's is kept.
+//The block of s is not changed.
+func (s *Snapshot) Merge(o *Snapshot) {
+	for k, v := range o.Entities {
+		s.Entities[k] = v
+	}
+	for k, v := range o.DOTs {
+		s.DOTs[k] = v
+	}
+	for k, v := range o.Chains {
+		s.Chains[k] = v
+	}
+	for _, rs := range o.Revocations {
+		for _, r := range rs {
+			s.Add(r, 0)
+		}
+	}
+	for k, v := range o.Aliases {
+		s.Aliases[k] = v
+	}
+	for k, v := range o.Routers {
+		s.Routers[k] = v
+	}
+	for k, v := range o.SRVs {
+		s.SRVs[k] = v
+	}
+}
+
+//Age returns how long ago the snapshot's block was mined
+func (s *Snapshot) Age() time.Duration {
+	return time.Since(s.BlockTime)
+}
+
+func sortKeys(k [][32]byte) {
+	sort.Slice(k, func(i, j int) bool {
+		return bytes.Compare(k[i][:], k[j][:]) < 0
+	})
+}
+
+func sortedKeys(m interface{}) [][32]byte {
+	rv := [][32]byte{}
+	switch mm := m.(type) {
+	case map[[32]byte]Object:
+		for k := range mm {
+			rv = append(rv, k)
+		}
+	case map[[32]byte][]*objects.Revocation:
+		for k := range mm {
+			rv = append(rv, k)
+		}
+	case map[[32]byte][32]byte:
+		for k := range mm {
+			rv = append(rv, k)
+		}
+	case map[[32]byte]string:
+		for k := range mm {
+			rv = append(rv, k)
+		}
+	}
+	sortKeys(rv)
+	return rv
+}
+
+//Write writes the snapshot signed by the given entity. Records are
+//written in a fixed order so the same state always gives the same bytes.
+func (s *Snapshot) Write(w io.Writer, signer *objects.Entity) error {
+	if signer.GetSK() == nil {
+		return errors.New("the snapshot signer needs a signing key")
+	}
+	h := sha256.New()
+	bw := bufio.NewWriter(io.MultiWriter(w, h))
+	hdr := make([]byte, len(magic)+2+8+32+8)
+	copy(hdr, magic)
+	binary.BigEndian.PutUint16(hdr[len(magic):], Version)
+	binary.BigEndian.PutUint64(hdr[len(magic)+2:], s.Block)
+	copy(hdr[len(magic)+10:], s.BlockHash[:])
+	binary.BigEndian.PutUint64(hdr[len(magic)+42:], uint64(s.BlockTime.UnixNano()))
+	bw.Write(hdr)
+	count := uint64(0)
+	lenbuf := make([]byte, binary.MaxVarintLen64)
+	record := func(kind byte, body []byte) {
+		bw.WriteByte(kind)
+		ln := binary.PutUvarint(lenbuf, uint64(len(body)))
+		bw.Write(lenbuf[:ln])
+		bw.Write(body)
+		count++
+	}
+	object := func(ro objects.RoutingObject, state int) {
+		content := ro.GetContent()
+		body := make([]byte, 2+len(content))
+		body[0] = byte(ro.GetRONum())
+		body[1] = byte(state)
+		copy(body[2:], content)
+		record(kindObject, body)
+	}
+	//Entities first so that they are loaded before what refers to them
+	for _, k := range sortedKeys(s.Entities) {
+		object(s.Entities[k].RO, s.Entities[k].State)
+	}
+	for _, k := range sortedKeys(s.DOTs) {
+		object(s.DOTs[k].RO, s.DOTs[k].State)
+	}
+	for _, k := range sortedKeys(s.Chains) {
+		object(s.Chains[k].RO, s.Chains[k].State)
+	}
+	for _, k := range sortedKeys(s.Revocations) {
+		for _, r := range s.Revocations[k] {
+			object(r, 0)
+		}
+	}
+	for _, k := range sortedKeys(s.Aliases) {
+		v := s.Aliases[k]
+		record(kindAlias, append(k[:], v[:]...))
+	}
+	for _, k := range sortedKeys(s.Routers) {
+		v := s.Routers[k]
+		record(kindRouter, append(k[:], v[:]...))
+	}
+	for _, k := range sortedKeys(s.SRVs) {
+		record(kindSRV, append(k[:], []byte(s.SRVs[k])...))
+	}
+	trailer := make([]byte, 9+32)
+	binary.BigEndian.PutUint64(trailer[1:], count)
+	copy(trailer[9:], signer.GetVK())
+	bw.Write(trailer)
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	sig := make([]byte, 64)
+	crypto.SignBlob(signer.GetSK(), signer.GetVK(), sig, h.Sum(nil))
+	_, err := w.Write(sig)
+	return err
+}
+
+//hashingReader hashes every byte that is read through it
+type hashingReader struct {
+	r *bufio.Reader
+	h hash.Hash
+}
+
+func (hr *hashingReader) Read(p []byte) (int, error) {
+	n, err := hr.r.Read(p)
+	hr.h.Write(p[:n])
+	return n, err
+}
+func (hr *hashingReader) ReadByte() (byte, error) {
+	b, err := hr.r.ReadByte()
+	if err == nil {
+		hr.h.Write([]byte{b})
+	}
+	return b, err
+}
+
+//Read reads a snapshot and checks that it was signed by the VK in it. It
+//is up to the caller to decide whether to trust that VK.
+func Read(r io.Reader) (*Snapshot, error) {
+	hr := &hashingReader{r: bufio.NewReader(r), h: sha256.New()}
+	hdr := make([]byte, len(magic)+2+8+32+8)
+	if _, err := io.ReadFull(hr, hdr); err != nil {
+		return nil, fmt.Errorf("could not read snapshot header: %v", err)
+	}
+	if string(hdr[:len(magic)]) != magic {
+		return nil, errors.New("this is not a registry snapshot")
+	}
+	if v := binary.BigEndian.Uint16(hdr[len(magic):]); v != Version {
+		return nil, fmt.Errorf("snapshot format version %d is not supported", v)
+	}
+	s := New(binary.BigEndian.Uint64(hdr[len(magic)+2:]), key(hdr[len(magic)+10:]),
+		time.Unix(0, int64(binary.BigEndian.Uint64(hdr[len(magic)+42:]))))
+	count := uint64(0)
+	for {
+		kind, err := hr.ReadByte()
+		if err != nil {
+			return nil, errors.New("snapshot is truncated")
+		}
+		if kind == 0 {
+			break
+		}
+		ln, err := binary.ReadUvarint(hr)
+		if err != nil || ln > maxRecord {
+			return nil, errors.New("snapshot is damaged")
+		}
+		body := make([]byte, ln)
+		if _, err := io.ReadFull(hr, body); err != nil {
+			return nil, errors.New("snapshot is truncated")
+		}
+		if err := s.load(kind, body); err != nil {
+			return nil, err
+		}
+		count++
+	}
+	trailer := make([]byte, 8+32)
+	if _, err := io.ReadFull(hr, trailer); err != nil {
+		return nil, errors.New("snapshot is truncated")
+	}
+	if binary.BigEndian.Uint64(trailer) != count {
+		return nil, errors.New("snapshot record count does not match")
+	}
+	digest := hr.h.Sum(nil)
+	sig := make([]byte, 64)
+	if _, err := io.ReadFull(hr.r, sig); err != nil {
+		return nil, errors.New("snapshot is truncated")
+	}
+	s.SignerVK = trailer[8:]
+	if !crypto.VerifyBlob(s.SignerVK, sig, digest) {
+		return nil, errors.New("snapshot signature is invalid")
+	}
+	return s, nil
+}
+
+func (s *Snapshot) load(kind byte, body []byte) error {
+	switch kind {
+	case kindObject:
+		if len(body) < 2 {
+			return errors.New("snapshot is damaged")
+		}
+		ro, err := objects.LoadRoutingObject(int(body[0]), body[2:])
+		if err != nil {
+			return fmt.Errorf("snapshot has a bad routing object: %v", err)
+		}
+		return s.Add(ro, int(body[1]))
+	case kindAlias, kindRouter:
+		if len(body) != 64 {
+			return errors.New("snapshot is damaged")
+		}
+		if kind == kindAlias {
+			s.Aliases[key(body[:32])] = key(body[32:])
+		} else {
+			s.Routers[key(body[:32])] = key(body[32:])
+		}
+	case kindSRV:
+		if len(body) < 32 {
+			return errors.New("snapshot is damaged")
+		}
+		s.SRVs[key(body[:32])] = string(body[32:])
+	default:
+		//Ignore records added by newer versions
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package regsnap_test
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/regsnap"
+	"github.com/immesys/bw2/objects"
+)
+
+func mkSnapshot(t *testing.T) (*regsnap.Snapshot, *objects.Entity, *objects.DOT) {
+	ns := objects.CreateNewEntity("", "", nil)
+	ent := objects.CreateNewEntity("", "", nil)
+	dot := objects.CreateDOT(true, ns.GetVK(), ent.GetVK())
+	dot.SetAccessURI(ns.GetVK(), "a/*")
+	dot.SetPermString("PC")
+	dot.Encode(ns.GetSK())
+	dc, err := objects.CreateDChain(true, dot)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rvk := objects.CreateRevocation(ns.GetVK(), dot.GetHash(), "")
+	rvk.Encode(ns.GetSK())
+	s := regsnap.New(42, [32]byte{1, 2, 3}, time.Unix(1500000000, 0))
+	for _, ro := range []objects.RoutingObject{ns, ent, dot, dc, rvk} {
+		if err := s.Add(ro, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s.Aliases[[32]byte{'n', 's'}] = [32]byte{9}
+	s.Routers[[32]byte{7}] = [32]byte{8}
+	s.SRVs[[32]byte{8}] = "127.0.0.1:4514"
+	return s, ns, dot
+}
+
+func TestRoundTrip(t *testing.T) {
+	s, signer, dot := mkSnapshot(t)
+	buf := bytes.Buffer{}
+	if err := s.Write(&buf, signer); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := regsnap.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(rs.SignerVK, signer.GetVK()) {
+		t.Fatal("signer VK did not round trip")
+	}
+	if rs.Block != 42 || rs.BlockHash != s.BlockHash || !rs.BlockTime.Equal(s.BlockTime) {
+		t.Fatal("header did not round trip")
+	}
+	if len(rs.Entities) != 2 || len(rs.DOTs) != 1 || len(rs.Chains) != 1 || len(rs.Revocations) != 1 {
+		t.Fatalf("objects did not round trip: %d %d %d %d", len(rs.Entities), len(rs.DOTs), len(rs.Chains), len(rs.Revocations))
+	}
+	granted := rs.GrantedFrom(dot.GetGiverVK())
+	if len(granted) != 1 || !bytes.Equal(granted[0][:], dot.GetHash()) {
+		t.Fatal("granted DOTs are wrong")
+	}
+	if k, ok := rs.AliasFor([32]byte{9}); !ok || k != ([32]byte{'n', 's'}) {
+		t.Fatal("alias did not round trip")
+	}
+	if rs.Routers[[32]byte{7}] != ([32]byte{8}) || rs.SRVs[[32]byte{8}] != "127.0.0.1:4514" {
+		t.Fatal("routers did not round trip")
+	}
+	again := bytes.Buffer{}
+	if err := rs.Write(&again, signer); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again.Bytes(), buf.Bytes()) {
+		t.Fatal("writing the same snapshot twice gave different bytes")
+	}
+}
+
+func TestTampered(t *testing.T) {
+	s, signer, _ := mkSnapshot(t)
+	buf := bytes.Buffer{}
+	if err := s.Write(&buf, signer); err != nil {
+		t.Fatal(err)
+	}
+	enc := buf.Bytes()
+	for _, i := range []int{10, 30, len(enc) / 2, len(enc) - 70} {
+		bad := append([]byte{}, enc...)
+		bad[i] ^= 0x40
+		if _, err := regsnap.Read(bytes.NewReader(bad)); err == nil {
+			t.Fatalf("snapshot with byte %d changed was accepted", i)
+		}
+	}
+	if _, err := regsnap.Read(bytes.NewReader(enc[:len(enc)-1])); err == nil {
+		t.Fatal("truncated snapshot was accepted")
+	}
+}
+
+func TestMerge(t *testing.T) {
+	s, _, dot := mkSnapshot(t)
+	m := regsnap.New(50, [32]byte{4}, time.Unix(1500000100, 0))
+	m.Add(dot, 3)
+	m.Aliases[[32]byte{'x'}] = [32]byte{10}
+	m.Merge(s)
+	m.Merge(s)
+	if m.Block != 50 {
+		t.Fatal("merge changed the block")
+	}
+	if len(m.Entities) != 2 || len(m.DOTs) != 1 || len(m.Chains) != 1 || len(m.Revocations) != 1 || len(m.Aliases) != 2 {
+		t.Fatalf("wrong objects after merge: %d %d %d %d %d", len(m.Entities), len(m.DOTs), len(m.Chains), len(m.Revocations), len(m.Aliases))
+	}
+	var dh [32]byte
+	copy(dh[:], dot.GetHash())
+	if m.DOTs[dh].State != 1 {
+		t.Fatal("merged DOT did not replace the existing one")
+	}
+	if len(m.Revocations[dh]) != 1 {
+		t.Fatal("revocation was duplicated")
+	}
+}
+
+func TestRevokedRoundTrip(t *testing.T) {
+	s, ns, dot := mkSnapshot(t)
+	//A revocation by someone who cannot revoke the DOT does not count
+	other := objects.CreateNewEntity("", "", nil)
+	bogus := objects.CreateRevocation(other.GetVK(), ns.GetVK(), "")
+	bogus.Encode(other.GetSK())
+	s.Add(bogus, 0)
+	buf := bytes.Buffer{}
+	if err := s.Write(&buf, ns); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := regsnap.Read(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	//As the snapshot is imported
+	imp := regsnap.New(rs.Block, rs.BlockHash, rs.BlockTime)
+	imp.Merge(rs)
+	if !imp.Revoked(dot.GetHash(), dot) {
+		t.Fatal("DOT revocation did not survive export and import")
+	}
+	if imp.Revoked(ns.GetVK(), ns) {
+		t.Fatal("revocation by another entity was accepted")
+	}
+}
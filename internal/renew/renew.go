@@ -0,0 +1,70 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package renew makes the copy of a DOT that replaces it when it is renewed.
+//Checking that the DOT and its entities may be renewed is done by the
+//router in api.
+package renew
+
+import (
+	"bytes"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//Clone returns a copy of old that expires at the given time, signed by
+//giver, which must be the DOT's giver. The URI, permissions, publish
+//limits, TTL, contact, comment and delegated revokers are the same. The
+//creation date is now, unless the DOT has none.
+func Clone(old *objects.DOT, giver *objects.Entity, expiry time.Time) (*objects.DOT, error) {
+	if !bytes.Equal(old.GetGiverVK(), giver.GetVK()) {
+		return nil, bwe.M(bwe.InvalidDOT, "Only the giver, "+crypto.FmtKey(old.GetGiverVK())+", can renew the DOT")
+	}
+	if !expiry.After(time.Now()) {
+		return nil, bwe.M(bwe.InvalidDOT, "The new expiry must be in the future")
+	}
+	d := objects.CreateDOT(old.IsAccess(), old.GetGiverVK(), old.GetReceiverVK())
+	d.SetTTL(old.GetTTL())
+	d.SetContact(old.GetContact())
+	d.SetComment(old.GetComment())
+	d.SetExpiry(expiry)
+	if old.GetCreated() != nil {
+		d.SetCreationToNow()
+	}
+	for _, r := range old.GetRevokers() {
+		d.AddRevoker(r)
+	}
+	if old.IsAccess() {
+		d.SetAccessURI(old.GetAccessURIMVK(), old.GetAccessURISuffix())
+		if !d.SetPermString(old.GetPermString()) {
+			return nil, bwe.M(bwe.BadPermissions, "Permission string is invalid")
+		}
+		d.SetPublishLimits(old.GetPublishLimits())
+	} else {
+		for k, v := range old.GetPermissions() {
+			d.SetPermission(k, v)
+		}
+	}
+	d.Encode(giver.GetSK())
+	if bytes.Equal(d.GetHash(), old.GetHash()) {
+		return nil, bwe.M(bwe.InvalidDOT, "The renewed DOT is the same as the old one")
+	}
+	return d, nil
+}
@@ -0,0 +1,97 @@
+package renew_test
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/immesys/bw2/internal/renew"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//reload decodes the content of d, so that the check is on what would be
+//published
+func reload(t *testing.T, d *objects.DOT) *objects.DOT {
+	ro, err := objects.NewDOT(d.GetRONum(), d.GetContent())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ro.(*objects.DOT)
+}
+
+func TestClone(t *testing.T) {
+	ns := objects.CreateNewEntity("", "", nil)
+	to := objects.CreateNewEntity("", "", nil)
+	rvk := objects.CreateNewEntity("", "", nil)
+	access := objects.CreateDOT(true, ns.GetVK(), to.GetVK())
+	access.SetAccessURI(ns.GetVK(), "a/b/*")
+	access.SetPermString("PC*")
+	access.SetPublishLimits(&objects.PublishLimits{TxLimit: 1000, StoreLimit: 5000, Retain: 3})
+	access.SetTTL(3)
+	access.SetContact("ops")
+	access.SetComment("lights")
+	access.SetCreationToNow()
+	access.SetExpiry(time.Now().Add(-time.Hour))
+	access.AddRevoker(rvk.GetVK())
+	access.Encode(ns.GetSK())
+	perm := objects.CreateDOT(false, ns.GetVK(), to.GetVK())
+	perm.SetPermission("room", "410")
+	perm.SetTTL(1)
+	perm.Encode(ns.GetSK())
+
+	for _, old := range []*objects.DOT{reload(t, access), reload(t, perm)} {
+		expiry := time.Now().Add(24 * time.Hour).Truncate(time.Millisecond)
+		nd, err := renew.Clone(old, ns, expiry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		nd = reload(t, nd)
+		if bytes.Equal(nd.GetHash(), old.GetHash()) {
+			t.Fatal("renewed DOT has the old hash")
+		}
+		if !nd.SigValid() {
+			t.Fatal("renewed DOT is not signed by the giver")
+		}
+		if nd.IsAccess() != old.IsAccess() ||
+			!bytes.Equal(nd.GetGiverVK(), old.GetGiverVK()) ||
+			!bytes.Equal(nd.GetReceiverVK(), old.GetReceiverVK()) ||
+			!reflect.DeepEqual(nd.GetPermissions(), old.GetPermissions()) ||
+			nd.GetTTL() != old.GetTTL() ||
+			nd.GetContact() != old.GetContact() ||
+			nd.GetComment() != old.GetComment() ||
+			!reflect.DeepEqual(nd.GetRevokers(), old.GetRevokers()) {
+			t.Fatalf("renewed DOT differs from the old one:\nold %s\nnew %s", old, nd)
+		}
+		if nd.IsAccess() && (!bytes.Equal(nd.GetAccessURIMVK(), old.GetAccessURIMVK()) ||
+			nd.GetAccessURISuffix() != old.GetAccessURISuffix() ||
+			nd.GetPermString() != old.GetPermString() ||
+			!reflect.DeepEqual(nd.GetPublishLimits(), old.GetPublishLimits())) {
+			t.Fatalf("renewed access DOT differs from the old one:\nold %s\nnew %s", old, nd)
+		}
+		if nd.GetExpiry() == nil || !nd.GetExpiry().Equal(expiry) {
+			t.Fatalf("expected expiry %s, got %v", expiry, nd.GetExpiry())
+		}
+		if (nd.GetCreated() == nil) != (old.GetCreated() == nil) {
+			t.Fatal("renewed DOT does not have a creation date like the old one")
+		}
+	}
+	if c := reload(t, access).GetPublishLimits(); c == nil || c.Retain != 3 {
+		t.Fatalf("publish limits did not survive encoding: %v", c)
+	}
+
+	for _, tc := range []struct {
+		name   string
+		giver  *objects.Entity
+		expiry time.Time
+	}{
+		{"not the giver", to, time.Now().Add(time.Hour)},
+		{"expiry in the past", ns, time.Now().Add(-time.Minute)},
+	} {
+		_, err := renew.Clone(reload(t, access), tc.giver, tc.expiry)
+		if err == nil || bwe.AsBW(err).Code != bwe.InvalidDOT {
+			t.Errorf("%s: expected InvalidDOT, got %v", tc.name, err)
+		}
+	}
+}
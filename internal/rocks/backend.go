@@ -0,0 +1,52 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package rocks
+
+import "github.com/immesys/bw2/internal/db"
+
+func init() {
+	db.Register("rocks", func() db.BWDB {
+		return DB{}
+	})
+}
+
+//DB exposes the RocksDB database as a storage backend. There is only one
+//RocksDB database per process, so every DB refers to the same one.
+type DB struct{}
+
+func (DB) Initialize(dbname string) {
+	RawInitialize(dbname)
+}
+func (DB) PutObject(cf int, key []byte, val []byte) {
+	PutObject(cf, key, val)
+}
+func (DB) GetObject(cf int, key []byte) ([]byte, error) {
+	return GetObject(cf, key)
+}
+func (DB) DeleteObject(cf int, key []byte) {
+	DeleteObject(cf, key)
+}
+func (DB) Exists(cf int, key []byte) bool {
+	return Exists(cf, key)
+}
+func (DB) CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	return CreateIterator(cf, prefix)
+}
+func (DB) CreateIteratorFrom(cf int, prefix []byte, start []byte) db.BWDBIterator {
+	return CreateIteratorFrom(cf, prefix, start)
+}
@@ -36,6 +36,14 @@ Status openDB(std::string name)
   cfz.push_back(ColumnFamilyDescriptor("CF_MSG_I", ColumnFamilyOptions()));
   // open the entity column family
   cfz.push_back(ColumnFamilyDescriptor("CF_ENTITY", ColumnFamilyOptions()));
+  // open the durable subscription queue column family
+  cfz.push_back(ColumnFamilyDescriptor("CF_QUEUE", ColumnFamilyOptions()));
+  // open the message history column family
+  cfz.push_back(ColumnFamilyDescriptor("CF_HIST", ColumnFamilyOptions()));
+  // open the pinned peer certificate column family
+  cfz.push_back(ColumnFamilyDescriptor("CF_PEER", ColumnFamilyOptions()));
+  // databases created by older versions lack the newer column families
+  options.create_missing_column_families = true;
   Status s = DB::Open(options, name, cfz, &handles, &db);
   return s;
 }
@@ -67,11 +75,26 @@ void createDB(std::string name)
   ColumnFamilyHandle* cf5;
   s = db->CreateColumnFamily(ColumnFamilyOptions(), "CF_ENTITY", &cf5);
   assert(s.ok());
+  // create column family
+  ColumnFamilyHandle* cf6;
+  s = db->CreateColumnFamily(ColumnFamilyOptions(), "CF_QUEUE", &cf6);
+  assert(s.ok());
+  // create column family
+  ColumnFamilyHandle* cf7;
+  s = db->CreateColumnFamily(ColumnFamilyOptions(), "CF_HIST", &cf7);
+  assert(s.ok());
+  // create column family
+  ColumnFamilyHandle* cf8;
+  s = db->CreateColumnFamily(ColumnFamilyOptions(), "CF_PEER", &cf8);
+  assert(s.ok());
   delete cf1;
   delete cf2;
   delete cf3;
   delete cf4;
   delete cf5;
+  delete cf6;
+  delete cf7;
+  delete cf8;
   delete db;
 }
 void init(const char* name, size_t namelen)
@@ -23,9 +23,10 @@ package rocks
 import "C"
 import (
 	"bytes"
-	"errors"
 	"runtime"
 	"unsafe"
+
+	"github.com/immesys/bw2/internal/db"
 )
 
 var doneInit bool
@@ -46,15 +47,26 @@ const (
 	CFMsg    = 3
 	CFMsgI   = 4
 	CFEntity = 5
+	CFQueue  = 6
+	CFHist   = 7
+	CFPeer   = 8
 )
 
+//cbytes allows empty values and prefixes, which cannot be indexed
+func cbytes(b []byte) *C.char {
+	if len(b) == 0 {
+		return nil
+	}
+	return (*C.char)(unsafe.Pointer(&b[0]))
+}
+
 //ErrObjNotFound is returned from GetObject if the object cannot be found
-var ErrObjNotFound = errors.New("Object Not Found")
+var ErrObjNotFound = db.ErrObjNotFound
 
 func PutObject(cf int, key []byte, val []byte) {
 	C.put_object(C.int(cf), (*C.char)(unsafe.Pointer(&key[0])),
 		(C.size_t)(len(key)),
-		(*C.char)(unsafe.Pointer(&val[0])),
+		cbytes(val),
 		(C.size_t)(len(val)))
 }
 
@@ -67,7 +79,9 @@ func GetObject(cf int, key []byte) ([]byte, error) {
 		return nil, ErrObjNotFound
 	}
 	rv := make([]byte, int(ln))
-	C.memcpy(unsafe.Pointer(&rv[0]), unsafe.Pointer(val), ln)
+	if ln > 0 {
+		C.memcpy(unsafe.Pointer(&rv[0]), unsafe.Pointer(val), ln)
+	}
 	C.free(unsafe.Pointer(val))
 	return rv, nil
 }
@@ -95,13 +109,23 @@ type Iterator struct {
 }
 
 func CreateIterator(cf int, prefix []byte) *Iterator {
+	return CreateIteratorFrom(cf, prefix, prefix)
+}
+
+//CreateIteratorFrom returns an iterator over the keys with the given
+//prefix, positioned on the first one that is not before start
+func CreateIteratorFrom(cf int, prefix []byte, start []byte) *Iterator {
+	//Seeking before the prefix would land on a key without it
+	if bytes.Compare(start, prefix) < 0 {
+		start = prefix
+	}
 	rv := Iterator{prefix: prefix}
 	var k *C.char
 	var kl C.size_t
 	var v *C.char
 	var vl C.size_t
-	C.iterator_create(C.int(cf), (*C.char)(unsafe.Pointer(&prefix[0])),
-		(C.size_t)(len(prefix)),
+	C.iterator_create(C.int(cf), cbytes(start),
+		(C.size_t)(len(start)),
 		&rv.state, &k, &kl, &v, &vl)
 	runtime.SetFinalizer(&rv, func(it *Iterator) {
 		//I have no idea how long rocks will take to do this. I suspect
@@ -164,6 +188,8 @@ func (i *Iterator) Key() []byte {
 }
 func (i *Iterator) Value() (value []byte) {
 	value = make([]byte, i.curvl)
-	C.memcpy(unsafe.Pointer(&value[0]), unsafe.Pointer(i.curv), i.curvl)
+	if i.curvl > 0 {
+		C.memcpy(unsafe.Pointer(&value[0]), unsafe.Pointer(i.curv), i.curvl)
+	}
 	return
 }
@@ -0,0 +1,311 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package store
+
+//This file keeps the history of persisted messages. PutMessage only keeps
+//the latest value for a topic, so if history is enabled every persisted
+//message is also stored under the topic key, a zero, the big endian
+//receive time and a sequence number. A prefix scan over a topic therefore
+//returns its history in order.
+
+import (
+	"encoding/binary"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	log "github.com/cihub/seelog"
+	"github.com/immesys/bw2/internal/db"
+)
+
+var histEnabled bool
+var histMaxCount int
+var histMaxAge time.Duration
+var histSeq uint32
+
+//The number of messages in the history of each topic, by history prefix,
+//counted when a message is first put on it. It and the history itself are
+//only changed with histLock held.
+var histCounts = make(map[string]int)
+var histLock sync.Mutex
+
+//How often the history is swept for messages older than the max age
+const histSweepInterval = 10 * time.Minute
+
+//SetHistoryRetention enables message history. At most maxCount messages
+//will be kept per topic, and messages older than maxAge are removed.
+//A value of zero means that limit is not enforced.
+func SetHistoryRetention(maxCount int, maxAge time.Duration) {
+	histMaxCount = maxCount
+	histMaxAge = maxAge
+	if !histEnabled {
+		histEnabled = true
+		if maxAge > 0 {
+			go func() {
+				for {
+					time.Sleep(histSweepInterval)
+					SweepHistory()
+				}
+			}()
+		}
+	}
+}
+
+//HistoryEnabled returns true if persisted messages are being retained
+func HistoryEnabled() bool {
+	return histEnabled
+}
+
+//The trailing zero stops topic "a/b" matching the history of "a/bc"
+func mkhistprefix(topic string) []byte {
+	ts := strings.Split(topic, "/")
+	key := make([]byte, len(topic)+2)
+	key[0] = byte(len(ts))
+	copy(key[1:], []byte(topic))
+	return key
+}
+
+func mkhistkey(topic string, rxtime time.Time) []byte {
+	pfx := mkhistprefix(topic)
+	key := make([]byte, len(pfx)+12)
+	copy(key, pfx)
+	binary.BigEndian.PutUint64(key[len(pfx):], uint64(rxtime.UnixNano()))
+	binary.BigEndian.PutUint32(key[len(pfx)+8:], atomic.AddUint32(&histSeq, 1))
+	return key
+}
+
+func histKeyTime(key []byte) time.Time {
+	ts := binary.BigEndian.Uint64(key[len(key)-12:])
+	return time.Unix(0, int64(ts))
+}
+
+//PutHistory adds a message to the history of the given topic, removing
+//old messages that are outside the retention policy. It does nothing if
+//history is not enabled.
+func PutHistory(topic string, rxtime time.Time, payload []byte) {
+	PutHistoryRetain(topic, rxtime, payload, 0)
+}
+
+//PutHistoryRetain is like PutHistory, but keeps at most maxCount messages
+//on the topic if that is lower than the router's limit. Zero means
+//only the router's limit applies.
+func PutHistoryRetain(topic string, rxtime time.Time, payload []byte, maxCount int) {
+	if !histEnabled {
+		return
+	}
+	if histMaxCount > 0 && (maxCount == 0 || histMaxCount < maxCount) {
+		maxCount = histMaxCount
+	}
+	pfx := mkhistprefix(topic)
+	histLock.Lock()
+	defer histLock.Unlock()
+	if maxCount == 0 {
+		//Nothing to trim, old messages are only removed by the sweep. The
+		//count must still be right for when the topic gets a limit
+		dbi_PutObject(db.CFHist, mkhistkey(topic, rxtime), payload)
+		if count, ok := histCounts[string(pfx)]; ok {
+			histCounts[string(pfx)] = count + 1
+		}
+		return
+	}
+	count, ok := histCounts[string(pfx)]
+	if !ok {
+		count = countHistory(pfx)
+	}
+	dbi_PutObject(db.CFHist, mkhistkey(topic, rxtime), payload)
+	count++
+	if count > maxCount {
+		count -= trimHistory(pfx, count-maxCount)
+	}
+	histCounts[string(pfx)] = count
+}
+
+//countHistory returns the number of messages in the history of a topic
+func countHistory(pfx []byte) int {
+	rv := 0
+	it := dbi_CreateIterator(db.CFHist, pfx)
+	for it.OK() {
+		if len(it.Key()) == len(pfx)+12 {
+			rv++
+		}
+		it.Next()
+	}
+	it.Release()
+	return rv
+}
+
+//trimHistory removes the oldest n messages from the history of a topic
+//and returns how many there were
+func trimHistory(pfx []byte, n int) int {
+	keys := [][]byte{}
+	it := dbi_CreateIterator(db.CFHist, pfx)
+	for it.OK() && len(keys) < n {
+		k := it.Key()
+		if len(k) == len(pfx)+12 {
+			kc := make([]byte, len(k))
+			copy(kc, k)
+			keys = append(keys, kc)
+		}
+		it.Next()
+	}
+	it.Release()
+	for _, k := range keys {
+		dbi_DeleteObject(db.CFHist, k)
+	}
+	return len(keys)
+}
+
+//SweepHistory removes messages older than the maximum age from all topics
+func SweepHistory() {
+	if histMaxAge <= 0 {
+		return
+	}
+	cutoff := time.Now().Add(-histMaxAge)
+	keys := [][]byte{}
+	//Keys start with the number of topic elements
+	for depth := 1; depth < 256; depth++ {
+		it := dbi_CreateIterator(db.CFHist, []byte{byte(depth)})
+		for it.OK() {
+			k := it.Key()
+			if len(k) > 12 && histKeyTime(k).Before(cutoff) {
+				kc := make([]byte, len(k))
+				copy(kc, k)
+				keys = append(keys, kc)
+			}
+			it.Next()
+		}
+		it.Release()
+	}
+	histLock.Lock()
+	for _, k := range keys {
+		dbi_DeleteObject(db.CFHist, k)
+		pfx := string(k[:len(k)-12])
+		if _, ok := histCounts[pfx]; ok {
+			histCounts[pfx]--
+		}
+	}
+	histLock.Unlock()
+	if len(keys) > 0 {
+		log.Infof("removed %d messages from history", len(keys))
+	}
+}
+
+//GetHistory returns the messages persisted on the exact topic with
+//a receive time in [from, to], in order. A zero time leaves that end of
+//the range unbounded.
+func GetHistory(topic string, from time.Time, to time.Time, handle chan SM) {
+	pfx := mkhistprefix(topic)
+	it := dbi_CreateIterator(db.CFHist, pfx)
+	for it.OK() {
+		k := it.Key()
+		if len(k) == len(pfx)+12 {
+			rxt := histKeyTime(k)
+			if !to.IsZero() && rxt.After(to) {
+				break
+			}
+			if from.IsZero() || !rxt.Before(from) {
+				v := it.Value()
+				body := make([]byte, len(v))
+				copy(body, v)
+				handle <- SM{URI: topic, Body: body, RXTime: rxt}
+			}
+		}
+		it.Next()
+	}
+	it.Release()
+}
+
+//GetMatchingHistory is like GetMatchingMessage, but it returns all the
+//messages persisted in the given time range rather than only the latest
+//message on each topic. Messages on a topic are in order, but the topics
+//are not.
+func GetMatchingHistory(uri string, from time.Time, to time.Time, handle chan SM) {
+	pattern := strings.Split(uri, "/")
+	//Only topics that start with the elements before the first wildcard
+	//can match, and only with as many elements as the pattern allows
+	literal := 0
+	for literal < len(pattern) && pattern[literal] != "+" && pattern[literal] != "*" {
+		literal++
+	}
+	if literal == len(pattern) {
+		GetHistory(uri, from, to, handle)
+		close(handle)
+		return
+	}
+	var lpfx []byte
+	if literal > 0 {
+		lpfx = []byte(strings.Join(pattern[:literal], "/") + "/")
+	}
+	mindepth, maxdepth := len(pattern), len(pattern)
+	for _, p := range pattern {
+		if p == "*" {
+			//A * can match no elements, or any number of them
+			mindepth--
+			maxdepth = 255
+		}
+	}
+	//Keys start with the number of topic elements, then the topic and a
+	//zero, so each topic is found once and then read with GetHistory
+	for depth := mindepth; depth <= maxdepth; depth++ {
+		if depth < 1 {
+			continue
+		}
+		var last string
+		topics := []string{}
+		it := dbi_CreateIterator(db.CFHist, append([]byte{byte(depth)}, lpfx...))
+		for it.OK() {
+			k := it.Key()
+			if len(k) > 14 {
+				topic := string(k[1 : len(k)-13])
+				if topic != last {
+					last = topic
+					if histTopicMatches(strings.Split(topic, "/"), pattern) {
+						topics = append(topics, topic)
+					}
+				}
+			}
+			it.Next()
+		}
+		it.Release()
+		for _, topic := range topics {
+			GetHistory(topic, from, to, handle)
+		}
+	}
+	close(handle)
+}
+
+//histTopicMatches returns true if the topic matches the pattern, which
+//may contain + and *. A * can match no elements.
+func histTopicMatches(topic []string, pattern []string) bool {
+	if len(pattern) == 0 {
+		return len(topic) == 0
+	}
+	if pattern[0] == "*" {
+		for i := 0; i <= len(topic); i++ {
+			if histTopicMatches(topic[i:], pattern[1:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(topic) == 0 || (pattern[0] != "+" && pattern[0] != topic[0]) {
+		return false
+	}
+	return histTopicMatches(topic[1:], pattern[1:])
+}
@@ -0,0 +1,64 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package store
+
+//This file stores the fingerprints of the TLS keys pinned for peer
+//routers, keyed by the VK of the router, and our own certificate if it is
+//not kept in a file
+
+import "github.com/immesys/bw2/internal/db"
+
+//Our own certificate is kept under a key that is not a VK
+var localCertKey = []byte("local")
+
+//GetLocalCert returns the PEM encoded certificate and key presented to
+//peers, if one has been saved
+func GetLocalCert() ([]byte, bool) {
+	value, err := dbi_GetObject(db.CFPeer, localCertKey)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+//PutLocalCert saves the PEM encoded certificate and key presented to peers
+func PutLocalCert(contents []byte) {
+	dbi_PutObject(db.CFPeer, localCertKey, contents)
+}
+
+//GetPeerCert returns the key fingerprint pinned for the router
+//with the given VK
+func GetPeerCert(vk []byte) ([]byte, bool) {
+	value, err := dbi_GetObject(db.CFPeer, vk)
+	if err != nil {
+		return nil, false
+	}
+	return value, true
+}
+
+//PutPeerCert pins the key fingerprint for the router with the
+//given VK, replacing any previous pin
+func PutPeerCert(vk []byte, fingerprint []byte) {
+	dbi_PutObject(db.CFPeer, vk, fingerprint)
+}
+
+//DeletePeerCert forgets the key pinned for the router with the given VK,
+//so that the next key it presents will be pinned
+func DeletePeerCert(vk []byte) {
+	dbi_DeleteObject(db.CFPeer, vk)
+}
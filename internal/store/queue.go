@@ -0,0 +1,133 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package store
+
+//This file stores the backlog of durable subscription queues. Each queue
+//has a head record holding the next sequence number to assign, and a
+//record per unacknowledged message keyed by the big endian sequence number
+//so that a prefix scan returns the messages in order.
+
+import (
+	"encoding/binary"
+
+	"github.com/immesys/bw2/internal/db"
+)
+
+const (
+	markQHead = 'h'
+	markQMsg  = 'm'
+)
+
+//QM is a message stored in a durable queue
+type QM struct {
+	Seq  uint64
+	Body []byte
+}
+
+func mkqheadkey(queue string) []byte {
+	key := make([]byte, len(queue)+1)
+	key[0] = markQHead
+	copy(key[1:], []byte(queue))
+	return key
+}
+
+//The trailing zero stops queue "a" matching the messages of queue "ab"
+func mkqprefix(queue string) []byte {
+	key := make([]byte, len(queue)+2)
+	key[0] = markQMsg
+	copy(key[1:], []byte(queue))
+	return key
+}
+
+func mkqmsgkey(queue string, seq uint64) []byte {
+	pfx := mkqprefix(queue)
+	key := make([]byte, len(pfx)+8)
+	copy(key, pfx)
+	binary.BigEndian.PutUint64(key[len(pfx):], seq)
+	return key
+}
+
+//GetQueueHead returns the next sequence number that should be assigned
+//for the given queue. It is zero for a queue that has never been used
+func GetQueueHead(queue string) uint64 {
+	value, err := dbi_GetObject(db.CFQueue, mkqheadkey(queue))
+	if err != nil || len(value) != 8 {
+		return 0
+	}
+	return binary.BigEndian.Uint64(value)
+}
+
+//EnqueueMessage stores a message in the given queue and advances the
+//queue head past seq
+func EnqueueMessage(queue string, seq uint64, payload []byte) {
+	dbi_PutObject(db.CFQueue, mkqmsgkey(queue, seq), payload)
+	head := make([]byte, 8)
+	binary.BigEndian.PutUint64(head, seq+1)
+	dbi_PutObject(db.CFQueue, mkqheadkey(queue), head)
+}
+
+//AckQueueMessage removes a message from the queue. It returns false if
+//the message was not in the queue (e.g. it has already been acknowledged)
+func AckQueueMessage(queue string, seq uint64) bool {
+	key := mkqmsgkey(queue, seq)
+	if !dbi_Exists(db.CFQueue, key) {
+		return false
+	}
+	dbi_DeleteObject(db.CFQueue, key)
+	return true
+}
+
+//GetQueueMessages returns up to max messages from the given queue with
+//a sequence number of at least from, in order.
+func GetQueueMessages(queue string, from uint64, max int) []QM {
+	rv := []QM{}
+	pfx := mkqprefix(queue)
+	it := dbi_CreateIteratorFrom(db.CFQueue, pfx, mkqmsgkey(queue, from))
+	for it.OK() && len(rv) < max {
+		k := it.Key()
+		if len(k) == len(pfx)+8 {
+			seq := binary.BigEndian.Uint64(k[len(pfx):])
+			v := it.Value()
+			body := make([]byte, len(v))
+			copy(body, v)
+			rv = append(rv, QM{Seq: seq, Body: body})
+		}
+		it.Next()
+	}
+	it.Release()
+	return rv
+}
+
+//DeleteQueue removes all messages and the head record of a queue
+func DeleteQueue(queue string) {
+	pfx := mkqprefix(queue)
+	keys := [][]byte{}
+	it := dbi_CreateIterator(db.CFQueue, pfx)
+	for it.OK() {
+		k := it.Key()
+		kc := make([]byte, len(k))
+		copy(kc, k)
+		keys = append(keys, kc)
+		it.Next()
+	}
+	it.Release()
+	for _, k := range keys {
+		dbi_DeleteObject(db.CFQueue, k)
+	}
+	dbi_DeleteObject(db.CFQueue, mkqheadkey(queue))
+}
@@ -26,8 +26,11 @@ package store
 import (
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/immesys/bw2/internal/db"
+	_ "github.com/immesys/bw2/internal/level"
+	_ "github.com/immesys/bw2/internal/mem"
 )
 
 //These constants are used to differentiate blocks of keys in the DB.
@@ -41,8 +44,46 @@ const (
 	markEEntity = 6
 )
 
-func Initialize(dbname string) {
-	dbi_RawInitialize(dbname)
+var dbh db.BWDB
+
+//Initialize opens the database using the named storage backend, or
+//DefaultBackend if backend is empty
+func Initialize(backend string, dbname string) error {
+	if backend == "" {
+		backend = DefaultBackend
+	}
+	h, err := db.Open(backend, dbname)
+	if err != nil {
+		return err
+	}
+	dbh = h
+	return nil
+}
+
+var dbi_ErrObjNotFound = db.ErrObjNotFound
+
+func dbi_PutObject(cf int, key []byte, val []byte) {
+	dbh.PutObject(cf, key, val)
+}
+
+func dbi_GetObject(cf int, key []byte) ([]byte, error) {
+	return dbh.GetObject(cf, key)
+}
+
+func dbi_DeleteObject(cf int, key []byte) {
+	dbh.DeleteObject(cf, key)
+}
+
+func dbi_Exists(cf int, key []byte) bool {
+	return dbh.Exists(cf, key)
+}
+
+func dbi_CreateIterator(cf int, prefix []byte) db.BWDBIterator {
+	return dbh.CreateIterator(cf, prefix)
+}
+
+func dbi_CreateIteratorFrom(cf int, prefix []byte, start []byte) db.BWDBIterator {
+	return dbh.CreateIteratorFrom(cf, prefix, start)
 }
 
 /*
@@ -251,6 +292,8 @@ func GetExactMessage(topic string) ([]byte, bool) {
 type SM struct {
 	URI  string
 	Body []byte
+	//Only set for messages from the history
+	RXTime time.Time
 }
 
 func MakeSMFromParts(uriparts []string, body []byte) SM {
@@ -1,14 +1,24 @@
 package store
 
 import (
+	"flag"
 	"fmt"
+	"os"
 	"strconv"
 	"testing"
 	"time"
 )
 
-func init() {
-	Initialize("foobar")
+//Run with -args -backend=memory to test another storage backend
+var testBackend = flag.String("backend", DefaultBackend, "storage backend to test against")
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if err := Initialize(*testBackend, "foobar"); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	os.Exit(m.Run())
 }
 func PrintSync(ch chan SM) {
 	for {
@@ -298,3 +308,151 @@ func TestIcle(t *testing.T) {
 	fmt.Println("Done")
 
 }
+
+func TestDurableQueue(t *testing.T) {
+	DeleteQueue("q")
+	DeleteQueue("qq")
+	for i := uint64(0); i < 10; i++ {
+		EnqueueMessage("q", i, []byte(strconv.Itoa(int(i))))
+	}
+	EnqueueMessage("qq", 0, []byte("other"))
+	if GetQueueHead("q") != 10 {
+		t.Fatalf("bad head %d", GetQueueHead("q"))
+	}
+	if !AckQueueMessage("q", 3) || AckQueueMessage("q", 3) {
+		t.Fatalf("bad ack")
+	}
+	msgs := GetQueueMessages("q", 2, 100)
+	if len(msgs) != 7 {
+		t.Fatalf("expected 7 messages, got %d", len(msgs))
+	}
+	for i := 1; i < len(msgs); i++ {
+		if msgs[i].Seq <= msgs[i-1].Seq {
+			t.Fatalf("messages out of order")
+		}
+	}
+	if string(msgs[0].Body) != "2" || msgs[1].Seq != 4 {
+		t.Fatalf("unexpected messages %+v", msgs)
+	}
+	if len(GetQueueMessages("q", 0, 3)) != 3 {
+		t.Fatalf("max not respected")
+	}
+	DeleteQueue("q")
+	if len(GetQueueMessages("q", 0, 100)) != 0 || GetQueueHead("q") != 0 {
+		t.Fatalf("queue not deleted")
+	}
+	if len(GetQueueMessages("qq", 0, 100)) != 1 {
+		t.Fatalf("deleting q affected qq")
+	}
+	DeleteQueue("qq")
+}
+
+func TestHistory(t *testing.T) {
+	SetHistoryRetention(3, 0)
+	base := time.Now()
+	for i := 0; i < 5; i++ {
+		for _, topic := range []string{"h/a/x", "h/b/x", "h/b/y"} {
+			msg := []byte(fmt.Sprintf("%s-%d", topic, i))
+			PutMessage(topic, msg)
+			PutHistory(topic, base.Add(time.Duration(i)*time.Second), msg)
+		}
+	}
+	count := func(uri string, from, to time.Time) []SM {
+		rv := []SM{}
+		ch := make(chan SM, 3)
+		go GetMatchingHistory(uri, from, to, ch)
+		for sm := range ch {
+			rv = append(rv, sm)
+		}
+		return rv
+	}
+	//Only the last three are retained
+	all := count("h/a/x", time.Time{}, time.Time{})
+	if len(all) != 3 || string(all[0].Body) != "h/a/x-2" || string(all[2].Body) != "h/a/x-4" {
+		t.Fatalf("unexpected history %+v", all)
+	}
+	rng := count("h/a/x", base.Add(3*time.Second), base.Add(4*time.Second))
+	if len(rng) != 2 || !rng[0].RXTime.Equal(base.Add(3*time.Second)) {
+		t.Fatalf("unexpected range %+v", rng)
+	}
+	if n := len(count("h/+/x", base.Add(4*time.Second), time.Time{})); n != 2 {
+		t.Fatalf("expected 2 wildcard results, got %d", n)
+	}
+	if n := len(count("h/*", time.Time{}, base.Add(2*time.Second))); n != 3 {
+		t.Fatalf("expected 3 star results, got %d", n)
+	}
+	if n := len(count("h/b/y", time.Time{}, base.Add(-time.Second))); n != 0 {
+		t.Fatalf("expected no results before the first message, got %d", n)
+	}
+	//A lower per message limit wins, a higher one does not
+	for i := 0; i < 5; i++ {
+		msg := []byte(fmt.Sprintf("h/c/x-%d", i))
+		PutMessage("h/c/x", msg)
+		PutMessage("h/c/y", msg)
+		PutHistoryRetain("h/c/x", base.Add(time.Duration(i)*time.Second), msg, 2)
+		PutHistoryRetain("h/c/y", base.Add(time.Duration(i)*time.Second), msg, 10)
+	}
+	if n := len(count("h/c/x", time.Time{}, time.Time{})); n != 2 {
+		t.Fatalf("expected 2 retained messages, got %d", n)
+	}
+	if n := len(count("h/c/y", time.Time{}, time.Time{})); n != 3 {
+		t.Fatalf("expected 3 retained messages, got %d", n)
+	}
+	//History is found even if the topic has no latest value
+	PutHistory("h/d/z", base, []byte("h/d/z-0"))
+	if n := len(count("h/d/*", time.Time{}, time.Time{})); n != 1 {
+		t.Fatalf("expected 1 message without a latest value, got %d", n)
+	}
+	//Counts survive a restart, when they are not yet known
+	histLock.Lock()
+	histCounts = make(map[string]int)
+	histLock.Unlock()
+	PutHistory("h/a/x", base.Add(5*time.Second), []byte("h/a/x-5"))
+	all = count("h/a/x", time.Time{}, time.Time{})
+	if len(all) != 3 || string(all[0].Body) != "h/a/x-3" {
+		t.Fatalf("unexpected history after recount %+v", all)
+	}
+	//Messages put without a limit are counted for when there is one
+	SetHistoryRetention(0, 0)
+	PutHistoryRetain("h/e/x", base, []byte("h/e/x-0"), 5)
+	for i := 1; i < 4; i++ {
+		PutHistory("h/e/x", base.Add(time.Duration(i)*time.Second), []byte(fmt.Sprintf("h/e/x-%d", i)))
+	}
+	PutHistoryRetain("h/e/x", base.Add(4*time.Second), []byte("h/e/x-4"), 2)
+	all = count("h/e/x", time.Time{}, time.Time{})
+	if len(all) != 2 || string(all[0].Body) != "h/e/x-3" {
+		t.Fatalf("unexpected history after a limit was set %+v", all)
+	}
+	SetHistoryRetention(3, 0)
+	//Wildcards before and after the literal part of the URI
+	if n := len(count("+/e/x", time.Time{}, time.Time{})); n != 2 {
+		t.Fatalf("expected 2 results for a leading wildcard, got %d", n)
+	}
+	if n := len(count("h/*/x", base.Add(4*time.Second), time.Time{})); n != 5 {
+		t.Fatalf("expected 5 results for an inner star, got %d", n)
+	}
+	if n := len(count("h/+", time.Time{}, time.Time{})); n != 0 {
+		t.Fatalf("expected no results at the wrong depth, got %d", n)
+	}
+}
+
+func TestPeerCert(t *testing.T) {
+	vk := []byte("0123456789abcdef0123456789abcdef")
+	DeletePeerCert(vk)
+	if _, ok := GetPeerCert(vk); ok {
+		t.Fatalf("expected no pin")
+	}
+	PutPeerCert(vk, []byte("first"))
+	PutPeerCert(vk, []byte("second"))
+	if fp, ok := GetPeerCert(vk); !ok || string(fp) != "second" {
+		t.Fatalf("expected the second pin, got %q", fp)
+	}
+	DeletePeerCert(vk)
+	if _, ok := GetPeerCert(vk); ok {
+		t.Fatalf("pin not deleted")
+	}
+	PutLocalCert([]byte("local"))
+	if c, ok := GetLocalCert(); !ok || string(c) != "local" {
+		t.Fatalf("expected the local certificate, got %q", c)
+	}
+}
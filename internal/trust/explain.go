@@ -0,0 +1,278 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package trust
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//The graph walk stops after this many partial chains have been examined
+const explainMaxScenarios = 4096
+
+//RejectedDOT is a DOT that could not be used to extend a partial chain
+type RejectedDOT struct {
+	Hash   string `json:"hash,omitempty"`
+	To     string `json:"to,omitempty"`
+	Reason string `json:"reason"`
+}
+
+//PartialChain is a chain from the namespace that does not reach the target,
+//along with the reasons each DOT leading on from it could not be used
+type PartialChain struct {
+	DOTs     []string       `json:"dots"`
+	EndsAt   string         `json:"endsat"`
+	Suffix   string         `json:"suffix"`
+	TTL      int            `json:"ttl"`
+	Rejected []*RejectedDOT `json:"rejected"`
+	//True if one of the rejected DOTs was granted to the target
+	NearTarget bool `json:"neartarget"`
+}
+
+//Explanation is the result of Explain
+type Explanation struct {
+	URI         string          `json:"uri"`
+	Permissions string          `json:"permissions"`
+	Target      string          `json:"target"`
+	Chains      []string        `json:"chains"`
+	Partial     []*PartialChain `json:"partial"`
+	//True if the walk was cut short and the explanation may be incomplete
+	Truncated bool `json:"truncated"`
+}
+
+type explainer struct {
+	res      Resolver
+	nsvk     []byte
+	suffix   string
+	perms    string
+	desperms *objects.AccessDOTPermissionSet
+	target   []byte
+	status   chan string
+}
+
+func (e *explainer) say(msg string) {
+	if e.status != nil {
+		e.status <- msg
+	}
+}
+
+//whyNot returns the chain obtained by adding the DOT in dl to c (which
+//may be nil for the namespace itself) or the reason it cannot be added.
+//Permission DOTs are not relevant and return nil, nil.
+func (e *explainer) whyNot(c *chain, dl Link) (*chain, *RejectedDOT) {
+	if dl.D == nil {
+		return nil, &RejectedDOT{Reason: "DOT is " + e.res.StateToString(dl.S)}
+	}
+	d := dl.D
+	if !d.IsAccess() {
+		return nil, nil
+	}
+	rej := &RejectedDOT{Hash: crypto.FmtHash(d.GetHash()), To: crypto.FmtKey(d.GetReceiverVK())}
+	if dl.S != core.StateValid {
+		rej.Reason = "DOT is " + e.res.StateToString(dl.S)
+		return nil, rej
+	}
+	if !bytes.Equal(d.GetAccessURIMVK(), e.nsvk) {
+		rej.Reason = "DOT is for namespace " + crypto.FmtKey(d.GetAccessURIMVK())
+		return nil, rej
+	}
+	if !e.desperms.IsSubsetOf(d.GetPermissionSet()) {
+		rej.Reason = fmt.Sprintf("DOT grants %s but %s is required", d.GetPermString(), e.perms)
+		return nil, rej
+	}
+	nu, ok := util.RestrictBy(e.suffix, d.GetAccessURISuffix())
+	if !ok || nu != e.suffix {
+		rej.Reason = fmt.Sprintf("DOT URI %s does not cover %s", d.GetAccessURISuffix(), e.suffix)
+		return nil, rej
+	}
+	if c == nil {
+		return &chain{dots: []*objects.DOT{d}, suffix: d.GetAccessURISuffix()}, nil
+	}
+	if bytes.Equal(d.GetReceiverVK(), e.nsvk) {
+		rej.Reason = "DOT leads back to the namespace"
+		return nil, rej
+	}
+	for _, cd := range c.dots {
+		if bytes.Equal(d.GetReceiverVK(), cd.GetReceiverVK()) {
+			rej.Reason = "DOT leads back into the chain"
+			return nil, rej
+		}
+	}
+	suffix, ok := util.RestrictBy(c.suffix, d.GetAccessURISuffix())
+	if !ok {
+		rej.Reason = fmt.Sprintf("DOT URI %s does not intersect the chain URI %s", d.GetAccessURISuffix(), c.suffix)
+		return nil, rej
+	}
+	nc, ok := c.add(d, suffix)
+	if !ok {
+		rej.Reason = "TTL exhausted"
+		return nil, rej
+	}
+	return nc, nil
+}
+
+func (e *explainer) reachesTarget(c *chain) bool {
+	return bytes.Equal(c.terminalVK(), e.target) || bytes.Equal(c.terminalVK(), util.EverybodySlice)
+}
+
+//Explain walks the access DOTs granted from the namespace like a chain
+//build for perms on suffix to target, but instead of only returning the
+//chains that reach the target, it also returns the partial chains that
+//could not be extended and why, closest to the target first. Progress is
+//reported on status if it is not nil.
+func Explain(res Resolver, nsvk []byte, suffix string, perms string, target []byte, maxPartial int, status chan string) (*Explanation, error) {
+	e := &explainer{
+		res:      res,
+		nsvk:     nsvk,
+		suffix:   suffix,
+		perms:    perms,
+		desperms: objects.GetADPSFromPermString(perms),
+		target:   target,
+		status:   status,
+	}
+	if e.desperms == nil {
+		return nil, bwe.M(bwe.BadChainBuildParams, "bad permissions")
+	}
+	if valid, _, _, _ := util.AnalyzeSuffix(suffix); !valid {
+		return nil, bwe.M(bwe.BadURI, "Invalid URI")
+	}
+	rv := &Explanation{
+		URI:         crypto.FmtKey(nsvk) + "/" + suffix,
+		Permissions: perms,
+		Target:      crypto.FmtKey(target),
+	}
+	//nil is the namespace itself, with no DOTs
+	evals := list.New()
+	evals.PushBack((*chain)(nil))
+	examined := 0
+	seen := make(map[string]bool)
+	for evals.Front() != nil {
+		le := evals.Front()
+		evals.Remove(le)
+		c := le.Value.(*chain)
+		examined++
+		if examined > explainMaxScenarios {
+			rv.Truncated = true
+			break
+		}
+		from := nsvk
+		if c != nil {
+			from = c.terminalVK()
+		}
+		e.say("looking for DOTs from " + crypto.FmtKey(from))
+		dlz, err := res.ResolveGrantedDOTs(from)
+		if err != nil {
+			return nil, err
+		}
+		pc := &PartialChain{EndsAt: crypto.FmtKey(from), Suffix: suffix, TTL: 256}
+		if c != nil {
+			for _, d := range c.dots {
+				pc.DOTs = append(pc.DOTs, crypto.FmtHash(d.GetHash()))
+			}
+			pc.Suffix = c.suffix
+			pc.TTL = c.ttl()
+		}
+		extended := false
+		for _, dl := range dlz {
+			nc, rej := e.whyNot(c, dl)
+			if rej != nil {
+				e.say(fmt.Sprintf("rejecting DOT(%s) - %s", rej.Hash, rej.Reason))
+				pc.Rejected = append(pc.Rejected, rej)
+				if rej.To == rv.Target {
+					pc.NearTarget = true
+				}
+				continue
+			}
+			if nc == nil {
+				continue
+			}
+			extended = true
+			if e.reachesTarget(nc) {
+				dc, err := objects.CreateDChain(true, nc.dots...)
+				if err != nil {
+					return nil, err
+				}
+				k := crypto.FmtHash(dc.GetChainHash())
+				if !seen[k] {
+					seen[k] = true
+					rv.Chains = append(rv.Chains, k)
+				}
+			} else {
+				evals.PushBack(nc)
+			}
+		}
+		if !extended || len(pc.Rejected) != 0 {
+			rv.Partial = append(rv.Partial, pc)
+		}
+	}
+	//Closest first: one DOT short of the target, then the longest
+	sort.SliceStable(rv.Partial, func(i, j int) bool {
+		pi, pj := rv.Partial[i], rv.Partial[j]
+		if pi.NearTarget != pj.NearTarget {
+			return pi.NearTarget
+		}
+		return len(pi.DOTs) > len(pj.DOTs)
+	})
+	if maxPartial > 0 && len(rv.Partial) > maxPartial {
+		rv.Partial = rv.Partial[:maxPartial]
+	}
+	e.say("explain operation complete")
+	return rv, nil
+}
+
+//String formats the explanation for people
+func (e *Explanation) String() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "Granting %s on %s to %s\n", e.Permissions, e.URI, e.Target)
+	if len(e.Chains) != 0 {
+		fmt.Fprintf(buf, "%d valid chains exist:\n", len(e.Chains))
+		for _, c := range e.Chains {
+			fmt.Fprintf(buf, "  %s\n", c)
+		}
+		return buf.String()
+	}
+	fmt.Fprintf(buf, "No valid chain exists. Closest partial chains:\n")
+	for i, pc := range e.Partial {
+		fmt.Fprintf(buf, "%d) ", i+1)
+		if len(pc.DOTs) == 0 {
+			fmt.Fprintf(buf, "from the namespace\n")
+		} else {
+			fmt.Fprintf(buf, "%s\n", strings.Join(pc.DOTs, " -> "))
+		}
+		fmt.Fprintf(buf, "   ends at %s (URI %s, TTL %d)\n", pc.EndsAt, pc.Suffix, pc.TTL)
+		if len(pc.Rejected) == 0 {
+			fmt.Fprintf(buf, "   no DOTs are granted from here\n")
+		}
+		for _, r := range pc.Rejected {
+			fmt.Fprintf(buf, "   DOT %s to %s: %s\n", r.Hash, r.To, r.Reason)
+		}
+	}
+	if e.Truncated {
+		fmt.Fprintf(buf, "(the search was cut short, there may be more)\n")
+	}
+	return buf.String()
+}
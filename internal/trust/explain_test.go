@@ -0,0 +1,133 @@
+package trust_test
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/trust"
+	"github.com/immesys/bw2/objects"
+)
+
+type resolver struct {
+	granted map[string][]trust.Link
+}
+
+func (r *resolver) ResolveGrantedDOTs(vk []byte) ([]trust.Link, error) {
+	if vk == nil {
+		return nil, errors.New("no such entity")
+	}
+	return r.granted[string(vk)], nil
+}
+func (r *resolver) StateToString(state int) string {
+	switch state {
+	case core.StateValid:
+		return "Valid"
+	case core.StateExpired:
+		return "Expired"
+	case core.StateRevoked:
+		return "Revoked"
+	}
+	return "Unknown"
+}
+
+//grant adds an access DOT from one entity to another on uri in ns's
+//namespace, in the given state
+func (r *resolver) grant(from, to, ns *objects.Entity, uri string, perms string, state int) *objects.DOT {
+	d := objects.CreateDOT(true, from.GetVK(), to.GetVK())
+	d.SetAccessURI(ns.GetVK(), uri)
+	d.SetPermString(perms)
+	d.SetTTL(5)
+	d.Encode(from.GetSK())
+	r.granted[string(from.GetVK())] = append(r.granted[string(from.GetVK())], trust.Link{D: d, S: state})
+	return d
+}
+
+func newEntity() *objects.Entity {
+	return objects.CreateNewEntity("", "", nil)
+}
+
+func TestExplain(t *testing.T) {
+	res := &resolver{granted: make(map[string][]trust.Link)}
+	ns, other, a, b, target := newEntity(), newEntity(), newEntity(), newEntity(), newEntity()
+	toA := res.grant(ns, a, ns, "a/*", "PC", core.StateValid)
+	res.grant(ns, b, ns, "x/*", "PC", core.StateValid)
+	res.grant(ns, b, ns, "a/*", "PC", core.StateRevoked)
+	res.grant(ns, b, other, "a/*", "PC", core.StateValid)
+	res.grant(a, target, ns, "a/b/c", "P", core.StateValid)
+	res.grant(a, ns, ns, "a/*", "C", core.StateValid)
+
+	ex, err := trust.Explain(res, ns.GetVK(), "a/b/c", "C", target.GetVK(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ex.Chains) != 0 {
+		t.Fatalf("expected no chains, got %v", ex.Chains)
+	}
+	if len(ex.Partial) != 2 {
+		t.Fatalf("expected two partial chains, got %d", len(ex.Partial))
+	}
+	near := ex.Partial[0]
+	if !near.NearTarget || len(near.DOTs) != 1 || near.DOTs[0] != crypto.FmtHash(toA.GetHash()) {
+		t.Fatalf("expected the chain through a first, got %+v", near)
+	}
+	if near.EndsAt != crypto.FmtKey(a.GetVK()) || near.Suffix != "a/*" || near.TTL != 5 {
+		t.Fatalf("bad partial chain %+v", near)
+	}
+	expectReasons(t, near, "DOT grants P but C is required", "DOT leads back to the namespace")
+	root := ex.Partial[1]
+	if root.NearTarget || len(root.DOTs) != 0 || root.EndsAt != crypto.FmtKey(ns.GetVK()) {
+		t.Fatalf("expected the namespace last, got %+v", root)
+	}
+	expectReasons(t, root, "DOT URI x/* does not cover a/b/c", "DOT is Revoked", "DOT is for namespace "+crypto.FmtKey(other.GetVK()))
+	if !strings.Contains(ex.String(), "No valid chain exists") {
+		t.Fatalf("bad explanation text:\n%s", ex)
+	}
+
+	ex, err = trust.Explain(res, ns.GetVK(), "a/b/c", "C", target.GetVK(), 1, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ex.Partial) != 1 || !ex.Partial[0].NearTarget {
+		t.Fatalf("expected only the closest partial chain, got %+v", ex.Partial)
+	}
+
+	res.grant(a, target, ns, "a/b/*", "C", core.StateValid)
+	ex, err = trust.Explain(res, ns.GetVK(), "a/b/c", "C", target.GetVK(), 0, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ex.Chains) != 1 {
+		t.Fatalf("expected one chain, got %v", ex.Chains)
+	}
+	if !strings.Contains(ex.String(), "1 valid chains exist") {
+		t.Fatalf("bad explanation text:\n%s", ex)
+	}
+}
+
+func TestExplainBadParams(t *testing.T) {
+	res := &resolver{granted: make(map[string][]trust.Link)}
+	ns, target := newEntity(), newEntity()
+	if _, err := trust.Explain(res, ns.GetVK(), "a/b", "Q", target.GetVK(), 0, nil); err == nil {
+		t.Fatal("bad permissions were accepted")
+	}
+	if _, err := trust.Explain(res, ns.GetVK(), "a/*/b/*", "C", target.GetVK(), 0, nil); err == nil {
+		t.Fatal("bad URI was accepted")
+	}
+	if _, err := trust.Explain(res, nil, "a/b", "C", target.GetVK(), 0, nil); err == nil {
+		t.Fatal("resolver error was ignored")
+	}
+}
+
+func expectReasons(t *testing.T, pc *trust.PartialChain, reasons ...string) {
+	if len(pc.Rejected) != len(reasons) {
+		t.Fatalf("expected %d rejected DOTs, got %+v", len(reasons), pc.Rejected)
+	}
+	for i, r := range reasons {
+		if pc.Rejected[i].Reason != r {
+			t.Fatalf("expected %q, got %q", r, pc.Rejected[i].Reason)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package trust
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+	"time"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+//The walk stops after this many DOTs have been added to the graph
+const graphMaxEdges = 10000
+
+//Edge is an access DOT in a trust graph
+type Edge struct {
+	Hash        string     `json:"hash"`
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	URI         string     `json:"uri"`
+	Permissions string     `json:"permissions"`
+	TTL         int        `json:"ttl"`
+	Expiry      *time.Time `json:"expiry,omitempty"`
+	State       string     `json:"state"`
+}
+
+//Graph is every access DOT reachable from a namespace
+type Graph struct {
+	Namespace string   `json:"namespace"`
+	Filter    string   `json:"filter,omitempty"`
+	Nodes     []string `json:"nodes"`
+	Edges     []*Edge  `json:"edges"`
+	//True if the walk was cut short and the graph is incomplete
+	Truncated bool `json:"truncated"`
+}
+
+//Walk walks the access DOTs granted from the namespace, then from their
+//receivers and so on. If filter is not empty, only DOTs whose URI
+//intersects that subtree of the namespace are included. Expired and revoked
+//DOTs are included (and followed) so that they can be shown.
+func Walk(res Resolver, nsvk []byte, filter string) (*Graph, error) {
+	rv := &Graph{
+		Namespace: crypto.FmtKey(nsvk),
+		Filter:    filter,
+		Nodes:     []string{crypto.FmtKey(nsvk)},
+	}
+	filterPattern := "*"
+	if filter != "" {
+		filterPattern = filter + "/*"
+		if valid, _, _, _ := util.AnalyzeSuffix(filterPattern); !valid {
+			return nil, bwe.M(bwe.BadURI, "invalid filter URI")
+		}
+	}
+	visited := map[string]bool{crypto.FmtKey(nsvk): true}
+	edges := make(map[string]bool)
+	toVisit := list.New()
+	toVisit.PushBack(nsvk)
+	for toVisit.Front() != nil {
+		le := toVisit.Front()
+		toVisit.Remove(le)
+		from := le.Value.([]byte)
+		dlz, err := res.ResolveGrantedDOTs(from)
+		if err != nil {
+			return nil, err
+		}
+		for _, dl := range dlz {
+			d := dl.D
+			if d == nil || !d.IsAccess() || !bytes.Equal(d.GetAccessURIMVK(), nsvk) {
+				continue
+			}
+			if _, ok := util.RestrictBy(filterPattern, d.GetAccessURISuffix()); !ok {
+				continue
+			}
+			hash := crypto.FmtHash(d.GetHash())
+			if edges[hash] {
+				continue
+			}
+			if len(rv.Edges) >= graphMaxEdges {
+				rv.Truncated = true
+				return rv, nil
+			}
+			edges[hash] = true
+			to := crypto.FmtKey(d.GetReceiverVK())
+			rv.Edges = append(rv.Edges, &Edge{
+				Hash:        hash,
+				From:        crypto.FmtKey(from),
+				To:          to,
+				URI:         d.GetAccessURISuffix(),
+				Permissions: d.GetPermString(),
+				TTL:         d.GetTTL(),
+				Expiry:      d.GetExpiry(),
+				State:       res.StateToString(dl.S),
+			})
+			if !visited[to] {
+				visited[to] = true
+				rv.Nodes = append(rv.Nodes, to)
+				toVisit.PushBack(d.GetReceiverVK())
+			}
+		}
+	}
+	return rv, nil
+}
+
+//GraphViz formats the graph in the GraphViz DOT language. Edges for DOTs
+//that are not valid are dashed and red.
+func (g *Graph) GraphViz() string {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "digraph bw2 {\n")
+	fmt.Fprintf(buf, "  node [shape=box, fontname=monospace];\n")
+	for _, n := range g.Nodes {
+		attrs := ""
+		if n == g.Namespace {
+			attrs = ", style=bold"
+		}
+		fmt.Fprintf(buf, "  %q [label=%q%s];\n", n, n[:8]+"...", attrs)
+	}
+	for _, e := range g.Edges {
+		label := fmt.Sprintf("%s\n%s ttl=%d", e.URI, e.Permissions, e.TTL)
+		if e.Expiry != nil {
+			label += "\nexpires " + e.Expiry.Format(time.RFC3339)
+		}
+		attrs := ""
+		if e.State != "Valid" {
+			label += "\n" + e.State
+			attrs = ", style=dashed, color=red"
+		}
+		fmt.Fprintf(buf, "  %q -> %q [label=%q, tooltip=%q%s];\n", e.From, e.To, label, e.Hash, attrs)
+	}
+	fmt.Fprintf(buf, "}\n")
+	return buf.String()
+}
@@ -0,0 +1,88 @@
+package trust_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/trust"
+	"github.com/immesys/bw2/objects"
+)
+
+func TestWalk(t *testing.T) {
+	res := &resolver{granted: make(map[string][]trust.Link)}
+	ns, other, a, b, c := newEntity(), newEntity(), newEntity(), newEntity(), newEntity()
+	toA := res.grant(ns, a, ns, "a/*", "PC", core.StateValid)
+	toB := res.grant(a, b, ns, "a/b", "C", core.StateRevoked)
+	toC := res.grant(b, c, ns, "x/y", "P", core.StateValid)
+	res.grant(ns, c, other, "a/*", "PC", core.StateValid)
+	//A loop back to the namespace is only walked once
+	back := res.grant(c, ns, ns, "*", "C", core.StateExpired)
+
+	g, err := trust.Walk(res, ns.GetVK(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEdges(t, g, toA, toB, toC, back)
+	nodes := []string{crypto.FmtKey(ns.GetVK()), crypto.FmtKey(a.GetVK()), crypto.FmtKey(b.GetVK()), crypto.FmtKey(c.GetVK())}
+	if strings.Join(g.Nodes, ",") != strings.Join(nodes, ",") {
+		t.Fatalf("expected nodes %v, got %v", nodes, g.Nodes)
+	}
+	if g.Edges[1].State != "Revoked" || g.Edges[1].From != crypto.FmtKey(a.GetVK()) || g.Edges[1].To != crypto.FmtKey(b.GetVK()) {
+		t.Fatalf("bad edge %+v", g.Edges[1])
+	}
+
+	//Only DOTs intersecting a/b are included, so c is not reached
+	g, err = trust.Walk(res, ns.GetVK(), "a/b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectEdges(t, g, toA, toB)
+	if len(g.Nodes) != 3 {
+		t.Fatalf("expected three nodes, got %v", g.Nodes)
+	}
+
+	if _, err := trust.Walk(res, ns.GetVK(), "a/+/*"); err == nil {
+		t.Fatal("bad filter was accepted")
+	}
+}
+
+func TestGraphViz(t *testing.T) {
+	res := &resolver{granted: make(map[string][]trust.Link)}
+	ns, a, b := newEntity(), newEntity(), newEntity()
+	res.grant(ns, a, ns, "a/*", "PC", core.StateValid)
+	res.grant(a, b, ns, "a/b", "C", core.StateRevoked)
+	g, err := trust.Walk(res, ns.GetVK(), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	gv := g.GraphViz()
+	lines := strings.Split(gv, "\n")
+	edges := []string{}
+	for _, l := range lines {
+		if strings.Contains(l, " -> ") {
+			edges = append(edges, l)
+		}
+	}
+	if len(edges) != 2 {
+		t.Fatalf("expected two edges, got:\n%s", gv)
+	}
+	if strings.Contains(edges[0], "dashed") || !strings.Contains(edges[1], "style=dashed, color=red") || !strings.Contains(edges[1], `\nRevoked`) {
+		t.Fatalf("only the revoked DOT should be dashed:\n%s", gv)
+	}
+	if !strings.Contains(gv, "style=bold") {
+		t.Fatalf("the namespace should be bold:\n%s", gv)
+	}
+}
+
+func expectEdges(t *testing.T, g *trust.Graph, dots ...*objects.DOT) {
+	if len(g.Edges) != len(dots) {
+		t.Fatalf("expected %d edges, got %d", len(dots), len(g.Edges))
+	}
+	for i, d := range dots {
+		if g.Edges[i].Hash != crypto.FmtHash(d.GetHash()) {
+			t.Fatalf("edge %d is not DOT %s", i, crypto.FmtHash(d.GetHash()))
+		}
+	}
+}
@@ -0,0 +1,148 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+package trust
+
+import (
+	"bytes"
+	"container/list"
+	"fmt"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+type permBuilder struct {
+	res       Resolver
+	authority []byte
+	target    []byte
+	want      map[string]string
+	status    chan string
+}
+
+func (b *permBuilder) say(msg string) {
+	if b.status != nil {
+		b.status <- msg
+	}
+}
+
+func (b *permBuilder) dotUseful(d *objects.DOT) bool {
+	if d.IsAccess() {
+		return false
+	}
+	for k, v := range b.want {
+		if dv, ok := d.GetPermission(k); !ok || dv != v {
+			b.say(fmt.Sprintf("rejecting DOT(%s) - does not grant %s=%s", crypto.FmtHash(d.GetHash()), k, v))
+			return false
+		}
+	}
+	return true
+}
+
+func (b *permBuilder) getOptions(from []byte) []*objects.DOT {
+	dlz, err := b.res.ResolveGrantedDOTs(from)
+	rv := []*objects.DOT{}
+	if err != nil {
+		//can happen if chain is still synchronizing
+		return rv
+	}
+	for _, dl := range dlz {
+		if dl.S != core.StateValid {
+			if dl.D != nil && !dl.D.IsAccess() {
+				b.say(fmt.Sprintf("rejecting DOT(%s) - Status is %s", crypto.FmtHash(dl.D.GetHash()), b.res.StateToString(dl.S)))
+			}
+			continue
+		}
+		if b.dotUseful(dl.D) {
+			b.say("possible edge DOT: " + crypto.FmtHash(dl.D.GetHash()))
+			rv = append(rv, dl.D)
+		}
+	}
+	return rv
+}
+
+func (b *permBuilder) reachesTarget(c *chain) bool {
+	return bytes.Equal(c.terminalVK(), b.target) || bytes.Equal(c.terminalVK(), util.EverybodySlice)
+}
+
+//BuildPermissionChains walks the permission DOTs granted from the authority
+//and returns every chain that reaches the target in which each DOT grants
+//all of the wanted key/value pairs. Progress is reported on status if it
+//is not nil.
+func BuildPermissionChains(res Resolver, authority []byte, target []byte, want map[string]string, status chan string) ([]*objects.DChain, error) {
+	b := &permBuilder{res: res, authority: authority, target: target, want: want, status: status}
+	if len(authority) != 32 || len(target) != 32 {
+		return nil, bwe.M(bwe.BadChainBuildParams, "bad authority or target")
+	}
+	valid := list.New()
+	evals := list.New()
+	b.say("looking for DOTs from " + crypto.FmtKey(authority))
+	for _, d := range b.getOptions(authority) {
+		c := &chain{dots: []*objects.DOT{d}}
+		if b.reachesTarget(c) {
+			b.say("found valid scenario")
+			valid.PushBack(c)
+		} else {
+			evals.PushBack(c)
+		}
+	}
+	for evals.Front() != nil {
+		le := evals.Front()
+		evals.Remove(le)
+		c := le.Value.(*chain)
+		for _, d := range b.getOptions(c.terminalVK()) {
+			//Don't walk around loops
+			loop := bytes.Equal(d.GetReceiverVK(), authority)
+			for _, cd := range c.dots {
+				if bytes.Equal(d.GetReceiverVK(), cd.GetReceiverVK()) {
+					loop = true
+				}
+			}
+			if loop {
+				continue
+			}
+			nc, ok := c.add(d, "")
+			if !ok {
+				continue
+			}
+			if b.reachesTarget(nc) {
+				b.say("graph walk found a valid scenario!")
+				valid.PushBack(nc)
+			} else {
+				evals.PushBack(nc)
+			}
+		}
+	}
+	seen := make(map[string]bool)
+	rv := make([]*objects.DChain, 0, valid.Len())
+	for e := valid.Front(); e != nil; e = e.Next() {
+		dc, err := objects.CreateDChain(false, e.Value.(*chain).dots...)
+		if err != nil {
+			return nil, err
+		}
+		k := crypto.FmtHash(dc.GetChainHash())
+		if !seen[k] {
+			seen[k] = true
+			rv = append(rv, dc)
+		}
+	}
+	b.say("permission chain build operation complete")
+	return rv, nil
+}
@@ -0,0 +1,80 @@
+package trust_test
+
+import (
+	"testing"
+
+	"github.com/immesys/bw2/crypto"
+	"github.com/immesys/bw2/internal/core"
+	"github.com/immesys/bw2/internal/trust"
+	"github.com/immesys/bw2/objects"
+)
+
+//permit adds a permission DOT granting kv from one entity to another
+func (r *resolver) permit(from, to *objects.Entity, kv map[string]string, state int) *objects.DOT {
+	d := objects.CreateDOT(false, from.GetVK(), to.GetVK())
+	for k, v := range kv {
+		d.SetPermission(k, v)
+	}
+	d.SetTTL(5)
+	d.Encode(from.GetSK())
+	r.granted[string(from.GetVK())] = append(r.granted[string(from.GetVK())], trust.Link{D: d, S: state})
+	return d
+}
+
+func chainHash(t *testing.T, dots ...*objects.DOT) string {
+	dc, err := objects.CreateDChain(false, dots...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return crypto.FmtHash(dc.GetChainHash())
+}
+
+func TestBuildPermissionChains(t *testing.T) {
+	res := &resolver{granted: make(map[string][]trust.Link)}
+	auth, a, b, c, d, target := newEntity(), newEntity(), newEntity(), newEntity(), newEntity(), newEntity()
+	room := map[string]string{"room": "410"}
+	toA := res.permit(auth, a, map[string]string{"room": "410", "floor": "4"}, core.StateValid)
+	aToTarget := res.permit(a, target, room, core.StateValid)
+	res.permit(a, auth, room, core.StateValid)
+	//The value does not match
+	toB := res.permit(auth, b, map[string]string{"room": "411"}, core.StateValid)
+	bToTarget := res.permit(b, target, room, core.StateValid)
+	//Access DOTs are not followed
+	res.grant(auth, c, auth, "*", "PC", core.StateValid)
+	res.permit(c, target, room, core.StateValid)
+	//Neither are revoked ones
+	res.permit(auth, d, room, core.StateRevoked)
+	res.permit(d, target, room, core.StateValid)
+
+	chains, err := trust.BuildPermissionChains(res, auth.GetVK(), target.GetVK(), room, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chains) != 1 || crypto.FmtHash(chains[0].GetChainHash()) != chainHash(t, toA, aToTarget) {
+		t.Fatalf("expected only the chain through a, got %d chains", len(chains))
+	}
+	if chains[0].IsAccess() {
+		t.Fatal("built an access chain")
+	}
+
+	//Without a wanted value, b's chain is good too
+	chains, err = trust.BuildPermissionChains(res, auth.GetVK(), target.GetVK(), map[string]string{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]bool{}
+	for _, dc := range chains {
+		got[crypto.FmtHash(dc.GetChainHash())] = true
+	}
+	if len(chains) != 2 || !got[chainHash(t, toA, aToTarget)] || !got[chainHash(t, toB, bToTarget)] {
+		t.Fatalf("expected the chains through a and b, got %d chains", len(chains))
+	}
+
+	chains, err = trust.BuildPermissionChains(res, auth.GetVK(), target.GetVK(), map[string]string{"room": "999"}, nil)
+	if err != nil || len(chains) != 0 {
+		t.Fatalf("expected no chains, got %d, %v", len(chains), err)
+	}
+	if _, err := trust.BuildPermissionChains(res, auth.GetVK()[:16], target.GetVK(), room, nil); err == nil {
+		t.Fatal("a bad authority was accepted")
+	}
+}
@@ -0,0 +1,71 @@
+// This file is part of BOSSWAVE.
+//
+// BOSSWAVE is free software: you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// BOSSWAVE is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License
+// along with BOSSWAVE.  If not, see <http://www.gnu.org/licenses/>.
+//
+// Copyright © 2015 Michael Andersen <m.andersen@cs.berkeley.edu>
+
+//Package trust walks the DOTs granted from an entity to build permission
+//chains, to explain why an access chain cannot be built and to draw the
+//trust graph of a namespace. Resolving the DOTs is done by the router in
+//api.
+package trust
+
+import "github.com/immesys/bw2/objects"
+
+//Link is a DOT and its registry state
+type Link struct {
+	D *objects.DOT
+	S int
+}
+
+//Resolver finds the DOTs granted from an entity
+type Resolver interface {
+	ResolveGrantedDOTs(vk []byte) ([]Link, error)
+	StateToString(state int) string
+}
+
+//chain is a partial chain of DOTs from the namespace, along with the URI
+//suffix that it grants
+type chain struct {
+	dots   []*objects.DOT
+	suffix string
+}
+
+func (c *chain) ttl() int {
+	ttl := 256
+	for _, d := range c.dots {
+		ttl = ttl - 1
+		if d.GetTTL() < ttl {
+			ttl = d.GetTTL()
+		}
+	}
+	return ttl
+}
+
+func (c *chain) terminalVK() []byte {
+	return c.dots[len(c.dots)-1].GetReceiverVK()
+}
+
+//add returns a copy of the chain extended by d, or false if the TTL does
+//not allow it
+func (c *chain) add(d *objects.DOT, suffix string) (*chain, bool) {
+	cc := make([]*objects.DOT, len(c.dots)+1)
+	copy(cc, c.dots)
+	cc[len(c.dots)] = d
+	rv := &chain{dots: cc, suffix: suffix}
+	if rv.ttl() < 0 {
+		return nil, false
+	}
+	return rv, true
+}
@@ -34,6 +34,8 @@ type configparams struct {
 	Entfile       string
 	DBPath        string
 	Lpath         string
+	KeyFile       string
+	CertFile      string
 	ListenOn      string
 	AmLight       string
 	MinerThreads  int
@@ -53,6 +55,9 @@ Version=2
 # this entity is used only if you are a DR
 Entity={{.Entfile}}
 DB={{.DBPath}}
+# the storage backend: level, memory, or rocks if built with RocksDB.
+# leave empty for the default
+DBBackend=
 LogPath={{.Lpath}}
 
 [native]
@@ -60,6 +65,21 @@ LogPath={{.Lpath}}
 # internal IP if you are not planning on acting
 # as a router
 ListenOn=:4514
+# Peers that support it can connect here instead, to have many
+# independent streams over one connection that survives a change
+# of address, e.g. :4515. Add it to the SRV record after the
+# ListenOn address. Leave empty to disable
+MuxListenOn=
+# The TLS certificate presented to peers is kept here so that
+# it does not change every time the router starts. Leave empty
+# to keep it in the router database
+CertFile={{.CertFile}}
+# Whether to pin the keys of the routers we connect to. "tofu"
+# pins the key seen on first contact and refuses connections
+# that present a different one until it is unpinned with
+# bw2 unpinpeer. "warn" only reports changes. Leave empty to
+# rely on the VK proof alone
+CertPinning=
 
 [oob]
 # OOB clients must be trusted. It is best to leave this
@@ -67,6 +87,61 @@ ListenOn=:4514
 # set it to 0.0.0.0
 ListenOn={{.ListenOn}}
 
+[metrics]
+# Prometheus metrics are served on /metrics at this address,
+# leave empty to disable
+ListenOn=
+# How many URI elements after the namespace are used to label
+# per-URI metrics
+PrefixDepth=1
+
+[history]
+# If enabled, every persisted message is kept (not just the
+# latest one) so that it can be queried by time range
+Enabled=false
+# The maximum number of messages kept per URI, 0 is unlimited
+MaxCount=1000
+# Messages older than this are removed, e.g 30d or 12h
+MaxAge=30d
+
+[audit]
+# Every publish, subscribe and query that is accepted or rejected
+# is appended to this file as a line of JSON. Leave empty to disable
+File=
+# The file is rotated when it reaches this size in MB
+MaxSize=100
+# How many rotated files are kept
+MaxFiles=5
+# If set, records are also published to this URI
+PublishURI=
+
+[offline]
+# A signed registry snapshot to resolve entities, DOTs, chains,
+# aliases and designated routers from while the chain is not
+# synced. Leave empty to always use the chain
+Snapshot=
+# The VKs trusted to sign snapshots, comma separated. This also
+# applies to snapshots loaded with bw2 registry import
+TrustedSigners=
+# If set, the snapshot must be of this block, as number:headerhash
+Checkpoint=
+
+[keyauthority]
+# If set, this router hands out IBE identity keys for URIs in this
+# namespace to entities that can prove they may consume them. The
+# router entity needs P and C on namespace/$/ibe/*
+Namespace=
+# The IBE master key seed, it is created if it does not exist
+KeyFile={{.KeyFile}}
+
+[expiry]
+# Warn this many days before a DOT in a chain the router has built,
+# or an entity it has loaded, expires. 0 disables the warnings
+WarnDays=14
+# If set, the current warnings are persisted on this URI as JSON.
+# The router entity needs P on it
+StatusURI=
+
 [altruism]
 # this decides how many light clients you will allow
 # to connect to you.
@@ -160,6 +235,8 @@ func makeConf(c *cli.Context) error {
 		Entfile:       entfile,
 		DBPath:        dbpath,
 		Lpath:         lpath,
+		KeyFile:       filepath.Join(configdir, "ibe.key"),
+		CertFile:      filepath.Join(configdir, "peer.pem"),
 		ListenOn:      listenon,
 		AmLight:       amlight,
 		MinerThreads:  c.Int("minerthreads"),
@@ -24,6 +24,7 @@ import (
 	"strconv"
 	"strings"
 
+	"github.com/golang/snappy"
 	"github.com/immesys/bw2/util/bwe"
 )
 
@@ -73,11 +74,33 @@ const (
 	CmdRevokeRO              = "revk"
 	CmdPutRevocation         = "prvk"
 	CmdFindDots              = "fdot"
+	CmdAckDurable            = "dack"
+	CmdExplainChain          = "expl"
+	CmdTrustGraph            = "tgrf"
+	CmdEstimateCost          = "estc"
+	CmdLimitUsage            = "lusg"
+	CmdBuildPermChain        = "bpch"
+	CmdVerifyPermChain       = "vpch"
+	CmdCompression           = "cmpr"
+	CmdPublishBatch          = "pbat"
+	CmdExportRegistry        = "rexp"
+	CmdImportRegistry        = "rimp"
+	CmdListExpiring          = "lexp"
+	CmdWatchExpiry           = "wexp"
+	CmdRenewDot              = "rndt"
+	CmdUnpinPeer             = "upin"
 
 	CmdResponse = "resp"
 	CmdResult   = "rslt"
 )
 
+//DefaultCompressThreshold is the smallest payload object that is worth
+//compressing, see WriteToStreamCompressed
+const DefaultCompressThreshold = 1024
+
+//The largest payload object we will decompress
+const maxDecompressedPO = 256 * 1024 * 1024
+
 type Header struct {
 	Content []byte
 	Key     string
@@ -213,7 +236,32 @@ func (f *Frame) AddPayloadObject(po PayloadObject) {
 }
 
 func (f *Frame) WriteToStream(s *bufio.Writer) {
-	s.WriteString(fmt.Sprintf("%4s %010d %010d\n", f.Cmd, f.Length, f.SeqNo))
+	f.WriteToStreamCompressed(s, 0)
+}
+
+//WriteToStreamCompressed writes the frame like WriteToStream, but payload
+//objects of at least threshold bytes are snappy compressed and sent as "pz"
+//lines instead of "po" lines if that makes them smaller. A threshold of
+//zero disables compression. It must only be used once the other side has
+//agreed to compression (see CmdCompression).
+func (f *Frame) WriteToStreamCompressed(s *bufio.Writer, threshold int) {
+	compressed := make([][]byte, len(f.POs))
+	length := f.Length
+	if threshold > 0 {
+		for i, pe := range f.POs {
+			content := pe.PO.GetContent()
+			if len(content) < threshold {
+				continue
+			}
+			z := snappy.Encode(nil, content)
+			if len(z) >= len(content) {
+				continue
+			}
+			compressed[i] = z
+			length += len(z) - len(content) + len(strconv.Itoa(len(z))) - len(pe.Length)
+		}
+	}
+	s.WriteString(fmt.Sprintf("%4s %010d %010d\n", f.Cmd, length, f.SeqNo))
 	for _, v := range f.Headers {
 		s.WriteString(fmt.Sprintf("kv %s %s\n", v.Key, v.Length))
 		s.Write(v.Content)
@@ -225,7 +273,14 @@ func (f *Frame) WriteToStream(s *bufio.Writer) {
 		s.Write(re.RO.GetContent())
 		s.WriteRune('\n')
 	}
-	for _, pe := range f.POs {
+	for i, pe := range f.POs {
+		if compressed[i] != nil {
+			s.WriteString(fmt.Sprintf("pz %s:%s %d\n",
+				pe.DotNum, pe.IntNum, len(compressed[i])))
+			s.Write(compressed[i])
+			s.WriteRune('\n')
+			continue
+		}
 		s.WriteString(fmt.Sprintf("po %s:%s %s\n",
 			pe.DotNum, pe.IntNum, pe.Length))
 		s.Write(pe.PO.GetContent())
@@ -331,7 +386,7 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 				return nil, e
 			}
 			f.ROs = append(f.ROs, ROEntry{ro, strconv.Itoa(ronum), strconv.Itoa(length)})
-		case "po":
+		case "po", "pz":
 			ponums := strings.Split(tok[1], ":")
 			var dponum int
 			var iponum int
@@ -376,6 +431,20 @@ func LoadFrameFromStream(s *bufio.Reader) (f *Frame, e error) {
 			if _, e := s.ReadByte(); e != nil {
 				return nil, e
 			}
+			if tok[0] == "pz" {
+				dlen, err := snappy.DecodedLen(body)
+				if err != nil {
+					return nil, err
+				}
+				if dlen > maxDecompressedPO {
+					return nil, bwe.M(bwe.MalformedOOBCommand, "Compressed PO is too large")
+				}
+				body, err = snappy.Decode(nil, body)
+				if err != nil {
+					return nil, err
+				}
+				length = len(body)
+			}
 			po, err := LoadPayloadObject(ponum, body)
 			if err != nil {
 				return nil, err
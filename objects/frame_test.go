@@ -0,0 +1,77 @@
+package objects
+
+import (
+	"bufio"
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func compressTestFrame(t testing.TB) *Frame {
+	f := CreateFrame(CmdPublish, 42)
+	f.AddHeader("uri", "scratch.ns/foo")
+	small, err := CreateOpaquePayloadObject(PONumString, []byte("hello"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large, err := CreateOpaquePayloadObject(PONumText, []byte(strings.Repeat("the quick brown fox\n", 1000)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.AddPayloadObject(small)
+	f.AddPayloadObject(large)
+	return f
+}
+
+func TestFrameCompressedRoundTrip(t *testing.T) {
+	f := compressTestFrame(t)
+	plain := bytes.Buffer{}
+	f.WriteToStream(bufio.NewWriter(&plain))
+	compressed := bytes.Buffer{}
+	f.WriteToStreamCompressed(bufio.NewWriter(&compressed), DefaultCompressThreshold)
+	if compressed.Len() >= plain.Len() {
+		t.Fatalf("compressed frame is %d bytes, plain is %d", compressed.Len(), plain.Len())
+	}
+	if strings.Count(compressed.String(), "\npz ") != 1 {
+		t.Fatal("expected only the large PO to be compressed")
+	}
+	for _, buf := range []*bytes.Buffer{&plain, &compressed} {
+		wire := buf.Len()
+		rf, err := LoadFrameFromStream(bufio.NewReader(buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rf.Length+27 != wire {
+			t.Fatalf("frame length %d does not match %d bytes written", rf.Length, wire-27)
+		}
+		if len(rf.POs) != 2 {
+			t.Fatalf("expected 2 POs, got %d", len(rf.POs))
+		}
+		for i, pe := range rf.POs {
+			if pe.PO.GetPONum() != f.POs[i].PO.GetPONum() || !bytes.Equal(pe.PO.GetContent(), f.POs[i].PO.GetContent()) {
+				t.Fatalf("PO %d did not round trip", i)
+			}
+			if pe.Length != f.POs[i].Length {
+				t.Fatalf("PO %d has length %s, expected %s", i, pe.Length, f.POs[i].Length)
+			}
+		}
+	}
+}
+
+func benchmarkFrameStream(b *testing.B, threshold int) {
+	f := compressTestFrame(b)
+	buf := bytes.Buffer{}
+	b.SetBytes(int64(f.Length))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		w := bufio.NewWriter(&buf)
+		f.WriteToStreamCompressed(w, threshold)
+		if _, err := LoadFrameFromStream(bufio.NewReader(&buf)); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFrameStreamPlain(b *testing.B)  { benchmarkFrameStream(b, 0) }
+func BenchmarkFrameStreamSnappy(b *testing.B) { benchmarkFrameStream(b, DefaultCompressThreshold) }
@@ -14,6 +14,14 @@ if rq.status_code != 200:
     sys.exit(1)
 
 doc = yaml.load(rq.text)
+#Allocations that have not made it upstream yet
+localpath = os.path.join(os.path.dirname(os.path.realpath(__file__)), "local_allocations.yaml")
+with open(localpath) as f:
+    for k, v in (yaml.load(f.read()) or {}).items():
+        if k in doc:
+            print("%s is now allocated upstream, remove it from local_allocations.yaml" % k)
+            continue
+        doc[k] = v
 def parsedot(s):
     i = s.split(".")
     return (int(i[0])<<24) + (int(i[1])<<16) + (int(i[2]) << 8) + int(i[3])
@@ -24,6 +32,7 @@ def gen_golang(subnets, doc):
     package = curpath.split("/")[-2]
     ofgo = open("poSymNames.go","w")
     print("//This file is autogenerated from https://github.com/immesys/bw2_pid/blob/master/allocations.yaml", file=ofgo)
+    print("//and local_allocations.yaml by gen_allocations_go.py, do not edit it by hand", file=ofgo)
     print("package %s\n\n" % package, file=ofgo)
     for i in subnets:
         d = doc[i[2]]
@@ -1,4 +1,5 @@
 //This file is autogenerated from https://github.com/immesys/bw2_pid/blob/master/allocations.yaml
+//and local_allocations.yaml by gen_allocations_go.py, do not edit it by hand
 package objects
 
 
@@ -191,6 +192,13 @@ const PODFMaskBWMessage = `1.0.1.1/32`
 const PODFBWMessage = `1.0.1.1`
 const POMaskBWMessage = 32
 
+//BoxedPayload (1.0.1.2/32): Boxed payload object
+//This object contains another payload object that has been encrypted into a box. Only the recipients named in the box can open it to recover the original PO number and contents.
+const PONumBoxedPayload = 16777474
+const PODFMaskBoxedPayload = `1.0.1.2/32`
+const PODFBoxedPayload = `1.0.1.2`
+const POMaskBoxedPayload = 32
+
 //Double (1.0.2.0/32): Double
 //This payload is an 8 byte long IEEE 754 double floating point value encoded in little endian. This should only be used if the semantic meaning is obvious in the context, otherwise a PID with a more specific semantic meaning should be used.
 const PONumDouble = 16777728
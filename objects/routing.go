@@ -575,17 +575,24 @@ func (ro *DChain) ConvertToDChainHash() (*DChain, error) {
 }
 
 //PublishLimits is an option found in an AccessDOT that governs
-//the resources that may be used by messages authorised via the DOT
+//the resources that may be used by messages authorised via the DOT.
+//A zero value means that resource is not limited by the DOT.
 type PublishLimits struct {
-	TxLimit    int64
+	//TxLimit is the publish bandwidth in bytes per second
+	TxLimit int64
+	//StoreLimit is the number of bytes that may be persisted, counting
+	//the latest message on each topic. Older messages kept in the
+	//history are not counted, they are bounded by Retain.
 	StoreLimit int64
-	Retain     int
+	//Retain is the number of persisted messages kept in the history
+	//of each topic
+	Retain int
 }
 
 func (p *PublishLimits) toBytes() []byte {
 	rv := make([]byte, 17)
 	binary.LittleEndian.PutUint64(rv, uint64(p.TxLimit))
-	binary.LittleEndian.PutUint64(rv, uint64(p.StoreLimit))
+	binary.LittleEndian.PutUint64(rv[8:], uint64(p.StoreLimit))
 	rv[16] = byte(p.Retain)
 	return rv
 }
@@ -1030,10 +1037,13 @@ func (ro *DOT) SigValid() bool {
 	} else if ro.sigok == sigInvalid {
 		return false
 	}
-	uriSane, _, _, _ := util.AnalyzeSuffix(ro.uriSuffix)
-	if !uriSane {
-		ro.sigok = sigInvalid
-		return false
+	//Permission DOTs have no URI
+	if ro.isAccess {
+		uriSane, _, _, _ := util.AnalyzeSuffix(ro.uriSuffix)
+		if !uriSane {
+			ro.sigok = sigInvalid
+			return false
+		}
 	}
 	if len(ro.signature) != 64 || len(ro.content) == 0 {
 		panic("DOT in invalid state")
@@ -1187,11 +1197,42 @@ func (ro *DOT) SetPermission(key string, value string) {
 	ro.kv[key] = value
 }
 
+//GetPermission returns the value of the given key in a Permission DOT's
+//table, and whether it is present
+func (ro *DOT) GetPermission(key string) (string, bool) {
+	v, ok := ro.kv[key]
+	return v, ok
+}
+
+//GetPermissions returns a copy of a Permission DOT's table
+func (ro *DOT) GetPermissions() map[string]string {
+	rv := make(map[string]string, len(ro.kv))
+	for k, v := range ro.kv {
+		rv[k] = v
+	}
+	return rv
+}
+
 //GetTTL gets the TTL of a DOT
 func (ro *DOT) GetTTL() int {
 	return ro.ttl
 }
 
+//GetPublishLimits returns the publish limits of an access DOT, or nil
+//if it has none
+func (ro *DOT) GetPublishLimits() *PublishLimits {
+	return ro.pubLim
+}
+
+//SetPublishLimits sets the publish limits of an access DOT. Use nil
+//to remove them
+func (ro *DOT) SetPublishLimits(v *PublishLimits) {
+	if v != nil && (v.Retain < 0 || v.Retain > 255) {
+		panic("Bad retain")
+	}
+	ro.pubLim = v
+}
+
 //SetTTL sets the TTL of a dot
 func (ro *DOT) SetTTL(v int) {
 	if v < 0 || v > 255 {
@@ -1310,7 +1351,7 @@ func (ro *DOT) String() string {
 		rv += "Expires: " + ro.expires.String()
 	}
 	if ro.pubLim != nil {
-		rv += "PubLim: store(" + string(ro.pubLim.StoreLimit) + ") tx(" + string(ro.pubLim.TxLimit) + ") p(" + string(ro.pubLim.Retain) + ")\n"
+		rv += fmt.Sprintf("PubLim: store(%d) tx(%d) p(%d)\n", ro.pubLim.StoreLimit, ro.pubLim.TxLimit, ro.pubLim.Retain)
 	}
 	return rv
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"sync"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util/bwe"
+)
+
+// oobClient speaks the OOB protocol directly to the agent. It is used
+// for commands that are newer than the bw2bind bindings.
+type oobClient struct {
+	conn     net.Conn
+	out      *bufio.Writer
+	olock    sync.Mutex
+	hlock    sync.Mutex
+	handlers map[int]func(f *objects.Frame)
+	// compressAbove is the PO size above which frames we send are
+	// compressed, zero if the agent does not support compression.
+	// Protected by olock
+	compressAbove int
+}
+
+func oobConnectOrExit(agent string) *oobClient {
+	conn, err := net.Dial("tcp", agent)
+	if err != nil {
+		fmt.Println("Could not connect to agent:", err)
+		os.Exit(1)
+	}
+	rv := &oobClient{
+		conn:     conn,
+		out:      bufio.NewWriter(conn),
+		handlers: make(map[int]func(f *objects.Frame)),
+	}
+	in := bufio.NewReader(conn)
+	helo, err := objects.LoadFrameFromStream(in)
+	if err != nil || helo.Cmd != objects.CmdHello {
+		fmt.Println("Agent did not say hello")
+		os.Exit(1)
+	}
+	go rv.rxloop(in)
+	if alg, ok := helo.GetFirstHeader("compression"); ok && alg == "snappy" {
+		f := objects.CreateFrame(objects.CmdCompression, 0)
+		f.AddHeader("algorithm", alg)
+		if rv.request(f, nil) == nil {
+			rv.olock.Lock()
+			rv.compressAbove = objects.DefaultCompressThreshold
+			rv.olock.Unlock()
+		}
+	}
+	return rv
+}
+
+func (c *oobClient) rxloop(in *bufio.Reader) {
+	for {
+		f, err := objects.LoadFrameFromStream(in)
+		if err != nil {
+			fmt.Println("Lost connection to agent:", err)
+			os.Exit(1)
+		}
+		c.hlock.Lock()
+		h, ok := c.handlers[f.SeqNo]
+		c.hlock.Unlock()
+		if ok {
+			h(f)
+		}
+	}
+}
+
+// frameError returns the error in a response frame, if any
+func frameError(f *objects.Frame) error {
+	status, _ := f.GetFirstHeader("status")
+	if f.Cmd != objects.CmdResponse || status == "okay" {
+		return nil
+	}
+	reason, _ := f.GetFirstHeader("reason")
+	code, _, _ := f.ParseFirstHeaderAsInt("code", 0)
+	return bwe.M(code, reason)
+}
+
+// request sends a frame and blocks until the agent marks the exchange
+// finished. onFrame is called for every frame that is not an error.
+// A nil onFrame discards them.
+func (c *oobClient) request(f *objects.Frame, onFrame func(f *objects.Frame)) error {
+	seqno := int(rand.Uint32() >> 1)
+	f.SeqNo = seqno
+	done := make(chan error, 1)
+	finish := func(err error) {
+		select {
+		case done <- err:
+		default:
+		}
+	}
+	c.hlock.Lock()
+	c.handlers[seqno] = func(r *objects.Frame) {
+		if err := frameError(r); err != nil {
+			finish(err)
+			return
+		}
+		if onFrame != nil {
+			onFrame(r)
+		}
+		finished, _, _ := r.ParseFirstHeaderAsBool("finished", false)
+		if finished {
+			finish(nil)
+		}
+	}
+	c.hlock.Unlock()
+	c.olock.Lock()
+	f.WriteToStreamCompressed(c.out, c.compressAbove)
+	c.olock.Unlock()
+	err := <-done
+	c.hlock.Lock()
+	delete(c.handlers, seqno)
+	c.hlock.Unlock()
+	return err
+}
+
+// requestOrExit is like request but prints the error and exits on failure
+func (c *oobClient) requestOrExit(f *objects.Frame, onFrame func(f *objects.Frame)) {
+	if err := c.request(f, onFrame); err != nil {
+		fmt.Println("Agent returned error:", err)
+		os.Exit(1)
+	}
+}
+
+func (c *oobClient) setEntityOrExit(e *objects.Entity) {
+	f := objects.CreateFrame(objects.CmdSetEntity, 0)
+	po, _ := objects.CreateOpaquePayloadObject(objects.PONumROEntityWKey, e.GetSigningBlob())
+	f.AddPayloadObject(po)
+	c.requestOrExit(f, nil)
+}
+
+// dumpFrame prints the headers and payload objects of a result frame
+func dumpFrame(f *objects.Frame) {
+	for _, h := range f.Headers {
+		if h.Key == "finished" || h.Key == "status" {
+			continue
+		}
+		fmt.Printf("%s: %s\n", h.Key, string(h.Content))
+	}
+	for _, po := range f.POs {
+		content := po.PO.GetContent()
+		fmt.Printf("PO %s len %s\n", po.DotNum, strconv.Itoa(len(content)))
+		if isPrintable(content) {
+			fmt.Println(string(content))
+		}
+	}
+}
+
+func isPrintable(b []byte) bool {
+	for _, c := range b {
+		if (c < 0x20 || c > 0x7e) && c != '\n' && c != '\t' {
+			return false
+		}
+	}
+	return true
+}
@@ -6,6 +6,7 @@ import (
 	"strconv"
 	"time"
 
+	"github.com/immesys/bw2/api"
 	"github.com/immesys/bw2/crypto"
 	"github.com/immesys/bw2/objects"
 	"github.com/immesys/bw2bind"
@@ -197,6 +198,11 @@ func dodotobj(d *objects.DOT, indent int, regnote string, cl *bw2bind.BW2Client)
 	if d.IsAccess() {
 		fmt.Println(istring(indent) + " URI: " + crypto.FmtKey(d.GetAccessURIMVK()) + "/" + d.GetAccessURISuffix())
 		fmt.Println(istring(indent) + " Permissions: " + d.GetPermString())
+		if pl := d.GetPublishLimits(); pl != nil {
+			fmt.Println(istring(indent) + fmt.Sprintf(" Publish limits: tx %d B/s, store %d B, retain %d", pl.TxLimit, pl.StoreLimit, pl.Retain))
+		}
+	} else {
+		fmt.Println(istring(indent) + " Permissions: " + api.FmtPermissions(d.GetPermissions()))
 	}
 	if len(d.GetContact()) != 0 {
 		fmt.Println(istring(indent) + " Contact: " + d.GetContact())
@@ -0,0 +1,95 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+// actionRegistryExport asks the agent for the registry objects relevant to
+// the given namespaces and saves them as a signed snapshot
+func actionRegistryExport(c *cli.Context) error {
+	nsz := c.StringSlice("ns")
+	if len(nsz) == 0 {
+		fmt.Println("Need at least one 'ns' parameter")
+		os.Exit(1)
+	}
+	if c.String("outfile") == "" {
+		fmt.Println("Need an 'outfile' parameter")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	if c.String("signer") != "" {
+		e := loadSigningEntityFile(c.String("signer"))
+		if e == nil {
+			fmt.Println("Could not load the signer entity file")
+			os.Exit(1)
+		}
+		ocl.setEntityOrExit(e)
+	}
+	f := objects.CreateFrame(objects.CmdExportRegistry, 0)
+	for _, ns := range nsz {
+		f.AddHeader("ns", vkOrEntityFile(ns))
+	}
+	var snap []byte
+	var summary *objects.Frame
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		for _, po := range r.POs {
+			if po.PO.GetPONum() == objects.PONumBlob {
+				snap = po.PO.GetContent()
+				summary = r
+			}
+		}
+	})
+	if snap == nil {
+		fmt.Println("Agent did not return a snapshot")
+		os.Exit(1)
+	}
+	if err := ioutil.WriteFile(c.String("outfile"), snap, 0644); err != nil {
+		fmt.Println("Could not write snapshot:", err)
+		os.Exit(1)
+	}
+	fmt.Println("Exported", registrySummary(summary))
+	return nil
+}
+
+// actionRegistryImport loads registry snapshots into the agent
+func actionRegistryImport(c *cli.Context) error {
+	if c.NArg() == 0 {
+		fmt.Println("Expected the snapshot file name")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	for _, fname := range c.Args() {
+		contents, err := ioutil.ReadFile(fname)
+		if err != nil {
+			fmt.Println("Could not read snapshot:", err)
+			os.Exit(1)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumBlob, contents)
+		if err != nil {
+			fmt.Println("Could not read snapshot:", err)
+			os.Exit(1)
+		}
+		f := objects.CreateFrame(objects.CmdImportRegistry, 0)
+		f.AddPayloadObject(po)
+		ocl.requestOrExit(f, func(r *objects.Frame) {
+			signer, _ := r.GetFirstHeader("signer")
+			fmt.Printf("Imported %s signed by %s\n", registrySummary(r), signer)
+		})
+	}
+	return nil
+}
+
+// registrySummary describes the snapshot in an export or import result
+func registrySummary(r *objects.Frame) string {
+	h := func(k string) string {
+		v, _ := r.GetFirstHeader(k)
+		return v
+	}
+	return fmt.Sprintf("snapshot of block %s (%s entities, %s DOTs, %s chains, %s aliases, %s revoked)",
+		h("block"), h("entities"), h("dots"), h("chains"), h("aliases"), h("revoked"))
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/immesys/bw2/util"
+	"github.com/urfave/cli"
+)
+
+// actionRenew publishes a copy of a DOT that expires later, signed by its
+// giver, and optionally revokes the old one once the copy is confirmed
+func actionRenew(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Expected the hash of the DOT to renew")
+		os.Exit(1)
+	}
+	if c.String("bankroll") == "" {
+		fmt.Println("Need bankroll to publish")
+		os.Exit(1)
+	}
+	bankroll := loadSigningEntityFile(c.String("bankroll"))
+	if bankroll == nil {
+		fmt.Println("Could not load the bankroll entity file")
+		os.Exit(1)
+	}
+	expiry, err := util.ParseDuration(c.String("expiry"))
+	if err != nil || expiry == nil {
+		fmt.Println("Bad expiry:", c.String("expiry"))
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	ocl.setEntityOrExit(bankroll)
+	f := objects.CreateFrame(objects.CmdRenewDot, 0)
+	f.AddHeader("dot", c.Args().Get(0))
+	f.AddHeader("expirydelta", expiry.String())
+	if c.Bool("revoke") {
+		f.AddHeader("revokeold", "true")
+	}
+	// The giver signs the new DOT, the bankroll pays for it
+	if c.String("from") != "" {
+		giver := loadSigningEntityFile(c.String("from"))
+		if giver == nil {
+			fmt.Println("Could not load the giver entity file")
+			os.Exit(1)
+		}
+		po, err := objects.CreateOpaquePayloadObject(objects.PONumROEntityWKey, giver.GetSigningBlob())
+		if err != nil {
+			fmt.Println("Could not load the giver entity file:", err)
+			os.Exit(1)
+		}
+		f.AddPayloadObject(po)
+	}
+	ocl.requestOrExit(f, func(r *objects.Frame) {
+		h := func(k string) string {
+			v, _ := r.GetFirstHeader(k)
+			return v
+		}
+		fmt.Printf("Published %s, renewing %s\n", h("hash"), h("old"))
+		if rvk, ok := r.GetFirstHeader("revocation"); ok {
+			fmt.Printf("Revoked %s with %s\n", h("old"), rvk)
+		}
+	})
+	return nil
+}
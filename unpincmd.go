@@ -0,0 +1,25 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/immesys/bw2/objects"
+	"github.com/urfave/cli"
+)
+
+// actionUnpinPeer makes the agent forget the key it pinned for a
+// designated router, so that the key the router presents next is pinned.
+// Use it when a router has really changed its key.
+func actionUnpinPeer(c *cli.Context) error {
+	if c.NArg() != 1 {
+		fmt.Println("Expected the designated router (VK, alias or entity file)")
+		os.Exit(1)
+	}
+	ocl := oobConnectOrExit(c.GlobalString("agent"))
+	f := objects.CreateFrame(objects.CmdUnpinPeer, 0)
+	f.AddHeader("vk", vkOrEntityFile(c.Args().Get(0)))
+	ocl.requestOrExit(f, func(r *objects.Frame) {})
+	fmt.Println("Unpinned, the key the router presents next will be pinned")
+	return nil
+}
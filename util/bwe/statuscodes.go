@@ -109,6 +109,23 @@ const (
 	//The revocation is not an authority for its target
 	InvalidRevocation = 435
 
+	//A durable queue is in use or the acknowledged message does not exist
+	DurableQueueError = 436
+
+	//A history query was made to a router that does not retain history
+	HistoryDisabled = 437
+
+	//A publish would exceed the PublishLimits of a DOT in its access chain
+	PublishLimitExceeded = 438
+
+	//A peer subscription has used all of its flow control credit and
+	//results are held back until the subscriber catches up
+	Throttled = 439
+
+	//An active subscription was terminated because a DOT in its access
+	//chain, or an entity one depends on, was revoked or expired
+	AccessRevoked = 440
+
 	//The 500 series are chain interaction errors
 	RegistryEntityResolutionFailed = 500
 	RegistryDOTResolutionFailed    = 501